@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// ACL lists the clients allowed to do something, either by the networks they
+// connect from or by the TSIG keys they sign with. A nil ACL allows nobody.
+type ACL struct {
+	Allow []netip.Prefix
+	Keys  []Name
+}
+
+// ParseACL reads a comma separated list of networks, single addresses and
+// TSIG key names, such as "192.0.2.0/24,2001:db8::1,key:ddns-key".
+func ParseACL(s string) (*ACL, error) {
+	a := &ACL{}
+	for _, field := range strings.Split(s, ",") {
+		if key, ok := strings.CutPrefix(field, "key:"); ok {
+			name, err := ParseName(key)
+			if err != nil {
+				return nil, err
+			}
+			a.Keys = append(a.Keys, name)
+			continue
+		}
+		if !strings.Contains(field, "/") {
+			addr, err := netip.ParseAddr(field)
+			if err != nil {
+				return nil, err
+			}
+			a.Allow = append(a.Allow, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(field)
+		if err != nil {
+			return nil, err
+		}
+		a.Allow = append(a.Allow, prefix.Masked())
+	}
+	return a, nil
+}
+
+// allows reports whether a client at from, whose request was signed with key
+// if that's set, is on the list.
+func (a *ACL) allows(from netip.Addr, key Name) bool {
+	if a == nil {
+		return false
+	}
+	for _, prefix := range a.Allow {
+		if prefix.Contains(from) {
+			return true
+		}
+	}
+	for _, k := range a.Keys {
+		if key != nil && k.Equal(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// addrOf returns the IP address of a client.
+func addrOf(a net.Addr) netip.Addr {
+	if a == nil {
+		return netip.Addr{}
+	}
+	ap, err := netip.ParseAddrPort(a.String())
+	if err != nil {
+		return netip.Addr{}
+	}
+	return ap.Addr().Unmap()
+}
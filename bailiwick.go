@@ -0,0 +1,207 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Trust ranks how far a record can be believed by where it came from,
+// following RFC 2181 section 5.4.1. Higher ranks are more trustworthy.
+type Trust int
+
+const (
+	// TrustAdditional is for the additional section, glue included
+	TrustAdditional Trust = iota
+	// TrustAnswer is for the answer section of a non-authoritative answer
+	TrustAnswer
+	// TrustAuthority is for the authority section of an authoritative
+	// answer
+	TrustAuthority
+	// TrustAuthAnswer is for the answer section of an authoritative answer
+	TrustAuthAnswer
+)
+
+// scrub drops the records in m, the response to q from servers for zone,
+// that have no business being there. Servers can only speak for names in
+// their own zone, and the rest is how cache poisoning gets in. Of what's
+// left, the answer section keeps only the records for q's name and the
+// aliases it leads to, the authority section only those for zones above
+// them, and the additional section only the addresses of nameservers.
+func scrub(q Question, m Message, zone Name) Message {
+	var dropped, unsolicited int
+	inZone := func(rr ResourceRecord) bool {
+		if rr.Name.IsSubdomainOf(zone) {
+			return true
+		}
+		dropped++
+		return false
+	}
+
+	// Follow the CNAME chain from q's name, in whatever order the records
+	// came in
+	chain := []Name{q.Name}
+	inChain := func(name Name) bool {
+		for _, n := range chain {
+			if n.Equal(name) {
+				return true
+			}
+		}
+		return false
+	}
+	for grew := true; grew; {
+		grew = false
+		for _, rr := range m.Answer {
+			cname := &CNAME{}
+			if rr.Type != TypeCName || !inChain(rr.Name) || !rr.Name.IsSubdomainOf(zone) || cname.Unpack(rr.Data) != nil {
+				continue
+			}
+			if !inChain(cname.Target) && len(chain) <= maxCNAMEChain {
+				chain = append(chain, cname.Target)
+				grew = true
+			}
+		}
+	}
+	var answer []ResourceRecord
+	for _, rr := range m.Answer {
+		if !inZone(rr) {
+			continue
+		}
+		if !inChain(rr.Name) {
+			unsolicited++
+			continue
+		}
+		answer = append(answer, rr)
+	}
+
+	last := chain[len(chain)-1]
+	var authority []ResourceRecord
+	var nameservers []Name
+	for _, rr := range m.Authority {
+		if !inZone(rr) {
+			continue
+		}
+		switch rr.Type {
+		case TypeNS, TypeSOA, TypeDS:
+			if !last.IsSubdomainOf(rr.Name) {
+				unsolicited++
+				continue
+			}
+		}
+		if rr.Type == TypeNS {
+			ns := &NS{}
+			if err := ns.Unpack(rr.Data); err == nil {
+				nameservers = append(nameservers, ns.Target)
+			}
+		}
+		authority = append(authority, rr)
+	}
+	for _, rr := range answer {
+		ns := &NS{}
+		if rr.Type == TypeNS && ns.Unpack(rr.Data) == nil {
+			nameservers = append(nameservers, ns.Target)
+		}
+	}
+
+	var additional []ResourceRecord
+	for _, rr := range m.Additional {
+		switch rr.Type {
+		case TypeOPT, TypeTSIG:
+			additional = append(additional, rr)
+			continue
+		case TypeA, TypeAAAA, TypeRRSIG:
+			if !inZone(rr) {
+				continue
+			}
+			var wanted bool
+			for _, name := range nameservers {
+				wanted = wanted || name.Equal(rr.Name)
+			}
+			if wanted {
+				additional = append(additional, rr)
+				continue
+			}
+		}
+		unsolicited++
+	}
+
+	if dropped > 0 {
+		spoofStats.Add("out_of_bailiwick", int64(dropped))
+	}
+	if unsolicited > 0 {
+		spoofStats.Add("unsolicited", int64(unsolicited))
+	}
+	m.Answer, m.Authority, m.Additional = answer, authority, additional
+	return m
+}
+
+// nameserverCache remembers the addresses of nameservers along with how far
+// they can be trusted, so that glue never replaces an address that came from
+// an authoritative answer. Like Cache, it holds at most maxCacheEntries. The
+// zero value is ready to use.
+type nameserverCache struct {
+	mu      sync.Mutex
+	entries map[nameserverKey]nameserverEntry
+}
+
+type nameserverKey struct {
+	name string
+	t    Type
+}
+
+type nameserverEntry struct {
+	ips     []net.IP
+	trust   Trust
+	expires time.Time
+}
+
+// get returns the addresses of type t we know for name.
+func (c *nameserverCache) get(name Name, t Type, now time.Time) []net.IP {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := nameserverKey{name.Canonical().String(), t}
+	e, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	if !now.Before(e.expires) {
+		delete(c.entries, key)
+		return nil
+	}
+	return e.ips
+}
+
+// put stores the addresses of type t for name, unless we already have ones
+// we trust more that haven't expired.
+func (c *nameserverCache) put(name Name, t Type, ips []net.IP, trust Trust, ttl uint32, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := nameserverKey{name.Canonical().String(), t}
+	if e, ok := c.entries[key]; ok && now.Before(e.expires) && e.trust > trust {
+		return
+	}
+	if c.entries == nil {
+		c.entries = map[nameserverKey]nameserverEntry{}
+	}
+	if len(c.entries) >= maxCacheEntries {
+		c.evict(now)
+	}
+	expires := now.Add(min(time.Duration(ttl)*time.Second, maxCacheTTL))
+	c.entries[key] = nameserverEntry{ips: ips, trust: trust, expires: expires}
+}
+
+// evict makes room in a full cache by dropping whatever has expired, and if
+// that isn't enough, an arbitrary entry.
+func (c *nameserverCache) evict(now time.Time) {
+	for k, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	for k := range c.entries {
+		if len(c.entries) < maxCacheEntries {
+			break
+		}
+		delete(c.entries, k)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestScrub(t *testing.T) {
+	type Test struct {
+		Description string
+		Question    string
+		Zone        string
+		Answer      string
+		Authority   string
+		Additional  string
+		Expected    []string
+	}
+	tests := []Test{
+		{
+			Description: "Referral with glue",
+			Question:    "www.example.com",
+			Zone:        "com",
+			Authority:   "example.com. 3600 IN NS ns1.example.com.\nexample.com. 3600 IN NS ns.example.net.",
+			Additional:  "ns1.example.com. 3600 IN A 192.0.2.1\nns.example.net. 3600 IN A 192.0.2.2\nmail.example.com. 3600 IN A 192.0.2.3",
+			// The com servers can't vouch for example.net, and nobody
+			// asked about mail.example.com
+			Expected: []string{
+				"example.com. 3600 IN NS ns1.example.com.",
+				"example.com. 3600 IN NS ns.example.net.",
+				"ns1.example.com. 3600 IN A 192.0.2.1",
+			},
+		},
+		{
+			Description: "Referral for somewhere else",
+			Question:    "www.example.com",
+			Zone:        "com",
+			Authority:   "example.org. 3600 IN NS ns1.example.org.\ncom. 3600 IN NS ns.attacker.example.",
+			Expected:    []string{"com. 3600 IN NS ns.attacker.example."},
+		},
+		{
+			Description: "Out of zone answer",
+			Question:    "www.example.com",
+			Zone:        "example.com",
+			Answer:      "www.example.com. 300 IN CNAME www.example.net.\nwww.example.net. 300 IN A 192.0.2.10",
+			Expected:    []string{"www.example.com. 300 IN CNAME www.example.net."},
+		},
+		{
+			Description: "Alias chain in any order",
+			Question:    "www.example.com",
+			Zone:        "example.com",
+			Answer:      "web.example.com. 300 IN A 192.0.2.10\nwww.example.com. 300 IN CNAME web.example.com.\nother.example.com. 300 IN A 192.0.2.11",
+			Expected: []string{
+				"web.example.com. 300 IN A 192.0.2.10",
+				"www.example.com. 300 IN CNAME web.example.com.",
+			},
+		},
+		{
+			Description: "Negative answer",
+			Question:    "nope.example.com",
+			Zone:        "example.com",
+			Authority:   "example.com. 300 IN SOA ns1.example.com. hostmaster.example.com. 1 3600 900 604800 300\nexample.net. 300 IN SOA ns1.example.net. hostmaster.example.net. 1 3600 900 604800 300",
+			Expected:    []string{"example.com. 300 IN SOA ns1.example.com. hostmaster.example.com. 1 3600 900 604800 300"},
+		},
+		{
+			Description: "The root can speak for anything",
+			Question:    "www.example.com",
+			Zone:        ".",
+			Authority:   "com. 3600 IN NS a.gtld-servers.net.",
+			Additional:  "a.gtld-servers.net. 3600 IN A 192.0.2.53",
+			Expected: []string{
+				"com. 3600 IN NS a.gtld-servers.net.",
+				"a.gtld-servers.net. 3600 IN A 192.0.2.53",
+			},
+		},
+	}
+	for _, test := range tests {
+		q := Question{Name: MustParseName(test.Question), Type: TypeA, Class: ClassIN}
+		m := Message{
+			Questions:  []Question{q},
+			Answer:     testRecords(t, test.Answer),
+			Authority:  testRecords(t, test.Authority),
+			Additional: testRecords(t, test.Additional),
+		}
+		scrubbed := scrub(q, m, MustParseName(test.Zone))
+		var got []string
+		for _, section := range [][]ResourceRecord{scrubbed.Answer, scrubbed.Authority, scrubbed.Additional} {
+			for _, rr := range section {
+				got = append(got, strings.Join(strings.Fields(rr.String()), " "))
+			}
+		}
+		if diff := cmp.Diff(test.Expected, got); diff != "" {
+			t.Errorf("%s: unexpected records (-want +got):\n%s", test.Description, diff)
+		}
+	}
+}
+
+func TestNameserverCache(t *testing.T) {
+	name := MustParseName("ns1.example.com")
+	glue := []net.IP{net.ParseIP("192.0.2.66").To4()}
+	auth := []net.IP{net.ParseIP("192.0.2.1").To4()}
+	now := time.Now()
+
+	type Test struct {
+		Description string
+		Puts        []Trust
+		After       time.Duration
+		Expected    []net.IP
+	}
+	tests := []Test{
+		{"Glue doesn't replace an authoritative answer", []Trust{TrustAuthAnswer, TrustAdditional}, 0, auth},
+		{"An authoritative answer replaces glue", []Trust{TrustAdditional, TrustAuthAnswer}, 0, auth},
+		{"Glue replaces an expired answer", []Trust{TrustAuthAnswer, TrustAdditional}, time.Hour, glue},
+	}
+	for _, test := range tests {
+		var c nameserverCache
+		for i, trust := range test.Puts {
+			ips := glue
+			if trust == TrustAuthAnswer {
+				ips = auth
+			}
+			at := now
+			if i > 0 {
+				at = now.Add(test.After)
+			}
+			c.put(name, TypeA, ips, trust, 300, at)
+		}
+		got := c.get(name, TypeA, now.Add(test.After))
+		if !cmp.Equal(got, test.Expected) {
+			t.Errorf("%s: expected %v, got %v", test.Description, test.Expected, got)
+		}
+	}
+
+	// Expired entries don't stay around, and the cache doesn't grow forever
+	var c nameserverCache
+	c.put(name, TypeA, glue, TrustAdditional, 300, now)
+	if c.get(name, TypeA, now.Add(time.Hour)) != nil || len(c.entries) != 0 {
+		t.Errorf("expected the expired entry to be dropped, have %d entries", len(c.entries))
+	}
+	for i := 0; i < maxCacheEntries+10; i++ {
+		c.put(MustParseName(fmt.Sprintf("ns%d.example.com", i)), TypeA, glue, TrustAdditional, 300, now)
+	}
+	if len(c.entries) > maxCacheEntries {
+		t.Errorf("expected at most %d entries, have %d", maxCacheEntries, len(c.entries))
+	}
+}
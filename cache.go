@@ -0,0 +1,375 @@
+package main
+
+import (
+	"expvar"
+	"sync"
+	"time"
+)
+
+// Bounds on what the resolver cache keeps. RFC 8767 suggests capping TTLs at
+// a day or so, and the entry limit keeps a flood of random names from using up
+// all our memory.
+const (
+	maxCacheTTL     = 24 * time.Hour
+	maxCacheEntries = 10000
+)
+
+// cacheStats counts how the cache is doing. The aggressive_ counters are
+// queries answered from cached NSEC and NSEC3 records that would otherwise
+// have gone to an authoritative server.
+var cacheStats = expvar.NewMap("cache")
+
+// cachedRRset is an RRset along with its signatures.
+type cachedRRset struct {
+	records []ResourceRecord
+	sigs    []ResourceRecord
+	stored  time.Time
+	expires time.Time
+}
+
+// aged returns the records and signatures with their TTLs counted down to
+// now.
+func (s *cachedRRset) aged(now time.Time) []ResourceRecord {
+	return agedRecords(append(append([]ResourceRecord{}, s.records...), s.sigs...), s.stored, now)
+}
+
+type cacheEntry struct {
+	msg    Message
+	status SecurityStatus
+	stored time.Time
+	// expires is when the shortest lived record in the answer runs out
+	expires time.Time
+}
+
+// zoneDenial holds the validated NSEC or NSEC3 records we've seen from a zone,
+// and its SOA for building negative answers from them.
+type zoneDenial struct {
+	soa    *cachedRRset
+	rrsets map[string]*cachedRRset
+}
+
+// Cache remembers the answers to recursive queries until their TTLs run out.
+// When Aggressive is set it also uses the validated NSEC and NSEC3 records it
+// has seen to answer for names and types they prove don't exist, and for
+// names covered by a wildcard it has an answer from, as described in RFC 8198.
+// A nil *Cache caches nothing.
+type Cache struct {
+	Aggressive bool
+	now        func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	// zones is keyed by the name of the zone that signed the records
+	zones map[string]*zoneDenial
+	// wildcards holds validated answers that came from wildcards, keyed by
+	// the wildcard name and type
+	wildcards map[string]*cachedRRset
+}
+
+func NewCache() *Cache {
+	return &Cache{
+		now:       time.Now,
+		entries:   map[string]*cacheEntry{},
+		zones:     map[string]*zoneDenial{},
+		wildcards: map[string]*cachedRRset{},
+	}
+}
+
+func cacheKey(name Name, t Type) string {
+	return name.Canonical().String() + " " + t.String()
+}
+
+// Get returns the cached answer to q, if there's one that hasn't expired, and
+// how it validated.
+func (c *Cache) Get(q Question) (Message, SecurityStatus, bool) {
+	if c == nil {
+		return Message{}, StatusInsecure, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	e, ok := c.entries[cacheKey(q.Name, q.Type)]
+	if !ok || !now.Before(e.expires) {
+		cacheStats.Add("misses", 1)
+		return Message{}, StatusInsecure, false
+	}
+	cacheStats.Add("hits", 1)
+	return Message{
+		ResponseCode: e.msg.ResponseCode,
+		Answer:       agedRecords(e.msg.Answer, e.stored, now),
+		Authority:    agedRecords(e.msg.Authority, e.stored, now),
+	}, e.status, true
+}
+
+// Put remembers m as the answer to q. Secure answers also teach the cache
+// about the NSEC and NSEC3 records and wildcards they contain.
+func (c *Cache) Put(q Question, m Message, status SecurityStatus) {
+	if c == nil || m.Truncated || status == StatusBogus {
+		return
+	}
+	if m.ResponseCode != ResponseCodeOk && m.ResponseCode != ResponseCodeNameError {
+		return
+	}
+	ttl := cacheTTL(m)
+	if ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if len(c.entries) >= maxCacheEntries {
+		c.evict(now)
+	}
+	c.entries[cacheKey(q.Name, q.Type)] = &cacheEntry{
+		msg:     Message{ResponseCode: m.ResponseCode, Answer: m.Answer, Authority: m.Authority},
+		status:  status,
+		stored:  now,
+		expires: now.Add(ttl),
+	}
+	if status == StatusSecure {
+		c.learn(m, now)
+	}
+}
+
+// cacheTTL works out how long an answer can be kept: as long as its shortest
+// lived record, and for negative answers no longer than the SOA's minimum as
+// RFC 2308 section 5 says.
+func cacheTTL(m Message) time.Duration {
+	ttl := maxCacheTTL
+	var seen bool
+	for _, rr := range append(append([]ResourceRecord{}, m.Answer...), m.Authority...) {
+		if rr.Type == TypeOPT {
+			continue
+		}
+		seen = true
+		if d := time.Duration(rr.TTL) * time.Second; d < ttl {
+			ttl = d
+		}
+	}
+	if !seen {
+		return 0
+	}
+	if len(m.Answer) == 0 {
+		if min, ok := negativeTTL(m.Authority); ok && min < ttl {
+			ttl = min
+		} else if !ok {
+			// Without an SOA there's no saying how long the answer holds
+			return 0
+		}
+	}
+	return ttl
+}
+
+// negativeTTL returns the SOA minimum from a negative answer's authority
+// section.
+func negativeTTL(authority []ResourceRecord) (time.Duration, bool) {
+	for _, rr := range authority {
+		soa := &SOA{}
+		if rr.Type == TypeSOA && soa.Unpack(rr.Data) == nil {
+			return time.Duration(soa.Minimum) * time.Second, true
+		}
+	}
+	return 0, false
+}
+
+// learn keeps the NSEC, NSEC3 and SOA records from a validated answer, along
+// with any RRsets that were synthesized from wildcards.
+func (c *Cache) learn(m Message, now time.Time) {
+	// RFC 8198 section 5.4 limits denial records to the SOA minimum, like
+	// the negative answers they stand in for
+	limit := maxCacheTTL
+	if min, ok := negativeTTL(m.Authority); ok {
+		limit = min
+	}
+	for _, set := range groupRRsets(m.Authority) {
+		if set[0].Type != TypeNSEC && set[0].Type != TypeNSEC3 && set[0].Type != TypeSOA {
+			continue
+		}
+		sigs, signer := signaturesFor(set, m.Authority)
+		if len(sigs) == 0 {
+			continue
+		}
+		cached := newCachedRRset(set, sigs, now, limit)
+		zd := c.zones[signer.Canonical().String()]
+		if zd == nil {
+			zd = &zoneDenial{rrsets: map[string]*cachedRRset{}}
+			c.zones[signer.Canonical().String()] = zd
+		}
+		if set[0].Type == TypeSOA {
+			zd.soa = cached
+		} else {
+			zd.rrsets[cacheKey(set[0].Name, set[0].Type)] = cached
+		}
+	}
+
+	for _, set := range groupRRsets(m.Answer) {
+		sigs, _ := signaturesFor(set, m.Answer)
+		owner := set[0].Name
+		for _, rr := range sigs {
+			sig := &RRSIG{}
+			if sig.Unpack(rr.Data) != nil || int(sig.Labels) >= labelCount(owner) {
+				continue
+			}
+			wildcard := owner[len(owner)-int(sig.Labels):].Child("*")
+			cached := newCachedRRset(renamed(set, wildcard), renamed(sigs, wildcard), now, maxCacheTTL)
+			c.wildcards[cacheKey(wildcard, set[0].Type)] = cached
+			break
+		}
+	}
+}
+
+func newCachedRRset(set, sigs []ResourceRecord, now time.Time, limit time.Duration) *cachedRRset {
+	ttl := limit
+	for _, rr := range set {
+		if d := time.Duration(rr.TTL) * time.Second; d < ttl {
+			ttl = d
+		}
+	}
+	return &cachedRRset{records: set, sigs: sigs, stored: now, expires: now.Add(ttl)}
+}
+
+// signaturesFor returns the RRSIG records among records that cover set, and
+// the zone that made them.
+func signaturesFor(set, records []ResourceRecord) ([]ResourceRecord, Name) {
+	var sigs []ResourceRecord
+	var signer Name
+	for _, rr := range records {
+		if rr.Type != TypeRRSIG || !rr.Name.Equal(set[0].Name) {
+			continue
+		}
+		sig := &RRSIG{}
+		if sig.Unpack(rr.Data) == nil && sig.TypeCovered == set[0].Type {
+			sigs = append(sigs, rr)
+			signer = sig.SignerName
+		}
+	}
+	return sigs, signer
+}
+
+// Synthesize answers q from the validated NSEC and NSEC3 records in the cache,
+// if they prove that the name or type doesn't exist or that a cached wildcard
+// answer applies.
+func (c *Cache) Synthesize(q Question) (Message, bool) {
+	if c == nil || !c.Aggressive {
+		return Message{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	zd := c.zoneFor(q.Name, now)
+	if zd == nil {
+		return Message{}, false
+	}
+	var records []ResourceRecord
+	for _, set := range zd.rrsets {
+		if now.Before(set.expires) {
+			records = append(records, set.records...)
+		}
+	}
+	d := newDenial(records)
+	if d.tooExpensive {
+		return Message{}, false
+	}
+
+	withSigs := func(proof []ResourceRecord) []ResourceRecord {
+		var authority []ResourceRecord
+		for _, rr := range proof {
+			authority = append(authority, zd.rrsets[cacheKey(rr.Name, rr.Type)].aged(now)...)
+		}
+		return authority
+	}
+	if ce, proof := d.wildcardProof(q.Name); proof != nil {
+		if w, ok := c.wildcards[cacheKey(ce.Child("*"), q.Type)]; ok && now.Before(w.expires) {
+			cacheStats.Add("aggressive_wildcard", 1)
+			return Message{
+				ResponseCode: ResponseCodeOk,
+				Answer:       renamed(w.aged(now), q.Name),
+				Authority:    withSigs(proof),
+			}, true
+		}
+	}
+	if proof := d.nameErrorProof(q.Name); proof != nil {
+		cacheStats.Add("aggressive_nxdomain", 1)
+		return Message{
+			ResponseCode: ResponseCodeNameError,
+			Authority:    append(zd.soa.aged(now), withSigs(proof)...),
+		}, true
+	}
+	if proof, status := d.noDataProof(q.Name, q.Type); proof != nil && status == StatusSecure {
+		cacheStats.Add("aggressive_nodata", 1)
+		return Message{
+			ResponseCode: ResponseCodeOk,
+			Authority:    append(zd.soa.aged(now), withSigs(proof)...),
+		}, true
+	}
+	return Message{}, false
+}
+
+// zoneFor finds the closest enclosing zone of name that we have an unexpired
+// SOA for.
+func (c *Cache) zoneFor(name Name, now time.Time) *zoneDenial {
+	for i := 0; i <= len(name); i++ {
+		zd := c.zones[name[i:].Canonical().String()]
+		if zd != nil && zd.soa != nil && now.Before(zd.soa.expires) {
+			return zd
+		}
+	}
+	return nil
+}
+
+// evict makes room in a full cache by dropping whatever has expired, and if
+// that isn't enough, an arbitrary entry.
+func (c *Cache) evict(now time.Time) {
+	for k, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	for k, w := range c.wildcards {
+		if !now.Before(w.expires) {
+			delete(c.wildcards, k)
+		}
+	}
+	for k, zd := range c.zones {
+		for rk, set := range zd.rrsets {
+			if !now.Before(set.expires) {
+				delete(zd.rrsets, rk)
+			}
+		}
+		if len(zd.rrsets) == 0 && (zd.soa == nil || !now.Before(zd.soa.expires)) {
+			delete(c.zones, k)
+		}
+	}
+	for k := range c.entries {
+		if len(c.entries) < maxCacheEntries {
+			break
+		}
+		delete(c.entries, k)
+	}
+}
+
+// agedRecords copies records with stored - now taken off their TTLs.
+func agedRecords(records []ResourceRecord, stored, now time.Time) []ResourceRecord {
+	elapsed := uint32(now.Sub(stored) / time.Second)
+	aged := make([]ResourceRecord, len(records))
+	for i, rr := range records {
+		if rr.TTL > elapsed {
+			rr.TTL -= elapsed
+		} else {
+			rr.TTL = 0
+		}
+		aged[i] = rr
+	}
+	return aged
+}
+
+// renamed copies records with their owner changed to name.
+func renamed(records []ResourceRecord, name Name) []ResourceRecord {
+	copied := make([]ResourceRecord, len(records))
+	for i, rr := range records {
+		rr.Name = name
+		copied[i] = rr
+	}
+	return copied
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCacheSynthesizesFromNSEC(t *testing.T) {
+	s := newTestSigner(t, "example.", AlgorithmECDSAP256SHA256)
+	signed := func(lines ...string) []ResourceRecord {
+		rrset := testRecords(t, lines...)
+		return append(rrset, s.sign(t, rrset))
+	}
+	now := time.Now()
+
+	// example. < *.example. < a.example. < www.example. < x.example.
+	soa := signed("example. 300 IN SOA ns.example. admin.example. 1 3600 600 86400 60")
+	apexNSEC := signed("example. 300 IN NSEC a.example. NS SOA RRSIG NSEC DNSKEY")
+	aNSEC := signed("a.example. 300 IN NSEC www.example. A RRSIG NSEC")
+	nxdomain := Message{
+		ResponseCode: ResponseCodeNameError,
+		Authority:    append(append(soa, apexNSEC...), aNSEC...),
+	}
+
+	type Test struct {
+		Description string
+		Question    string
+		Type        Type
+		Aggressive  bool
+		Status      SecurityStatus
+		Later       time.Duration
+		Expected    ResponseCode
+		Synthesized bool
+	}
+	tests := []Test{
+		{"Covered name", "b.example.", TypeA, true, StatusSecure, 0, ResponseCodeNameError, true},
+		{"Name below a covered name", "c.b.example.", TypeA, true, StatusSecure, 0, ResponseCodeNameError, true},
+		{"Missing type", "a.example.", TypeTXT, true, StatusSecure, 0, ResponseCodeOk, true},
+		{"Existing type", "a.example.", TypeA, true, StatusSecure, 0, 0, false},
+		{"Name outside the cached ranges", "x.example.", TypeA, true, StatusSecure, 0, 0, false},
+		{"Turned off", "b.example.", TypeA, false, StatusSecure, 0, 0, false},
+		{"Not validated", "b.example.", TypeA, true, StatusInsecure, 0, 0, false},
+		{"Past the SOA minimum", "b.example.", TypeA, true, StatusSecure, 2 * time.Minute, 0, false},
+	}
+	for _, test := range tests {
+		c := NewCache()
+		c.Aggressive = test.Aggressive
+		c.now = func() time.Time { return now }
+		c.Put(Question{Name: MustParseName("nope.example."), Type: TypeA, Class: ClassIN}, nxdomain, test.Status)
+		c.now = func() time.Time { return now.Add(test.Later) }
+
+		m, ok := c.Synthesize(Question{Name: MustParseName(test.Question), Type: test.Type, Class: ClassIN})
+		if ok != test.Synthesized {
+			t.Errorf("%s: expected synthesized %v, got %v", test.Description, test.Synthesized, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if m.ResponseCode != test.Expected {
+			t.Errorf("%s: expected %v, got %v", test.Description, test.Expected, m.ResponseCode)
+		}
+		if len(m.Answer) != 0 || len(m.Authority) == 0 || m.Authority[0].Type != TypeSOA {
+			t.Errorf("%s: expected an SOA and proof in the authority section, got %v", test.Description, m)
+		}
+	}
+}
+
+func TestCacheSynthesizesWildcards(t *testing.T) {
+	s := newTestSigner(t, "example.", AlgorithmECDSAP256SHA256)
+	now := time.Now()
+	wildcard := testRecords(t, "*.example. 300 IN A 192.0.2.3")
+	answer := append(wildcard, s.sign(t, wildcard))
+	answer = renamed(answer, MustParseName("b.example."))
+	wildNSEC := testRecords(t, "*.example. 300 IN NSEC a.example. A RRSIG NSEC")
+	aNSEC := testRecords(t, "a.example. 300 IN NSEC www.example. A RRSIG NSEC")
+	resp := Message{
+		Answer:    answer,
+		Authority: append(append(wildNSEC, s.sign(t, wildNSEC)), append(aNSEC, s.sign(t, aNSEC))...),
+	}
+	soa := testRecords(t, "example. 300 IN SOA ns.example. admin.example. 1 3600 600 86400 300")
+	nodata := Message{Authority: append(soa, s.sign(t, soa))}
+
+	c := NewCache()
+	c.Aggressive = true
+	c.now = func() time.Time { return now }
+	c.Put(Question{Name: MustParseName("b.example."), Type: TypeA, Class: ClassIN}, resp, StatusSecure)
+	c.Put(Question{Name: MustParseName("example."), Type: TypeTXT, Class: ClassIN}, nodata, StatusSecure)
+
+	m, ok := c.Synthesize(Question{Name: MustParseName("c.example."), Type: TypeA, Class: ClassIN})
+	if !ok {
+		t.Fatal("expected an answer from the wildcard")
+	}
+	if len(m.Answer) != 2 || !m.Answer[0].Name.Equal(MustParseName("c.example.")) || m.Answer[1].Type != TypeRRSIG {
+		t.Errorf("expected the wildcard's A record and signature for c.example., got %v", m.Answer)
+	}
+	m, ok = c.Synthesize(Question{Name: MustParseName("c.example."), Type: TypeAAAA, Class: ClassIN})
+	if !ok || m.ResponseCode != ResponseCodeOk || len(m.Answer) != 0 {
+		t.Errorf("expected a no data answer for a type the wildcard doesn't have, got %v", m)
+	}
+	if _, ok := c.Synthesize(Question{Name: MustParseName("c.example."), Type: TypeAAAA, Class: ClassIN}); !ok {
+		t.Error("expected the no data answer to be repeatable")
+	}
+}
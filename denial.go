@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+)
+
+// denial holds the NSEC and NSEC3 records from a response, which together may
+// prove that a name or type doesn't exist.
+type denial struct {
+	nsecs  []nsecRecord
+	nsec3s []nsec3Record
+	// tooExpensive is set when NSEC3 records were dropped because they asked
+	// for more hash iterations than we're willing to do
+	tooExpensive bool
+}
+
+type nsecRecord struct {
+	owner Name
+	rd    *NSEC
+	rr    ResourceRecord
+}
+
+type nsec3Record struct {
+	zone Name
+	hash []byte
+	rd   *NSEC3
+	rr   ResourceRecord
+}
+
+func newDenial(records []ResourceRecord) *denial {
+	d := &denial{}
+	for _, rr := range records {
+		switch rr.Type {
+		case TypeNSEC:
+			rd := &NSEC{}
+			if rd.Unpack(rr.Data) == nil {
+				d.nsecs = append(d.nsecs, nsecRecord{owner: rr.Name, rd: rd, rr: rr})
+			}
+		case TypeNSEC3:
+			rd := &NSEC3{}
+			if rd.Unpack(rr.Data) != nil || rd.HashAlgorithm != NSEC3HashSHA1 || len(rr.Name) == 0 {
+				continue
+			}
+			if rd.Iterations > maxNSEC3Iterations {
+				d.tooExpensive = true
+				continue
+			}
+			hash, err := base32Hex.DecodeString(strings.ToUpper(string(rr.Name[0])))
+			if err != nil {
+				continue
+			}
+			d.nsec3s = append(d.nsec3s, nsec3Record{zone: rr.Name.Parent(), hash: hash, rd: rd, rr: rr})
+		}
+	}
+	return d
+}
+
+// provesNameError reports whether the records show that name doesn't exist,
+// and that no wildcard could have answered for it.
+func (d *denial) provesNameError(name Name) bool {
+	return d.nameErrorProof(name) != nil
+}
+
+// nameErrorProof returns the records that prove name doesn't exist, or nil if
+// there aren't enough of them.
+func (d *denial) nameErrorProof(name Name) []ResourceRecord {
+	if n := d.nsecCovering(name); n != nil {
+		ce := nsecClosestEncloser(name, n)
+		if w := d.nsecCovering(ce.Child("*")); w != nil {
+			return dedupRecords([]ResourceRecord{n.rr, w.rr})
+		}
+		return nil
+	}
+	if ce, nc, _, ok := d.nsec3ClosestEncloser(name); ok {
+		if w := d.nsec3Covering(ce.Child("*")); w != nil {
+			return dedupRecords([]ResourceRecord{d.nsec3Matching(ce).rr, d.nsec3Covering(nc).rr, w.rr})
+		}
+	}
+	return nil
+}
+
+// provesNoData reports whether the records show that name has no records of
+// type t. The status is insecure when the proof rests on an opt-out NSEC3
+// record, which says nothing about unsigned delegations.
+func (d *denial) provesNoData(name Name, t Type) (SecurityStatus, bool) {
+	proof, status := d.noDataProof(name, t)
+	return status, proof != nil
+}
+
+// noDataProof returns the records that prove name has no records of type t,
+// or nil if there aren't enough of them.
+func (d *denial) noDataProof(name Name, t Type) ([]ResourceRecord, SecurityStatus) {
+	if n := d.nsecMatching(name); n != nil {
+		if noDataAt(n.rd.Types, t) {
+			return []ResourceRecord{n.rr}, StatusSecure
+		}
+		return nil, StatusSecure
+	}
+	if n := d.nsecCovering(name); n != nil {
+		// An empty non-terminal exists only because there are names below it
+		if n.rd.NextDomain.IsSubdomainOf(name) {
+			return []ResourceRecord{n.rr}, StatusSecure
+		}
+		// Otherwise the answer can only have come from a wildcard
+		ce := nsecClosestEncloser(name, n)
+		if w := d.nsecMatching(ce.Child("*")); w != nil && noDataAt(w.rd.Types, t) {
+			return dedupRecords([]ResourceRecord{n.rr, w.rr}), StatusSecure
+		}
+		return nil, StatusSecure
+	}
+
+	if n := d.nsec3Matching(name); n != nil {
+		if noDataAt(n.rd.Types, t) {
+			return []ResourceRecord{n.rr}, StatusSecure
+		}
+		return nil, StatusSecure
+	}
+	ce, nc, optOut, ok := d.nsec3ClosestEncloser(name)
+	if !ok {
+		return nil, StatusSecure
+	}
+	proof := []ResourceRecord{d.nsec3Matching(ce).rr, d.nsec3Covering(nc).rr}
+	if t == TypeDS && optOut {
+		return proof, StatusInsecure
+	}
+	if w := d.nsec3Matching(ce.Child("*")); w != nil && noDataAt(w.rd.Types, t) {
+		return dedupRecords(append(proof, w.rr)), StatusSecure
+	}
+	return nil, StatusSecure
+}
+
+// wildcardProof returns the closest encloser of name and the records that
+// show name doesn't exist while the wildcard below its closest encloser does,
+// which is all it takes to answer from that wildcard.
+func (d *denial) wildcardProof(name Name) (Name, []ResourceRecord) {
+	if n := d.nsecCovering(name); n != nil {
+		ce := nsecClosestEncloser(name, n)
+		if d.nsecMatching(ce.Child("*")) != nil {
+			return ce, []ResourceRecord{n.rr}
+		}
+		return nil, nil
+	}
+	if ce, nc, _, ok := d.nsec3ClosestEncloser(name); ok && d.nsec3Matching(ce.Child("*")) != nil {
+		return ce, []ResourceRecord{d.nsec3Covering(nc).rr}
+	}
+	return nil, nil
+}
+
+// provesNoExactMatch reports whether the records show that name doesn't exist
+// below its closest encloser, which a wildcard answer needs.
+func (d *denial) provesNoExactMatch(name, closestEncloser Name) bool {
+	if d.nsecCovering(name) != nil {
+		return true
+	}
+	nextCloser := name[len(name)-len(closestEncloser)-1:]
+	return d.nsec3Covering(nextCloser) != nil
+}
+
+// isDelegation reports whether the records show that name is a zone cut,
+// meaning it has NS records but isn't the apex of the zone that signed them.
+func (d *denial) isDelegation(name Name) bool {
+	var types []Type
+	if n := d.nsecMatching(name); n != nil {
+		types = n.rd.Types
+	} else if n := d.nsec3Matching(name); n != nil {
+		types = n.rd.Types
+	}
+	return isZoneCut(types)
+}
+
+// noDataAt reports whether the types at a name rule out an answer of type t.
+func noDataAt(types []Type, t Type) bool {
+	if hasType(types, t) || hasType(types, TypeCName) {
+		return false
+	}
+	// A parent's record at a delegation can only vouch for the DS records,
+	// since everything else there belongs to the child
+	if t != TypeDS && hasType(types, TypeNS) && !hasType(types, TypeSOA) {
+		return false
+	}
+	return true
+}
+
+func (d *denial) nsecMatching(name Name) *nsecRecord {
+	for i, n := range d.nsecs {
+		if n.owner.Equal(name) {
+			return &d.nsecs[i]
+		}
+	}
+	return nil
+}
+
+// nsecCovering finds the NSEC record that falls between name's neighbours in
+// canonical order, proving name doesn't exist. The last NSEC in a zone points
+// back to the apex, so it covers everything after its owner.
+func (d *denial) nsecCovering(name Name) *nsecRecord {
+	for i, n := range d.nsecs {
+		owner, next := n.owner, n.rd.NextDomain
+		var covers bool
+		if owner.Compare(next) < 0 {
+			covers = owner.Compare(name) < 0 && name.Compare(next) < 0
+		} else {
+			covers = owner.Compare(name) < 0 && name.IsSubdomainOf(next)
+		}
+		// An NSEC at a zone cut belongs to the parent, which can't speak for
+		// names below the cut
+		if covers && name.IsSubdomainOf(owner) && isZoneCut(n.rd.Types) {
+			continue
+		}
+		if covers {
+			return &d.nsecs[i]
+		}
+	}
+	return nil
+}
+
+// isZoneCut reports whether the types at a name make it a delegation.
+func isZoneCut(types []Type) bool {
+	return hasType(types, TypeNS) && !hasType(types, TypeSOA)
+}
+
+// nsecClosestEncloser works out the closest encloser of a name covered by n,
+// which is the longest ancestor of name that's known to exist.
+func nsecClosestEncloser(name Name, n *nsecRecord) Name {
+	l := domainSuffixLen(name, n.owner)
+	if m := domainSuffixLen(name, n.rd.NextDomain); m > l {
+		l = m
+	}
+	return name[len(name)-l:]
+}
+
+func (d *denial) nsec3Matching(name Name) *nsec3Record {
+	for i, n := range d.nsec3s {
+		if !name.IsSubdomainOf(n.zone) {
+			continue
+		}
+		if bytes.Equal(hashName(name, n.rd.Iterations, n.rd.Salt), n.hash) {
+			return &d.nsec3s[i]
+		}
+	}
+	return nil
+}
+
+func (d *denial) nsec3Covering(name Name) *nsec3Record {
+	for i, n := range d.nsec3s {
+		if !name.IsSubdomainOf(n.zone) {
+			continue
+		}
+		h := hashName(name, n.rd.Iterations, n.rd.Salt)
+		var covers bool
+		if bytes.Compare(n.hash, n.rd.NextHashed) < 0 {
+			covers = bytes.Compare(n.hash, h) < 0 && bytes.Compare(h, n.rd.NextHashed) < 0
+		} else {
+			covers = bytes.Compare(n.hash, h) < 0 || bytes.Compare(h, n.rd.NextHashed) < 0
+		}
+		if covers {
+			return &d.nsec3s[i]
+		}
+	}
+	return nil
+}
+
+// nsec3ClosestEncloser finds the closest encloser proof described in RFC 5155
+// section 7.2.1: an NSEC3 record matching the longest existing ancestor of
+// name, and another covering the next closer name one label below it.
+func (d *denial) nsec3ClosestEncloser(name Name) (closestEncloser, nextCloser Name, optOut bool, ok bool) {
+	for i := 1; i <= len(name); i++ {
+		ce := name[i:]
+		m := d.nsec3Matching(ce)
+		if m == nil {
+			continue
+		}
+		// Nothing below a zone cut can be proven from the parent
+		if isZoneCut(m.rd.Types) {
+			return nil, nil, false, false
+		}
+		nc := name[i-1:]
+		n := d.nsec3Covering(nc)
+		if n == nil {
+			return nil, nil, false, false
+		}
+		return ce, nc, n.rd.OptOut(), true
+	}
+	return nil, nil, false, false
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+)
+
+// canonicalNameLayouts describes the data of the types whose embedded names are
+// lowercased in the canonical form used for signing, following RFC 4034
+// section 6.2 as corrected by RFC 6840 section 5.1, which took RRSIG and NSEC
+// off the list. It uses the same encoding as compressedRDataLayouts. NAPTR is
+// on the list too, but its name comes after variable length strings, so it's
+// handled separately.
+var canonicalNameLayouts = map[Type][]int{
+	TypeNS:    {0},
+	TypeMD:    {0},
+	TypeMF:    {0},
+	TypeCName: {0},
+	TypeSOA:   {0, 0},
+	TypeMB:    {0},
+	TypeMG:    {0},
+	TypeMR:    {0},
+	TypePTR:   {0},
+	TypeMInfo: {0, 0},
+	TypeMX:    {2, 0},
+	TypeSRV:   {6, 0},
+}
+
+// canonicalRData returns data in the canonical form from RFC 4034 section 6.2.
+// Data that doesn't fit its type's layout is returned unchanged; it can't have
+// been signed in any other form.
+func canonicalRData(t Type, data []byte) []byte {
+	if t == TypeNAPTR {
+		naptr := &NAPTR{}
+		if err := naptr.Unpack(data); err != nil {
+			return data
+		}
+		naptr.Replacement = naptr.Replacement.Canonical()
+		return naptr.Pack()
+	}
+	layout, ok := canonicalNameLayouts[t]
+	if !ok {
+		return data
+	}
+	var out bytes.Buffer
+	r := newWireReader(data)
+	for _, field := range layout {
+		if field > 0 {
+			out.Write(r.bytes(field))
+			continue
+		}
+		writeName(&out, r.name().Canonical())
+	}
+	out.Write(r.rest())
+	if r.err != nil {
+		return data
+	}
+	return out.Bytes()
+}
+
+// labelCount counts the labels of a name the way the RRSIG labels field does,
+// leaving out a leading wildcard.
+func labelCount(n Name) int {
+	if len(n) > 0 && bytes.Equal(n[0], []byte("*")) {
+		return len(n) - 1
+	}
+	return len(n)
+}
+
+// signedData builds the data that sig is a signature over, as described in RFC
+// 4034 section 3.1.8.1. The records must all belong to the same RRset.
+func signedData(sig *RRSIG, rrset []ResourceRecord) []byte {
+	header := *sig
+	header.SignerName = sig.SignerName.Canonical()
+	var buf bytes.Buffer
+	buf.Write(header.packHeader())
+
+	owner := rrset[0].Name.Canonical()
+	// An answer synthesized from a wildcard was signed with the wildcard as
+	// its owner
+	if int(sig.Labels) < labelCount(owner) {
+		owner = owner[len(owner)-int(sig.Labels):].Child("*")
+	}
+
+	var datas [][]byte
+	for _, rr := range rrset {
+		datas = append(datas, canonicalRData(rr.Type, rr.Data))
+	}
+	sort.Slice(datas, func(i, j int) bool { return bytes.Compare(datas[i], datas[j]) < 0 })
+	for i, data := range datas {
+		if i > 0 && bytes.Equal(datas[i-1], data) {
+			continue
+		}
+		writeName(&buf, owner)
+		binary.Write(&buf, binary.BigEndian, rrset[0].Type)
+		binary.Write(&buf, binary.BigEndian, rrset[0].Class)
+		binary.Write(&buf, binary.BigEndian, sig.OriginalTTL)
+		binary.Write(&buf, binary.BigEndian, uint16(len(data)))
+		buf.Write(data)
+	}
+	return buf.Bytes()
+}
+
+// supportedAlgorithm reports whether we can verify signatures made with a.
+// Validators are supposed to treat zones signed only with algorithms they
+// don't support as insecure rather than bogus.
+func supportedAlgorithm(a Algorithm) bool {
+	switch a {
+	case AlgorithmRSASHA1, AlgorithmRSASHA1NSEC3, AlgorithmRSASHA256, AlgorithmRSASHA512,
+		AlgorithmECDSAP256SHA256, AlgorithmECDSAP384SHA384, AlgorithmED25519:
+		return true
+	}
+	return false
+}
+
+// verifyRRSIG checks that sig is key's signature over rrset. It doesn't look at
+// the validity window; callers check that against their own clock.
+func verifyRRSIG(sig *RRSIG, key *DNSKEY, rrset []ResourceRecord) error {
+	if key.Flags&DNSKEYFlagRevoke != 0 {
+		return errors.New("key has been revoked")
+	}
+	return checkSignature(sig, key, rrset)
+}
+
+// checkSignature is verifyRRSIG for keys that may have been revoked, which
+// still sign the DNSKEY RRset to prove the revocation is genuine.
+func checkSignature(sig *RRSIG, key *DNSKEY, rrset []ResourceRecord) error {
+	if key.Algorithm != sig.Algorithm || key.KeyTag() != sig.KeyTag {
+		return errors.New("signature wasn't made by this key")
+	}
+	if key.Flags&DNSKEYFlagZone == 0 || key.Protocol != 3 {
+		return errors.New("key isn't a zone key")
+	}
+	data := signedData(sig, rrset)
+
+	switch sig.Algorithm {
+	case AlgorithmRSASHA1, AlgorithmRSASHA1NSEC3, AlgorithmRSASHA256, AlgorithmRSASHA512:
+		pub, err := rsaPublicKey(key.PublicKey)
+		if err != nil {
+			return err
+		}
+		h, hashed := hashFor(sig.Algorithm, data)
+		return rsa.VerifyPKCS1v15(pub, h, hashed, sig.Signature)
+	case AlgorithmECDSAP256SHA256, AlgorithmECDSAP384SHA384:
+		curve := elliptic.P256()
+		if sig.Algorithm == AlgorithmECDSAP384SHA384 {
+			curve = elliptic.P384()
+		}
+		pub, err := ecdsa.ParseUncompressedPublicKey(curve, append([]byte{4}, key.PublicKey...))
+		if err != nil {
+			return fmt.Errorf("bad ECDSA key: %v", err)
+		}
+		if len(sig.Signature)%2 != 0 {
+			return errors.New("bad ECDSA signature length")
+		}
+		half := len(sig.Signature) / 2
+		r := new(big.Int).SetBytes(sig.Signature[:half])
+		s := new(big.Int).SetBytes(sig.Signature[half:])
+		_, hashed := hashFor(sig.Algorithm, data)
+		if !ecdsa.Verify(pub, hashed, r, s) {
+			return errors.New("ECDSA signature doesn't verify")
+		}
+		return nil
+	case AlgorithmED25519:
+		if len(key.PublicKey) != ed25519.PublicKeySize {
+			return errors.New("bad Ed25519 key length")
+		}
+		if !ed25519.Verify(ed25519.PublicKey(key.PublicKey), data, sig.Signature) {
+			return errors.New("Ed25519 signature doesn't verify")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported algorithm %s", sig.Algorithm)
+}
+
+func hashFor(a Algorithm, data []byte) (crypto.Hash, []byte) {
+	switch a {
+	case AlgorithmRSASHA1, AlgorithmRSASHA1NSEC3:
+		h := sha1.Sum(data)
+		return crypto.SHA1, h[:]
+	case AlgorithmRSASHA512:
+		h := sha512.Sum512(data)
+		return crypto.SHA512, h[:]
+	case AlgorithmECDSAP384SHA384:
+		h := sha512.Sum384(data)
+		return crypto.SHA384, h[:]
+	}
+	h := sha256.Sum256(data)
+	return crypto.SHA256, h[:]
+}
+
+// rsaPublicKey decodes an RSA key in the format from RFC 3110 section 2.
+func rsaPublicKey(b []byte) (*rsa.PublicKey, error) {
+	if len(b) < 3 {
+		return nil, errors.New("RSA key is too short")
+	}
+	expLen := int(b[0])
+	b = b[1:]
+	if expLen == 0 {
+		expLen = int(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if expLen == 0 || expLen > 4 || len(b) <= expLen {
+		return nil, errors.New("bad RSA key exponent")
+	}
+	var exp int
+	for _, c := range b[:expLen] {
+		exp = exp<<8 | int(c)
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(b[expLen:]), E: exp}, nil
+}
+
+// dsDigest computes the digest a DS record holds for key, which is owned by
+// owner, as described in RFC 4034 section 5.1.4.
+func dsDigest(owner Name, key *DNSKEY, dt DigestType) ([]byte, error) {
+	data := append(owner.Canonical().wireBytes(), key.Pack()...)
+	switch dt {
+	case DigestSHA1:
+		h := sha1.Sum(data)
+		return h[:], nil
+	case DigestSHA256:
+		h := sha256.Sum256(data)
+		return h[:], nil
+	case DigestSHA384:
+		h := sha512.Sum384(data)
+		return h[:], nil
+	}
+	return nil, fmt.Errorf("unsupported digest type %d", dt)
+}
+
+// Matches reports whether the DS record refers to key, owned by owner.
+func (d *DS) Matches(owner Name, key *DNSKEY) bool {
+	if d.KeyTag != key.KeyTag() || d.Algorithm != key.Algorithm {
+		return false
+	}
+	digest, err := dsDigest(owner, key, d.DigestType)
+	return err == nil && bytes.Equal(digest, d.Digest)
+}
+
+// hashName computes the NSEC3 hash of a name as described in RFC 5155 section
+// 5.
+func hashName(n Name, iterations uint16, salt []byte) []byte {
+	h := sha1.New()
+	h.Write(n.Canonical().wireBytes())
+	h.Write(salt)
+	digest := h.Sum(nil)
+	for i := 0; i < int(iterations); i++ {
+		h.Reset()
+		h.Write(digest)
+		h.Write(salt)
+		digest = h.Sum(digest[:0])
+	}
+	return digest
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSigner signs RRsets for a zone with a freshly generated key.
+type testSigner struct {
+	zone Name
+	key  *DNSKEY
+	sk   *SigningKey
+}
+
+func newTestSigner(t *testing.T, zone string, alg Algorithm) *testSigner {
+	sk, err := GenerateSigningKey(alg, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testSigner{zone: MustParseName(zone), key: sk.DNSKEY, sk: sk}
+}
+
+// sign returns an RRSIG record over rrset that's valid for an hour either side
+// of now.
+func (s *testSigner) sign(t *testing.T, rrset []ResourceRecord) ResourceRecord {
+	now := time.Now()
+	rr, err := s.sk.signRRset(rrset, s.zone, now.Add(-time.Hour), now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+func (s *testSigner) dnskey() ResourceRecord {
+	return ResourceRecord{Name: s.zone, Type: TypeDNSKEY, Class: ClassIN, TTL: 3600, Data: s.key.Pack()}
+}
+
+func (s *testSigner) ds(t *testing.T) ResourceRecord {
+	digest, err := dsDigest(s.zone, s.key, DigestSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := &DS{KeyTag: s.key.KeyTag(), Algorithm: s.key.Algorithm, DigestType: DigestSHA256, Digest: digest}
+	return ResourceRecord{Name: s.zone, Type: TypeDS, Class: ClassIN, TTL: 3600, Data: ds.Pack()}
+}
+
+// testRecords parses records in master file format.
+func testRecords(t *testing.T, lines ...string) []ResourceRecord {
+	records, err := parseRecords(strings.NewReader(strings.Join(lines, "\n")), Name{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestVerifyRRSIG(t *testing.T) {
+	for _, alg := range []Algorithm{AlgorithmED25519, AlgorithmECDSAP256SHA256} {
+		s := newTestSigner(t, "example.", alg)
+		rrset := testRecords(t,
+			"www.example. 300 IN A 192.0.2.1",
+			"WWW.example. 300 IN A 192.0.2.2",
+		)
+		rr := s.sign(t, rrset)
+		sig := &RRSIG{}
+		if err := sig.Unpack(rr.Data); err != nil {
+			t.Fatal(err)
+		}
+		// The order of the records and the case of their names mustn't matter
+		reordered := []ResourceRecord{rrset[1], rrset[0]}
+		if err := verifyRRSIG(sig, s.key, reordered); err != nil {
+			t.Errorf("%s: unexpected error: %v", alg, err)
+		}
+		tampered := testRecords(t, "www.example. 300 IN A 192.0.2.3")
+		if err := verifyRRSIG(sig, s.key, tampered); err == nil {
+			t.Errorf("%s: expected a signature over different data to fail", alg)
+		}
+		revoked := *s.key
+		revoked.Flags |= DNSKEYFlagRevoke
+		if err := verifyRRSIG(sig, &revoked, rrset); err == nil {
+			t.Errorf("%s: expected a revoked key to be rejected", alg)
+		}
+	}
+}
+
+func TestDSMatches(t *testing.T) {
+	// The DS example from RFC 4034 section 5.4
+	data, err := ParseRData(TypeDNSKEY, fields(t, rfc4034Key), Name{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := &DNSKEY{}
+	if err := key.Unpack(data); err != nil {
+		t.Fatal(err)
+	}
+	data, err = ParseRData(TypeDS, fields(t, "60485 5 1 2BB183AF5F22588179A53B0A98631FAD1A292118"), Name{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := &DS{}
+	if err := ds.Unpack(data); err != nil {
+		t.Fatal(err)
+	}
+	if !ds.Matches(MustParseName("dskey.example.com."), key) {
+		t.Error("expected the DS to match the key")
+	}
+	if ds.Matches(MustParseName("other.example.com."), key) {
+		t.Error("expected the DS not to match the key under a different owner")
+	}
+}
+
+func TestHashName(t *testing.T) {
+	// Hashes from RFC 5155 appendix A
+	tests := map[string]string{
+		"example.":     "0p9mhaveqvm6t7vbl5lop2u3t2rp3tom",
+		"a.example.":   "35mthgpgcu1qg68fab165klnsnk3dpvl",
+		"*.w.example.": "r53bq7cc2uvmubfu5ocmm6pers9tk9en",
+	}
+	for name, expected := range tests {
+		got := strings.ToLower(base32Hex.EncodeToString(hashName(MustParseName(name), 12, []byte{0xaa, 0xbb, 0xcc, 0xdd})))
+		if got != expected {
+			t.Errorf("%s: expected %s, got %s", name, expected, got)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+)
+
+// dohContentType is the media type of DNS messages sent over HTTPS.
+const dohContentType = "application/dns-message"
+
+// ServeHTTP answers DNS over HTTPS (RFC 8484). Queries come either as the
+// base64url dns parameter of a GET, or as the body of a POST, and go through
+// the same handling as queries over TCP. The server is usually mounted at
+// /dns-query, and served over TLS with HTTP/2 as section 5.2 recommends.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var b []byte
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		param := r.URL.Query().Get("dns")
+		if param == "" {
+			http.Error(w, "missing dns parameter", http.StatusBadRequest)
+			return
+		}
+		// Section 4.1 leaves padding off, but some clients add it anyway
+		b, err = base64.RawURLEncoding.DecodeString(param)
+		if err != nil {
+			b, err = base64.URLEncoding.DecodeString(param)
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("decoding dns parameter: %v", err), http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dohContentType {
+			http.Error(w, "expected "+dohContentType, http.StatusUnsupportedMediaType)
+			return
+		}
+		b, err = io.ReadAll(io.LimitReader(r.Body, 0xFFFF+1))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(b) > 0xFFFF {
+			http.Error(w, "message too long", http.StatusRequestEntityTooLarge)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "expected GET or POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if len(b) < 12 {
+		http.Error(w, "message too short", http.StatusBadRequest)
+		return
+	}
+
+	var from net.Addr
+	if ap, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		from = ap
+	}
+	m, c, ans := s.receive(b, from)
+	out := s.reply(m, c, ans, 0xFFFF)
+	resp := Message{}
+	Unmarshal(out, &resp)
+
+	w.Header().Set("Content-Type", dohContentType)
+	if ttl, ok := cacheableFor(resp); ok {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", ttl))
+	}
+	if _, err := w.Write(out); err != nil {
+		log.Printf("writing to %s: %v", r.RemoteAddr, err)
+	}
+}
+
+// cacheableFor works out how long an HTTP cache may keep a response, which
+// section 5.1 says shouldn't outlast the smallest TTL in it. Failures aren't
+// cached at all.
+func cacheableFor(m Message) (uint32, bool) {
+	if m.ResponseCode != ResponseCodeOk && m.ResponseCode != ResponseCodeNameError {
+		return 0, false
+	}
+	var ttl uint32
+	var found bool
+	for _, section := range [][]ResourceRecord{m.Answer, m.Authority, m.Additional} {
+		for _, rr := range section {
+			if rr.Type == TypeOPT || rr.Type == TypeTSIG {
+				continue
+			}
+			if !found || rr.TTL < ttl {
+				ttl, found = rr.TTL, true
+			}
+		}
+	}
+	return ttl, found
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServeHTTP(t *testing.T) {
+	s := &Server{}
+	s.AddZone(mustParseZone(t, testZone, "example.com"))
+	query := func(name string) []byte {
+		m := Message{Questions: []Question{{Name: MustParseName(name), Type: TypeA, Class: ClassIN}}}
+		m.updateCounts()
+		return m.Marshal()
+	}
+	post := func(body []byte, contentType string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+		return r
+	}
+
+	type Test struct {
+		Description  string
+		Request      *http.Request
+		Status       int
+		CacheControl string
+		Answers      int
+	}
+	tests := []Test{
+		{"GET", httptest.NewRequest(http.MethodGet, "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(query("www.example.com")), nil), http.StatusOK, "max-age=300", 1},
+		{"POST", post(query("ns1.example.com"), dohContentType), http.StatusOK, "max-age=3600", 1},
+		// The SOA in the authority section only lasts as long as its minimum
+		{"Name error", post(query("nope.example.com"), dohContentType), http.StatusOK, "max-age=300", 0},
+		{"No dns parameter", httptest.NewRequest(http.MethodGet, "/dns-query", nil), http.StatusBadRequest, "", 0},
+		{"Bad base64", httptest.NewRequest(http.MethodGet, "/dns-query?dns=!!!", nil), http.StatusBadRequest, "", 0},
+		{"Wrong content type", post(query("www.example.com"), "text/plain"), http.StatusUnsupportedMediaType, "", 0},
+		{"Wrong method", httptest.NewRequest(http.MethodPut, "/dns-query", nil), http.StatusMethodNotAllowed, "", 0},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, test.Request)
+		if w.Code != test.Status {
+			t.Errorf("%s: expected status %d, got %d", test.Description, test.Status, w.Code)
+			continue
+		}
+		if got := w.Header().Get("Cache-Control"); got != test.CacheControl {
+			t.Errorf("%s: expected Cache-Control %q, got %q", test.Description, test.CacheControl, got)
+		}
+		if test.Status != http.StatusOK {
+			continue
+		}
+		if ct := w.Header().Get("Content-Type"); ct != dohContentType {
+			t.Errorf("%s: expected content type %s, got %s", test.Description, dohContentType, ct)
+		}
+		resp := Message{}
+		Unmarshal(w.Body.Bytes(), &resp)
+		if len(resp.Answer) != test.Answers {
+			t.Errorf("%s: expected %d answers, got %d", test.Description, test.Answers, len(resp.Answer))
+		}
+	}
+}
+
+func TestServeHTTP2(t *testing.T) {
+	s := &Server{}
+	s.AddZone(mustParseZone(t, testZone, "example.com"))
+	ts := httptest.NewUnstartedServer(s)
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	m := Message{Questions: []Question{{Name: MustParseName("www.example.com"), Type: TypeA, Class: ClassIN}}}
+	m.updateCounts()
+	resp, err := ts.Client().Post(ts.URL+"/dns-query", dohContentType, bytes.NewReader(m.Marshal()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("expected HTTP/2, got %s", resp.Proto)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	answer := Message{}
+	Unmarshal(b, &answer)
+	if len(answer.Answer) != 1 || !strings.HasPrefix(answer.Answer[0].String(), "www.example.com.") {
+		t.Errorf("expected an answer for www.example.com, got %v", answer.Answer)
+	}
+}
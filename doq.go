@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/quic"
+)
+
+// Error codes from RFC 9250 section 4.3, sent when closing a DNS over QUIC
+// connection or stream.
+const (
+	doqNoError       = 0x0
+	doqInternalError = 0x1
+	doqProtocolError = 0x2
+)
+
+// ServeQUIC answers DNS over QUIC (RFC 9250) on conn, which is usually
+// listening on UDP port 853. Each query comes on a stream of its own, framed
+// as it would be over TCP, and the answer goes back on the same stream. It
+// returns when the server is closed.
+//
+// The QUIC package doesn't support 0-RTT yet, so clients always wait for the
+// handshake. Once it does, queries that arrive in early data have to pass
+// replaySafe first.
+func (s *Server) ServeQUIC(conn net.PacketConn, config *tls.Config) error {
+	config = config.Clone()
+	// Unlike DNS over TLS, section 4.1.1 makes ALPN mandatory
+	config.NextProtos = []string{"doq"}
+	e, err := quic.NewEndpoint(conn, &quic.Config{TLSConfig: config})
+	if err != nil {
+		return fmt.Errorf("listening for QUIC: %v", err)
+	}
+	s.mu.Lock()
+	s.listeners = append(s.listeners, quicEndpointCloser{e})
+	s.mu.Unlock()
+	for {
+		c, err := e.Accept(context.Background())
+		if err != nil {
+			// Accept only fails once the endpoint is closed
+			return err
+		}
+		go s.serveQUICConn(c)
+	}
+}
+
+// replaySafe reports whether m may be answered from 0-RTT data, which an
+// attacker can replay. Section 4.5 limits that to plain queries, leaving out
+// updates, NOTIFY and zone transfers, whose effects or cost shouldn't be
+// repeatable by someone else.
+func replaySafe(m Message) bool {
+	return m.OpCode == OpCodeStandard && len(m.Questions) == 1 && !isTransfer(m)
+}
+
+// quicEndpointCloser closes a QUIC endpoint along with the server, giving
+// its connections a moment to hear about it.
+type quicEndpointCloser struct {
+	e *quic.Endpoint
+}
+
+func (c quicEndpointCloser) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	c.e.Close(ctx)
+	return nil
+}
+
+// serveQUICConn answers the queries on each stream a client opens, until the
+// connection closes.
+func (s *Server) serveQUICConn(c *quic.Conn) {
+	for {
+		st, err := c.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		go s.serveQUICStream(c, st)
+	}
+}
+
+// serveQUICStream answers the one query on a stream. Zone transfers are
+// streamed back as a series of messages, as section 4.2 allows.
+func (s *Server) serveQUICStream(c *quic.Conn, st *quic.Stream) {
+	ctx, cancel := context.WithTimeout(context.Background(), tcpIdleTimeout)
+	defer cancel()
+	st.SetReadContext(ctx)
+	st.SetWriteContext(ctx)
+	defer st.CloseRead()
+
+	b, err := readTCPMessage(st)
+	if err != nil {
+		st.Reset(doqProtocolError)
+		return
+	}
+	// The client has to finish the stream after its query, and section
+	// 4.2.1 calls a nonzero ID a protocol error, so that IDs don't get in
+	// the way of caching
+	if _, err := st.ReadByte(); err != io.EOF || len(b) < 12 || binary.BigEndian.Uint16(b) != 0 {
+		c.Abort(&quic.ApplicationError{Code: doqProtocolError, Reason: "expected one query with an ID of 0"})
+		return
+	}
+	remote := net.UDPAddrFromAddrPort(c.RemoteAddr())
+	m, cl, ans := s.receive(b, remote)
+	if ans == nil && isTransfer(m) {
+		err = s.transfer(st, m, cl)
+	} else {
+		err = writeTCPMessage(st, s.reply(m, cl, ans, 0xFFFF))
+	}
+	if err != nil {
+		log.Printf("writing to %v: %v", remote, err)
+		st.Reset(doqInternalError)
+		return
+	}
+	st.CloseWrite()
+}
+
+// doqTransport sends queries over DNS over QUIC. It keeps one connection
+// open and opens a stream on it for each query, so queries don't wait on
+// each other.
+type doqTransport struct {
+	addr   string
+	config *quic.Config
+
+	mu       sync.Mutex
+	endpoint *quic.Endpoint
+	conn     *quic.Conn
+}
+
+func (t *doqTransport) exchange(ctx context.Context, req []byte) ([]byte, error) {
+	id := binary.BigEndian.Uint16(req)
+	body := append([]byte{}, req...)
+	binary.BigEndian.PutUint16(body, 0)
+	// As with DNS over TLS, a connection we kept may have gone idle and been
+	// closed, so a failure on one gets a second try on a fresh connection
+	for {
+		conn, fresh, err := t.connection(ctx)
+		if err != nil {
+			return nil, err
+		}
+		b, err := queryQUIC(ctx, conn, body)
+		if err == nil {
+			binary.BigEndian.PutUint16(b, id)
+			return b, nil
+		}
+		if ctx.Err() != nil {
+			// Only the stream was given up on, not the connection
+			return nil, err
+		}
+		t.drop(conn)
+		if fresh {
+			return nil, fmt.Errorf("querying %s over QUIC: %v", t.addr, err)
+		}
+	}
+}
+
+// connection returns the open connection to the server, dialing one if
+// there isn't one, and whether it's new.
+func (t *doqTransport) connection(ctx context.Context) (*quic.Conn, bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn != nil {
+		return t.conn, false, nil
+	}
+	if t.endpoint == nil {
+		e, err := quic.Listen("udp", ":0", nil)
+		if err != nil {
+			return nil, false, fmt.Errorf("listening for QUIC: %v", err)
+		}
+		t.endpoint = e
+	}
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	conn, err := t.endpoint.Dial(ctx, "udp", t.addr, t.config)
+	if err != nil {
+		return nil, false, fmt.Errorf("dialing %s over QUIC: %v", t.addr, err)
+	}
+	t.conn = conn
+	return conn, true, nil
+}
+
+// drop forgets conn after a query on it failed, unless it's already been
+// replaced.
+func (t *doqTransport) drop(conn *quic.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn == conn {
+		t.conn = nil
+	}
+	conn.Abort(&quic.ApplicationError{Code: doqNoError})
+}
+
+// queryQUIC sends req on a new stream on conn, finishing the stream to show
+// there's nothing more to come, and reads the response.
+func queryQUIC(ctx context.Context, conn *quic.Conn, req []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	st, err := conn.NewStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer st.CloseRead()
+	st.SetReadContext(ctx)
+	st.SetWriteContext(ctx)
+	if err := writeTCPMessage(st, req); err != nil {
+		return nil, err
+	}
+	st.CloseWrite()
+	b, err := readTCPMessage(st)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < 12 {
+		return nil, errors.New("response is too short")
+	}
+	return b, nil
+}
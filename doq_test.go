@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/quic"
+)
+
+func TestServeQUIC(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	cert := writeTestCert(t, certFile, keyFile, 1)
+	config, err := LoadTLSConfig(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{}
+	s.AddZone(mustParseZone(t, testZone, "example.com"))
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeQUIC(pc, config)
+	defer pc.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	e, err := quic.Listen("udp", "127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	clientConfig := &quic.Config{TLSConfig: &tls.Config{RootCAs: roots, ServerName: "localhost", NextProtos: []string{"doq"}}}
+	conn, err := e.Dial(ctx, "udp", pc.LocalAddr().String(), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	query := func(id uint16, name string) (Message, error) {
+		m := Message{ID: id, Questions: []Question{{Name: MustParseName(name), Type: TypeA, Class: ClassIN}}}
+		m.updateCounts()
+		b, err := queryQUIC(ctx, conn, m.Marshal())
+		resp := Message{}
+		if err == nil {
+			Unmarshal(b, &resp)
+		}
+		return resp, err
+	}
+
+	// Each query gets a stream of its own, so they can all be in flight at once
+	names := []string{"www.example.com", "ns1.example.com", "www.example.com", "ns1.example.com"}
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := query(0, name)
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+				return
+			}
+			if resp.ID != 0 || resp.ResponseCode != ResponseCodeOk || len(resp.Answer) != 1 {
+				t.Errorf("%s: expected an answer with an ID of 0, got ID %d, %v with %d records", name, resp.ID, resp.ResponseCode, len(resp.Answer))
+			}
+		}()
+	}
+	wg.Wait()
+	if proto := conn.ConnectionState().NegotiatedProtocol; proto != "doq" {
+		t.Errorf("expected ALPN to settle on doq, got %q", proto)
+	}
+
+	// A query with an ID is a protocol error, which closes the connection
+	if _, err := query(7, "www.example.com"); err == nil {
+		t.Error("expected a query with a nonzero ID to fail")
+	}
+	err = conn.Wait(ctx)
+	if !errors.Is(err, &quic.ApplicationError{Code: doqProtocolError}) {
+		t.Errorf("expected the connection to close with a protocol error, got %v", err)
+	}
+}
+
+func TestReplaySafe(t *testing.T) {
+	type Test struct {
+		Description string
+		OpCode      OpCode
+		Type        Type
+		Expected    bool
+	}
+	tests := []Test{
+		{"A plain query", OpCodeStandard, TypeA, true},
+		{"A zone transfer", OpCodeStandard, TypeAXFR, false},
+		{"An incremental zone transfer", OpCodeStandard, TypeIXFR, false},
+		{"An update", OpCodeUpdate, TypeSOA, false},
+		{"A NOTIFY", OpCodeNotify, TypeSOA, false},
+	}
+	for _, test := range tests {
+		m := Message{OpCode: test.OpCode, Questions: []Question{{Name: MustParseName("example.com"), Type: test.Type, Class: ClassIN}}}
+		if got := replaySafe(m); got != test.Expected {
+			t.Errorf("%s: expected %v, got %v", test.Description, test.Expected, got)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader hands out a certificate loaded from files, loading it again
+// whenever the files change so certificates can be rotated without a
+// restart.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// LoadTLSConfig builds the TLS config for serving DNS over TLS or HTTPS with
+// the PEM certificate chain and key in the given files. The files are checked
+// for changes on each handshake. Session tickets are left on, so clients can
+// resume sessions rather than doing a full handshake each time they connect.
+func LoadTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.GetCertificate(nil); err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		GetCertificate: r.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}, nil
+}
+
+// GetCertificate returns the current certificate, reloading it if either of
+// its files has changed. If the new files can't be loaded the old certificate
+// is kept, since a rotation may be half way through writing them.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var modTime time.Time
+	for _, path := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			if r.cert != nil {
+				return r.cert, nil
+			}
+			return nil, err
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	if r.cert != nil && !modTime.After(r.modTime) {
+		return r.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		if r.cert != nil {
+			return r.cert, nil
+		}
+		return nil, fmt.Errorf("loading certificate: %v", err)
+	}
+	r.cert, r.modTime = &cert, modTime
+	return r.cert, nil
+}
+
+// ServeTLS answers DNS over TLS (RFC 7858) on l, which is usually listening
+// on port 853. Messages are framed as they are over TCP, and a client can
+// send any number of queries on a connection, so it goes through the same
+// handling as queries over TCP. It returns when the server is closed.
+func (s *Server) ServeTLS(l net.Listener, config *tls.Config) error {
+	config = config.Clone()
+	if len(config.NextProtos) == 0 {
+		// RFC 7858 section 3.2 doesn't require ALPN, but "dot" is
+		// registered for it
+		config.NextProtos = []string{"dot"}
+	}
+	s.mu.Lock()
+	s.listeners = append(s.listeners, l)
+	s.mu.Unlock()
+	return s.serveStream(tls.NewListener(l, config))
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate for localhost to certFile and
+// keyFile, returning it for clients to trust.
+func writeTestCert(t *testing.T, certFile, keyFile string, serial int64) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestServeTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	cert := writeTestCert(t, certFile, keyFile, 1)
+	config, err := LoadTLSConfig(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{}
+	s.AddZone(mustParseZone(t, testZone, "example.com"))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeTLS(l, config)
+	defer l.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	clientConfig := &tls.Config{RootCAs: roots, ServerName: "localhost", NextProtos: []string{"dot"}, ClientSessionCache: tls.NewLRUClientSessionCache(1)}
+	query := func(conn net.Conn, name string) Message {
+		m := Message{ID: 3, Questions: []Question{{Name: MustParseName(name), Type: TypeA, Class: ClassIN}}}
+		m.updateCounts()
+		if err := writeTCPMessage(conn, m.Marshal()); err != nil {
+			t.Fatal(err)
+		}
+		b, err := readTCPMessage(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := Message{}
+		Unmarshal(b, &resp)
+		return resp
+	}
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Several queries can share a connection
+	for _, name := range []string{"www.example.com", "ns1.example.com"} {
+		if resp := query(conn, name); resp.ResponseCode != ResponseCodeOk || len(resp.Answer) != 1 {
+			t.Errorf("expected an answer for %s, got %v with %d records", name, resp.ResponseCode, len(resp.Answer))
+		}
+	}
+	if proto := conn.ConnectionState().NegotiatedProtocol; proto != "dot" {
+		t.Errorf("expected ALPN to settle on dot, got %q", proto)
+	}
+	conn.Close()
+
+	conn, err = tls.Dial("tcp", l.Addr().String(), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query(conn, "www.example.com")
+	if !conn.ConnectionState().DidResume {
+		t.Error("expected the second connection to resume the session")
+	}
+	conn.Close()
+
+	// A rotated certificate is picked up by the next handshake
+	rotated := writeTestCert(t, certFile, keyFile, 2)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	roots.AddCert(rotated)
+	conn, err = tls.Dial("tcp", l.Addr().String(), &tls.Config{RootCAs: roots, ServerName: "localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64(); got != 2 {
+		t.Errorf("expected the rotated certificate, got serial %d", got)
+	}
+}
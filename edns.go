@@ -0,0 +1,101 @@
+package main
+
+// EDNS(0) options are carried in the additional section of a message by an
+// OPT pseudo record, described in RFC 6891.
+
+// ednsUDPSize is the payload size we advertise, following the recommendation
+// of DNS flag day 2020 to avoid fragmentation.
+const ednsUDPSize = 1232
+
+// minUDPSize is the most a client that doesn't use EDNS can receive over UDP.
+const minUDPSize = 512
+
+// ednsFlagDO is the "DNSSEC OK" bit in the flags of an OPT record.
+const ednsFlagDO = 1 << 15
+
+// SetEDNS0 adds an OPT record to the message, replacing any it already had.
+// dnssecOK sets the DO bit, which asks for DNSSEC records to be included.
+func (m *Message) SetEDNS0(udpSize uint16, dnssecOK bool) {
+	m.removeOPT()
+	opt := ResourceRecord{
+		Name:  Name{},
+		Type:  TypeOPT,
+		Class: Class(udpSize),
+	}
+	if dnssecOK {
+		opt.TTL |= ednsFlagDO
+	}
+	m.Additional = append(m.Additional, opt)
+	m.ARCount = uint16(len(m.Additional))
+}
+
+// EDNS0 returns the payload size and DO bit from the message's OPT record, and
+// whether it had one.
+func (m *Message) EDNS0() (udpSize uint16, dnssecOK bool, ok bool) {
+	for _, rr := range m.Additional {
+		if rr.Type == TypeOPT {
+			return uint16(rr.Class), rr.TTL&ednsFlagDO != 0, true
+		}
+	}
+	return 0, false, false
+}
+
+// DNSSECOK reports whether the sender of the message asked for DNSSEC records.
+func (m *Message) DNSSECOK() bool {
+	_, do, _ := m.EDNS0()
+	return do
+}
+
+func (m *Message) removeOPT() {
+	var kept []ResourceRecord
+	for _, rr := range m.Additional {
+		if rr.Type != TypeOPT {
+			kept = append(kept, rr)
+		}
+	}
+	m.Additional = kept
+}
+
+// maxUDPResponseSize is how big a UDP response to req can be.
+func maxUDPResponseSize(req Message) int {
+	size, _, ok := req.EDNS0()
+	if !ok || size < minUDPSize {
+		return minUDPSize
+	}
+	if size > ednsUDPSize {
+		return ednsUDPSize
+	}
+	return int(size)
+}
+
+// truncate cuts a response down to an empty one with the TC bit set, telling
+// the client to retry over TCP. Only the OPT record is kept.
+func (m *Message) truncate() {
+	var opt []ResourceRecord
+	for _, rr := range m.Additional {
+		if rr.Type == TypeOPT {
+			opt = append(opt, rr)
+		}
+	}
+	m.Truncated = true
+	m.Answer = nil
+	m.Authority = nil
+	m.Additional = opt
+	m.updateCounts()
+}
+
+// stripDNSSEC removes the DNSSEC records that a client which didn't set the DO
+// bit isn't expecting, unless they're what it asked for.
+func stripDNSSEC(records []ResourceRecord, qtype Type) []ResourceRecord {
+	var kept []ResourceRecord
+	for _, rr := range records {
+		switch rr.Type {
+		case TypeRRSIG, TypeNSEC, TypeNSEC3:
+			if rr.Type != qtype {
+				continue
+			}
+		}
+		kept = append(kept, rr)
+	}
+	return kept
+}
@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestEDNS0(t *testing.T) {
+	m := Message{Questions: []Question{{Name: MustParseName("example.com"), Type: TypeA, Class: ClassIN}}, QdCount: 1}
+	if size := maxUDPResponseSize(m); size != minUDPSize {
+		t.Errorf("expected %d without EDNS, got %d", minUDPSize, size)
+	}
+	m.SetEDNS0(4096, true)
+	m.SetEDNS0(4096, true)
+
+	var got Message
+	if err := Unmarshal(m.Marshal(), &got); err != nil {
+		t.Fatal(err)
+	}
+	size, do, ok := got.EDNS0()
+	if !ok || size != 4096 || !do {
+		t.Errorf("expected a 4096 octet payload with DO set, got %d, %v, %v", size, do, ok)
+	}
+	if len(got.Additional) != 1 {
+		t.Errorf("expected one OPT record, got %d", len(got.Additional))
+	}
+	if size := maxUDPResponseSize(got); size != ednsUDPSize {
+		t.Errorf("expected responses to be capped at %d, got %d", ednsUDPSize, size)
+	}
+
+	got.Answer = testRecords(t, "example.com. 300 IN A 192.0.2.1")
+	got.truncate()
+	if !got.Truncated || len(got.Answer) != 0 || got.ARCount != 1 {
+		t.Errorf("expected an empty truncated response keeping its OPT record, got %+v", got)
+	}
+}
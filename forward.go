@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ForwardRule says how to resolve names under Suffix: by forwarding them to
+// Pool, or resolving them ourselves from the root if Pool is nil.
+type ForwardRule struct {
+	Suffix Name
+	Pool   *Pool
+	// Insecure skips DNSSEC validation for names under Suffix, for
+	// internal zones that aren't signed or aren't reachable from the
+	// public tree of trust
+	Insecure bool
+}
+
+// ParseForwardRule reads how to resolve names under suffix from a list of
+// options separated by commas: the upstreams to forward to, as NewClient
+// takes them, or "recurse" to resolve the names ourselves, along with
+// "strategy:name" to pick how the upstreams are shared, "race:n" and
+// "stagger:duration" to race them, and "no-dnssec" to skip validation.
+func ParseForwardRule(suffix Name, spec string) (*ForwardRule, error) {
+	rule := &ForwardRule{Suffix: suffix}
+	var servers []string
+	var recurse bool
+	strategy := RoundRobin
+	var race int
+	var stagger time.Duration
+	for _, opt := range strings.Split(spec, ",") {
+		switch {
+		case opt == "recurse":
+			recurse = true
+		case opt == "no-dnssec":
+			rule.Insecure = true
+		case strings.HasPrefix(opt, "strategy:"):
+			s, err := ParseStrategy(strings.TrimPrefix(opt, "strategy:"))
+			if err != nil {
+				return nil, err
+			}
+			strategy = s
+		case strings.HasPrefix(opt, "race:"):
+			n, err := strconv.Atoi(strings.TrimPrefix(opt, "race:"))
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("bad race option %q", opt)
+			}
+			race = n
+		case strings.HasPrefix(opt, "stagger:"):
+			d, err := time.ParseDuration(strings.TrimPrefix(opt, "stagger:"))
+			if err != nil {
+				return nil, fmt.Errorf("bad stagger option %q: %v", opt, err)
+			}
+			stagger = d
+		case opt != "":
+			servers = append(servers, opt)
+		}
+	}
+	switch {
+	case recurse && len(servers) > 0:
+		return nil, fmt.Errorf("forwarding rule for %s has upstreams and recurse", suffix)
+	case recurse:
+		return rule, nil
+	case len(servers) == 0:
+		return nil, fmt.Errorf("forwarding rule for %s has no upstreams", suffix)
+	}
+	pool, err := NewPool(servers, strategy)
+	if err != nil {
+		return nil, err
+	}
+	pool.Race, pool.Stagger = race, stagger
+	rule.Pool = pool
+	return rule, nil
+}
+
+// route returns the forwarding rule for name, which is the one with the
+// longest suffix that name falls under, or nil if there isn't one.
+func (s *Server) route(name Name) *ForwardRule {
+	var best *ForwardRule
+	for _, rule := range s.rules {
+		n := domainSuffixLen(name, rule.Suffix)
+		if n == len(rule.Suffix) && (best == nil || n > len(best.Suffix)) {
+			best = rule
+		}
+	}
+	return best
+}
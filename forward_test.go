@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseForwardRule(t *testing.T) {
+	type Test struct {
+		Spec      string
+		Upstreams int
+		Strategy  Strategy
+		Insecure  bool
+		Error     bool
+	}
+	tests := []Test{
+		{"192.0.2.53:53", 1, RoundRobin, false, false},
+		{"192.0.2.53:53,tls://192.0.2.54,strategy:strict-order,no-dnssec", 2, StrictOrder, true, false},
+		{"recurse", 0, 0, false, false},
+		{"recurse,no-dnssec", 0, 0, true, false},
+		{"recurse,192.0.2.53:53", 0, 0, false, true},
+		{"no-dnssec", 0, 0, false, true},
+		{"192.0.2.53:53,strategy:fastest", 0, 0, false, true},
+	}
+	for _, test := range tests {
+		rule, err := ParseForwardRule(MustParseName("corp.example"), test.Spec)
+		if (err != nil) != test.Error {
+			t.Errorf("%s: expected error %v, got %v", test.Spec, test.Error, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		var upstreams int
+		if rule.Pool != nil {
+			upstreams = len(rule.Pool.upstreams)
+			if rule.Pool.Strategy != test.Strategy {
+				t.Errorf("%s: expected strategy %d, got %d", test.Spec, test.Strategy, rule.Pool.Strategy)
+			}
+		}
+		if upstreams != test.Upstreams || rule.Insecure != test.Insecure {
+			t.Errorf("%s: expected %d upstreams and insecure %v, got %d and %v", test.Spec, test.Upstreams, test.Insecure, upstreams, rule.Insecure)
+		}
+	}
+}
+
+func TestConditionalForwarding(t *testing.T) {
+	corp := startUpstream(t, "127.0.0.1:0")
+	public, err := NewClient(startUpstream(t, "127.0.0.1:0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	anchors, err := NewTrustAnchors(nil, RootAnchors(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule := func(suffix, spec string) *ForwardRule {
+		r, err := ParseForwardRule(MustParseName(suffix), spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	s := &Server{
+		cli: public,
+		rules: []*ForwardRule{
+			rule(".", deadAddr(t)),
+			rule("example.com", "recurse,no-dnssec"),
+			rule("www.example.com", corp+",no-dnssec"),
+			rule("alias.example.com", corp),
+		},
+	}
+	s.validator = NewValidator(s.lookup, anchors)
+	// A denial cached from the public tree doesn't speak for names that are
+	// sent somewhere else
+	s.cache = NewCache()
+	denial := Message{ResponseCode: ResponseCodeNameError, Authority: testRecords(t, "example.com. 300 IN SOA ns.example.com. admin.example.com. 1 3600 600 86400 300")}
+	s.cache.Put(Question{Name: MustParseName("www.example.com"), Type: TypeA, Class: ClassIN}, denial, StatusSecure)
+
+	type Test struct {
+		Description  string
+		Name         string
+		ResponseCode ResponseCode
+	}
+	tests := []Test{
+		{"Longest suffix wins", "www.example.com", ResponseCodeOk},
+		{"Resolved ourselves", "ns1.example.com", ResponseCodeOk},
+		// Validating needs the root's keys, which have to come from the
+		// dead default route
+		{"Validated", "alias.example.com", ResponseCodeServerFailure},
+		{"Default route", "www.example.org", ResponseCodeServerFailure},
+	}
+	for _, test := range tests {
+		ans := s.handle(Message{RecursionDesired: true, Questions: []Question{{Name: MustParseName(test.Name), Type: TypeA, Class: ClassIN}}}, client{})
+		if ans.ResponseCode != test.ResponseCode {
+			t.Errorf("%s: expected %v, got %v", test.Description, test.ResponseCode, ans.ResponseCode)
+		}
+		if test.ResponseCode == ResponseCodeOk && len(ans.Answer) == 0 {
+			t.Errorf("%s: expected an answer", test.Description)
+		}
+	}
+	if got := s.route(MustParseName("deep.www.example.com")); got == nil || !got.Suffix.Equal(MustParseName("www.example.com")) {
+		t.Errorf("expected deep.www.example.com to go to the www.example.com rule, got %v", got)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// idnaProfile converts between U-labels and A-labels following IDNA 2008 as
+// amended by UTS #46. We turn off the STD3 rules because DNS labels are allowed
+// to contain things like underscores that a hostname can't.
+var idnaProfile = idna.New(
+	idna.MapForLookup(),
+	idna.BidiRule(),
+	idna.Transitional(false),
+	idna.StrictDomainName(false),
+)
+
+// idnaDisplayProfile is used to render names for people. It's forgiving so that
+// a name we can't render still shows up as its A-labels rather than an error.
+var idnaDisplayProfile = idna.New(
+	idna.BidiRule(),
+	idna.StrictDomainName(false),
+)
+
+// unicodeDots are the characters UTS #46 treats as label separators in
+// addition to the ASCII full stop.
+var unicodeDots = strings.NewReplacer("。", ".", "．", ".", "｡", ".")
+
+// toALabel converts a label written in Unicode into its ASCII form. Labels that
+// are already A-labels are checked instead, so that we never put an invalid
+// punycode label on the wire.
+func toALabel(label []byte) ([]byte, error) {
+	if isASCII(label) {
+		if _, err := idnaProfile.ToUnicode(string(label)); err != nil {
+			return nil, fmt.Errorf("invalid internationalized label %q: %v", label, err)
+		}
+		return label, nil
+	}
+	a, err := idnaProfile.ToASCII(string(label))
+	if err != nil {
+		return nil, fmt.Errorf("invalid internationalized label %q: %v", label, err)
+	}
+	if len(a) > maxLabelLen {
+		return nil, fmt.Errorf("label %q is longer than %d octets once encoded as %q", label, maxLabelLen, a)
+	}
+	return []byte(a), nil
+}
+
+// DisplayString returns the name with any A-labels converted back to Unicode.
+// It's meant for logs and output read by people; use String for anything that
+// needs to be parsed again.
+func (n Name) DisplayString() string {
+	if len(n) == 0 {
+		return "."
+	}
+	var sb strings.Builder
+	for _, label := range n {
+		if isALabel(label) {
+			if u, err := idnaDisplayProfile.ToUnicode(string(label)); err == nil {
+				sb.WriteString(u)
+				sb.WriteByte('.')
+				continue
+			}
+		}
+		sb.WriteString(strings.TrimSuffix(Name{label}.String(), "."))
+		sb.WriteByte('.')
+	}
+	return sb.String()
+}
+
+func isALabel(label []byte) bool {
+	return len(label) >= 4 && labelEqual(label[:4], []byte("xn--"))
+}
+
+func isASCII(b []byte) bool {
+	for _, c := range b {
+		if c >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
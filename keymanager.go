@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// KeyPolicy decides when a zone's keys are rolled and how long each step of a
+// rollover waits. The waits are driven by TTLs: a step can only be taken once
+// every resolver that might have cached the old state has had to fetch it
+// again.
+type KeyPolicy struct {
+	Algorithm   Algorithm
+	KSKLifetime time.Duration
+	ZSKLifetime time.Duration
+	// DNSKEYTTL is the TTL the zone's DNSKEY records are served with
+	DNSKEYTTL time.Duration
+	// MaxZoneTTL is the longest TTL of any record in the zone, which bounds
+	// how long signatures from a retired key may still be cached
+	MaxZoneTTL time.Duration
+	// DSTTL is the TTL the parent serves our DS records with
+	DSTTL time.Duration
+	// PropagationDelay allows for secondaries catching up with a change
+	PropagationDelay time.Duration
+}
+
+// DefaultKeyPolicy returns a policy with the usual lifetimes, taking the TTLs
+// from z.
+func DefaultKeyPolicy(z *Zone) KeyPolicy {
+	soa, _ := z.SOA()
+	var maxTTL uint32
+	for _, rr := range z.Records {
+		if rr.TTL > maxTTL {
+			maxTTL = rr.TTL
+		}
+	}
+	return KeyPolicy{
+		Algorithm:        AlgorithmECDSAP256SHA256,
+		KSKLifetime:      365 * 24 * time.Hour,
+		ZSKLifetime:      90 * 24 * time.Hour,
+		DNSKEYTTL:        time.Duration(soa.TTL) * time.Second,
+		MaxZoneTTL:       time.Duration(maxTTL) * time.Second,
+		DSTTL:            24 * time.Hour,
+		PropagationDelay: time.Hour,
+	}
+}
+
+// KeyState is where a key is in its life.
+type KeyState int
+
+const (
+	// KeyGenerated keys exist but haven't been published yet
+	KeyGenerated KeyState = iota
+	// KeyPublished keys are in the DNSKEY RRset but don't sign anything yet
+	KeyPublished
+	// KeyActive keys sign the zone
+	KeyActive
+	// KeyRetired keys no longer sign but stay published until signatures
+	// made with them have expired from caches
+	KeyRetired
+	// KeyRemoved keys are gone from the zone
+	KeyRemoved
+)
+
+var keyStateNames = map[KeyState]string{
+	KeyGenerated: "generated",
+	KeyPublished: "published",
+	KeyActive:    "active",
+	KeyRetired:   "retired",
+	KeyRemoved:   "removed",
+}
+
+func (s KeyState) String() string {
+	return keyStateNames[s]
+}
+
+// ManagedKey is a signing key along with its timeline. Unset times haven't
+// been scheduled yet.
+type ManagedKey struct {
+	*SigningKey
+	Created  time.Time
+	Publish  time.Time
+	Activate time.Time
+	Inactive time.Time
+	Delete   time.Time
+	// DSSeen is when the operator confirmed that the parent serves a DS record
+	// for this key, which a KSK rollover waits for
+	DSSeen time.Time
+}
+
+// State works out which state the key is in at now.
+func (k *ManagedKey) State(now time.Time) KeyState {
+	switch {
+	case reached(now, k.Delete):
+		return KeyRemoved
+	case reached(now, k.Inactive):
+		return KeyRetired
+	case reached(now, k.Activate):
+		return KeyActive
+	case reached(now, k.Publish):
+		return KeyPublished
+	}
+	return KeyGenerated
+}
+
+// next returns the key's next scheduled event after now.
+func (k *ManagedKey) next(now time.Time) (string, time.Time) {
+	for _, e := range []struct {
+		name string
+		at   time.Time
+	}{
+		{"publish", k.Publish},
+		{"activate", k.Activate},
+		{"retire", k.Inactive},
+		{"remove", k.Delete},
+	} {
+		if !e.at.IsZero() && now.Before(e.at) {
+			return e.name, e.at
+		}
+	}
+	return "", time.Time{}
+}
+
+func (k *ManagedKey) role() string {
+	if k.IsKSK() {
+		return "KSK"
+	}
+	return "ZSK"
+}
+
+func reached(now, t time.Time) bool {
+	return !t.IsZero() && !now.Before(t)
+}
+
+// KeyManager looks after the keys of one zone, kept in a directory, rolling
+// them over as the policy dictates. ZSKs are rolled by pre-publishing the new
+// key, and KSKs by double signing the DNSKEY RRset until the parent has
+// picked up the new DS record.
+type KeyManager struct {
+	Dir    string
+	Origin Name
+	Policy KeyPolicy
+	now    func() time.Time
+
+	mu   sync.Mutex
+	keys []*ManagedKey
+	// states are the keys' states as of the last Run, to tell when they move
+	// on just because time has passed
+	states map[*ManagedKey]KeyState
+}
+
+// LoadKeyManager reads the keys for origin and their timelines from dir. Keys
+// without a timeline, such as ones made before the zone was managed, are
+// taken to have been active since they were found.
+func LoadKeyManager(dir string, origin Name, policy KeyPolicy) (*KeyManager, error) {
+	m := &KeyManager{Dir: dir, Origin: origin, Policy: policy, now: time.Now}
+	keys, err := LoadSigningKeys(dir, origin)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		mk := &ManagedKey{SigningKey: k}
+		path := m.statePath(mk)
+		if err := readKeyState(path, mk); os.IsNotExist(err) {
+			now := m.now()
+			mk.Created, mk.Publish, mk.Activate = now, now, now
+			if err := m.saveState(mk); err != nil {
+				return nil, err
+			}
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		m.keys = append(m.keys, mk)
+	}
+	return m, nil
+}
+
+// Keys returns the keys the manager knows about, oldest first.
+func (m *KeyManager) Keys() []*ManagedKey {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := append([]*ManagedKey(nil), m.keys...)
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Created.Before(keys[j].Created) })
+	return keys
+}
+
+// Run brings the keys up to date: it creates the first keys for a new zone,
+// starts rollovers when keys reach the end of their lifetimes, and deletes
+// keys that have been removed. It reports whether the set of keys the zone
+// should publish or sign with may have changed.
+func (m *KeyManager) Run() (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	p := m.Policy
+	// A new key can only be used once resolvers that cached the old DNSKEY
+	// RRset have had to fetch it again
+	prepublish := p.DNSKEYTTL + p.PropagationDelay
+	var changed bool
+
+	// The operator confirms DS records with -key-status -ds-seen, which runs
+	// in another process, so pick up any that have been seen since last time
+	for _, k := range m.keys {
+		if !k.DSSeen.IsZero() || !k.IsKSK() {
+			continue
+		}
+		onDisk := &ManagedKey{SigningKey: k.SigningKey}
+		path := m.statePath(k)
+		if err := readKeyState(path, onDisk); err != nil && !os.IsNotExist(err) {
+			return changed, fmt.Errorf("%s: %v", path, err)
+		}
+		k.DSSeen = onDisk.DSSeen
+	}
+
+	var kept []*ManagedKey
+	for _, k := range m.keys {
+		if k.State(now) != KeyRemoved {
+			kept = append(kept, k)
+			continue
+		}
+		base := filepath.Join(m.Dir, keyFileName(m.Origin, k.DNSKEY))
+		for _, ext := range []string{".key", ".private", ".state"} {
+			if err := os.Remove(base + ext); err != nil && !os.IsNotExist(err) {
+				return changed, err
+			}
+		}
+		changed = true
+	}
+	m.keys = kept
+
+	for _, ksk := range []bool{true, false} {
+		current := m.current(ksk)
+		if current == nil {
+			if _, err := m.generate(ksk, now, now); err != nil {
+				return changed, err
+			}
+			changed = true
+			continue
+		}
+
+		if ksk {
+			if !now.Before(current.Activate.Add(p.KSKLifetime)) {
+				// Double signature: the new KSK signs the DNSKEY RRset
+				// straight away, alongside the old one, until its DS is in
+				// the parent
+				if _, err := m.generate(true, now, now); err != nil {
+					return changed, err
+				}
+				changed = true
+			}
+			// Once the parent has the newest KSK's DS, the older ones can go
+			// after the old DS records have expired from caches
+			if !current.DSSeen.IsZero() {
+				done := current.DSSeen.Add(p.DSTTL + p.PropagationDelay)
+				for _, k := range m.keys {
+					if k != current && k.IsKSK() && k.Inactive.IsZero() && k.Activate.Before(current.Activate) {
+						k.Inactive, k.Delete = done, done
+						if err := m.saveState(k); err != nil {
+							return changed, err
+						}
+						changed = true
+					}
+				}
+			}
+			continue
+		}
+
+		// Pre-publication: the new ZSK is published ahead of time, so that it's
+		// in every cache by the time it takes over
+		if current.Inactive.IsZero() && !now.Before(current.Activate.Add(p.ZSKLifetime-prepublish)) {
+			successor, err := m.generate(false, now, now.Add(prepublish))
+			if err != nil {
+				return changed, err
+			}
+			current.Inactive = successor.Activate
+			// The old key's signatures can be cached for as long as the
+			// longest TTL in the zone after it stops signing
+			current.Delete = current.Inactive.Add(p.MaxZoneTTL + p.PropagationDelay)
+			if err := m.saveState(current); err != nil {
+				return changed, err
+			}
+			changed = true
+		}
+	}
+
+	states := map[*ManagedKey]KeyState{}
+	for _, k := range m.keys {
+		states[k] = k.State(now)
+		if s, ok := m.states[k]; !ok || s != states[k] {
+			changed = true
+		}
+	}
+	m.states = states
+	return changed, nil
+}
+
+// current returns the newest key of the kind that isn't scheduled to retire.
+func (m *KeyManager) current(ksk bool) *ManagedKey {
+	var current *ManagedKey
+	for _, k := range m.keys {
+		if k.IsKSK() != ksk || !k.Inactive.IsZero() {
+			continue
+		}
+		if current == nil || k.Activate.After(current.Activate) {
+			current = k
+		}
+	}
+	return current
+}
+
+func (m *KeyManager) generate(ksk bool, publish, activate time.Time) (*ManagedKey, error) {
+	sk, err := GenerateSigningKey(m.Policy.Algorithm, ksk)
+	if err != nil {
+		return nil, err
+	}
+	k := &ManagedKey{SigningKey: sk, Created: m.now(), Publish: publish, Activate: activate}
+	if err := SaveSigningKey(m.Dir, m.Origin, sk); err != nil {
+		return nil, err
+	}
+	if err := m.saveState(k); err != nil {
+		return nil, err
+	}
+	m.keys = append(m.keys, k)
+	return k, nil
+}
+
+// SetDSSeen records that the parent now serves a DS record for the KSK with
+// the given tag, letting the rollover to it finish. It's saved straight away,
+// for a server running on the same keys to pick up on its next Run.
+func (m *KeyManager) SetDSSeen(tag uint16) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, k := range m.keys {
+		if k.IsKSK() && k.DNSKEY.KeyTag() == tag {
+			k.DSSeen = m.now()
+			return m.saveState(k)
+		}
+	}
+	return fmt.Errorf("no KSK with tag %d for %s", tag, m.Origin)
+}
+
+// Signer returns a signer for the keys as they stand now.
+func (m *KeyManager) Signer() *ZoneSigner {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	var active, standby, cds []*SigningKey
+	for _, k := range m.keys {
+		switch k.State(now) {
+		case KeyActive:
+			active = append(active, k.SigningKey)
+			if k.IsKSK() && k.Inactive.IsZero() {
+				cds = append(cds, k.SigningKey)
+			}
+		case KeyPublished, KeyRetired:
+			standby = append(standby, k.SigningKey)
+		}
+	}
+	s := NewZoneSigner(active)
+	s.Standby = standby
+	s.CDS = cds
+	return s
+}
+
+// WriteStatus prints a table of the keys, their states and what happens to
+// each of them next.
+func (m *KeyManager) WriteStatus(w io.Writer) error {
+	now := m.now()
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "TAG\tROLE\tALGORITHM\tSTATE\tNEXT\tAT\n")
+	for _, k := range m.Keys() {
+		event, at := k.next(now)
+		when := "-"
+		switch {
+		case event != "":
+			when = at.UTC().Format(time.RFC3339)
+		case k.IsKSK() && k.DSSeen.IsZero() && k.State(now) == KeyActive:
+			event = "waiting for DS"
+		default:
+			event = "-"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\n", k.DNSKEY.KeyTag(), k.role(), k.DNSKEY.Algorithm, k.State(now), event, when)
+	}
+	return tw.Flush()
+}
+
+func (m *KeyManager) statePath(k *ManagedKey) string {
+	return filepath.Join(m.Dir, keyFileName(m.Origin, k.DNSKEY)+".state")
+}
+
+// keyStateFields are the times kept in a .state file, in the order they're
+// written.
+var keyStateFields = []string{"Created", "Publish", "Activate", "Inactive", "Delete", "DSSeen"}
+
+func (k *ManagedKey) times() []*time.Time {
+	return []*time.Time{&k.Created, &k.Publish, &k.Activate, &k.Inactive, &k.Delete, &k.DSSeen}
+}
+
+// saveState writes the key's timeline next to its key files, as lines of
+// "Field: time".
+func (m *KeyManager) saveState(k *ManagedKey) error {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "; %s %d for %s\n", k.role(), k.DNSKEY.KeyTag(), m.Origin)
+	for i, t := range k.times() {
+		if !t.IsZero() {
+			fmt.Fprintf(&sb, "%s: %s\n", keyStateFields[i], t.UTC().Format(time.RFC3339))
+		}
+	}
+	return os.WriteFile(m.statePath(k), []byte(sb.String()), 0644)
+}
+
+func readKeyState(path string, k *ManagedKey) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, ";") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			return fmt.Errorf("bad line %q", line)
+		}
+		field, value := line[:i], strings.TrimSpace(line[i+1:])
+		known := false
+		for j, name := range keyStateFields {
+			if name != field {
+				continue
+			}
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return fmt.Errorf("%s: %v", field, err)
+			}
+			*k.times()[j] = t
+			known = true
+		}
+		if !known {
+			return fmt.Errorf("unknown field %q", field)
+		}
+	}
+	return scanner.Err()
+}
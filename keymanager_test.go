@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyManagerRollovers(t *testing.T) {
+	dir := t.TempDir()
+	origin := MustParseName("example.com")
+	policy := KeyPolicy{
+		Algorithm:        AlgorithmED25519,
+		KSKLifetime:      45 * 24 * time.Hour,
+		ZSKLifetime:      30 * 24 * time.Hour,
+		DNSKEYTTL:        time.Hour,
+		MaxZoneTTL:       24 * time.Hour,
+		DSTTL:            24 * time.Hour,
+		PropagationDelay: time.Hour,
+	}
+	m, err := LoadKeyManager(dir, origin, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	m.now = func() time.Time { return now }
+
+	run := func(description string, expectChange bool) *ZoneSigner {
+		changed, err := m.Run()
+		if err != nil {
+			t.Fatalf("%s: %v", description, err)
+		}
+		if changed != expectChange {
+			t.Errorf("%s: expected changed to be %v", description, expectChange)
+		}
+		return m.Signer()
+	}
+	count := func(description string, s *ZoneSigner, active, standby int) {
+		if len(s.Keys) != active || len(s.Standby) != standby {
+			t.Errorf("%s: expected %d active and %d standby keys, got %d and %d", description, active, standby, len(s.Keys), len(s.Standby))
+		}
+	}
+
+	s := run("new zone", true)
+	count("new zone", s, 2, 0)
+	run("nothing to do", false)
+
+	// The ZSK is rolled by publishing its successor two hours (the DNSKEY TTL
+	// plus propagation) before it's due to take over
+	now = now.Add(policy.ZSKLifetime - 2*time.Hour)
+	s = run("ZSK pre-publication", true)
+	count("ZSK pre-publication", s, 2, 1)
+	now = now.Add(2 * time.Hour)
+	s = run("new ZSK active", true)
+	count("new ZSK active", s, 2, 1)
+	now = now.Add(policy.MaxZoneTTL + policy.PropagationDelay)
+	s = run("old ZSK removed", true)
+	count("old ZSK removed", s, 2, 0)
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.private")); len(files) != 2 {
+		t.Errorf("expected the old ZSK's files to be deleted, got %v", files)
+	}
+
+	// The KSK is rolled by double signing until the parent has the new DS
+	now = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC).Add(policy.KSKLifetime)
+	s = run("KSK double signature", true)
+	count("KSK double signature", s, 3, 0)
+	if len(s.keysFor(TypeDNSKEY)) != 2 || len(s.CDS) != 2 {
+		t.Errorf("expected both KSKs to sign the keys and be offered to the parent")
+	}
+	var status bytes.Buffer
+	m.WriteStatus(&status)
+	if !strings.Contains(status.String(), "waiting for DS") {
+		t.Errorf("expected the status to show the KSKs waiting for DS records, got\n%s", status.String())
+	}
+	newKSK := m.current(true)
+	// The operator confirms the DS with -key-status -ds-seen, which loads
+	// the keys in a process of its own
+	operator, err := LoadKeyManager(dir, origin, KeyPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	operator.now = func() time.Time { return now }
+	if err := operator.SetDSSeen(newKSK.DNSKEY.KeyTag()); err != nil {
+		t.Fatal(err)
+	}
+	s = run("DS seen", true)
+	if len(s.CDS) != 1 || s.CDS[0] != newKSK.SigningKey {
+		t.Errorf("expected only the new KSK to be offered to the parent once its DS is seen")
+	}
+	now = now.Add(policy.DSTTL + policy.PropagationDelay)
+	s = run("old KSK removed", true)
+	count("old KSK removed", s, 2, 0)
+
+	// Everything survives a restart
+	reloaded, err := LoadKeyManager(dir, origin, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reloaded.Keys()) != 2 || !reloaded.current(true).DSSeen.Equal(newKSK.DSSeen) {
+		t.Errorf("expected the keys and their timelines to be reloaded")
+	}
+}
+
+func TestKeyManagerAdoptsExistingKeys(t *testing.T) {
+	dir := t.TempDir()
+	origin := MustParseName("example.com")
+	k, err := GenerateSigningKey(AlgorithmECDSAP256SHA256, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveSigningKey(dir, origin, k); err != nil {
+		t.Fatal(err)
+	}
+	m, err := LoadKeyManager(dir, origin, KeyPolicy{Algorithm: AlgorithmECDSAP256SHA256, KSKLifetime: time.Hour, ZSKLifetime: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(m.statePath(m.Keys()[0])); err != nil {
+		t.Errorf("expected a state file to be written for the existing key: %v", err)
+	}
+	if m.Keys()[0].State(time.Now()) != KeyActive {
+		t.Errorf("expected the existing key to be active")
+	}
+}
@@ -1,64 +1,296 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
-	"math"
-	"math/rand"
 	"net"
-	"reflect"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 const maxBufferSize = 2048
 
+// queryTimeout is how long we wait for a server to answer before giving up on
+// it and trying the next one.
+const queryTimeout = 3 * time.Second
+
+// maxReferrals bounds how many referrals ResolveRecursively will follow, and
+// how deep it will go resolving the names of nameservers along the way.
+const maxReferrals = 16
+
+// IPv6Policy decides how a Client uses nameservers' IPv6 addresses when it
+// resolves names iteratively.
+type IPv6Policy int
+
+const (
+	// PreferIPv4 tries a nameserver's IPv4 addresses before its IPv6 ones
+	PreferIPv4 IPv6Policy = iota
+	// PreferIPv6 tries a nameserver's IPv6 addresses first
+	PreferIPv6
+	// DisableIPv6 never sends queries over IPv6, for hosts without v6 connectivity
+	DisableIPv6
+)
+
+// ParseIPv6Policy reads a policy as given on the command line.
+func ParseIPv6Policy(s string) (IPv6Policy, error) {
+	switch s {
+	case "prefer-v4":
+		return PreferIPv4, nil
+	case "prefer-v6":
+		return PreferIPv6, nil
+	case "disable":
+		return DisableIPv6, nil
+	}
+	return 0, fmt.Errorf("unknown IPv6 policy %q, expected prefer-v4, prefer-v6 or disable", s)
+}
+
 type Client struct {
 	addr *net.UDPAddr
+	IPv6 IPv6Policy
+	// DNSSEC asks servers to include DNSSEC records in their answers, and to
+	// leave checking them to us
+	DNSSEC bool
+	// TSIG signs the messages sent to the client's server, and checks that
+	// the answers come back signed with the same key. It isn't used when
+	// resolving iteratively, since other servers won't know the key.
+	TSIG *TSIGKey
+
+	// RootCAs checks the certificates of tls://, quic:// and https://
+	// servers, and if it's nil the system's roots are used
+	RootCAs *x509.CertPool
+	// SPKIPins, if they're set, are the base64 SHA-256 digests of the
+	// public keys an encrypted server may present, one of which it
+	// has to. They take the place of checking the certificate against
+	// RootCAs.
+	SPKIPins []string
+	// Opportunistic lets queries to an encrypted server fall back
+	// to plain DNS on port 53 when the encrypted connection fails, which
+	// RFC 8310 calls the opportunistic privacy profile. Otherwise they fail.
+	Opportunistic bool
+
+	tlsAddr, quicAddr, dohURL string
+	transportOnce             sync.Once
+	encrypted                 encryptedTransport
+	// nameservers are the addresses of the nameservers we've been
+	// referred to while resolving
+	nameservers nameserverCache
 }
 
-func NewClient(hostPort string) (*Client, error) {
-	addr, err := net.ResolveUDPAddr("udp", hostPort)
+// NewClient creates a client that sends its queries to server. It may be an
+// IPv4 or IPv6 address, such as "8.8.8.8:53" or "[2001:4860:4860::8888]:53",
+// or a DNS over TLS server like "tls://dns.example:853", a DNS over QUIC
+// server like "quic://dns.example:853", or a DNS over HTTPS URL like
+// "https://dns.example/dns-query". Encrypted connections are kept
+// open and reused across queries.
+func NewClient(server string) (*Client, error) {
+	u, err := parseUpstream(server)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := net.ResolveUDPAddr("udp", u.plain)
 	if err != nil {
 		return nil, fmt.Errorf("resolving addr: %v", err)
 	}
 	return &Client{
-		addr: addr,
+		addr:     addr,
+		tlsAddr:  u.tlsAddr,
+		quicAddr: u.quicAddr,
+		dohURL:   u.dohURL,
 	}, nil
 }
 
 func (cli *Client) Resolve(q Question) (Message, error) {
+	m, err := cli.Exchange(cli.query(q))
+	restoreCase(&m, q)
+	return m, err
+}
+
+// Exchange sends m to the client's server and waits for the response.
+func (cli *Client) Exchange(m Message) (Message, error) {
+	return cli.ExchangeContext(context.Background(), m)
+}
+
+// ExchangeContext is like Exchange, but gives up waiting for the response
+// when ctx is done.
+func (cli *Client) ExchangeContext(ctx context.Context, m Message) (Message, error) {
+	return cli.send(ctx, cli.addr, m, cli.TSIG)
+}
+
+// exchange sends a query for q to addr and waits for the response.
+func (cli *Client) exchange(addr *net.UDPAddr, q Question) (Message, error) {
+	m, err := cli.send(context.Background(), addr, cli.query(q), nil)
+	restoreCase(&m, q)
+	return m, err
+}
+
+func (cli *Client) query(q Question) Message {
+	return newQuery(q, cli.DNSSEC)
+}
+
+// newQuery builds a recursive query for q, with the case of its name mixed
+// up. With dnssec set it asks for DNSSEC records and for the server to leave
+// checking them to us.
+func newQuery(q Question, dnssec bool) Message {
+	q.Name = randomizeCase(q.Name)
 	m := Message{
-		ID:               uint16(rand.Intn(math.MaxUint16)),
+		ID:               randomID(),
 		OpCode:           OpCodeStandard,
 		RecursionDesired: true,
 		QdCount:          1,
 		Questions:        []Question{q},
 	}
-	conn, err := net.DialUDP("udp", nil, cli.addr)
+	if dnssec {
+		m.CheckingDisabled = true
+		m.SetEDNS0(ednsUDPSize, true)
+	} else {
+		m.SetEDNS0(ednsUDPSize, false)
+	}
+	return m
+}
+
+// send sends m to addr, signed with key if it's set, and waits for the
+// response, retrying over TCP if the answer didn't fit in a UDP packet. A
+// server that didn't understand the query hasn't answered it, so FORMERR and
+// NOTIMP come back as errors.
+func (cli *Client) send(ctx context.Context, addr *net.UDPAddr, m Message, key *TSIGKey) (Message, error) {
+	req := m.Marshal()
+	var mac []byte
+	if key != nil {
+		req, mac = signMessage(m, key, nil, time.Now())
+	}
+	b, err := cli.roundTrip(ctx, addr, m, req)
 	if err != nil {
-		return m, fmt.Errorf("dialing upstream DNS server: %v", err)
+		return Message{}, err
+	}
+	resp := Message{}
+	if err := Unmarshal(b, &resp); err != nil {
+		return Message{}, fmt.Errorf("response from %v: %v", addr, err)
+	}
+	if resp.ResponseCode == ResponseCodeFormatError || resp.ResponseCode == ResponseCodeNotImplemented {
+		return Message{}, fmt.Errorf("%v answered %v", addr, resp.ResponseCode)
+	}
+	if key != nil {
+		sig, err := verifyTSIG(b, TSIGKeyring{key.Name.Canonical().String(): key}, mac, time.Now())
+		if err == nil && sig == nil {
+			err = errors.New("response isn't signed")
+		}
+		if err != nil {
+			return Message{}, fmt.Errorf("TSIG from %v: %v", addr, err)
+		}
+		resp.Additional = resp.Additional[:len(resp.Additional)-1]
+		resp.updateCounts()
+	}
+	return resp, nil
+}
+
+// roundTrip sends req, which is m marshalled, to addr and returns the
+// response. Queries to the client's own server go over its encrypted
+// transport if it has one, and the rest over UDP, retrying over TCP if the
+// answer didn't fit. Responses that don't match m are rejected.
+func (cli *Client) roundTrip(ctx context.Context, addr *net.UDPAddr, m Message, req []byte) ([]byte, error) {
+	if t := cli.transport(); t != nil && addr == cli.addr {
+		b, err := t.exchange(ctx, req)
+		if err == nil {
+			err = checkResponse(addr, m, b)
+		}
+		if err == nil || !cli.Opportunistic || ctx.Err() != nil {
+			return b, err
+		}
+		log.Printf("%v, falling back to plain DNS", err)
+	}
+	b, err := exchangeUDP(ctx, addr, m, req)
+	if err != nil {
+		return nil, err
+	}
+	resp := Message{}
+	Unmarshal(b, &resp)
+	if resp.Truncated {
+		b, err = exchangeTCP(ctx, addr, req)
+		if err == nil {
+			err = checkResponse(addr, m, b)
+		}
+		return b, err
+	}
+	return b, nil
+}
+
+// checkResponse makes sure b is the response to m, counting it as a spoofing
+// attempt if it isn't.
+func checkResponse(addr *net.UDPAddr, m Message, b []byte) error {
+	if reason := responseMismatch(m, b); reason != "" {
+		spoofStats.Add(reason, 1)
+		return fmt.Errorf("response from %v doesn't match the query: %s", addr, reason)
+	}
+	return nil
+}
+
+// exchangeUDP sends req, which is m marshalled, to addr from a random port.
+// Packets that don't match m are counted and ignored, since anyone can send
+// them, and we carry on waiting for the real response.
+func exchangeUDP(ctx context.Context, addr *net.UDPAddr, m Message, req []byte) ([]byte, error) {
+	conn, err := dialUDP(addr)
+	if err != nil {
+		return nil, fmt.Errorf("dialing upstream DNS server: %v", err)
 	}
 	defer conn.Close()
-	if _, err := conn.Write(m.Marshal()); err != nil {
-		return m, fmt.Errorf("writing message: %v", err)
+	conn.SetDeadline(time.Now().Add(queryTimeout))
+	defer context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })()
+	if _, err := conn.Write(req); err != nil {
+		return nil, fmt.Errorf("writing message: %v", err)
 	}
 	buf := make([]byte, maxBufferSize)
-	// TODO: we have to match this up with the packet that was sent because there might be multiple in flight
-	if _, _, err := conn.ReadFrom(buf); err != nil {
-		return m, fmt.Errorf("reading response: %v", err)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return nil, fmt.Errorf("reading response: %v", err)
+		}
+		if reason := responseMismatch(m, buf[:n]); reason != "" {
+			spoofStats.Add(reason, 1)
+			log.Printf("ignoring response from %v: %s", addr, reason)
+			continue
+		}
+		return buf[:n], nil
 	}
-	Unmarshal(buf, &m)
-	return m, nil
 }
 
-func domainSuffixLen(a [][]byte, b [][]byte) int {
+func exchangeTCP(ctx context.Context, addr *net.UDPAddr, req []byte) ([]byte, error) {
+	dialer := &net.Dialer{Timeout: queryTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr.String())
+	if err != nil {
+		return nil, fmt.Errorf("dialing upstream DNS server over TCP: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(queryTimeout))
+	defer context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })()
+	if err := writeTCPMessage(conn, req); err != nil {
+		return nil, fmt.Errorf("writing message: %v", err)
+	}
+	b, err := readTCPMessage(conn)
+	if err != nil {
+		return nil, fmt.Errorf("reading response: %v", err)
+	}
+	return b, nil
+}
+
+// domainSuffixLen counts how many trailing labels two names have in common.
+func domainSuffixLen(a Name, b Name) int {
 	var suffixLen int
 	aPtr := len(a) - 1
 	bPtr := len(b) - 1
 	for aPtr >= 0 && bPtr >= 0 {
-		if bytes.Equal(a[aPtr], b[bPtr]) {
+		if labelEqual(a[aPtr], b[bPtr]) {
 			suffixLen += 1
 		} else {
 			break
@@ -69,60 +301,219 @@ func domainSuffixLen(a [][]byte, b [][]byte) int {
 	return suffixLen
 }
 
-func toIPStr(data []byte) string {
-	b := make([]string, 4)
-	for i, byt := range data {
-		b[i] = fmt.Sprintf("%d", byt)
+// ResolveRecursively answers q by starting at the client's server and following
+// referrals down the tree until some server gives us an answer.
+func (cli *Client) ResolveRecursively(q Question) (Message, error) {
+	return cli.resolveFrom(q, []*net.UDPAddr{cli.addr}, 0)
+}
+
+func (cli *Client) resolveFrom(q Question, servers []*net.UDPAddr, depth int) (Message, error) {
+	if depth > maxReferrals {
+		return Message{}, fmt.Errorf("gave up resolving %s: too much indirection", q.Name)
 	}
-	return strings.Join(b, ".")
+	// The zone we believe the current servers to be authoritative for. Each
+	// referral has to take us closer to the name, or we'd go round in circles.
+	var zone Name
+	for hop := 0; hop < maxReferrals; hop++ {
+		m, err := cli.askAny(q, servers)
+		if err != nil {
+			return m, err
+		}
+		m = scrub(q, m, zone)
+		if m.ResponseCode != ResponseCodeOk || len(m.Answer) > 0 {
+			return cli.followCNAME(q, m, depth)
+		}
+
+		// Otherwise we're hoping for a referral: NS records in the authority
+		// section for a zone that's closer to the name than the one we asked
+		var ns []ResourceRecord
+		var cut Name
+		for _, rr := range m.Authority {
+			if rr.Type != TypeNS || !q.Name.IsSubdomainOf(rr.Name) || len(rr.Name) <= len(zone) {
+				continue
+			}
+			if cut == nil || len(rr.Name) > len(cut) {
+				cut, ns = rr.Name, nil
+			}
+			if rr.Name.Equal(cut) {
+				ns = append(ns, rr)
+			}
+		}
+		if ns == nil {
+			// No answer and nowhere else to go, so this is a NODATA answer
+			return m, nil
+		}
+		zone = cut
+
+		servers = cli.nameserverAddrs(ns, m.Additional, depth)
+		if len(servers) == 0 {
+			return m, fmt.Errorf("couldn't find an address for any nameserver of %s", cut)
+		}
+	}
+	return Message{}, fmt.Errorf("gave up resolving %s: too many referrals", q.Name)
 }
 
-func (cli *Client) ResolveRecursively(q Question) (Message, error) {
-	// Ask for domain name
-	m, err := cli.Resolve(q)
-	if err != nil {
-		return m, fmt.Errorf("attempting to resolve name: %v", err)
-	}
-	// If we get an A record, that matches our query, return it
-	// If we get an NS record that partially or fully matches our query, check if we also have an A record for it. If we don't, we have to resolve that name
-	var ns *ResourceRecord
-	var bestSuffixLen int
-	for _, ans := range m.Answer {
-		if ans.Type == TypeA && reflect.DeepEqual(q.Name, ans.Name) {
+// askAny sends q to each server in turn until one of them answers.
+func (cli *Client) askAny(q Question, servers []*net.UDPAddr) (Message, error) {
+	var lastErr error
+	for _, addr := range servers {
+		m, err := cli.exchange(addr, q)
+		if err == nil {
 			return m, nil
 		}
-		// TODO: this is actually supposed to come from the Authority section I think?
-		if ans.Type == TypeNS {
-			suffixLen := domainSuffixLen(q.Name, ans.Name)
-			if suffixLen > bestSuffixLen {
-				ns = &ans
-				bestSuffixLen = suffixLen
+		lastErr = err
+	}
+	return Message{}, fmt.Errorf("no nameserver answered for %s: %v", q.Name, lastErr)
+}
+
+// followCNAME finishes resolving q if the answer in m is an alias without the
+// record we asked for.
+func (cli *Client) followCNAME(q Question, m Message, depth int) (Message, error) {
+	if q.Type == TypeCName || q.Type == TypeANY || m.ResponseCode != ResponseCodeOk {
+		return m, nil
+	}
+	name := q.Name
+	for i := 0; i < maxCNAMEChain; i++ {
+		var next Name
+		for _, rr := range m.Answer {
+			if !rr.Name.Equal(name) {
+				continue
+			}
+			if rr.Type == q.Type {
+				return m, nil
+			}
+			if rr.Type == TypeCName {
+				cname := &CNAME{}
+				if err := cname.Unpack(rr.Data); err == nil {
+					next = cname.Target
+				}
 			}
 		}
+		if next == nil {
+			break
+		}
+		name = next
+	}
+	if name.Equal(q.Name) {
+		return m, nil
+	}
+	// The answer stopped at an alias, so carry on from the target
+	target, err := cli.resolveFrom(Question{Name: name, Type: q.Type, Class: q.Class}, []*net.UDPAddr{cli.addr}, depth+1)
+	if err != nil {
+		return m, err
 	}
+	m.Answer = append(m.Answer, target.Answer...)
+	m.ResponseCode = target.ResponseCode
+	return m, nil
+}
 
-	if ns != nil {
-		//var nsARecord *ResourceRecord
-		//// I think this is actually supposed to come from the Additional section?
-		//for _, ans := range m.Answer {
-		//	if ans.Type == TypeA && reflect.DeepEqual(ns.Data, ans.Name) {
-		//		nsARecord = &ans
-		//		break
-		//	}
-		//}
-		//if nsARecord == nil {
-		//	// resolve recursively if this happens
-		//	return m, fmt.Errorf("I'd have to resolve this NS recursively, and I'm not willing to do that")
-		//}
+// nameserverAddrs works out where to send queries next after a referral. It
+// uses the addresses it already knows for the nameservers, or any glue that
+// came with the referral, and resolves the nameservers' names itself if
+// there isn't any. Glue is trusted least, so it never replaces an address
+// from an authoritative answer.
+func (cli *Client) nameserverAddrs(ns []ResourceRecord, additional []ResourceRecord, depth int) []*net.UDPAddr {
+	var names []Name
+	for _, rr := range ns {
+		target := &NS{}
+		if err := target.Unpack(rr.Data); err == nil {
+			names = append(names, target.Target)
+		}
+	}
 
-		nsCli, err := NewClient(toIPStr(ns.Data) + ":53")
-		if err != nil {
-			return m, fmt.Errorf("creating nameserver client: %v", err)
+	now := time.Now()
+	for _, name := range names {
+		for _, t := range cli.addressTypes() {
+			if glue, ttl := addressRecords(additional, name, t); len(glue) > 0 {
+				cli.nameservers.put(name, t, glue, TrustAdditional, ttl, now)
+			}
+		}
+	}
+	var ips []net.IP
+	for _, name := range names {
+		for _, t := range cli.addressTypes() {
+			ips = append(ips, cli.nameservers.get(name, t, now)...)
+		}
+	}
+	if len(ips) == 0 {
+		for _, name := range names {
+			for _, t := range cli.addressTypes() {
+				m, err := cli.resolveFrom(Question{Name: name, Type: t, Class: ClassIN}, []*net.UDPAddr{cli.addr}, depth+1)
+				if err != nil {
+					continue
+				}
+				found, ttl := addressRecords(m.Answer, name, t)
+				if len(found) == 0 {
+					continue
+				}
+				trust := TrustAnswer
+				if m.AuthoritativeAnswer {
+					trust = TrustAuthAnswer
+				}
+				cli.nameservers.put(name, t, found, trust, ttl, now)
+				ips = append(ips, found...)
+			}
+			// One nameserver we can reach is enough to carry on with
+			if len(ips) > 0 {
+				break
+			}
 		}
-		return nsCli.ResolveRecursively(q)
 	}
 
-	return m, fmt.Errorf("dead end")
+	var addrs []*net.UDPAddr
+	for _, ip := range cli.orderAddrs(ips) {
+		addrs = append(addrs, &net.UDPAddr{IP: ip, Port: 53})
+	}
+	return addrs
+}
+
+// addressRecords returns the addresses of type t for name among records,
+// along with the smallest of their TTLs.
+func addressRecords(records []ResourceRecord, name Name, t Type) ([]net.IP, uint32) {
+	var ips []net.IP
+	var ttl uint32
+	for _, rr := range records {
+		if rr.Type == t && rr.Name.Equal(name) {
+			if len(ips) == 0 || rr.TTL < ttl {
+				ttl = rr.TTL
+			}
+			ips = append(ips, net.IP(rr.Data))
+		}
+	}
+	return ips, ttl
+}
+
+// addressTypes returns the address record types to look up for a nameserver,
+// in the order the client's IPv6 policy wants to try them.
+func (cli *Client) addressTypes() []Type {
+	switch cli.IPv6 {
+	case PreferIPv6:
+		return []Type{TypeAAAA, TypeA}
+	case DisableIPv6:
+		return []Type{TypeA}
+	}
+	return []Type{TypeA, TypeAAAA}
+}
+
+// orderAddrs sorts nameserver addresses according to the client's IPv6
+// policy, dropping the IPv6 ones if it's disabled.
+func (cli *Client) orderAddrs(ips []net.IP) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		switch len(ip) {
+		case net.IPv4len:
+			v4 = append(v4, ip)
+		case net.IPv6len:
+			v6 = append(v6, ip)
+		}
+	}
+	switch cli.IPv6 {
+	case PreferIPv6:
+		return append(v6, v4...)
+	case DisableIPv6:
+		return v4
+	}
+	return append(v4, v6...)
 }
 
 // Test for Implementing recursion
@@ -134,30 +525,62 @@ func (cli *Client) ResolveRecursively(q Question) (Message, error) {
 
 type Server struct {
 	conn net.PacketConn
+	tcp  net.Listener
 	cli  *Client
+	// rules say which queries we aren't authoritative for are forwarded,
+	// and where to. The rest we resolve ourselves starting from cli's
+	// server.
+	rules []*ForwardRule
+	zones []*Zone
+	// validator checks recursive answers if it's set
+	validator *Validator
+	cache     *Cache
+	// keys are the TSIG keys we accept signatures from
+	keys TSIGKeyring
+	// listeners are the extra listeners, such as for DNS over TLS and
+	// QUIC, that close along with the server
+	mu        sync.Mutex
+	listeners []io.Closer
 }
 
-func NewServer(port string, cli *Client) (*Server, error) {
-	conn, err := net.ListenPacket("udp", "localhost:"+port)
+// NewServer listens for queries on addr. Use a host of "::" to listen on both
+// IPv4 and IPv6.
+func NewServer(addr string, cli *Client) (*Server, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	// Zone transfers and answers too big for UDP come over TCP on the same
+	// port
+	tcp, err := net.Listen("tcp", conn.LocalAddr().String())
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 	return &Server{
-		conn: conn,
-		cli:  cli,
+		conn:  conn,
+		tcp:   tcp,
+		cli:   cli,
+		cache: NewCache(),
 	}, nil
 }
 
 func (s *Server) ListenAsUpstream() error {
 	buff := make([]byte, maxBufferSize)
 	for {
-		_, addr, err := s.conn.ReadFrom(buff)
+		n, addr, err := s.conn.ReadFrom(buff)
+		if errors.Is(err, net.ErrClosed) {
+			return err
+		}
 		if err != nil {
 			log.Println("error reading from conn", err)
 			continue
 		}
 		m := Message{}
-		Unmarshal(buff, &m)
+		if err := Unmarshal(buff[:n], &m); err != nil {
+			log.Printf("request from %v: %v", addr, err)
+			continue
+		}
 		ans := Message{
 			ID:                 m.ID,
 			IsResponse:         true,
@@ -165,81 +588,489 @@ func (s *Server) ListenAsUpstream() error {
 			RecursionAvailable: false,
 			ResponseCode:       ResponseCodeOk,
 			QdCount:            1,
-			AnCount:            2,
+			NSCount:            1,
+			ARCount:            2,
 			Questions:          m.Questions,
-			Answer: []ResourceRecord{
+			Authority: []ResourceRecord{
 				{
-					Name:  [][]byte{[]byte("com")},
+					Name:  MustParseName("com"),
 					Type:  TypeNS,
 					Class: ClassIN,
-					// I'm not sure what the Data section of an NS type is supposed to look like, come back to this
-					// Data:  []byte("dns.google.com"),
-					Data: []byte{8, 8, 8, 8},
+					Data:  MustParseName("dns.google.com").wireBytes(),
 				},
+			},
+			Additional: []ResourceRecord{
 				{
-					Name:  [][]byte{[]byte("dns"), []byte("google"), []byte("com")},
+					Name:  MustParseName("dns.google.com"),
 					Type:  TypeA,
 					Class: ClassIN,
 					Data:  []byte{8, 8, 8, 8},
 				},
+				{
+					Name:  MustParseName("dns.google.com"),
+					Type:  TypeAAAA,
+					Class: ClassIN,
+					Data:  net.ParseIP("2001:4860:4860::8888"),
+				},
 			},
 		}
 		if _, err := s.conn.WriteTo(ans.Marshal(), addr); err != nil {
 			log.Println("error writing to conn:", err)
 		}
 	}
-	return nil
+}
+
+// AddZone makes the server authoritative for z.
+func (s *Server) AddZone(z *Zone) {
+	s.zones = append(s.zones, z)
+}
+
+// findZone returns the most specific zone that name falls in, or nil if we
+// aren't authoritative for it.
+func (s *Server) findZone(name Name) *Zone {
+	var best *Zone
+	for _, z := range s.zones {
+		if name.IsSubdomainOf(z.Origin) && (best == nil || len(z.Origin) > len(best.Origin)) {
+			best = z
+		}
+	}
+	return best
 }
 
 func (s *Server) Listen() error {
+	go s.serveStream(s.tcp)
 	buff := make([]byte, maxBufferSize)
-	// TODO: be able to handle multiple connections at a time
 	for {
-		_, addr, err := s.conn.ReadFrom(buff)
+		n, addr, err := s.conn.ReadFrom(buff)
+		if errors.Is(err, net.ErrClosed) {
+			return err
+		}
 		if err != nil {
 			log.Println("error reading from conn", err)
 			continue
 		}
-		m := Message{}
-		Unmarshal(buff, &m)
-		// Not sure how to deal with multiple questions atm. And if there are no questions I'm pretty sure the prescribed behavior is for the server to crash
-		upstreamAns, err := s.cli.ResolveRecursively(m.Questions[0])
-		if err != nil {
-			log.Println(err)
-			continue
+		b := s.respond(buff[:n], addr, true)
+		if _, err := s.conn.WriteTo(b, addr); err != nil {
+			log.Println("error writing to conn:", err)
 		}
-		ans := Message{
-			ID:                 m.ID,
-			IsResponse:         true,
-			OpCode:             OpCodeStandard,
-			RecursionAvailable: true,
-			ResponseCode:       ResponseCodeOk,
-			QdCount:            m.QdCount,
-			Questions:          m.Questions,
-			AnCount:            upstreamAns.AnCount,
-			Answer:             upstreamAns.Answer,
+	}
+}
+
+// client is who a request came from: its address, and the TSIG signature on
+// the request if it was signed.
+type client struct {
+	addr net.Addr
+	sig  *tsigSignature
+}
+
+// key returns the name of the TSIG key that signed the request, or nil if it
+// wasn't signed.
+func (c client) key() Name {
+	if c.sig == nil || c.sig.err != 0 {
+		return nil
+	}
+	return c.sig.keyName
+}
+
+// respond builds the marshalled response to the request in b, checking and
+// adding TSIG signatures and truncating UDP responses that are too big.
+func (s *Server) respond(b []byte, from net.Addr, udp bool) []byte {
+	m, c, ans := s.receive(b, from)
+	limit := 0xFFFF
+	if udp {
+		limit = maxUDPResponseSize(m)
+	}
+	return s.reply(m, c, ans, limit)
+}
+
+// receive reads the request in b and checks its TSIG signature, if it has one.
+// When the request can't be handled it returns the response to send instead.
+func (s *Server) receive(b []byte, from net.Addr) (Message, client, *Message) {
+	m := Message{}
+	if err := Unmarshal(b, &m); err != nil {
+		log.Printf("request from %v: %v", from, err)
+		return m, client{addr: from}, &Message{ID: m.ID, IsResponse: true, OpCode: m.OpCode, ResponseCode: ResponseCodeFormatError}
+	}
+	sig, err := verifyTSIG(b, s.keys, nil, time.Now())
+	c := client{addr: from, sig: sig}
+	if err != nil {
+		log.Printf("request from %v: %v", from, err)
+		// A bad signature gets NOTAUTH when the response is signed
+		return m, c, &Message{ID: m.ID, IsResponse: true, OpCode: m.OpCode, ResponseCode: ResponseCodeFormatError, Questions: m.Questions}
+	}
+	if sig != nil {
+		m.Additional = m.Additional[:len(m.Additional)-1]
+		m.updateCounts()
+	}
+	return m, c, nil
+}
+
+// reply marshals the response to m, working it out first unless it's given,
+// and signs it if the request was signed. Responses longer than limit are
+// truncated.
+func (s *Server) reply(m Message, c client, ans *Message, limit int) []byte {
+	if ans == nil {
+		handled := s.handle(m, c)
+		ans = &handled
+	}
+	ans.updateCounts()
+	limit -= c.sig.size()
+	out := ans.Marshal()
+	if len(out) > limit {
+		ans.truncate()
+		out = ans.Marshal()
+	}
+	if c.sig != nil {
+		out = c.sig.sign(*ans, time.Now())
+	}
+	return out
+}
+
+// handle builds the response to a query, answering from one of our zones if we
+// can and resolving it recursively otherwise.
+func (s *Server) handle(m Message, c client) (ans Message) {
+	ans = Message{
+		ID:               m.ID,
+		IsResponse:       true,
+		OpCode:           m.OpCode,
+		RecursionDesired: m.RecursionDesired,
+		ResponseCode:     ResponseCodeOk,
+		Questions:        m.Questions,
+	}
+	defer func() {
+		if _, do, ok := m.EDNS0(); ok {
+			ans.SetEDNS0(ednsUDPSize, do)
 		}
-		if _, err := s.conn.WriteTo(ans.Marshal(), addr); err != nil {
-			log.Println("error writing to conn:", err)
+		ans.updateCounts()
+	}()
+	switch m.OpCode {
+	case OpCodeUpdate:
+		s.update(m, c, &ans)
+		return ans
+	case OpCodeNotify:
+		s.notified(m, c, &ans)
+		return ans
+	}
+	if m.OpCode != OpCodeStandard {
+		ans.ResponseCode = ResponseCodeNotImplemented
+		return ans
+	}
+	// Nobody really sends more than one question, and RFC 9619 makes that official
+	if len(m.Questions) != 1 {
+		ans.ResponseCode = ResponseCodeFormatError
+		return ans
+	}
+	q := m.Questions[0]
+	if isTransfer(m) {
+		s.transferOverUDP(m, c, &ans)
+		return ans
+	}
+
+	if z := s.findZone(q.Name); z != nil {
+		if !z.serving() {
+			// A secondary zone that's expired has nothing we can vouch for
+			ans.ResponseCode = ResponseCodeServerFailure
+			return ans
 		}
+		z.Answer(q, &ans)
+		if m.DNSSECOK() {
+			z.AddDNSSEC(q, &ans)
+		}
+		return ans
 	}
-	return nil
+
+	ans.RecursionAvailable = true
+	upstreamAns, status, err := s.resolve(q, m.CheckingDisabled)
+	if err != nil {
+		log.Printf("resolving %s: %v", q.Name.DisplayString(), err)
+		ans.ResponseCode = ResponseCodeServerFailure
+		return ans
+	}
+	// RFC 6840 section 5.8 says to only set AD for clients that show they
+	// understand it
+	ans.AuthenticatedData = status == StatusSecure && (m.AuthenticatedData || m.DNSSECOK())
+	ans.ResponseCode = upstreamAns.ResponseCode
+	ans.Answer = upstreamAns.Answer
+	ans.Authority = upstreamAns.Authority
+	if !m.DNSSECOK() {
+		ans.Answer = stripDNSSEC(ans.Answer, q.Type)
+		ans.Authority = stripDNSSEC(ans.Authority, q.Type)
+	}
+	return ans
+}
+
+// resolve answers q from the cache if it can, and otherwise resolves it
+// recursively and validates the answer. Clients that set CD want to do their
+// own checking, so when checkingDisabled is set fresh answers are passed on
+// unvalidated, whatever state they're in.
+//
+// Names that a rule sends somewhere other than the default route may not
+// exist in the public tree at all, so the validated NSEC records we've
+// cached from it, and anything that relied on them, don't speak for them.
+func (s *Server) resolve(q Question, checkingDisabled bool) (Message, SecurityStatus, error) {
+	rule := s.route(q.Name)
+	diverted := rule != nil && !rule.Suffix.IsRoot() && (rule.Pool != nil || rule.Insecure)
+	if m, status, ok := s.cache.Get(q); ok && !(diverted && status == StatusSecure) {
+		return m, status, nil
+	}
+	if !diverted {
+		if m, ok := s.cache.Synthesize(q); ok {
+			return m, StatusSecure, nil
+		}
+	}
+	m, err := s.lookup(q)
+	if err != nil {
+		return Message{}, StatusInsecure, err
+	}
+	status := StatusInsecure
+	cached := m
+	if s.validator != nil {
+		if checkingDisabled || (rule != nil && rule.Insecure) {
+			return m, StatusInsecure, nil
+		}
+		var verified []ResourceRecord
+		status, verified, err = s.validator.validate(q, m)
+		if status == StatusBogus {
+			return Message{}, status, fmt.Errorf("validating: %v", err)
+		}
+		// The cache learns about other names from a secure answer's
+		// authority section, so only keep what was checked there
+		if status == StatusSecure {
+			cached.Authority = verified
+		}
+	}
+	s.cache.Put(q, cached, status)
+	return m, status, nil
+}
+
+// lookup answers q from upstream, either by forwarding it as the rules say or
+// by resolving it recursively.
+func (s *Server) lookup(q Question) (Message, error) {
+	name := q.Name
+	if q.Type == TypeDS && !name.IsRoot() {
+		// DS records live on the parent's side of a zone cut, so they go
+		// wherever the parent's names do
+		name = name.Parent()
+	}
+	if rule := s.route(name); rule != nil && rule.Pool != nil {
+		return rule.Pool.Resolve(q)
+	}
+	return s.cli.ResolveRecursively(q)
 }
 
 func (s *Server) Close() error {
+	s.mu.Lock()
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	s.mu.Unlock()
+	s.tcp.Close()
 	return s.conn.Close()
 }
 
+type zoneFlag struct {
+	origin Name
+	path   string
+}
+
+// zoneFlags collects the -zone flags.
+type zoneFlags []zoneFlag
+
+func (z *zoneFlags) String() string {
+	var parts []string
+	for _, zf := range *z {
+		parts = append(parts, zf.origin.String()+"="+zf.path)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (z *zoneFlags) Set(v string) error {
+	i := strings.Index(v, "=")
+	if i < 0 {
+		return fmt.Errorf("expected origin=path, got %q", v)
+	}
+	origin, err := ParseName(v[:i])
+	if err != nil {
+		return err
+	}
+	*z = append(*z, zoneFlag{origin: origin, path: v[i+1:]})
+	return nil
+}
+
+// reloadOnHangup reads the zone files again whenever we get SIGHUP, and tells
+// the secondaries of any zone that changed.
+func reloadOnHangup(server *Server, zones zoneFlags) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		for _, zf := range zones {
+			z := server.findZone(zf.origin)
+			if z == nil || !z.Origin.Equal(zf.origin) {
+				continue
+			}
+			changed, err := z.Reload(zf.path)
+			switch {
+			case err != nil:
+				log.Printf("reloading %s: %v", z.Origin, err)
+			case changed:
+				log.Printf("reloaded %s, serial now %d", z.Origin, z.serial())
+				server.notifySecondaries(z)
+			}
+		}
+	}
+}
+
+// anchorRefreshInterval is how often we fetch the keys of zones with managed
+// trust anchors. RFC 5011 section 2.3 wants at least one fetch every 15 days,
+// and at most one an hour.
+const anchorRefreshInterval = 12 * time.Hour
+
+// keyCheckInterval is how often we check whether a signed zone's keys need to
+// move on to the next step of a rollover.
+const keyCheckInterval = 10 * time.Minute
+
+// manageKeys runs the key manager for a zone and signs it again if its keys
+// have changed.
+func manageKeys(km *KeyManager, z *Zone, nsec3 bool) error {
+	changed, err := km.Run()
+	if err != nil || !changed {
+		return err
+	}
+	signer := km.Signer()
+	if nsec3 {
+		// RFC 9276 recommends no extra iterations and no salt
+		signer.NSEC3 = &NSEC3PARAM{HashAlgorithm: NSEC3HashSHA1}
+	}
+	log.Printf("signing %s with %d active and %d standby keys", z.Origin, len(signer.Keys), len(signer.Standby))
+	return z.Sign(signer)
+}
+
+// showKeyStatus prints the state of the keys in a zone's key directory,
+// first recording that the parent has a DS for the KSK dsSeen if it's set.
+func showKeyStatus(zf zoneFlag, dsSeen uint) error {
+	km, err := LoadKeyManager(zf.path, zf.origin, KeyPolicy{})
+	if err != nil {
+		return err
+	}
+	if dsSeen != 0 {
+		if err := km.SetDSSeen(uint16(dsSeen)); err != nil {
+			return err
+		}
+	}
+	return km.WriteStatus(os.Stdout)
+}
+
+// runQuery resolves name with cli and prints the answer, rendering any
+// internationalized names in Unicode.
+func runQuery(cli *Client, name, qtype string) error {
+	qname, err := ParseName(name)
+	if err != nil {
+		return err
+	}
+	t, err := ParseType(qtype)
+	if err != nil {
+		return err
+	}
+	m, err := cli.Resolve(Question{Name: qname, Type: t, Class: ClassIN})
+	if err != nil {
+		return err
+	}
+	for _, rr := range m.Answer {
+		fmt.Println(rr.DisplayString())
+	}
+	return nil
+}
+
 func main() {
 	upstream := flag.Bool("upstream", false, "act as an upstream")
+	query := flag.String("query", "", "look up a single name and print the answer instead of serving")
+	queryServer := flag.String("server", "8.8.8.8:53", "the server to send -query lookups to, as host:port, tls://host:853, quic://host:853 or https://host/dns-query")
+	spkiPins := flag.String("spki-pin", "", "with an encrypted -server, base64 SHA-256 digests of public keys to accept in place of checking its certificate, separated by commas")
+	opportunistic := flag.Bool("opportunistic", false, "with an encrypted -server, fall back to plain DNS if the encrypted connection fails")
+	queryType := flag.String("type", "A", "the type of record -query looks up")
+	tsigKeys := flag.String("tsig-keys", "", "a file of TSIG keys, one per line as name, algorithm and base64 secret, for signed updates and transfers")
+	tsigKey := flag.String("tsig-key", "", "the name of a key from -tsig-keys to sign -query lookups with")
+	forward := flag.String("forward", "", "upstream servers to forward queries no -forward-zone covers to, instead of resolving them ourselves, separated by commas, each as host:port, tls://host, quic://host or https://host/dns-query, along with any options -forward-zone takes")
+	forwardStrategy := flag.String("forward-strategy", "round-robin", "how to pick which -forward upstream to ask first: round-robin, random, lowest-latency or strict-order")
+	listen := flag.String("listen", "localhost:5003", "the address to serve on, e.g. [::]:53 for IPv4 and IPv6")
+	ipv6 := flag.String("ipv6", "prefer-v4", "how to use IPv6 nameservers: prefer-v4, prefer-v6 or disable")
+	dnssec := flag.Bool("dnssec", false, "validate DNSSEC signatures on recursive answers")
+	trustAnchors := flag.String("trust-anchors", "", "a file of DS or DNSKEY records to trust as they are, for zones outside the public tree")
+	aggressiveNSEC := flag.Bool("aggressive-nsec", true, "with -dnssec, answer for names and types that cached NSEC and NSEC3 records prove don't exist")
+	tlsListen := flag.String("tls-listen", "", "an address to serve DNS over TLS on as well, e.g. [::]:853, using -tls-cert and -tls-key")
+	quicListen := flag.String("quic-listen", "", "a UDP address to serve DNS over QUIC on as well, e.g. [::]:853, using -tls-cert and -tls-key")
+	httpsListen := flag.String("https-listen", "", "an address to serve DNS over HTTPS on at /dns-query, e.g. [::]:443, using -tls-cert and -tls-key")
+	tlsCert := flag.String("tls-cert", "", "a PEM file of the certificate chain for DNS over TLS, QUIC and HTTPS, read again when it changes")
+	tlsKey := flag.String("tls-key", "", "a PEM file of the private key for -tls-cert")
+	debugAddr := flag.String("debug-addr", "", "serve counters such as queries answered from the cache at /debug/vars on this address")
+	anchorState := flag.String("anchor-state", "", "a file to keep the root zone's trust anchors in as they're updated, so they survive restarts")
+	var zones, signed, updaters, transfers, secondaries, alsoNotify, rules zoneFlags
+	flag.Var(&rules, "forward-zone", "forward queries for names under a suffix to other upstreams, or resolve them ourselves, given as suffix=192.0.2.53:53,tls://dns.example or suffix=recurse, optionally with ,strategy:name, ,race:n to send each query to n upstreams at once, ,stagger:50ms to start each racer that much after the last, and ,no-dnssec to skip validation (repeatable)")
+	flag.Var(&zones, "zone", "serve a zone authoritatively, given as origin=path/to/zonefile (repeatable)")
+	flag.Var(&signed, "sign", "sign a zone with the keys in a directory, given as origin=path/to/keys (repeatable)")
+	signAlgorithm := flag.String("sign-algorithm", "ECDSAP256SHA256", "the algorithm for new signing keys: ECDSAP256SHA256 or ED25519")
+	flag.Var(&updaters, "allow-update", "accept dynamic updates to a zone from some addresses or TSIG keys, given as origin=192.0.2.0/24,2001:db8::1,key:name (repeatable)")
+	flag.Var(&secondaries, "secondary", "serve a copy of a zone transferred from its primaries, given as origin=192.0.2.1:53,key:name (repeatable)")
+	secondaryDir := flag.String("secondary-dir", "", "a directory to keep copies of secondary zones in, so they survive restarts")
+	flag.Var(&alsoNotify, "also-notify", "send NOTIFYs about changes to a zone to these secondaries as well as its NS records, given as origin=192.0.2.2:53,198.51.100.2:53 (repeatable)")
+	flag.Var(&transfers, "allow-transfer", "let some addresses or TSIG keys transfer a zone, given as origin=192.0.2.0/24,key:name (repeatable)")
+	nsec3 := flag.Bool("nsec3", false, "use NSEC3 rather than NSEC in signed zones")
+	var keyStatus zoneFlag
+	flag.Func("key-status", "print the state of a zone's keys, given as origin=path/to/keys, and exit", func(v string) error {
+		var zf zoneFlags
+		if err := zf.Set(v); err != nil {
+			return err
+		}
+		keyStatus = zf[0]
+		return nil
+	})
+	dsSeen := flag.Uint("ds-seen", 0, "with -key-status, record that the parent now has a DS record for the KSK with this tag")
 	flag.Parse()
+	if keyStatus.path != "" {
+		if err := showKeyStatus(keyStatus, *dsSeen); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	keys := TSIGKeyring{}
+	if *tsigKeys != "" {
+		var err error
+		if keys, err = LoadTSIGKeys(*tsigKeys); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *query != "" {
+		var key *TSIGKey
+		if *tsigKey != "" {
+			name, err := ParseName(*tsigKey)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if key = keys.Get(name); key == nil {
+				log.Fatalf("no TSIG key called %s in -tsig-keys", *tsigKey)
+			}
+		}
+		cli, err := NewClient(*queryServer)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cli.TSIG = key
+		cli.Opportunistic = *opportunistic
+		if *spkiPins != "" {
+			cli.SPKIPins = strings.Split(*spkiPins, ",")
+		}
+		if err := runQuery(cli, *query, *queryType); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	if *upstream {
 		cli, err := NewClient("8.8.8.8:53")
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		server, err := NewServer("5005", cli)
+		server, err := NewServer("localhost:5005", cli)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -254,11 +1085,174 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	if cli.IPv6, err = ParseIPv6Policy(*ipv6); err != nil {
+		log.Fatal(err)
+	}
 
-	server, err := NewServer("5003", cli)
+	server, err := NewServer(*listen, cli)
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.keys = keys
+	if *forward != "" {
+		// -forward is the default route, for names no -forward-zone covers
+		rules = append(zoneFlags{{origin: Name{}, path: *forward + ",strategy:" + *forwardStrategy}}, rules...)
+	}
+	for _, rf := range rules {
+		rule, err := ParseForwardRule(rf.origin, rf.path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if rule.Pool != nil {
+			go rule.Pool.Run()
+		}
+		server.rules = append(server.rules, rule)
+	}
+	if *dnssec {
+		var static []ResourceRecord
+		if *trustAnchors != "" {
+			if static, err = LoadTrustAnchors(*trustAnchors); err != nil {
+				log.Fatal(err)
+			}
+		}
+		anchors, err := NewTrustAnchors(static, RootAnchors(), *anchorState)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cli.DNSSEC = true
+		for _, rule := range server.rules {
+			if rule.Pool != nil {
+				rule.Pool.DNSSEC = true
+			}
+		}
+		server.validator = NewValidator(server.lookup, anchors)
+		server.cache.Aggressive = *aggressiveNSEC
+		go func() {
+			for range time.Tick(anchorRefreshInterval) {
+				server.validator.RefreshAnchors()
+			}
+		}()
+	}
+	alg, err := parseAlgorithm(*signAlgorithm)
 	if err != nil {
 		log.Fatal(err)
 	}
+	for _, zf := range zones {
+		z, err := LoadZone(zf.path, zf.origin)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, uf := range updaters {
+			if uf.origin.Equal(z.Origin) {
+				if z.Updates, err = ParseUpdatePolicy(uf.path); err != nil {
+					log.Fatalf("-allow-update for %s: %v", z.Origin, err)
+				}
+			}
+		}
+		for _, sf := range signed {
+			if !sf.origin.Equal(z.Origin) {
+				continue
+			}
+			policy := DefaultKeyPolicy(z)
+			policy.Algorithm = alg
+			km, err := LoadKeyManager(sf.path, z.Origin, policy)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if err := manageKeys(km, z, *nsec3); err != nil {
+				log.Fatal(err)
+			}
+			go func(z *Zone) {
+				for range time.Tick(keyCheckInterval) {
+					if err := manageKeys(km, z, *nsec3); err != nil {
+						log.Printf("managing keys for %s: %v", z.Origin, err)
+					}
+				}
+			}(z)
+		}
+		server.AddZone(z)
+	}
+	for _, sf := range secondaries {
+		var primaries []string
+		var key *TSIGKey
+		for _, p := range strings.Split(sf.path, ",") {
+			if name, ok := strings.CutPrefix(p, "key:"); ok {
+				n, err := ParseName(name)
+				if err != nil {
+					log.Fatal(err)
+				}
+				if key = keys.Get(n); key == nil {
+					log.Fatalf("no TSIG key called %s in -tsig-keys", name)
+				}
+				continue
+			}
+			primaries = append(primaries, p)
+		}
+		var path string
+		if *secondaryDir != "" {
+			path = filepath.Join(*secondaryDir, strings.TrimSuffix(sf.origin.String(), ".")+".zone")
+		}
+		sec, err := NewSecondary(sf.origin, primaries, key, path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		server.AddZone(sec.Zone)
+		go sec.Run()
+	}
+	for _, z := range server.zones {
+		for _, tf := range transfers {
+			if tf.origin.Equal(z.Origin) {
+				if z.Transfers, err = ParseACL(tf.path); err != nil {
+					log.Fatalf("-allow-transfer for %s: %v", z.Origin, err)
+				}
+			}
+		}
+		for _, nf := range alsoNotify {
+			if nf.origin.Equal(z.Origin) {
+				z.AlsoNotify = append(z.AlsoNotify, strings.Split(nf.path, ",")...)
+			}
+		}
+	}
+	go reloadOnHangup(server, zones)
+
+	var tlsConfig *tls.Config
+	if *tlsListen != "" || *quicListen != "" || *httpsListen != "" {
+		if tlsConfig, err = LoadTLSConfig(*tlsCert, *tlsKey); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *tlsListen != "" {
+		l, err := net.Listen("tcp", *tlsListen)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			log.Printf("serving DNS over TLS: %v", server.ServeTLS(l, tlsConfig))
+		}()
+	}
+	if *quicListen != "" {
+		conn, err := net.ListenPacket("udp", *quicListen)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			log.Printf("serving DNS over QUIC: %v", server.ServeQUIC(conn, tlsConfig))
+		}()
+	}
+	if *httpsListen != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/dns-query", server)
+		// ServeTLS offers HTTP/2 along with HTTP/1.1
+		hs := &http.Server{Addr: *httpsListen, Handler: mux, TLSConfig: tlsConfig}
+		go func() {
+			log.Printf("serving DNS over HTTPS: %v", hs.ListenAndServeTLS("", ""))
+		}()
+	}
+	if *debugAddr != "" {
+		go func() {
+			log.Printf("serving debug counters: %v", http.ListenAndServe(*debugAddr, nil))
+		}()
+	}
 
 	if err := server.Listen(); err != nil {
 		log.Fatal(err)
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestOrderAddrs(t *testing.T) {
+	type Test struct {
+		Description string
+		Policy      IPv6Policy
+		Expected    []string
+	}
+
+	ips := []net.IP{
+		net.ParseIP("2001:db8::1"),
+		net.ParseIP("192.0.2.1").To4(),
+		net.ParseIP("2001:db8::2"),
+		net.ParseIP("192.0.2.2").To4(),
+	}
+	tests := []Test{
+		{"Prefer IPv4", PreferIPv4, []string{"192.0.2.1", "192.0.2.2", "2001:db8::1", "2001:db8::2"}},
+		{"Prefer IPv6", PreferIPv6, []string{"2001:db8::1", "2001:db8::2", "192.0.2.1", "192.0.2.2"}},
+		{"IPv6 disabled", DisableIPv6, []string{"192.0.2.1", "192.0.2.2"}},
+	}
+	for _, test := range tests {
+		cli := &Client{IPv6: test.Policy}
+		var got []string
+		for _, ip := range cli.orderAddrs(ips) {
+			got = append(got, ip.String())
+		}
+		if !cmp.Equal(test.Expected, got) {
+			t.Errorf("%s: (-want +got)\n%v", test.Description, cmp.Diff(test.Expected, got))
+		}
+	}
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 )
 
@@ -14,6 +16,11 @@ const (
 	OpCodeStatus
 )
 
+const (
+	OpCodeNotify OpCode = 4
+	OpCodeUpdate OpCode = 5
+)
+
 type ResponseCode byte
 
 const (
@@ -23,8 +30,43 @@ const (
 	ResponseCodeNameError
 	ResponseCodeNotImplemented
 	ResponseCodeRefused
+	// The rest are from RFC 2136 for dynamic updates
+	ResponseCodeYXDomain
+	ResponseCodeYXRRSet
+	ResponseCodeNXRRSet
+	ResponseCodeNotAuth
+	ResponseCodeNotZone
 )
 
+// String returns the mnemonic for the response code, as dig shows it.
+func (r ResponseCode) String() string {
+	switch r {
+	case ResponseCodeOk:
+		return "NOERROR"
+	case ResponseCodeFormatError:
+		return "FORMERR"
+	case ResponseCodeServerFailure:
+		return "SERVFAIL"
+	case ResponseCodeNameError:
+		return "NXDOMAIN"
+	case ResponseCodeNotImplemented:
+		return "NOTIMP"
+	case ResponseCodeRefused:
+		return "REFUSED"
+	case ResponseCodeYXDomain:
+		return "YXDOMAIN"
+	case ResponseCodeYXRRSet:
+		return "YXRRSET"
+	case ResponseCodeNXRRSet:
+		return "NXRRSET"
+	case ResponseCodeNotAuth:
+		return "NOTAUTH"
+	case ResponseCodeNotZone:
+		return "NOTZONE"
+	}
+	return fmt.Sprintf("RCODE%d", r)
+}
+
 // TODO: separate Header, etc.
 type Message struct {
 	ID uint16
@@ -34,6 +76,8 @@ type Message struct {
 	Truncated bool
 	RecursionDesired bool
 	RecursionAvailable bool
+	AuthenticatedData bool
+	CheckingDisabled bool
 	ResponseCode ResponseCode
 	QdCount uint16
 	AnCount uint16
@@ -46,48 +90,27 @@ type Message struct {
 }
 
 type Question struct {
-	Name [][]byte
+	Name Name
 	Type Type
 	Class Class
 }
 
 type ResourceRecord struct {
-	Name [][]byte
+	Name Name
 	Type Type
 	Class Class
 	TTL uint32
 	Data []byte
 }
 
-type Type uint16
-
-const (
-	TypeA = 1 + iota
-	TypeNS
-	TypeMD
-	TypeMF
-	TypeCName
-	TypeSOA
-	TypeMB
-	TypeMG
-	TypeMR
-	TypeNull
-	TypeWKS
-	TypePTR
-	TypeHIinfo
-	TypeMInfo
-	MX
-	TXT
-)
-
-type Class uint16
-
-const (
-	ClassIN = 1 + iota
-	ClassCS
-	ClassCH
-	ClassHS
-)
+// updateCounts sets the section counts in the header from the sections
+// themselves.
+func (m *Message) updateCounts() {
+	m.QdCount = uint16(len(m.Questions))
+	m.AnCount = uint16(len(m.Answer))
+	m.NSCount = uint16(len(m.Authority))
+	m.ARCount = uint16(len(m.Additional))
+}
 
 func (m *Message) Marshal() []byte {
 	b := make([]byte, 0, 12)
@@ -117,6 +140,12 @@ func (m *Message) Marshal() []byte {
 	if m.RecursionAvailable {
 		byt += 1 << 7
 	}
+	if m.AuthenticatedData {
+		byt += 1 << 5
+	}
+	if m.CheckingDisabled {
+		byt += 1 << 4
+	}
 
 	byt += byte(m.ResponseCode)
 
@@ -150,8 +179,10 @@ func (m *Message) Marshal() []byte {
 	return buf.Bytes()
 }
 
+// Unmarshal reads the message in b into m. Anyone can send us anything, so
+// counts that promise more than b holds, or lengths that run past its end,
+// are an error rather than something to trust.
 func Unmarshal(b []byte, m *Message) error {
-	// TODO: check if the buffer is the appropriate size
 	buf := bytes.NewBuffer(b)
 	binary.Read(buf, binary.BigEndian, &m.ID)
 
@@ -176,17 +207,29 @@ func Unmarshal(b []byte, m *Message) error {
 	if byt & 128 == 128 {
 		m.RecursionAvailable = true
 	}
+	if byt & 32 == 32 {
+		m.AuthenticatedData = true
+	}
+	if byt & 16 == 16 {
+		m.CheckingDisabled = true
+	}
 	m.ResponseCode = ResponseCode(byt & 15)
 
 	binary.Read(buf, binary.BigEndian, &m.QdCount)
 	binary.Read(buf, binary.BigEndian, &m.AnCount)
 	binary.Read(buf, binary.BigEndian, &m.NSCount)
 	binary.Read(buf, binary.BigEndian, &m.ARCount)
+	if len(b) < 12 {
+		return fmt.Errorf("message is %d octets, too short for a header", len(b))
+	}
 
 	var qsRead uint16
 	offset := 12 // skip over header
 	for ; qsRead < m.QdCount; qsRead++ {
-		q, n := decodeQuestion(buf)
+		q, n, err := decodeQuestion(buf)
+		if err != nil {
+			return fmt.Errorf("reading question %d: %v", qsRead+1, err)
+		}
 		// A bug happened because I forgot to set the offset of the ResourceScanner to 12 +
 		// the question section length
 		offset += n
@@ -194,45 +237,60 @@ func Unmarshal(b []byte, m *Message) error {
 	}
 
 	scanner := NewResourceRecordScanner(b, offset)
-	var ansRead uint16
-	for ; ansRead < m.AnCount; ansRead++ {
-		m.Answer = append(m.Answer, scanner.decodeRecord())
+	sections := []struct {
+		name    string
+		count   uint16
+		records *[]ResourceRecord
+	}{
+		{"answer", m.AnCount, &m.Answer},
+		{"authority", m.NSCount, &m.Authority},
+		{"additional", m.ARCount, &m.Additional},
 	}
-
-	var nsRead uint16
-	for ; nsRead < m.NSCount; nsRead++ {
-		m.Authority = append(m.Authority, scanner.decodeRecord())
-	}
-
-	var arRead uint16
-	for ; arRead < m.ARCount; arRead++ {
-		m.Additional = append(m.Additional, scanner.decodeRecord())
+	for _, section := range sections {
+		for i := uint16(0); i < section.count; i++ {
+			rr, err := scanner.decodeRecord()
+			if err != nil {
+				return fmt.Errorf("reading %s record %d: %v", section.name, i+1, err)
+			}
+			*section.records = append(*section.records, rr)
+		}
 	}
 
 	return nil
 }
 
-func decodeQuestion(buf io.Reader) (Question, int) {
+func decodeQuestion(buf io.Reader) (Question, int, error) {
 	q := Question{}
 	n := 0
 
 	for {
 		var labelLen byte
-		binary.Read(buf, binary.BigEndian, &labelLen)
+		if err := binary.Read(buf, binary.BigEndian, &labelLen); err != nil {
+			return q, n, io.ErrUnexpectedEOF
+		}
 		if labelLen == 0 {
 			n += 1
 			break
 		}
+		if labelLen&192 != 0 {
+			return q, n, fmt.Errorf("bad label length %d", labelLen)
+		}
 		label := make([]byte, labelLen)
-		buf.Read(label)
+		if _, err := io.ReadFull(buf, label); err != nil {
+			return q, n, io.ErrUnexpectedEOF
+		}
 		q.Name = append(q.Name, label)
-		n += int(labelLen + 1)
+		n += int(labelLen) + 1
+	}
+	if err := binary.Read(buf, binary.BigEndian, &q.Type); err != nil {
+		return q, n, io.ErrUnexpectedEOF
+	}
+	if err := binary.Read(buf, binary.BigEndian, &q.Class); err != nil {
+		return q, n, io.ErrUnexpectedEOF
 	}
-	binary.Read(buf, binary.BigEndian, &q.Type)
-	binary.Read(buf, binary.BigEndian, &q.Class)
 	n += 4
 
-	return q, n
+	return q, n, nil
 }
 
 func NewResourceRecordScanner(buf []byte, pos int) *ResourceRecordScanner {
@@ -257,56 +315,125 @@ type ResourceRecordScanner struct {
 // and whenever we encounter an offset, check if we've already parsed it
 
 // A bug! I initially figured I could just implement the pointer stuff later, but no such luck of course
-func (r *ResourceRecordScanner) decodeRecord() ResourceRecord {
+func (r *ResourceRecordScanner) decodeRecord() (ResourceRecord, error) {
 	rr := ResourceRecord{}
 	startOffset := r.pos
-	recordLen := 0
+	if startOffset >= len(r.buf) {
+		return rr, io.ErrUnexpectedEOF
+	}
 
-	labels, scanned := r.scanLabelsAt(startOffset)
+	labels, scanned, ok := r.scanName(startOffset, len(r.buf))
+	if !ok {
+		return rr, errors.New("bad owner name")
+	}
 	rr.Name = labels
 
-	buf := bytes.NewBuffer(r.buf[startOffset + scanned:])
-	recordLen += scanned
-
-	binary.Read(buf, binary.BigEndian, &rr.Type)
-	recordLen += 2
-	binary.Read(buf, binary.BigEndian, &rr.Class)
-	recordLen += 2
-	binary.Read(buf, binary.BigEndian, &rr.TTL)
-	recordLen += 4
-	var dataLen uint16
-	binary.Read(buf, binary.BigEndian, &dataLen)
-	data := make([]byte, dataLen)
-	buf.Read(data)
-	rr.Data = data
-	recordLen += int(dataLen + 2)
-	r.pos += recordLen
-	return rr
+	// Type, class, TTL and the length of the data
+	fixed := startOffset + scanned
+	if fixed+10 > len(r.buf) {
+		return rr, io.ErrUnexpectedEOF
+	}
+	rr.Type = Type(binary.BigEndian.Uint16(r.buf[fixed:]))
+	rr.Class = Class(binary.BigEndian.Uint16(r.buf[fixed+2:]))
+	rr.TTL = binary.BigEndian.Uint32(r.buf[fixed+4:])
+	dataLen := int(binary.BigEndian.Uint16(r.buf[fixed+8:]))
+	dataStart := fixed + 10
+	dataEnd := dataStart + dataLen
+	if dataEnd > len(r.buf) {
+		return rr, fmt.Errorf("%d octets of data run past the end of the message", dataLen)
+	}
+	rr.Data = r.decompressRData(rr.Type, dataStart, dataEnd)
+	r.pos = dataEnd
+	return rr, nil
+}
+
+// compressedRDataLayouts describes the data of the types that RFC 3597 says may
+// contain compressed names. A zero is a name and anything else is that many
+// octets of fixed-size fields. Names in any other type, including newer ones
+// like SRV and the DNSSEC types, must never be compressed, so those are left
+// alone.
+var compressedRDataLayouts = map[Type][]int{
+	TypeNS:    {0},
+	TypeMD:    {0},
+	TypeMF:    {0},
+	TypeCName: {0},
+	TypeSOA:   {0, 0},
+	TypeMB:    {0},
+	TypeMG:    {0},
+	TypeMR:    {0},
+	TypePTR:   {0},
+	TypeMInfo: {0, 0},
+	TypeMX:    {2, 0},
 }
 
-func (r *ResourceRecordScanner) scanLabelsAt(startOffset int) ([][]byte, int) {
-	buf := bytes.NewBuffer(r.buf[startOffset:])
-	var labels [][]byte
+// decompressRData copies out the data of a record that lies between start and
+// end, expanding any compressed names so that the data makes sense away from
+// the message it came in. If the data doesn't fit the layout we expect for its
+// type it's kept exactly as it was.
+func (r *ResourceRecordScanner) decompressRData(t Type, start, end int) []byte {
+	raw := make([]byte, end-start)
+	copy(raw, r.buf[start:end])
+	layout, ok := compressedRDataLayouts[t]
+	if !ok {
+		return raw
+	}
+	var out bytes.Buffer
+	pos := start
+	for _, field := range layout {
+		if field > 0 {
+			if pos+field > end {
+				return raw
+			}
+			out.Write(r.buf[pos : pos+field])
+			pos += field
+			continue
+		}
+		name, scanned, ok := r.scanName(pos, end)
+		if !ok {
+			return raw
+		}
+		writeName(&out, name)
+		pos += scanned
+	}
+	out.Write(r.buf[pos:end])
+	return out.Bytes()
+}
+
+// scanName reads a possibly compressed name starting at startOffset, which must
+// not run past end. It returns the name, how many octets it took up at
+// startOffset, and whether it was well formed.
+func (r *ResourceRecordScanner) scanName(startOffset, end int) (Name, int, bool) {
+	var labels Name
 	var scanned int
 
 	for {
-		var labelLen byte
-		binary.Read(buf, binary.BigEndian, &labelLen)
+		pos := startOffset + scanned
+		if pos >= end {
+			return labels, scanned, false
+		}
+		labelLen := r.buf[pos]
 		// termination of labels
 		if labelLen == 0 {
-			return labels, scanned + 1
+			return labels, scanned + 1, true
 		}
 		if labelLen & 192 == 192 {
-			// scanLabelsAt this position
-			var dereferencingOffset uint16 = uint16(labelLen & 63) << 7
-			var offsetSecondByte byte
-			binary.Read(buf, binary.BigEndian, &offsetSecondByte)
-			dereferencingOffset += uint16(offsetSecondByte)
-			ptrLabels, _ := r.scanLabelsAt(int(dereferencingOffset))
-			return append(labels, ptrLabels...), scanned + 2
+			if pos+1 >= end {
+				return labels, scanned, false
+			}
+			dereferencingOffset := int(labelLen&63)<<8 + int(r.buf[pos+1])
+			// Only following pointers to before where this name started means a
+			// malicious message can't send us round in circles
+			if dereferencingOffset >= startOffset {
+				return labels, scanned + 2, false
+			}
+			ptrLabels, _, ok := r.scanName(dereferencingOffset, len(r.buf))
+			return append(labels, ptrLabels...), scanned + 2, ok
+		}
+		if labelLen&192 != 0 || pos+1+int(labelLen) > end {
+			return labels, scanned, false
 		}
 		label := make([]byte, labelLen)
-		buf.Read(label)
+		copy(label, r.buf[pos+1:])
 		labels = append(labels, label)
 		scanned += int(labelLen) + 1
 	}
@@ -324,4 +451,4 @@ func encodeResourceRecord(buf io.Writer, rr ResourceRecord) {
 	binary.Write(buf, binary.BigEndian, rr.TTL)
 	binary.Write(buf, binary.BigEndian, uint16(len(rr.Data)))
 	buf.Write(rr.Data)
-}
\ No newline at end of file
+}
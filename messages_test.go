@@ -311,3 +311,122 @@ func TestUnmarshal(t *testing.T) {
 		}
 	}
 }
+
+func TestUnmarshalRData(t *testing.T) {
+	b := []byte{
+		0, 1, 132, 0, 0, 1, 0, 2, 0, 0, 0, 0,
+		// Question
+		7, byte('e'), byte('x'), byte('a'), byte('m'), byte('p'), byte('l'), byte('e'),
+		3, byte('c'), byte('o'), byte('m'),
+		0,
+		// NS
+		0, 2,
+		// IN
+		0, 1,
+		// Answer 1, an NS record whose data points back at the question
+		192, 12,
+		0, 2,
+		0, 1,
+		0, 0, 0, 10,
+		0, 6,
+		3, byte('n'), byte('s'), byte('1'),
+		192, 12,
+		// Answer 2, a type we don't know about that happens to contain
+		// something that looks like a pointer
+		192, 12,
+		2, 219,
+		0, 1,
+		0, 0, 0, 10,
+		0, 4,
+		1, byte('a'), 192, 12,
+	}
+	m := Message{}
+	Unmarshal(b, &m)
+	if len(m.Answer) != 2 {
+		t.Fatalf("expected 2 answers, got %d", len(m.Answer))
+	}
+	ns, err := m.Answer[0].RData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ns.String() != "ns1.example.com." {
+		t.Errorf("expected the NS data to be decompressed, got %s", ns)
+	}
+	unknown := m.Answer[1]
+	if unknown.String() != "example.com.\t10\tIN\tTYPE731\t\\# 4 0161c00c" {
+		t.Errorf("expected the unknown data to be kept as it was, got %s", unknown)
+	}
+
+	// The decompressed message should survive a round trip unchanged
+	again := Message{}
+	Unmarshal(m.Marshal(), &again)
+	if !cmp.Equal(m, again) {
+		t.Errorf("round trip: (-want +got)\n%v", cmp.Diff(m, again))
+	}
+
+	// A TXT record whose string claims more octets than it has
+	b = []byte{
+		0, 1, 132, 0, 0, 0, 0, 1, 0, 0, 0, 0,
+		7, byte('e'), byte('x'), byte('a'), byte('m'), byte('p'), byte('l'), byte('e'), 0,
+		0, 16,
+		0, 1,
+		0, 0, 0, 10,
+		0, 2,
+		5, byte('a'),
+	}
+	m = Message{}
+	if err := Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Answer[0].RData(); err == nil {
+		t.Error("expected the truncated TXT data to be an error")
+	}
+	if got := m.Answer[0].String(); got != "example.\t10\tIN\tTXT\t\\# 2 0561" {
+		t.Errorf("expected the truncated TXT data to be shown as it was, got %s", got)
+	}
+}
+
+func TestUnmarshalMalformed(t *testing.T) {
+	header := func(qd, an uint16) []byte {
+		return []byte{0, 1, 132, 0, byte(qd >> 8), byte(qd), byte(an >> 8), byte(an), 0, 0, 0, 0}
+	}
+	question := []byte{3, byte('c'), byte('o'), byte('m'), 0, 0, 1, 0, 1}
+	record := func(rdlength uint16, data ...byte) []byte {
+		return append([]byte{192, 12, 0, 1, 0, 1, 0, 0, 0, 10, byte(rdlength >> 8), byte(rdlength)}, data...)
+	}
+	concat := func(parts ...[]byte) []byte {
+		var b []byte
+		for _, p := range parts {
+			b = append(b, p...)
+		}
+		return b
+	}
+
+	type Test struct {
+		Description string
+		Bytes       []byte
+	}
+	tests := []Test{
+		{"Empty", nil},
+		{"Short header", []byte{0, 1, 132}},
+		{"Over-counted answers", header(0, 0xffff)},
+		{"Over-counted questions", header(0xffff, 0)},
+		{"Truncated question", concat(header(1, 0), question[:6])},
+		{"Question label too long", concat(header(1, 0), []byte{255, byte('a')})},
+		{"Answer past the end", concat(header(1, 2), question, record(4, 8, 8, 8, 8))},
+		{"Overlong rdlength", concat(header(1, 1), question, record(0xffff, 8, 8, 8, 8))},
+		{"Truncated record", concat(header(1, 1), question, record(4)[:8])},
+		{"Forward pointer", concat(header(0, 1), []byte{192, 14, 0, 1, 0, 1, 0, 0, 0, 10, 0, 0})},
+	}
+	for _, test := range tests {
+		m := Message{}
+		if err := Unmarshal(test.Bytes, &m); err == nil {
+			t.Errorf("%s: expected an error", test.Description)
+		}
+		ans := Message{}
+		out := (&Server{}).respond(test.Bytes, nil, true)
+		if err := Unmarshal(out, &ans); err != nil || ans.ResponseCode != ResponseCodeFormatError {
+			t.Errorf("%s: expected FORMERR, got %v (%v)", test.Description, ans.ResponseCode, err)
+		}
+	}
+}
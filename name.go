@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	maxLabelLen = 63
+	maxNameLen  = 255
+)
+
+// Name is a domain name stored as its sequence of labels, most specific first.
+// The root name has no labels. Labels are kept exactly as they were received
+// so that case is preserved on the wire, but every comparison is
+// case-insensitive as required by RFC 4343.
+type Name [][]byte
+
+// ParseName parses a name in presentation format such as "www.example.com."
+// The trailing dot is optional. A backslash escapes the next character, and
+// \DDD encodes an arbitrary octet as a three digit decimal number. Labels
+// containing Unicode are converted to their A-label ("xn--") form.
+func ParseName(s string) (Name, error) {
+	if s == "" {
+		return nil, errors.New("empty name")
+	}
+	s = unicodeDots.Replace(s)
+	if s == "." {
+		return Name{}, nil
+	}
+	var name Name
+	wireLen := 1
+	labels := splitLabels(s)
+	if labels[len(labels)-1] == "" {
+		// Fully qualified
+		labels = labels[:len(labels)-1]
+	}
+	for _, raw := range labels {
+		if raw == "" {
+			return nil, fmt.Errorf("empty label in %q", s)
+		}
+		label, err := unescape(raw, 0, "")
+		if err != nil {
+			return nil, fmt.Errorf("%v in %q", err, s)
+		}
+		// Raw non-ASCII characters are Unicode, as opposed to octets
+		// written with \DDD escapes, which are taken literally
+		if strings.IndexFunc(raw, func(r rune) bool { return r >= 0x80 }) >= 0 || isALabel(label) {
+			if label, err = toALabel(label); err != nil {
+				return nil, err
+			}
+		}
+		if len(label) > maxLabelLen {
+			return nil, fmt.Errorf("label %q is longer than %d octets", label, maxLabelLen)
+		}
+		wireLen += len(label) + 1
+		name = append(name, label)
+	}
+	if wireLen > maxNameLen {
+		return nil, fmt.Errorf("name %q is longer than %d octets", s, maxNameLen)
+	}
+	return name, nil
+}
+
+// splitLabels splits a name in presentation format at the dots that aren't
+// escaped, leaving the labels escaped.
+func splitLabels(s string) []string {
+	var labels []string
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '.':
+			labels = append(labels, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(labels, s[start:])
+}
+
+// unescape reads s with the escapes of RFC 1035 section 5.1 taken out: a
+// backslash escapes the next character, and \DDD is an octet written as a
+// three digit decimal number. Characters in keep are left escaped, for callers
+// that still need to tell them apart from unescaped ones. The result can be no
+// longer than limit octets, unless limit is zero.
+func unescape(s string, limit int, keep string) ([]byte, error) {
+	var out []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			out = append(out, s[i])
+			continue
+		}
+		if i+1 >= len(s) {
+			return nil, errors.New("trailing backslash")
+		}
+		switch {
+		case isDigit(s[i+1]):
+			if i+3 >= len(s) || !isDigit(s[i+2]) || !isDigit(s[i+3]) {
+				return nil, errors.New("bad \\DDD escape")
+			}
+			v := int(s[i+1]-'0')*100 + int(s[i+2]-'0')*10 + int(s[i+3]-'0')
+			if v > 255 {
+				return nil, errors.New("\\DDD escape out of range")
+			}
+			out = append(out, byte(v))
+			i += 3
+		case strings.IndexByte(keep, s[i+1]) >= 0:
+			out = append(out, '\\', s[i+1])
+			i++
+		default:
+			out = append(out, s[i+1])
+			i++
+		}
+	}
+	if limit > 0 && len(out) > limit {
+		return nil, fmt.Errorf("longer than %d octets", limit)
+	}
+	return out, nil
+}
+
+// MustParseName is like ParseName but panics on error. It's meant for
+// constants and tests.
+func MustParseName(s string) Name {
+	n, err := ParseName(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// String returns the name in presentation format, fully qualified, with any
+// special characters escaped.
+func (n Name) String() string {
+	if len(n) == 0 {
+		return "."
+	}
+	var sb strings.Builder
+	for _, label := range n {
+		for _, c := range label {
+			switch {
+			case c == '.' || c == '\\' || c == '"' || c == '(' || c == ')' || c == ';' || c == '@' || c == '$':
+				sb.WriteByte('\\')
+				sb.WriteByte(c)
+			case c <= ' ' || c >= 0x7f:
+				fmt.Fprintf(&sb, "\\%03d", c)
+			default:
+				sb.WriteByte(c)
+			}
+		}
+		sb.WriteByte('.')
+	}
+	return sb.String()
+}
+
+// Equal reports whether two names are the same, ignoring ASCII case.
+func (n Name) Equal(o Name) bool {
+	if len(n) != len(o) {
+		return false
+	}
+	for i := range n {
+		if !labelEqual(n[i], o[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Compare orders names canonically as described in RFC 4034 section 6.1:
+// labels are compared from the root down as lowercased octet strings, and a
+// name sorts before all of its subdomains. It returns -1, 0 or 1.
+func (n Name) Compare(o Name) int {
+	i, j := len(n)-1, len(o)-1
+	for i >= 0 && j >= 0 {
+		if c := bytes.Compare(lowerLabel(n[i]), lowerLabel(o[j])); c != 0 {
+			return c
+		}
+		i--
+		j--
+	}
+	switch {
+	case i < 0 && j < 0:
+		return 0
+	case i < 0:
+		return -1
+	default:
+		return 1
+	}
+}
+
+// Canonical returns a lowercased copy of the name, which is the form used
+// when names are hashed or signed.
+func (n Name) Canonical() Name {
+	c := make(Name, len(n))
+	for i, label := range n {
+		c[i] = lowerLabel(label)
+	}
+	return c
+}
+
+// Parent returns the name with its leftmost label removed. The parent of the
+// root is the root.
+func (n Name) Parent() Name {
+	if len(n) == 0 {
+		return n
+	}
+	return n[1:]
+}
+
+// Child returns a new name with label prepended to n.
+func (n Name) Child(label string) Name {
+	c := make(Name, 0, len(n)+1)
+	c = append(c, []byte(label))
+	return append(c, n...)
+}
+
+// IsSubdomainOf reports whether n is o or falls beneath it.
+func (n Name) IsSubdomainOf(o Name) bool {
+	if len(n) < len(o) {
+		return false
+	}
+	return n[len(n)-len(o):].Equal(o)
+}
+
+// IsChildOf reports whether n is exactly one label below o.
+func (n Name) IsChildOf(o Name) bool {
+	return len(n) == len(o)+1 && n.IsSubdomainOf(o)
+}
+
+// IsRoot reports whether n is the root name.
+func (n Name) IsRoot() bool {
+	return len(n) == 0
+}
+
+// wireLen is the number of octets the name takes up uncompressed on the wire.
+func (n Name) wireLen() int {
+	l := 1
+	for _, label := range n {
+		l += len(label) + 1
+	}
+	return l
+}
+
+func labelEqual(a, b []byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if toLower(a[i]) != toLower(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func lowerLabel(label []byte) []byte {
+	l := make([]byte, len(label))
+	for i, c := range label {
+		l[i] = toLower(c)
+	}
+	return l
+}
+
+func toLower(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+// wireBytes returns the uncompressed wire format of the name.
+func (n Name) wireBytes() []byte {
+	b := make([]byte, 0, n.wireLen())
+	for _, label := range n {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseName(t *testing.T) {
+	type Test struct {
+		Description string
+		Input       string
+		Expected    Name
+		ExpectErr   bool
+	}
+
+	tests := []Test{
+		{
+			Description: "A fully qualified name",
+			Input:       "www.Example.com.",
+			Expected:    Name{[]byte("www"), []byte("Example"), []byte("com")},
+		},
+		{
+			Description: "A name without the trailing dot",
+			Input:       "example.com",
+			Expected:    Name{[]byte("example"), []byte("com")},
+		},
+		{
+			Description: "The root",
+			Input:       ".",
+			Expected:    Name{},
+		},
+		{
+			Description: "Escaped dot and decimal escape",
+			Input:       `a\.b.c\032d.com`,
+			Expected:    Name{[]byte("a.b"), []byte("c d"), []byte("com")},
+		},
+		{
+			Description: "Escaped backslash before a dot",
+			Input:       `a\\.com`,
+			Expected:    Name{[]byte(`a\`), []byte("com")},
+		},
+		{
+			Description: "Trailing backslash",
+			Input:       `a.com\`,
+			ExpectErr:   true,
+		},
+		{
+			Description: "Empty label",
+			Input:       "a..com",
+			ExpectErr:   true,
+		},
+		{
+			Description: "Decimal escape out of range",
+			Input:       `a\300.com`,
+			ExpectErr:   true,
+		},
+		{
+			Description: "Label too long",
+			Input:       "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa.com",
+			ExpectErr:   true,
+		},
+	}
+	for _, test := range tests {
+		n, err := ParseName(test.Input)
+		if test.ExpectErr {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %v", test.Description, n)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.Description, err)
+			continue
+		}
+		if !cmp.Equal(test.Expected, n) {
+			t.Errorf("%s: (-want +got)\n%v", test.Description, cmp.Diff(test.Expected, n))
+		}
+	}
+}
+
+func TestNameString(t *testing.T) {
+	for _, s := range []string{".", "example.com.", `a\.b.c\032d.com.`} {
+		if got := MustParseName(s).String(); got != s {
+			t.Errorf("expected %q, got %q", s, got)
+		}
+	}
+}
+
+func TestNameEqual(t *testing.T) {
+	if !MustParseName("Google.COM").Equal(MustParseName("google.com.")) {
+		t.Error("expected names differing only in case to be equal")
+	}
+	if MustParseName("google.com").Equal(MustParseName("google.co")) {
+		t.Error("expected different names not to be equal")
+	}
+}
+
+func TestNameCompare(t *testing.T) {
+	// The example ordering from RFC 4034 section 6.1
+	expected := []string{
+		"example.",
+		"a.example.",
+		"yljkjljk.a.example.",
+		"Z.a.example.",
+		"zABC.a.EXAMPLE.",
+		"z.example.",
+		`\001.z.example.`,
+		"*.z.example.",
+		`\200.z.example.`,
+	}
+	names := make([]Name, len(expected))
+	for i := range expected {
+		names[len(expected)-1-i] = MustParseName(expected[i])
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return names[i].Compare(names[j]) < 0
+	})
+	for i, n := range names {
+		if !n.Equal(MustParseName(expected[i])) {
+			t.Errorf("position %d: expected %s, got %s", i, expected[i], n)
+		}
+	}
+}
+
+func TestNameHierarchy(t *testing.T) {
+	com := MustParseName("com")
+	google := MustParseName("GOOGLE.com")
+	www := google.Child("www")
+	if !www.Equal(MustParseName("www.google.com")) {
+		t.Errorf("unexpected child %s", www)
+	}
+	if !www.Parent().Equal(google) {
+		t.Errorf("unexpected parent %s", www.Parent())
+	}
+	if !www.IsSubdomainOf(com) || !google.IsSubdomainOf(google) {
+		t.Error("expected subdomain relationship")
+	}
+	if com.IsSubdomainOf(google) {
+		t.Error("com should not be a subdomain of google.com")
+	}
+	if !google.IsChildOf(com) || www.IsChildOf(com) {
+		t.Error("unexpected child relationship")
+	}
+	if domainSuffixLen(www, MustParseName("mail.Google.COM")) != 2 {
+		t.Error("expected a case-insensitive suffix length of 2")
+	}
+}
+
+func TestParseNameIDN(t *testing.T) {
+	type Test struct {
+		Description string
+		Input       string
+		Expected    string
+		ExpectErr   bool
+	}
+
+	tests := []Test{
+		{
+			Description: "Unicode labels are converted to A-labels",
+			Input:       "bücher.example",
+			Expected:    "xn--bcher-kva.example.",
+		},
+		{
+			Description: "Case is mapped per UTS #46",
+			Input:       "BÜCHER.example",
+			Expected:    "xn--bcher-kva.example.",
+		},
+		{
+			Description: "Ideographic full stops separate labels",
+			Input:       "例え。テスト",
+			Expected:    "xn--r8jz45g.xn--zckzah.",
+		},
+		{
+			Description: "Valid A-labels are accepted as is",
+			Input:       "xn--bcher-kva.example",
+			Expected:    "xn--bcher-kva.example.",
+		},
+		{
+			Description: "Escaped octets are not treated as Unicode",
+			Input:       `\200.example`,
+			Expected:    `\200.example.`,
+		},
+		{
+			Description: "Invalid punycode",
+			Input:       "xn--a.example",
+			ExpectErr:   true,
+		},
+		{
+			Description: "Disallowed code point",
+			Input:       "a b.example",
+			ExpectErr:   true,
+		},
+	}
+	for _, test := range tests {
+		n, err := ParseName(test.Input)
+		if test.ExpectErr {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %v", test.Description, n)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.Description, err)
+			continue
+		}
+		if n.String() != test.Expected {
+			t.Errorf("%s: expected %s, got %s", test.Description, test.Expected, n)
+		}
+	}
+}
+
+func TestNameDisplayString(t *testing.T) {
+	n := MustParseName("xn--bcher-kva.example")
+	if got := n.DisplayString(); got != "bücher.example." {
+		t.Errorf("expected bücher.example., got %s", got)
+	}
+}
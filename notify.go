@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// notifyAttempts is how many times we send a NOTIFY before giving up on a
+// secondary that doesn't answer.
+const notifyAttempts = 5
+
+// notifyRetryInterval is how long we wait for a secondary to acknowledge a
+// NOTIFY before sending it again, doubling each time.
+const notifyRetryInterval = 2 * time.Second
+
+// Reload reads the zone's master file at path again, reporting whether it
+// changed. The new records are only taken if their serial is greater than
+// the zone's, so secondaries comparing serials will see the change.
+func (z *Zone) Reload(path string) (bool, error) {
+	next, err := LoadZone(path, z.Origin)
+	if err != nil {
+		return false, err
+	}
+	_, soa := next.SOA()
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if _, current := z.SOA(); current != nil && !serialGreater(soa.Serial, current.Serial) {
+		return false, nil
+	}
+	previous := z.Records
+	z.Records = next.Records
+	if z.signer != nil {
+		if err := z.sign(z.signer); err != nil {
+			z.Records = previous
+			return false, err
+		}
+	}
+	z.recordChange(previous)
+	return true, nil
+}
+
+// serial returns the zone's current SOA serial.
+func (z *Zone) serial() uint32 {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	if _, soa := z.SOA(); soa != nil {
+		return soa.Serial
+	}
+	return 0
+}
+
+// notifySecondaries tells the zone's secondaries that it has changed, as
+// described in RFC 1996, so they don't have to wait for their next refresh.
+// Each is sent a NOTIFY in the background until it acknowledges it.
+func (s *Server) notifySecondaries(z *Zone) {
+	z.mu.RLock()
+	soaRR, _ := z.SOA()
+	z.mu.RUnlock()
+	for _, addr := range s.notifyTargets(z) {
+		go sendNotify(z.Origin, soaRR, addr)
+	}
+}
+
+// notifyTargets lists where to send NOTIFYs for z: the servers named in its NS
+// records, apart from the primary named in its SOA, and any others it's
+// configured with.
+func (s *Server) notifyTargets(z *Zone) []string {
+	z.mu.RLock()
+	_, soa := z.SOA()
+	ns := z.RRset(z.Origin, TypeNS)
+	z.mu.RUnlock()
+
+	seen := map[string]bool{}
+	var targets []string
+	add := func(addr string) {
+		if !seen[addr] {
+			seen[addr] = true
+			targets = append(targets, addr)
+		}
+	}
+	for _, rr := range ns {
+		target := &NS{}
+		if target.Unpack(rr.Data) != nil || (soa != nil && target.Target.Equal(soa.MName)) {
+			continue
+		}
+		for _, ip := range s.addressesOf(target.Target) {
+			add(net.JoinHostPort(ip.String(), "53"))
+		}
+	}
+	for _, addr := range z.AlsoNotify {
+		add(addr)
+	}
+	return targets
+}
+
+// addressesOf finds the addresses of a name server, from our own zones if
+// it's in one of them and otherwise by resolving it.
+func (s *Server) addressesOf(name Name) []net.IP {
+	var records []ResourceRecord
+	if z := s.findZone(name); z != nil {
+		z.mu.RLock()
+		records = append(z.RRset(name, TypeA), z.RRset(name, TypeAAAA)...)
+		z.mu.RUnlock()
+	} else if s.cli != nil {
+		for _, t := range []Type{TypeA, TypeAAAA} {
+			resp, _, err := s.resolve(Question{Name: name, Type: t, Class: ClassIN}, false)
+			if err != nil {
+				log.Printf("finding %s to notify it: %v", name, err)
+				continue
+			}
+			records = append(records, filterName(resp.Answer, finalName(Question{Name: name, Type: t}, resp.Answer))...)
+		}
+	}
+	var ips []net.IP
+	for _, rr := range records {
+		switch rr.Type {
+		case TypeA:
+			a := &A{}
+			if a.Unpack(rr.Data) == nil {
+				ips = append(ips, a.IP)
+			}
+		case TypeAAAA:
+			aaaa := &AAAA{}
+			if aaaa.Unpack(rr.Data) == nil {
+				ips = append(ips, aaaa.IP)
+			}
+		}
+	}
+	return ips
+}
+
+// sendNotify sends a NOTIFY for a zone to addr, trying again with a growing
+// wait until it's acknowledged or we run out of attempts. The SOA goes in the
+// answer section as a hint, which RFC 1996 section 3.7 allows.
+func sendNotify(origin Name, soa ResourceRecord, addr string) {
+	serial := &SOA{}
+	serial.Unpack(soa.Data)
+	cli, err := NewClient(addr)
+	if err != nil {
+		log.Printf("notifying %s of %s: %v", addr, origin, err)
+		return
+	}
+	m := Message{
+		ID:                  randomID(),
+		OpCode:              OpCodeNotify,
+		AuthoritativeAnswer: true,
+		Questions:           []Question{{Name: origin, Type: TypeSOA, Class: ClassIN}},
+		Answer:              []ResourceRecord{soa},
+	}
+	m.updateCounts()
+	wait := notifyRetryInterval
+	for attempt := 1; ; attempt++ {
+		resp, err := cli.Exchange(m)
+		if err == nil && (!resp.IsResponse || resp.OpCode != OpCodeNotify || resp.ID != m.ID) {
+			err = fmt.Errorf("unexpected response %v", resp)
+		} else if err == nil && resp.ResponseCode != ResponseCodeOk {
+			err = fmt.Errorf("answered %v", resp.ResponseCode)
+		}
+		if err == nil {
+			log.Printf("notified %s of %s serial %d", addr, origin, serial.Serial)
+			return
+		}
+		if attempt == notifyAttempts {
+			log.Printf("giving up notifying %s of %s serial %d after %d attempts: %v", addr, origin, serial.Serial, attempt, err)
+			return
+		}
+		log.Printf("notifying %s of %s: %v, trying again in %v", addr, origin, err, wait)
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
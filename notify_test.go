@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestNotifyTargets(t *testing.T) {
+	s := &Server{}
+	z := mustParseZone(t, testZone+`
+@	IN NS ns2
+@	IN NS ns3.example.org.
+ns2	IN A 192.0.2.2
+ns2	IN AAAA 2001:db8::2
+`, "example.com")
+	z.AlsoNotify = []string{"198.51.100.9:5300", "192.0.2.2:53"}
+	s.AddZone(z)
+
+	// ns1 is the primary named in the SOA, and ns3 is out of the zone with no
+	// resolver to find it
+	expected := []string{"192.0.2.2:53", "[2001:db8::2]:53", "198.51.100.9:5300"}
+	if diff := cmp.Diff(expected, s.notifyTargets(z)); diff != "" {
+		t.Errorf("unexpected targets (-want +got):\n%s", diff)
+	}
+}
+
+func TestNotifyOnUpdate(t *testing.T) {
+	// The secondary's primary is on the same address as the primary's
+	// NOTIFY comes from, so it's listened to
+	sec, err := NewSecondary(MustParseName("example.com"), []string{"127.0.0.1:53"}, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, secondaryAddr := startPrimary(t, sec.Zone, nil)
+
+	z := mustParseZone(t, testZone, "example.com")
+	z.Updates, _ = ParseUpdatePolicy("127.0.0.1")
+	z.AlsoNotify = []string{secondaryAddr}
+	s := &Server{}
+	s.AddZone(z)
+	update := Message{
+		OpCode:    OpCodeUpdate,
+		Questions: []Question{{Name: MustParseName("example.com"), Type: TypeSOA, Class: ClassIN}},
+		Authority: testRecords(t, "new.example.com. 300 IN A 192.0.2.99"),
+	}
+	if rcode := s.handle(update, client{addr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}}).ResponseCode; rcode != ResponseCodeOk {
+		t.Fatalf("update failed with %v", rcode)
+	}
+	select {
+	case <-sec.notify:
+	case <-time.After(5 * time.Second):
+		t.Error("expected the secondary to be notified of the update")
+	}
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "example.com.zone")
+	if err := os.WriteFile(path, []byte(testZone), 0644); err != nil {
+		t.Fatal(err)
+	}
+	z, err := LoadZone(path, MustParseName("example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type Test struct {
+		Description string
+		Data        string
+		Changed     bool
+		Serial      uint32
+	}
+	tests := []Test{
+		{"Same serial", testZone + "new A 192.0.2.99\n", false, 2020010101},
+		{"New serial", strings.Replace(testZone, "2020010101", "2020010102", 1) + "new A 192.0.2.99\n", true, 2020010102},
+		{"Older serial", testZone, false, 2020010102},
+	}
+	for _, test := range tests {
+		if err := os.WriteFile(path, []byte(test.Data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		changed, err := z.Reload(path)
+		if err != nil {
+			t.Fatalf("%s: %v", test.Description, err)
+		}
+		if changed != test.Changed || z.serial() != test.Serial {
+			t.Errorf("%s: expected changed %v with serial %d, got %v with %d", test.Description, test.Changed, test.Serial, changed, z.serial())
+		}
+	}
+	if len(z.RRset(MustParseName("new.example.com"), TypeA)) != 1 {
+		t.Error("expected the reloaded zone to have the new record")
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Circuit breaking and health probing for upstreams. After breakerThreshold
+// failures in a row an upstream is left alone for breakerCooldown, doubling
+// each time a trial query fails, up to maxBreakerCooldown.
+const (
+	breakerThreshold   = 3
+	breakerCooldown    = 30 * time.Second
+	maxBreakerCooldown = 5 * time.Minute
+	probeInterval      = 10 * time.Second
+)
+
+// upstreamStats counts the queries each upstream has been sent, how many of
+// them failed, and how many races it won. An upstream that's in more than one
+// pool shares its counters between them.
+var (
+	upstreamStats   = expvar.NewMap("upstreams")
+	upstreamStatsMu sync.Mutex
+)
+
+// statsFor returns the counters for server, creating them the first time.
+func statsFor(server string) *expvar.Map {
+	upstreamStatsMu.Lock()
+	defer upstreamStatsMu.Unlock()
+	if stats, ok := upstreamStats.Get(server).(*expvar.Map); ok {
+		return stats
+	}
+	stats := new(expvar.Map).Init()
+	upstreamStats.Set(server, stats)
+	return stats
+}
+
+// Strategy is how a Pool picks which of its upstreams to ask first.
+type Strategy int
+
+const (
+	// RoundRobin takes turns, spreading queries evenly
+	RoundRobin Strategy = iota
+	// Random picks an upstream at random for each query
+	Random
+	// LowestLatency asks whichever upstream has been answering fastest
+	LowestLatency
+	// StrictOrder always asks the first healthy upstream in the order
+	// they were given, keeping the rest as backups
+	StrictOrder
+)
+
+// ParseStrategy reads a strategy as given on the command line.
+func ParseStrategy(s string) (Strategy, error) {
+	switch s {
+	case "round-robin":
+		return RoundRobin, nil
+	case "random":
+		return Random, nil
+	case "lowest-latency":
+		return LowestLatency, nil
+	case "strict-order":
+		return StrictOrder, nil
+	}
+	return 0, fmt.Errorf("unknown strategy %q, expected round-robin, random, lowest-latency or strict-order", s)
+}
+
+// poolUpstream is one of a pool's upstreams and what we know of its health.
+type poolUpstream struct {
+	name string
+	cli  *Client
+	// latency is a moving average of how long it takes to answer, or zero
+	// until it has
+	latency time.Duration
+	// failures counts the queries that have failed since the last one that
+	// didn't
+	failures int
+	// openUntil is when the circuit breaker next lets a query through, and
+	// is zero while the upstream is healthy
+	openUntil time.Time
+	cooldown  time.Duration
+	stats     *expvar.Map
+}
+
+// Pool sends queries to whichever of several upstream servers is healthy,
+// failing over to the others when one doesn't answer. Upstreams that keep
+// failing are taken out of rotation until a health probe or a trial query
+// finds them answering again.
+type Pool struct {
+	Strategy Strategy
+	// DNSSEC asks upstreams to include DNSSEC records in their answers,
+	// and to leave checking them to us
+	DNSSEC bool
+	// Race, if it's more than one, sends each query to that many
+	// upstreams at once and takes the first good answer. Stagger holds
+	// each one back that much longer than the one before, so that a quick
+	// answer saves sending the rest at all.
+	Race    int
+	Stagger time.Duration
+	now     func() time.Time
+
+	mu        sync.Mutex
+	upstreams []*poolUpstream
+	next      int
+}
+
+// NewPool creates a pool of upstreams, each given as NewClient takes them.
+func NewPool(servers []string, strategy Strategy) (*Pool, error) {
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no upstream servers")
+	}
+	p := &Pool{Strategy: strategy, now: time.Now}
+	for _, server := range servers {
+		cli, err := NewClient(server)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %s: %v", server, err)
+		}
+		p.upstreams = append(p.upstreams, &poolUpstream{name: server, cli: cli, stats: statsFor(server)})
+	}
+	return p, nil
+}
+
+// Resolve asks the pool's upstreams to resolve q.
+func (p *Pool) Resolve(q Question) (Message, error) {
+	m, err := p.Exchange(newQuery(q, p.DNSSEC))
+	restoreCase(&m, q)
+	return m, err
+}
+
+// Exchange sends m to the upstreams in the order the strategy picks until one
+// of them answers. A SERVFAIL may be down to the upstream rather than the
+// name, so it's only passed on if none of the others do better.
+func (p *Pool) Exchange(m Message) (Message, error) {
+	upstreams := p.order()
+	var lastErr error
+	var failed *Message
+	if p.Race > 1 {
+		n := min(p.Race, len(upstreams))
+		resp, err := p.race(m, upstreams[:n])
+		if (err == nil && resp.ResponseCode != ResponseCodeServerFailure) || n == len(upstreams) {
+			return resp, err
+		}
+		// Every racer failed, so the rest get their turn one at a time,
+		// with the racers' SERVFAIL kept in case they do no better
+		if err == nil {
+			failed = &resp
+		}
+		lastErr = err
+		upstreams = upstreams[n:]
+	}
+	for _, u := range upstreams {
+		start := p.now()
+		resp, err := u.cli.Exchange(m)
+		p.record(u, p.now().Sub(start), err)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.ResponseCode == ResponseCodeServerFailure {
+			failed = &resp
+			continue
+		}
+		return resp, nil
+	}
+	if failed != nil {
+		return *failed, nil
+	}
+	return Message{}, fmt.Errorf("no upstream answered: %v", lastErr)
+}
+
+// race sends m to all of upstreams at once, or staggered if the pool says to,
+// and returns the first answer that isn't a SERVFAIL. The queries still
+// waiting for an answer are given up on then.
+func (p *Pool) race(m Message, upstreams []*poolUpstream) (Message, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	type result struct {
+		u    *poolUpstream
+		resp Message
+		err  error
+	}
+	results := make(chan result, len(upstreams))
+	for i, u := range upstreams {
+		go func() {
+			if i > 0 && p.Stagger > 0 {
+				select {
+				case <-time.After(time.Duration(i) * p.Stagger):
+				case <-ctx.Done():
+					results <- result{u: u, err: ctx.Err()}
+					return
+				}
+			}
+			start := p.now()
+			resp, err := u.cli.ExchangeContext(ctx, m)
+			// Losing a race says nothing about an upstream's health
+			if err == nil || ctx.Err() == nil {
+				p.record(u, p.now().Sub(start), err)
+			}
+			results <- result{u, resp, err}
+		}()
+	}
+	var lastErr error
+	var failed *Message
+	for range upstreams {
+		r := <-results
+		if r.err != nil {
+			lastErr = r.err
+			continue
+		}
+		if r.resp.ResponseCode == ResponseCodeServerFailure {
+			failed = &r.resp
+			continue
+		}
+		r.u.stats.Add("race_wins", 1)
+		return r.resp, nil
+	}
+	if failed != nil {
+		return *failed, nil
+	}
+	return Message{}, fmt.Errorf("no upstream answered: %v", lastErr)
+}
+
+// order returns the upstreams to try for the next query. Those whose circuit
+// breaker is open come last, in case all the others fail too.
+func (p *Pool) order() []*poolUpstream {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.now()
+	var healthy, broken []*poolUpstream
+	for _, u := range p.upstreams {
+		// Once the cooldown is over the upstream gets a trial query,
+		// which closes the breaker if it succeeds
+		if now.Before(u.openUntil) {
+			broken = append(broken, u)
+		} else {
+			healthy = append(healthy, u)
+		}
+	}
+	switch p.Strategy {
+	case RoundRobin:
+		if len(healthy) > 0 {
+			i := p.next % len(healthy)
+			healthy = append(healthy[i:], healthy[:i]...)
+			p.next++
+		}
+	case Random:
+		rand.Shuffle(len(healthy), func(i, j int) {
+			healthy[i], healthy[j] = healthy[j], healthy[i]
+		})
+	case LowestLatency:
+		// Upstreams we haven't timed yet go first, so that they get timed
+		sort.SliceStable(healthy, func(i, j int) bool {
+			return healthy[i].latency < healthy[j].latency
+		})
+	}
+	return append(healthy, broken...)
+}
+
+// record updates what we know of u after a query that took rtt and failed if
+// err is set.
+func (p *Pool) record(u *poolUpstream, rtt time.Duration, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	u.stats.Add("queries", 1)
+	if err == nil {
+		if !u.openUntil.IsZero() {
+			log.Printf("upstream %s is answering again", u.name)
+		}
+		u.failures, u.openUntil, u.cooldown = 0, time.Time{}, 0
+		if u.latency == 0 {
+			u.latency = rtt
+		} else {
+			u.latency = (4*u.latency + rtt) / 5
+		}
+		return
+	}
+	u.stats.Add("failures", 1)
+	u.failures++
+	if u.failures < breakerThreshold {
+		return
+	}
+	if u.cooldown == 0 {
+		u.cooldown = breakerCooldown
+		log.Printf("upstream %s failed %d times in a row, leaving it alone for %v: %v", u.name, u.failures, u.cooldown, err)
+	} else {
+		u.cooldown = min(2*u.cooldown, maxBreakerCooldown)
+	}
+	u.openUntil = p.now().Add(u.cooldown)
+}
+
+// Run probes the upstreams every probeInterval. It never returns, so it
+// should be called in its own goroutine.
+func (p *Pool) Run() {
+	for range time.Tick(probeInterval) {
+		p.probe()
+	}
+}
+
+// probe asks each upstream for the root's NS records, so that failures are
+// noticed before clients' queries run into them, and upstreams that have
+// come back are put back into rotation without waiting out their cooldown.
+func (p *Pool) probe() {
+	var wg sync.WaitGroup
+	for _, u := range p.upstreams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := p.now()
+			resp, err := u.cli.Exchange(newQuery(Question{Name: Name{}, Type: TypeNS, Class: ClassIN}, false))
+			if err == nil && resp.ResponseCode == ResponseCodeServerFailure {
+				err = fmt.Errorf("probe got %v", resp.ResponseCode)
+			}
+			p.record(u, p.now().Sub(start), err)
+		}()
+	}
+	wg.Wait()
+}
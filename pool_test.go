@@ -0,0 +1,245 @@
+package main
+
+import (
+	"expvar"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// startUpstream serves the test zone on addr, along with a root zone for
+// health probes to ask about.
+func startUpstream(t *testing.T, addr string) string {
+	s, err := NewServer(addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.AddZone(mustParseZone(t, testZone, "example.com"))
+	s.AddZone(mustParseZone(t, testZone, "."))
+	go s.Listen()
+	t.Cleanup(func() { s.Close() })
+	return s.conn.LocalAddr().String()
+}
+
+// deadAddr returns an address nothing is listening on.
+func deadAddr(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().String()
+}
+
+func TestPoolOrder(t *testing.T) {
+	type Test struct {
+		Description string
+		Strategy    Strategy
+		Expected    [][]string
+	}
+	tests := []Test{
+		{"Strict order", StrictOrder, [][]string{{"a", "b", "c", "d"}, {"a", "b", "c", "d"}}},
+		{"Round robin", RoundRobin, [][]string{{"a", "b", "c", "d"}, {"b", "c", "a", "d"}, {"c", "a", "b", "d"}}},
+		{"Lowest latency", LowestLatency, [][]string{{"c", "b", "a", "d"}}},
+	}
+	now := time.Now()
+	for _, test := range tests {
+		p := &Pool{Strategy: test.Strategy, now: func() time.Time { return now }}
+		for i, name := range []string{"a", "b", "c", "d"} {
+			p.upstreams = append(p.upstreams, &poolUpstream{name: name, latency: time.Duration(30-10*i) * time.Millisecond})
+		}
+		// d's circuit is open, so it's only there as a last resort
+		p.upstreams[3].openUntil = now.Add(time.Second)
+		for i, expected := range test.Expected {
+			var got []string
+			for _, u := range p.order() {
+				got = append(got, u.name)
+			}
+			if diff := cmp.Diff(expected, got); diff != "" {
+				t.Errorf("%s: query %d: unexpected order (-want +got):\n%s", test.Description, i, diff)
+			}
+		}
+	}
+}
+
+func TestPoolFailover(t *testing.T) {
+	dead := deadAddr(t)
+	live := startUpstream(t, "127.0.0.1:0")
+	p, err := NewPool([]string{dead, live}, StrictOrder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	www := Question{Name: MustParseName("www.example.com"), Type: TypeA, Class: ClassIN}
+	first := func() string {
+		return p.order()[0].name
+	}
+
+	for i := 0; i < breakerThreshold; i++ {
+		m, err := p.Resolve(www)
+		if err != nil || len(m.Answer) != 1 {
+			t.Fatalf("expected the live upstream to answer, got %v, %v", m.Answer, err)
+		}
+	}
+	if got := first(); got != live {
+		t.Errorf("expected the dead upstream's circuit to open, but %s is still first", got)
+	}
+
+	// The next probe notices when the upstream comes back
+	startUpstream(t, dead)
+	p.probe()
+	if got := first(); got != dead {
+		t.Errorf("expected the revived upstream to be first again, got %s", got)
+	}
+
+	// Another pool with the same upstream counts its queries in the same
+	// place
+	other, err := NewPool([]string{live}, RoundRobin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.upstreams[0].stats != p.upstreams[1].stats {
+		t.Error("expected pools to share an upstream's counters")
+	}
+
+	// With every upstream down, queries still fail
+	p, err = NewPool([]string{deadAddr(t)}, RoundRobin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Resolve(www); err == nil {
+		t.Error("expected an error with no upstreams answering")
+	}
+}
+
+func TestForward(t *testing.T) {
+	p, err := NewPool([]string{deadAddr(t), startUpstream(t, "127.0.0.1:0")}, RoundRobin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{rules: []*ForwardRule{{Suffix: Name{}, Pool: p}}}
+	for i := 0; i < 2; i++ {
+		ans := s.handle(Message{RecursionDesired: true, Questions: []Question{{Name: MustParseName("www.example.com"), Type: TypeA, Class: ClassIN}}}, client{})
+		if ans.ResponseCode != ResponseCodeOk || len(ans.Answer) != 1 || !ans.RecursionAvailable {
+			t.Errorf("expected a forwarded answer, got %v with %d records", ans.ResponseCode, len(ans.Answer))
+		}
+	}
+}
+
+// blackhole returns an address that takes queries and never answers them,
+// along with a count of how many it's had.
+func blackhole(t *testing.T) (string, *atomic.Int32) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	var count atomic.Int32
+	go func() {
+		buf := make([]byte, maxBufferSize)
+		for {
+			if _, _, err := conn.ReadFrom(buf); err != nil {
+				return
+			}
+			count.Add(1)
+		}
+	}()
+	return conn.LocalAddr().String(), &count
+}
+
+func TestPoolRace(t *testing.T) {
+	live := startUpstream(t, "127.0.0.1:0")
+	// This one answers SERVFAIL, since it can't reach its own upstream
+	failing, err := NewServer("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead, err := NewPool([]string{deadAddr(t)}, RoundRobin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failing.rules = []*ForwardRule{{Suffix: Name{}, Pool: dead}}
+	go failing.Listen()
+	defer failing.Close()
+
+	type Test struct {
+		Description string
+		Upstreams   []string
+		Stagger     time.Duration
+		Winner      string
+		// Sent is how many queries the blackhole expects
+		Sent int32
+	}
+	tests := []Test{
+		{"Fastest answer wins", []string{"blackhole", live}, 0, live, 1},
+		{"SERVFAIL doesn't win", []string{failing.conn.LocalAddr().String(), live}, 0, live, 0},
+		{"A quick answer saves sending the rest", []string{live, "blackhole"}, time.Second, live, 0},
+	}
+	for _, test := range tests {
+		hole, sent := blackhole(t)
+		var servers []string
+		for _, s := range test.Upstreams {
+			if s == "blackhole" {
+				s = hole
+			}
+			servers = append(servers, s)
+		}
+		p, err := NewPool(servers, StrictOrder)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Race, p.Stagger = len(servers), test.Stagger
+		// The live upstream's counters carry over from the tests before
+		wins := func(u *poolUpstream) int64 {
+			v, _ := u.stats.Get("race_wins").(*expvar.Int)
+			if v == nil {
+				return 0
+			}
+			return v.Value()
+		}
+		before := map[string]int64{}
+		for _, u := range p.upstreams {
+			before[u.name] = wins(u)
+		}
+
+		start := time.Now()
+		m, err := p.Resolve(Question{Name: MustParseName("www.example.com"), Type: TypeA, Class: ClassIN})
+		if err != nil || len(m.Answer) != 1 {
+			t.Errorf("%s: expected an answer, got %v, %v", test.Description, m.Answer, err)
+			continue
+		}
+		if elapsed := time.Since(start); elapsed > queryTimeout/2 {
+			t.Errorf("%s: expected a quick answer, took %v", test.Description, elapsed)
+		}
+		// Let the losers finish giving up
+		time.Sleep(10 * time.Millisecond)
+		p.mu.Lock()
+		for _, u := range p.upstreams {
+			won := wins(u) - before[u.name]
+			if (won == 1) != (u.name == test.Winner) {
+				t.Errorf("%s: expected %s to win, but %s won %d", test.Description, test.Winner, u.name, won)
+			}
+			// Giving up on the losers doesn't count against them
+			if u.failures != 0 {
+				t.Errorf("%s: expected no failures for %s, got %d", test.Description, u.name, u.failures)
+			}
+		}
+		p.mu.Unlock()
+		if got := sent.Load(); got != test.Sent {
+			t.Errorf("%s: expected the blackhole to get %d queries, got %d", test.Description, test.Sent, got)
+		}
+	}
+
+	// When nothing does better, the racers' SERVFAIL is still the answer
+	p, err := NewPool([]string{failing.conn.LocalAddr().String(), deadAddr(t), deadAddr(t)}, StrictOrder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Race = 2
+	m, err := p.Resolve(Question{Name: MustParseName("www.example.com"), Type: TypeA, Class: ClassIN})
+	if err != nil || m.ResponseCode != ResponseCodeServerFailure {
+		t.Errorf("expected the racers' SERVFAIL, got %v, %v", m.ResponseCode, err)
+	}
+}
@@ -0,0 +1,900 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// RData is the typed form of a resource record's data. ResourceRecord.Data
+// always holds the uncompressed wire format; an RData is a view of it that
+// knows how to read and print the presentation format used in zone files.
+type RData interface {
+	// Pack encodes the data in uncompressed wire format.
+	Pack() []byte
+	// Unpack decodes data in uncompressed wire format.
+	Unpack(data []byte) error
+	// Parse reads the presentation format fields of a record. Relative names
+	// are taken to be relative to origin.
+	Parse(fields []string, origin Name) error
+	// String returns the data in presentation format.
+	String() string
+}
+
+// rdataTypes holds the types we know the layout of. Anything else is handled
+// as an UnknownRData.
+var rdataTypes = map[Type]func() RData{
+	TypeA:          func() RData { return new(A) },
+	TypeNS:         func() RData { return new(NS) },
+	TypeCName:      func() RData { return new(CNAME) },
+	TypeSOA:        func() RData { return new(SOA) },
+	TypePTR:        func() RData { return new(PTR) },
+	TypeMX:         func() RData { return new(MX) },
+	TypeTXT:        func() RData { return new(TXT) },
+	TypeAAAA:       func() RData { return new(AAAA) },
+	TypeSRV:        func() RData { return new(SRV) },
+	TypeNAPTR:      func() RData { return new(NAPTR) },
+	TypeDS:         func() RData { return new(DS) },
+	TypeSSHFP:      func() RData { return new(SSHFP) },
+	TypeRRSIG:      func() RData { return new(RRSIG) },
+	TypeNSEC:       func() RData { return new(NSEC) },
+	TypeDNSKEY:     func() RData { return new(DNSKEY) },
+	TypeCDS:        func() RData { return new(DS) },
+	TypeCDNSKEY:    func() RData { return new(DNSKEY) },
+	TypeNSEC3:      func() RData { return new(NSEC3) },
+	TypeNSEC3PARAM: func() RData { return new(NSEC3PARAM) },
+	TypeTLSA:       func() RData { return new(TLSA) },
+	TypeSVCB:       func() RData { return new(SVCB) },
+	TypeHTTPS:      func() RData { return new(HTTPS) },
+	TypeCAA:        func() RData { return new(CAA) },
+	TypeTSIG:       func() RData { return new(TSIG) },
+}
+
+func newRData(t Type) RData {
+	if f, ok := rdataTypes[t]; ok {
+		return f()
+	}
+	return new(UnknownRData)
+}
+
+// RData decodes the record's data according to its type.
+func (rr ResourceRecord) RData() (RData, error) {
+	rd := newRData(rr.Type)
+	if err := rd.Unpack(rr.Data); err != nil {
+		return nil, fmt.Errorf("decoding %s data: %v", rr.Type, err)
+	}
+	return rd, nil
+}
+
+// ParseRData converts the presentation format fields of a record of type t
+// into wire format. The generic \# syntax from RFC 3597 is accepted for every
+// type, and is the only syntax accepted for types we don't know.
+func ParseRData(t Type, fields []string, origin Name) ([]byte, error) {
+	if len(fields) > 0 && fields[0] == `\#` {
+		var u UnknownRData
+		if err := u.Parse(fields, origin); err != nil {
+			return nil, err
+		}
+		// Make sure a known type written generically is still well formed
+		if _, known := rdataTypes[t]; known {
+			if err := newRData(t).Unpack(u.Data); err != nil {
+				return nil, fmt.Errorf("generic %s data: %v", t, err)
+			}
+		}
+		return u.Data, nil
+	}
+	rd := newRData(t)
+	if err := rd.Parse(fields, origin); err != nil {
+		return nil, fmt.Errorf("%s: %v", t, err)
+	}
+	return rd.Pack(), nil
+}
+
+// String returns the record in presentation format.
+func (rr ResourceRecord) String() string {
+	return rr.format(rr.Name.String())
+}
+
+// DisplayString is like String but renders the owner name in Unicode.
+func (rr ResourceRecord) DisplayString() string {
+	return rr.format(rr.Name.DisplayString())
+}
+
+func (rr ResourceRecord) format(owner string) string {
+	var data string
+	if rd, err := rr.RData(); err == nil {
+		data = rd.String()
+	} else {
+		data = (&UnknownRData{Data: rr.Data}).String()
+	}
+	return fmt.Sprintf("%s\t%d\t%s\t%s\t%s", owner, rr.TTL, rr.Class, rr.Type, data)
+}
+
+// UnknownRData is the data of a record whose type we don't know. It's printed
+// and parsed using the \# syntax from RFC 3597.
+type UnknownRData struct {
+	Data []byte
+}
+
+func (u *UnknownRData) Pack() []byte {
+	return u.Data
+}
+
+func (u *UnknownRData) Unpack(data []byte) error {
+	u.Data = data
+	return nil
+}
+
+func (u *UnknownRData) Parse(fields []string, origin Name) error {
+	if len(fields) < 2 || fields[0] != `\#` {
+		return errors.New(`data of an unknown type must use the \# syntax`)
+	}
+	n, err := strconv.ParseUint(fields[1], 10, 16)
+	if err != nil {
+		return fmt.Errorf("bad \\# length %q", fields[1])
+	}
+	data, err := parseHex(fields[2:])
+	if err != nil {
+		return err
+	}
+	if len(data) != int(n) {
+		return fmt.Errorf("\\# length is %d but there are %d octets of data", n, len(data))
+	}
+	u.Data = data
+	return nil
+}
+
+func (u *UnknownRData) String() string {
+	if len(u.Data) == 0 {
+		return `\# 0`
+	}
+	return fmt.Sprintf(`\# %d %s`, len(u.Data), hex.EncodeToString(u.Data))
+}
+
+type A struct {
+	IP net.IP
+}
+
+func (a *A) Pack() []byte {
+	return []byte(a.IP.To4())
+}
+
+func (a *A) Unpack(data []byte) error {
+	if len(data) != net.IPv4len {
+		return fmt.Errorf("expected %d octets, got %d", net.IPv4len, len(data))
+	}
+	a.IP = net.IP(data)
+	return nil
+}
+
+func (a *A) Parse(fields []string, origin Name) error {
+	if len(fields) != 1 {
+		return errors.New("expected an address")
+	}
+	ip := net.ParseIP(fields[0])
+	if ip == nil || ip.To4() == nil {
+		return fmt.Errorf("bad IPv4 address %q", fields[0])
+	}
+	a.IP = ip.To4()
+	return nil
+}
+
+func (a *A) String() string {
+	return a.IP.String()
+}
+
+type AAAA struct {
+	IP net.IP
+}
+
+func (a *AAAA) Pack() []byte {
+	return []byte(a.IP.To16())
+}
+
+func (a *AAAA) Unpack(data []byte) error {
+	if len(data) != net.IPv6len {
+		return fmt.Errorf("expected %d octets, got %d", net.IPv6len, len(data))
+	}
+	a.IP = net.IP(data)
+	return nil
+}
+
+func (a *AAAA) Parse(fields []string, origin Name) error {
+	if len(fields) != 1 {
+		return errors.New("expected an address")
+	}
+	ip := net.ParseIP(fields[0])
+	if ip == nil || !strings.Contains(fields[0], ":") {
+		return fmt.Errorf("bad IPv6 address %q", fields[0])
+	}
+	a.IP = ip.To16()
+	return nil
+}
+
+func (a *AAAA) String() string {
+	// net.IP would print a v4-mapped address as plain IPv4, which we couldn't
+	// read back in as an AAAA record
+	if v4 := a.IP.To4(); v4 != nil {
+		return "::ffff:" + v4.String()
+	}
+	return a.IP.String()
+}
+
+// nameRData is the layout shared by every type whose data is a single name.
+type nameRData struct {
+	Target Name
+}
+
+func (n *nameRData) Pack() []byte {
+	var buf bytes.Buffer
+	writeName(&buf, n.Target)
+	return buf.Bytes()
+}
+
+func (n *nameRData) Unpack(data []byte) error {
+	r := newWireReader(data)
+	n.Target = r.name()
+	return r.finish()
+}
+
+func (n *nameRData) Parse(fields []string, origin Name) error {
+	if len(fields) != 1 {
+		return errors.New("expected a name")
+	}
+	var err error
+	n.Target, err = parseRelativeName(fields[0], origin)
+	return err
+}
+
+func (n *nameRData) String() string {
+	return n.Target.String()
+}
+
+type NS struct{ nameRData }
+
+type CNAME struct{ nameRData }
+
+type PTR struct{ nameRData }
+
+type SOA struct {
+	MName   Name
+	RName   Name
+	Serial  uint32
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	Minimum uint32
+}
+
+func (s *SOA) Pack() []byte {
+	var buf bytes.Buffer
+	writeName(&buf, s.MName)
+	writeName(&buf, s.RName)
+	binary.Write(&buf, binary.BigEndian, s.Serial)
+	binary.Write(&buf, binary.BigEndian, s.Refresh)
+	binary.Write(&buf, binary.BigEndian, s.Retry)
+	binary.Write(&buf, binary.BigEndian, s.Expire)
+	binary.Write(&buf, binary.BigEndian, s.Minimum)
+	return buf.Bytes()
+}
+
+func (s *SOA) Unpack(data []byte) error {
+	r := newWireReader(data)
+	s.MName = r.name()
+	s.RName = r.name()
+	s.Serial = r.uint32()
+	s.Refresh = r.uint32()
+	s.Retry = r.uint32()
+	s.Expire = r.uint32()
+	s.Minimum = r.uint32()
+	return r.finish()
+}
+
+func (s *SOA) Parse(fields []string, origin Name) error {
+	if len(fields) != 7 {
+		return errors.New("expected mname, rname, serial, refresh, retry, expire and minimum")
+	}
+	var err error
+	if s.MName, err = parseRelativeName(fields[0], origin); err != nil {
+		return err
+	}
+	if s.RName, err = parseRelativeName(fields[1], origin); err != nil {
+		return err
+	}
+	if s.Serial, err = parseUint32(fields[2]); err != nil {
+		return err
+	}
+	if s.Refresh, err = parseTTL(fields[3]); err != nil {
+		return err
+	}
+	if s.Retry, err = parseTTL(fields[4]); err != nil {
+		return err
+	}
+	if s.Expire, err = parseTTL(fields[5]); err != nil {
+		return err
+	}
+	s.Minimum, err = parseTTL(fields[6])
+	return err
+}
+
+func (s *SOA) String() string {
+	return fmt.Sprintf("%s %s %d %d %d %d %d", s.MName, s.RName, s.Serial, s.Refresh, s.Retry, s.Expire, s.Minimum)
+}
+
+type MX struct {
+	Preference uint16
+	Exchange   Name
+}
+
+func (m *MX) Pack() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, m.Preference)
+	writeName(&buf, m.Exchange)
+	return buf.Bytes()
+}
+
+func (m *MX) Unpack(data []byte) error {
+	r := newWireReader(data)
+	m.Preference = r.uint16()
+	m.Exchange = r.name()
+	return r.finish()
+}
+
+func (m *MX) Parse(fields []string, origin Name) error {
+	if len(fields) != 2 {
+		return errors.New("expected a preference and an exchange")
+	}
+	var err error
+	if m.Preference, err = parseUint16(fields[0]); err != nil {
+		return err
+	}
+	m.Exchange, err = parseRelativeName(fields[1], origin)
+	return err
+}
+
+func (m *MX) String() string {
+	return fmt.Sprintf("%d %s", m.Preference, m.Exchange)
+}
+
+type TXT struct {
+	Strings [][]byte
+}
+
+func (t *TXT) Pack() []byte {
+	var buf bytes.Buffer
+	for _, s := range t.Strings {
+		writeCharString(&buf, s)
+	}
+	return buf.Bytes()
+}
+
+func (t *TXT) Unpack(data []byte) error {
+	r := newWireReader(data)
+	t.Strings = nil
+	for r.err == nil && r.len() > 0 {
+		t.Strings = append(t.Strings, r.charString())
+	}
+	return r.finish()
+}
+
+func (t *TXT) Parse(fields []string, origin Name) error {
+	if len(fields) == 0 {
+		return errors.New("expected at least one string")
+	}
+	t.Strings = nil
+	for _, f := range fields {
+		s, err := parseCharString(f)
+		if err != nil {
+			return err
+		}
+		t.Strings = append(t.Strings, s)
+	}
+	return nil
+}
+
+func (t *TXT) String() string {
+	quoted := make([]string, len(t.Strings))
+	for i, s := range t.Strings {
+		quoted[i] = formatCharString(s)
+	}
+	return strings.Join(quoted, " ")
+}
+
+type SRV struct {
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+	Target   Name
+}
+
+func (s *SRV) Pack() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, s.Priority)
+	binary.Write(&buf, binary.BigEndian, s.Weight)
+	binary.Write(&buf, binary.BigEndian, s.Port)
+	writeName(&buf, s.Target)
+	return buf.Bytes()
+}
+
+func (s *SRV) Unpack(data []byte) error {
+	r := newWireReader(data)
+	s.Priority = r.uint16()
+	s.Weight = r.uint16()
+	s.Port = r.uint16()
+	s.Target = r.name()
+	return r.finish()
+}
+
+func (s *SRV) Parse(fields []string, origin Name) error {
+	if len(fields) != 4 {
+		return errors.New("expected a priority, weight, port and target")
+	}
+	var err error
+	if s.Priority, err = parseUint16(fields[0]); err != nil {
+		return err
+	}
+	if s.Weight, err = parseUint16(fields[1]); err != nil {
+		return err
+	}
+	if s.Port, err = parseUint16(fields[2]); err != nil {
+		return err
+	}
+	s.Target, err = parseRelativeName(fields[3], origin)
+	return err
+}
+
+func (s *SRV) String() string {
+	return fmt.Sprintf("%d %d %d %s", s.Priority, s.Weight, s.Port, s.Target)
+}
+
+type NAPTR struct {
+	Order       uint16
+	Preference  uint16
+	Flags       []byte
+	Services    []byte
+	Regexp      []byte
+	Replacement Name
+}
+
+func (n *NAPTR) Pack() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, n.Order)
+	binary.Write(&buf, binary.BigEndian, n.Preference)
+	writeCharString(&buf, n.Flags)
+	writeCharString(&buf, n.Services)
+	writeCharString(&buf, n.Regexp)
+	writeName(&buf, n.Replacement)
+	return buf.Bytes()
+}
+
+func (n *NAPTR) Unpack(data []byte) error {
+	r := newWireReader(data)
+	n.Order = r.uint16()
+	n.Preference = r.uint16()
+	n.Flags = r.charString()
+	n.Services = r.charString()
+	n.Regexp = r.charString()
+	n.Replacement = r.name()
+	return r.finish()
+}
+
+func (n *NAPTR) Parse(fields []string, origin Name) error {
+	if len(fields) != 6 {
+		return errors.New("expected an order, preference, flags, services, regexp and replacement")
+	}
+	var err error
+	if n.Order, err = parseUint16(fields[0]); err != nil {
+		return err
+	}
+	if n.Preference, err = parseUint16(fields[1]); err != nil {
+		return err
+	}
+	if n.Flags, err = parseCharString(fields[2]); err != nil {
+		return err
+	}
+	if n.Services, err = parseCharString(fields[3]); err != nil {
+		return err
+	}
+	if n.Regexp, err = parseCharString(fields[4]); err != nil {
+		return err
+	}
+	n.Replacement, err = parseRelativeName(fields[5], origin)
+	return err
+}
+
+func (n *NAPTR) String() string {
+	return fmt.Sprintf("%d %d %s %s %s %s", n.Order, n.Preference, formatCharString(n.Flags),
+		formatCharString(n.Services), formatCharString(n.Regexp), n.Replacement)
+}
+
+// SSHFP holds the fingerprint of a host's SSH key, from RFC 4255.
+type SSHFP struct {
+	Algorithm   uint8
+	Type        uint8
+	Fingerprint []byte
+}
+
+func (s *SSHFP) Pack() []byte {
+	return append([]byte{s.Algorithm, s.Type}, s.Fingerprint...)
+}
+
+func (s *SSHFP) Unpack(data []byte) error {
+	r := newWireReader(data)
+	s.Algorithm = r.uint8()
+	s.Type = r.uint8()
+	s.Fingerprint = r.rest()
+	return r.finish()
+}
+
+func (s *SSHFP) Parse(fields []string, origin Name) error {
+	if len(fields) < 3 {
+		return errors.New("expected an algorithm, fingerprint type and fingerprint")
+	}
+	var err error
+	if s.Algorithm, err = parseUint8(fields[0]); err != nil {
+		return err
+	}
+	if s.Type, err = parseUint8(fields[1]); err != nil {
+		return err
+	}
+	s.Fingerprint, err = parseHex(fields[2:])
+	return err
+}
+
+func (s *SSHFP) String() string {
+	return fmt.Sprintf("%d %d %s", s.Algorithm, s.Type, strings.ToUpper(hex.EncodeToString(s.Fingerprint)))
+}
+
+// TLSA associates a TLS certificate or public key with a service, from RFC 6698.
+type TLSA struct {
+	Usage        uint8
+	Selector     uint8
+	MatchingType uint8
+	Certificate  []byte
+}
+
+func (t *TLSA) Pack() []byte {
+	return append([]byte{t.Usage, t.Selector, t.MatchingType}, t.Certificate...)
+}
+
+func (t *TLSA) Unpack(data []byte) error {
+	r := newWireReader(data)
+	t.Usage = r.uint8()
+	t.Selector = r.uint8()
+	t.MatchingType = r.uint8()
+	t.Certificate = r.rest()
+	return r.finish()
+}
+
+func (t *TLSA) Parse(fields []string, origin Name) error {
+	if len(fields) < 4 {
+		return errors.New("expected a usage, selector, matching type and certificate data")
+	}
+	var err error
+	if t.Usage, err = parseUint8(fields[0]); err != nil {
+		return err
+	}
+	if t.Selector, err = parseUint8(fields[1]); err != nil {
+		return err
+	}
+	if t.MatchingType, err = parseUint8(fields[2]); err != nil {
+		return err
+	}
+	t.Certificate, err = parseHex(fields[3:])
+	return err
+}
+
+func (t *TLSA) String() string {
+	return fmt.Sprintf("%d %d %d %s", t.Usage, t.Selector, t.MatchingType, strings.ToUpper(hex.EncodeToString(t.Certificate)))
+}
+
+// CAA says which certificate authorities may issue certificates for a name,
+// from RFC 8659.
+type CAA struct {
+	Flags uint8
+	Tag   []byte
+	Value []byte
+}
+
+func (c *CAA) Pack() []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(c.Flags)
+	writeCharString(&buf, c.Tag)
+	buf.Write(c.Value)
+	return buf.Bytes()
+}
+
+func (c *CAA) Unpack(data []byte) error {
+	r := newWireReader(data)
+	c.Flags = r.uint8()
+	c.Tag = r.charString()
+	c.Value = r.rest()
+	if r.err == nil && len(c.Tag) == 0 {
+		return errors.New("empty tag")
+	}
+	return r.finish()
+}
+
+func (c *CAA) Parse(fields []string, origin Name) error {
+	if len(fields) != 3 {
+		return errors.New("expected flags, a tag and a value")
+	}
+	var err error
+	if c.Flags, err = parseUint8(fields[0]); err != nil {
+		return err
+	}
+	c.Tag = []byte(fields[1])
+	if len(c.Tag) == 0 || len(c.Tag) > 15 {
+		return fmt.Errorf("tag %q should be between 1 and 15 characters", fields[1])
+	}
+	for _, ch := range c.Tag {
+		if !(ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || isDigit(ch)) {
+			return fmt.Errorf("tag %q should only contain letters and digits", fields[1])
+		}
+	}
+	c.Value, err = parseCharString(fields[2])
+	return err
+}
+
+func (c *CAA) String() string {
+	return fmt.Sprintf("%d %s %s", c.Flags, c.Tag, formatCharString(c.Value))
+}
+
+// wireReader reads the fields of uncompressed record data. Rather than have
+// every field return an error, the first problem is remembered and reported
+// by finish.
+type wireReader struct {
+	data []byte
+	off  int
+	err  error
+}
+
+func newWireReader(data []byte) *wireReader {
+	return &wireReader{data: data}
+}
+
+func (r *wireReader) len() int {
+	return len(r.data) - r.off
+}
+
+func (r *wireReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || r.off+n > len(r.data) {
+		r.err = errors.New("data is too short")
+		return nil
+	}
+	b := r.data[r.off : r.off+n]
+	r.off += n
+	return b
+}
+
+func (r *wireReader) uint8() uint8 {
+	b := r.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *wireReader) uint16() uint16 {
+	b := r.next(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+func (r *wireReader) uint32() uint32 {
+	b := r.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (r *wireReader) bytes(n int) []byte {
+	b := r.next(n)
+	if b == nil {
+		return nil
+	}
+	c := make([]byte, n)
+	copy(c, b)
+	return c
+}
+
+func (r *wireReader) rest() []byte {
+	return r.bytes(r.len())
+}
+
+func (r *wireReader) charString() []byte {
+	return r.bytes(int(r.uint8()))
+}
+
+// name reads an uncompressed name. Compression pointers aren't allowed here
+// because the decoder has already expanded the ones that are legal.
+func (r *wireReader) name() Name {
+	n := Name{}
+	for r.err == nil {
+		l := r.uint8()
+		if l == 0 {
+			return n
+		}
+		if l&0xC0 != 0 {
+			r.err = errors.New("unexpected compression pointer")
+			return nil
+		}
+		n = append(n, r.bytes(int(l)))
+	}
+	return nil
+}
+
+// finish reports the first error encountered, or an error if there's data
+// left over.
+func (r *wireReader) finish() error {
+	if r.err != nil {
+		return r.err
+	}
+	if r.len() != 0 {
+		return fmt.Errorf("%d octets of unexpected trailing data", r.len())
+	}
+	return nil
+}
+
+func writeName(buf *bytes.Buffer, n Name) {
+	for _, label := range n {
+		buf.WriteByte(byte(len(label)))
+		buf.Write(label)
+	}
+	buf.WriteByte(0)
+}
+
+func writeCharString(buf *bytes.Buffer, s []byte) {
+	buf.WriteByte(byte(len(s)))
+	buf.Write(s)
+}
+
+// parseRelativeName parses a name from a zone file, where "@" is the origin and
+// a name without a trailing dot is relative to it.
+func parseRelativeName(s string, origin Name) (Name, error) {
+	if s == "@" {
+		return origin, nil
+	}
+	n, err := ParseName(s)
+	if err != nil {
+		return nil, err
+	}
+	if isFullyQualified(s) {
+		return n, nil
+	}
+	if n.wireLen()+origin.wireLen()-1 > maxNameLen {
+		return nil, fmt.Errorf("name %q is too long once the origin is appended", s)
+	}
+	return append(n, origin...), nil
+}
+
+// isFullyQualified reports whether s ends in a dot that isn't escaped.
+func isFullyQualified(s string) bool {
+	if !strings.HasSuffix(s, ".") {
+		return false
+	}
+	backslashes := 0
+	for i := len(s) - 2; i >= 0 && s[i] == '\\'; i-- {
+		backslashes++
+	}
+	return backslashes%2 == 0
+}
+
+// parseCharString reads a character string that may be quoted and may use the
+// same escapes as names.
+func parseCharString(s string) ([]byte, error) {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		s = s[1 : len(s)-1]
+	}
+	out, err := unescape(s, 255, "")
+	if err != nil {
+		return nil, fmt.Errorf("string %q: %v", s, err)
+	}
+	return out, nil
+}
+
+func formatCharString(s []byte) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, c := range s {
+		switch {
+		case c == '"' || c == '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c < ' ' || c >= 0x7f:
+			fmt.Fprintf(&sb, "\\%03d", c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+func parseUint8(s string) (uint8, error) {
+	n, err := strconv.ParseUint(s, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("bad number %q", s)
+	}
+	return uint8(n), nil
+}
+
+func parseUint16(s string) (uint16, error) {
+	n, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("bad number %q", s)
+	}
+	return uint16(n), nil
+}
+
+func parseUint32(s string) (uint32, error) {
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("bad number %q", s)
+	}
+	return uint32(n), nil
+}
+
+// parseHex reads hex data that may have been split over several fields.
+func parseHex(fields []string) ([]byte, error) {
+	b, err := hex.DecodeString(strings.Join(fields, ""))
+	if err != nil {
+		return nil, fmt.Errorf("bad hex data: %v", err)
+	}
+	return b, nil
+}
+
+// parseTTL reads a duration in seconds, also accepting the BIND style units
+// such as 1h30m or 2w.
+func parseTTL(s string) (uint32, error) {
+	if s == "" {
+		return 0, errors.New("empty TTL")
+	}
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return uint32(n), nil
+	}
+	var total, cur uint64
+	var sawDigit bool
+	for _, c := range strings.ToLower(s) {
+		if c >= '0' && c <= '9' {
+			cur = cur*10 + uint64(c-'0')
+			sawDigit = true
+			continue
+		}
+		if !sawDigit {
+			return 0, fmt.Errorf("bad TTL %q", s)
+		}
+		switch c {
+		case 's':
+		case 'm':
+			cur *= 60
+		case 'h':
+			cur *= 60 * 60
+		case 'd':
+			cur *= 60 * 60 * 24
+		case 'w':
+			cur *= 60 * 60 * 24 * 7
+		default:
+			return 0, fmt.Errorf("bad TTL %q", s)
+		}
+		total += cur
+		cur = 0
+		sawDigit = false
+	}
+	total += cur
+	if total > 0xFFFFFFFF {
+		return 0, fmt.Errorf("TTL %q is too large", s)
+	}
+	return uint32(total), nil
+}
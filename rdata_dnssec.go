@@ -0,0 +1,607 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Algorithm is a DNSSEC signing algorithm number from the IANA registry.
+type Algorithm uint8
+
+const (
+	AlgorithmRSASHA1         Algorithm = 5
+	AlgorithmRSASHA1NSEC3    Algorithm = 7
+	AlgorithmRSASHA256       Algorithm = 8
+	AlgorithmRSASHA512       Algorithm = 10
+	AlgorithmECDSAP256SHA256 Algorithm = 13
+	AlgorithmECDSAP384SHA384 Algorithm = 14
+	AlgorithmED25519         Algorithm = 15
+	AlgorithmED448           Algorithm = 16
+)
+
+var algorithmNames = map[Algorithm]string{
+	AlgorithmRSASHA1:         "RSASHA1",
+	AlgorithmRSASHA1NSEC3:    "RSASHA1-NSEC3-SHA1",
+	AlgorithmRSASHA256:       "RSASHA256",
+	AlgorithmRSASHA512:       "RSASHA512",
+	AlgorithmECDSAP256SHA256: "ECDSAP256SHA256",
+	AlgorithmECDSAP384SHA384: "ECDSAP384SHA384",
+	AlgorithmED25519:         "ED25519",
+	AlgorithmED448:           "ED448",
+}
+
+func (a Algorithm) String() string {
+	if s, ok := algorithmNames[a]; ok {
+		return s
+	}
+	return strconv.Itoa(int(a))
+}
+
+// parseAlgorithm reads an algorithm given either as a number or a mnemonic.
+func parseAlgorithm(s string) (Algorithm, error) {
+	if n, err := parseUint8(s); err == nil {
+		return Algorithm(n), nil
+	}
+	for a, name := range algorithmNames {
+		if strings.EqualFold(name, s) {
+			return a, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown algorithm %q", s)
+}
+
+// DigestType is a DS digest algorithm number.
+type DigestType uint8
+
+const (
+	DigestSHA1   DigestType = 1
+	DigestSHA256 DigestType = 2
+	DigestSHA384 DigestType = 4
+)
+
+// DNSKEY flags from RFC 4034 and RFC 5011.
+const (
+	DNSKEYFlagZone   uint16 = 1 << 8
+	DNSKEYFlagRevoke uint16 = 1 << 7
+	DNSKEYFlagSEP    uint16 = 1
+)
+
+type DNSKEY struct {
+	Flags     uint16
+	Protocol  uint8
+	Algorithm Algorithm
+	PublicKey []byte
+}
+
+func (k *DNSKEY) Pack() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, k.Flags)
+	buf.WriteByte(k.Protocol)
+	buf.WriteByte(byte(k.Algorithm))
+	buf.Write(k.PublicKey)
+	return buf.Bytes()
+}
+
+func (k *DNSKEY) Unpack(data []byte) error {
+	r := newWireReader(data)
+	k.Flags = r.uint16()
+	k.Protocol = r.uint8()
+	k.Algorithm = Algorithm(r.uint8())
+	k.PublicKey = r.rest()
+	return r.finish()
+}
+
+func (k *DNSKEY) Parse(fields []string, origin Name) error {
+	if len(fields) < 4 {
+		return errors.New("expected flags, protocol, algorithm and a public key")
+	}
+	var err error
+	if k.Flags, err = parseUint16(fields[0]); err != nil {
+		return err
+	}
+	if k.Protocol, err = parseUint8(fields[1]); err != nil {
+		return err
+	}
+	if k.Algorithm, err = parseAlgorithm(fields[2]); err != nil {
+		return err
+	}
+	k.PublicKey, err = parseBase64(fields[3:])
+	return err
+}
+
+func (k *DNSKEY) String() string {
+	return fmt.Sprintf("%d %d %d %s", k.Flags, k.Protocol, k.Algorithm, base64.StdEncoding.EncodeToString(k.PublicKey))
+}
+
+// KeyTag computes the tag that RRSIG and DS records use to refer to the key,
+// as described in RFC 4034 appendix B.
+func (k *DNSKEY) KeyTag() uint16 {
+	var ac uint32
+	for i, b := range k.Pack() {
+		if i&1 == 0 {
+			ac += uint32(b) << 8
+		} else {
+			ac += uint32(b)
+		}
+	}
+	ac += ac >> 16 & 0xFFFF
+	return uint16(ac & 0xFFFF)
+}
+
+// IsKSK reports whether the key has the secure entry point flag, which by
+// convention marks a key signing key.
+func (k *DNSKEY) IsKSK() bool {
+	return k.Flags&DNSKEYFlagSEP != 0
+}
+
+type DS struct {
+	KeyTag     uint16
+	Algorithm  Algorithm
+	DigestType DigestType
+	Digest     []byte
+}
+
+func (d *DS) Pack() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, d.KeyTag)
+	buf.WriteByte(byte(d.Algorithm))
+	buf.WriteByte(byte(d.DigestType))
+	buf.Write(d.Digest)
+	return buf.Bytes()
+}
+
+func (d *DS) Unpack(data []byte) error {
+	r := newWireReader(data)
+	d.KeyTag = r.uint16()
+	d.Algorithm = Algorithm(r.uint8())
+	d.DigestType = DigestType(r.uint8())
+	d.Digest = r.rest()
+	return r.finish()
+}
+
+func (d *DS) Parse(fields []string, origin Name) error {
+	if len(fields) < 4 {
+		return errors.New("expected a key tag, algorithm, digest type and digest")
+	}
+	var err error
+	if d.KeyTag, err = parseUint16(fields[0]); err != nil {
+		return err
+	}
+	if d.Algorithm, err = parseAlgorithm(fields[1]); err != nil {
+		return err
+	}
+	dt, err := parseUint8(fields[2])
+	if err != nil {
+		return err
+	}
+	d.DigestType = DigestType(dt)
+	d.Digest, err = parseHex(fields[3:])
+	return err
+}
+
+func (d *DS) String() string {
+	return fmt.Sprintf("%d %d %d %s", d.KeyTag, d.Algorithm, d.DigestType, strings.ToUpper(hex.EncodeToString(d.Digest)))
+}
+
+// RRSIG is a signature over an RRset. The signer's name must never be
+// compressed on the wire, which wireReader.name enforces.
+type RRSIG struct {
+	TypeCovered Type
+	Algorithm   Algorithm
+	Labels      uint8
+	OriginalTTL uint32
+	Expiration  uint32
+	Inception   uint32
+	KeyTag      uint16
+	SignerName  Name
+	Signature   []byte
+}
+
+// packHeader encodes everything but the signature, which is the part of the
+// record that's included in the data being signed.
+func (s *RRSIG) packHeader() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, s.TypeCovered)
+	buf.WriteByte(byte(s.Algorithm))
+	buf.WriteByte(s.Labels)
+	binary.Write(&buf, binary.BigEndian, s.OriginalTTL)
+	binary.Write(&buf, binary.BigEndian, s.Expiration)
+	binary.Write(&buf, binary.BigEndian, s.Inception)
+	binary.Write(&buf, binary.BigEndian, s.KeyTag)
+	writeName(&buf, s.SignerName)
+	return buf.Bytes()
+}
+
+func (s *RRSIG) Pack() []byte {
+	return append(s.packHeader(), s.Signature...)
+}
+
+func (s *RRSIG) Unpack(data []byte) error {
+	r := newWireReader(data)
+	s.TypeCovered = Type(r.uint16())
+	s.Algorithm = Algorithm(r.uint8())
+	s.Labels = r.uint8()
+	s.OriginalTTL = r.uint32()
+	s.Expiration = r.uint32()
+	s.Inception = r.uint32()
+	s.KeyTag = r.uint16()
+	s.SignerName = r.name()
+	s.Signature = r.rest()
+	return r.finish()
+}
+
+func (s *RRSIG) Parse(fields []string, origin Name) error {
+	if len(fields) < 9 {
+		return errors.New("expected type covered, algorithm, labels, original TTL, expiration, inception, key tag, signer and signature")
+	}
+	var err error
+	if s.TypeCovered, err = ParseType(fields[0]); err != nil {
+		return err
+	}
+	if s.Algorithm, err = parseAlgorithm(fields[1]); err != nil {
+		return err
+	}
+	if s.Labels, err = parseUint8(fields[2]); err != nil {
+		return err
+	}
+	if s.OriginalTTL, err = parseTTL(fields[3]); err != nil {
+		return err
+	}
+	if s.Expiration, err = parseSigTime(fields[4]); err != nil {
+		return err
+	}
+	if s.Inception, err = parseSigTime(fields[5]); err != nil {
+		return err
+	}
+	if s.KeyTag, err = parseUint16(fields[6]); err != nil {
+		return err
+	}
+	if s.SignerName, err = parseRelativeName(fields[7], origin); err != nil {
+		return err
+	}
+	s.Signature, err = parseBase64(fields[8:])
+	return err
+}
+
+func (s *RRSIG) String() string {
+	return fmt.Sprintf("%s %d %d %d %s %s %d %s %s", s.TypeCovered, s.Algorithm, s.Labels, s.OriginalTTL,
+		formatSigTime(s.Expiration), formatSigTime(s.Inception), s.KeyTag, s.SignerName,
+		base64.StdEncoding.EncodeToString(s.Signature))
+}
+
+// ValidAt reports whether t falls inside the signature's validity window. The
+// times are compared using serial number arithmetic (RFC 1982) as RFC 4034
+// section 3.1.5 requires, so that they keep working after 2106.
+func (s *RRSIG) ValidAt(t time.Time) bool {
+	now := uint32(t.Unix())
+	return serialLTE(s.Inception, now) && serialLTE(now, s.Expiration)
+}
+
+// serialLTE reports whether a <= b in serial number arithmetic.
+func serialLTE(a, b uint32) bool {
+	return a == b || int32(b-a) > 0
+}
+
+// sigTimeLayout is the YYYYMMDDHHmmSS format used for signature times.
+const sigTimeLayout = "20060102150405"
+
+// parseSigTime reads a signature time, either in YYYYMMDDHHmmSS form or as a
+// number of seconds since the epoch.
+func parseSigTime(s string) (uint32, error) {
+	if len(s) == len(sigTimeLayout) {
+		t, err := time.Parse(sigTimeLayout, s)
+		if err != nil {
+			return 0, fmt.Errorf("bad signature time %q", s)
+		}
+		// Times after 2106 wrap around, as RFC 4034 section 3.2 describes
+		return uint32(t.Unix()), nil
+	}
+	return parseUint32(s)
+}
+
+// formatSigTime prints a signature time in YYYYMMDDHHmmSS form, choosing the
+// date that's closest to now since the 32 bit value wraps.
+func formatSigTime(v uint32) string {
+	now := time.Now().Unix()
+	t := int64(v) + (now-int64(v)+1<<31)/(1<<32)*(1<<32)
+	return time.Unix(t, 0).UTC().Format(sigTimeLayout)
+}
+
+type NSEC struct {
+	NextDomain Name
+	Types      []Type
+}
+
+func (n *NSEC) Pack() []byte {
+	var buf bytes.Buffer
+	writeName(&buf, n.NextDomain)
+	buf.Write(packTypeBitmap(n.Types))
+	return buf.Bytes()
+}
+
+func (n *NSEC) Unpack(data []byte) error {
+	r := newWireReader(data)
+	n.NextDomain = r.name()
+	if r.err != nil {
+		return r.err
+	}
+	var err error
+	n.Types, err = unpackTypeBitmap(r.rest())
+	return err
+}
+
+func (n *NSEC) Parse(fields []string, origin Name) error {
+	if len(fields) < 1 {
+		return errors.New("expected a next domain name")
+	}
+	var err error
+	if n.NextDomain, err = parseRelativeName(fields[0], origin); err != nil {
+		return err
+	}
+	n.Types, err = parseTypeList(fields[1:])
+	return err
+}
+
+func (n *NSEC) String() string {
+	return strings.TrimSpace(n.NextDomain.String() + " " + formatTypeList(n.Types))
+}
+
+// HasType reports whether the type bitmap includes t.
+func (n *NSEC) HasType(t Type) bool {
+	return hasType(n.Types, t)
+}
+
+// NSEC3 flags from RFC 5155.
+const NSEC3FlagOptOut uint8 = 1
+
+// NSEC3HashSHA1 is the only NSEC3 hash algorithm there is.
+const NSEC3HashSHA1 uint8 = 1
+
+// base32Hex is the encoding used for hashed owner names in NSEC3 records.
+var base32Hex = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+type NSEC3 struct {
+	HashAlgorithm uint8
+	Flags         uint8
+	Iterations    uint16
+	Salt          []byte
+	NextHashed    []byte
+	Types         []Type
+}
+
+func (n *NSEC3) Pack() []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(n.HashAlgorithm)
+	buf.WriteByte(n.Flags)
+	binary.Write(&buf, binary.BigEndian, n.Iterations)
+	writeCharString(&buf, n.Salt)
+	writeCharString(&buf, n.NextHashed)
+	buf.Write(packTypeBitmap(n.Types))
+	return buf.Bytes()
+}
+
+func (n *NSEC3) Unpack(data []byte) error {
+	r := newWireReader(data)
+	n.HashAlgorithm = r.uint8()
+	n.Flags = r.uint8()
+	n.Iterations = r.uint16()
+	n.Salt = r.charString()
+	n.NextHashed = r.charString()
+	if r.err != nil {
+		return r.err
+	}
+	var err error
+	n.Types, err = unpackTypeBitmap(r.rest())
+	return err
+}
+
+func (n *NSEC3) Parse(fields []string, origin Name) error {
+	if len(fields) < 5 {
+		return errors.New("expected a hash algorithm, flags, iterations, salt and next hashed owner")
+	}
+	var err error
+	if n.HashAlgorithm, err = parseUint8(fields[0]); err != nil {
+		return err
+	}
+	if n.Flags, err = parseUint8(fields[1]); err != nil {
+		return err
+	}
+	if n.Iterations, err = parseUint16(fields[2]); err != nil {
+		return err
+	}
+	if n.Salt, err = parseSalt(fields[3]); err != nil {
+		return err
+	}
+	if n.NextHashed, err = base32Hex.DecodeString(strings.ToUpper(fields[4])); err != nil {
+		return fmt.Errorf("bad next hashed owner %q", fields[4])
+	}
+	n.Types, err = parseTypeList(fields[5:])
+	return err
+}
+
+func (n *NSEC3) String() string {
+	s := fmt.Sprintf("%d %d %d %s %s", n.HashAlgorithm, n.Flags, n.Iterations, formatSalt(n.Salt),
+		strings.ToLower(base32Hex.EncodeToString(n.NextHashed)))
+	return strings.TrimSpace(s + " " + formatTypeList(n.Types))
+}
+
+// HasType reports whether the type bitmap includes t.
+func (n *NSEC3) HasType(t Type) bool {
+	return hasType(n.Types, t)
+}
+
+// OptOut reports whether the record may cover unsigned delegations.
+func (n *NSEC3) OptOut() bool {
+	return n.Flags&NSEC3FlagOptOut != 0
+}
+
+type NSEC3PARAM struct {
+	HashAlgorithm uint8
+	Flags         uint8
+	Iterations    uint16
+	Salt          []byte
+}
+
+func (n *NSEC3PARAM) Pack() []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(n.HashAlgorithm)
+	buf.WriteByte(n.Flags)
+	binary.Write(&buf, binary.BigEndian, n.Iterations)
+	writeCharString(&buf, n.Salt)
+	return buf.Bytes()
+}
+
+func (n *NSEC3PARAM) Unpack(data []byte) error {
+	r := newWireReader(data)
+	n.HashAlgorithm = r.uint8()
+	n.Flags = r.uint8()
+	n.Iterations = r.uint16()
+	n.Salt = r.charString()
+	return r.finish()
+}
+
+func (n *NSEC3PARAM) Parse(fields []string, origin Name) error {
+	if len(fields) != 4 {
+		return errors.New("expected a hash algorithm, flags, iterations and salt")
+	}
+	var err error
+	if n.HashAlgorithm, err = parseUint8(fields[0]); err != nil {
+		return err
+	}
+	if n.Flags, err = parseUint8(fields[1]); err != nil {
+		return err
+	}
+	if n.Iterations, err = parseUint16(fields[2]); err != nil {
+		return err
+	}
+	n.Salt, err = parseSalt(fields[3])
+	return err
+}
+
+func (n *NSEC3PARAM) String() string {
+	return fmt.Sprintf("%d %d %d %s", n.HashAlgorithm, n.Flags, n.Iterations, formatSalt(n.Salt))
+}
+
+// parseSalt reads an NSEC3 salt, where "-" means there isn't one.
+func parseSalt(s string) ([]byte, error) {
+	if s == "-" {
+		return nil, nil
+	}
+	salt, err := hex.DecodeString(s)
+	if err != nil || len(salt) > 255 {
+		return nil, fmt.Errorf("bad salt %q", s)
+	}
+	return salt, nil
+}
+
+func formatSalt(salt []byte) string {
+	if len(salt) == 0 {
+		return "-"
+	}
+	return strings.ToUpper(hex.EncodeToString(salt))
+}
+
+// packTypeBitmap encodes a set of types as the window blocks described in RFC
+// 4034 section 4.1.2.
+func packTypeBitmap(types []Type) []byte {
+	sorted := append([]Type(nil), types...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var out []byte
+	var block [32]byte
+	window, blockLen := -1, 0
+	flush := func() {
+		if window >= 0 {
+			out = append(out, byte(window), byte(blockLen))
+			out = append(out, block[:blockLen]...)
+		}
+		block = [32]byte{}
+		blockLen = 0
+	}
+	for _, t := range sorted {
+		if int(t>>8) != window {
+			flush()
+			window = int(t >> 8)
+		}
+		lo := int(t & 0xFF)
+		block[lo/8] |= 0x80 >> uint(lo%8)
+		if lo/8+1 > blockLen {
+			blockLen = lo/8 + 1
+		}
+	}
+	flush()
+	return out
+}
+
+func unpackTypeBitmap(b []byte) ([]Type, error) {
+	var types []Type
+	lastWindow := -1
+	for len(b) > 0 {
+		if len(b) < 2 {
+			return nil, errors.New("truncated type bitmap")
+		}
+		window, length := int(b[0]), int(b[1])
+		if window <= lastWindow {
+			return nil, errors.New("type bitmap windows out of order")
+		}
+		if length == 0 || length > 32 || len(b) < 2+length {
+			return nil, errors.New("bad type bitmap window length")
+		}
+		for i, byt := range b[2 : 2+length] {
+			for bit := 0; bit < 8; bit++ {
+				if byt&(0x80>>uint(bit)) != 0 {
+					types = append(types, Type(window<<8|i*8+bit))
+				}
+			}
+		}
+		lastWindow = window
+		b = b[2+length:]
+	}
+	return types, nil
+}
+
+func parseTypeList(fields []string) ([]Type, error) {
+	var types []Type
+	for _, f := range fields {
+		t, err := ParseType(f)
+		if err != nil {
+			return nil, err
+		}
+		types = append(types, t)
+	}
+	return types, nil
+}
+
+func formatTypeList(types []Type) string {
+	names := make([]string, len(types))
+	for i, t := range types {
+		names[i] = t.String()
+	}
+	return strings.Join(names, " ")
+}
+
+func hasType(types []Type, t Type) bool {
+	for _, tt := range types {
+		if tt == t {
+			return true
+		}
+	}
+	return false
+}
+
+// parseBase64 reads base64 data that may have been split over several fields.
+func parseBase64(fields []string) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.Join(fields, ""))
+	if err != nil {
+		return nil, fmt.Errorf("bad base64 data: %v", err)
+	}
+	return b, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// The key from RFC 4034 section 5.4
+const rfc4034Key = `256 3 5 ( AQOeiiR0GOMYkDshWoSKz9Xz
+	fwJr1AYtsmx3TGkJaNXVbfi/ 2pHm822aJ5iI9BMzNXxeYCmZ
+	DRD99WYwYqUSdjMmmAphXdvx egXd/M5+X7OrzKBaMbCVdFLU
+	Uh6DhweJBjEVv5f2wwjM9Xzc nOf+EPbtG9DMBmADjFDc2w/r
+	ljwvFw== )`
+
+func TestParseDNSSECRData(t *testing.T) {
+	type Test struct {
+		Description string
+		Type        Type
+		Input       string
+		Printed     string
+	}
+
+	tests := []Test{
+		{
+			Description: "DNSKEY",
+			Type:        TypeDNSKEY,
+			Input:       rfc4034Key,
+			Printed:     "256 3 5 AQOeiiR0GOMYkDshWoSKz9XzfwJr1AYtsmx3TGkJaNXVbfi/2pHm822aJ5iI9BMzNXxeYCmZDRD99WYwYqUSdjMmmAphXdvxegXd/M5+X7OrzKBaMbCVdFLUUh6DhweJBjEVv5f2wwjM9XzcnOf+EPbtG9DMBmADjFDc2w/rljwvFw==",
+		},
+		{
+			Description: "DS with a mnemonic algorithm",
+			Type:        TypeDS,
+			Input:       "60485 RSASHA1 1 ( 2BB183AF5F22588179A53B0A9 8631FAD1A292118 )",
+			Printed:     "60485 5 1 2BB183AF5F22588179A53B0A98631FAD1A292118",
+		},
+		{
+			Description: "RRSIG",
+			Type:        TypeRRSIG,
+			Input:       "A 13 3 3600 20300101000000 20200101000000 2642 example.com. dGVzdA==",
+			Printed:     "A 13 3 3600 20300101000000 20200101000000 2642 example.com. dGVzdA==",
+		},
+		{
+			Description: "NSEC from RFC 4034 section 4.3",
+			Type:        TypeNSEC,
+			Input:       "host.example.com. A MX RRSIG NSEC TYPE1234",
+			Printed:     "host.example.com. A MX RRSIG NSEC TYPE1234",
+		},
+		{
+			Description: "NSEC3 from RFC 5155 appendix A",
+			Type:        TypeNSEC3,
+			Input:       "1 1 12 aabbccdd ( 2t7b4g4vsa5smi47k61mv5bv1a22bojr MX DNSKEY NS SOA NSEC3PARAM RRSIG )",
+			Printed:     "1 1 12 AABBCCDD 2t7b4g4vsa5smi47k61mv5bv1a22bojr NS SOA MX RRSIG DNSKEY NSEC3PARAM",
+		},
+		{
+			Description: "NSEC3PARAM without a salt",
+			Type:        TypeNSEC3PARAM,
+			Input:       "1 0 0 -",
+			Printed:     "1 0 0 -",
+		},
+	}
+	for _, test := range tests {
+		data, err := ParseRData(test.Type, fields(t, test.Input), Name{})
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.Description, err)
+			continue
+		}
+		rd, err := ResourceRecord{Type: test.Type, Data: data}.RData()
+		if err != nil {
+			t.Errorf("%s: unexpected error decoding: %v", test.Description, err)
+			continue
+		}
+		if rd.String() != test.Printed {
+			t.Errorf("%s: expected %q, got %q", test.Description, test.Printed, rd.String())
+		}
+	}
+}
+
+func TestTypeBitmap(t *testing.T) {
+	// The bitmap from the NSEC example in RFC 4034 section 4.3
+	expected := []byte{0x00, 0x06, 0x40, 0x01, 0x00, 0x00, 0x00, 0x03,
+		0x04, 0x1b, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x20}
+	types := []Type{TypeNSEC, TypeA, Type(1234), TypeRRSIG, TypeMX}
+	got := packTypeBitmap(types)
+	if !cmp.Equal(expected, got) {
+		t.Errorf("(-want +got)\n%v", cmp.Diff(expected, got))
+	}
+	unpacked, err := unpackTypeBitmap(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal([]Type{TypeA, TypeMX, TypeRRSIG, TypeNSEC, Type(1234)}, unpacked) {
+		t.Errorf("unexpected types %v", unpacked)
+	}
+	if _, err := unpackTypeBitmap([]byte{0x00, 0x00}); err == nil {
+		t.Error("expected an empty window to be rejected")
+	}
+}
+
+func TestKeyTag(t *testing.T) {
+	data, err := ParseRData(TypeDNSKEY, fields(t, rfc4034Key), Name{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := &DNSKEY{}
+	if err := key.Unpack(data); err != nil {
+		t.Fatal(err)
+	}
+	if key.KeyTag() != 60485 {
+		t.Errorf("expected key tag 60485, got %d", key.KeyTag())
+	}
+}
+
+func TestRRSIGValidAt(t *testing.T) {
+	sig := &RRSIG{
+		Inception:  uint32(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC).Unix()),
+		Expiration: uint32(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC).Unix()),
+	}
+	if !sig.ValidAt(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Error("expected the signature to be valid in 2025")
+	}
+	if sig.ValidAt(time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)) || sig.ValidAt(time.Date(2031, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Error("expected the signature to be invalid outside its window")
+	}
+	// A window that spans the 32 bit wraparound in 2106
+	wrapped := &RRSIG{
+		Inception:  uint32(time.Date(2106, 1, 1, 0, 0, 0, 0, time.UTC).Unix()),
+		Expiration: uint32(time.Date(2106, 6, 1, 0, 0, 0, 0, time.UTC).Unix()),
+	}
+	if !wrapped.ValidAt(time.Date(2106, 3, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Error("expected serial arithmetic to cope with the wraparound")
+	}
+}
+
+func TestUnmarshalRRSIGNotDecompressed(t *testing.T) {
+	// An RRSIG whose signer name is a compression pointer isn't valid, so the
+	// decoder must leave it alone rather than expand it
+	b := []byte{
+		0, 1, 132, 0, 0, 1, 0, 1, 0, 0, 0, 0,
+		3, byte('c'), byte('o'), byte('m'), 0,
+		0, 46, 0, 1,
+		192, 12,
+		0, 46,
+		0, 1,
+		0, 0, 0, 10,
+		0, 20,
+		0, 1, 13, 1, 0, 0, 0, 10, 0, 0, 0, 2, 0, 0, 0, 1, 0, 1, 192, 12,
+	}
+	m := Message{}
+	Unmarshal(b, &m)
+	if len(m.Answer) != 1 || len(m.Answer[0].Data) != 20 {
+		t.Fatalf("expected the data to be kept as it was, got %v", m.Answer)
+	}
+	if _, err := m.Answer[0].RData(); err == nil {
+		t.Error("expected a compressed signer name to be rejected")
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseRData(t *testing.T) {
+	type Test struct {
+		Description string
+		Type        Type
+		Input       string
+		Expected    []byte
+		Printed     string
+	}
+
+	origin := MustParseName("example.com")
+	tests := []Test{
+		{
+			Description: "A",
+			Type:        TypeA,
+			Input:       "192.0.2.1",
+			Expected:    []byte{192, 0, 2, 1},
+			Printed:     "192.0.2.1",
+		},
+		{
+			Description: "AAAA",
+			Type:        TypeAAAA,
+			Input:       "2001:db8::1",
+			Expected:    []byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1},
+			Printed:     "2001:db8::1",
+		},
+		{
+			Description: "AAAA holding a v4-mapped address",
+			Type:        TypeAAAA,
+			Input:       "::ffff:192.0.2.1",
+			Expected:    []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 192, 0, 2, 1},
+			Printed:     "::ffff:192.0.2.1",
+		},
+		{
+			Description: "NS relative to the origin",
+			Type:        TypeNS,
+			Input:       "ns1",
+			Expected:    []byte{3, 'n', 's', '1', 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0},
+			Printed:     "ns1.example.com.",
+		},
+		{
+			Description: "MX",
+			Type:        TypeMX,
+			Input:       "10 mail.example.net.",
+			Expected:    []byte{0, 10, 4, 'm', 'a', 'i', 'l', 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'n', 'e', 't', 0},
+			Printed:     "10 mail.example.net.",
+		},
+		{
+			Description: "TXT with several strings",
+			Type:        TypeTXT,
+			Input:       `"hello world" "say \"hi\""`,
+			Expected:    append([]byte("\x0bhello world"), []byte("\x08say \"hi\"")...),
+			Printed:     `"hello world" "say \"hi\""`,
+		},
+		{
+			Description: "SOA at the origin",
+			Type:        TypeSOA,
+			Input:       "@ hostmaster 2020010101 1h 15m 1w 300",
+			Expected: append(append(origin.wireBytes(), MustParseName("hostmaster.example.com").wireBytes()...),
+				0x78, 0x66, 0xe8, 0x75, 0, 0, 0x0e, 0x10, 0, 0, 0x03, 0x84, 0, 0x09, 0x3a, 0x80, 0, 0, 1, 0x2c),
+			Printed: "example.com. hostmaster.example.com. 2020010101 3600 900 604800 300",
+		},
+		{
+			Description: "SRV",
+			Type:        TypeSRV,
+			Input:       "10 60 5060 sip",
+			Expected:    append([]byte{0, 10, 0, 60, 0x13, 0xc4}, MustParseName("sip.example.com").wireBytes()...),
+			Printed:     "10 60 5060 sip.example.com.",
+		},
+		{
+			Description: "NAPTR",
+			Type:        TypeNAPTR,
+			Input:       `100 10 "S" "SIP+D2U" "" _sip._udp`,
+			Printed:     `100 10 "S" "SIP+D2U" "" _sip._udp.example.com.`,
+		},
+		{
+			Description: "SSHFP with the fingerprint split across fields",
+			Type:        TypeSSHFP,
+			Input:       "4 2 123456789abcdef6 7890",
+			Expected:    []byte{4, 2, 0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde, 0xf6, 0x78, 0x90},
+			Printed:     "4 2 123456789ABCDEF67890",
+		},
+		{
+			Description: "TLSA",
+			Type:        TypeTLSA,
+			Input:       "3 1 1 0D6FCE13243AA7",
+			Expected:    []byte{3, 1, 1, 0x0d, 0x6f, 0xce, 0x13, 0x24, 0x3a, 0xa7},
+			Printed:     "3 1 1 0D6FCE13243AA7",
+		},
+		{
+			Description: "CAA",
+			Type:        TypeCAA,
+			Input:       `0 issue "letsencrypt.org"`,
+			Expected:    append([]byte{0, 5, 'i', 's', 's', 'u', 'e'}, []byte("letsencrypt.org")...),
+			Printed:     `0 issue "letsencrypt.org"`,
+		},
+		{
+			Description: "SVCB in alias mode",
+			Type:        TypeSVCB,
+			Input:       "0 svc.example.net.",
+			Printed:     "0 svc.example.net.",
+		},
+		{
+			Description: "HTTPS with every well known parameter, out of order",
+			Type:        TypeHTTPS,
+			Input:       `1 . ipv6hint=2001:db8::1 port=8443 alpn=h2,h3 ech=AEX+DQBB ipv4hint=192.0.2.1,192.0.2.2 no-default-alpn mandatory=port,alpn`,
+			Printed:     "1 . mandatory=alpn,port alpn=h2,h3 no-default-alpn port=8443 ipv4hint=192.0.2.1,192.0.2.2 ech=AEX+DQBB ipv6hint=2001:db8::1",
+		},
+		{
+			Description: "SVCB with an unknown key and an escaped comma in alpn",
+			Type:        TypeSVCB,
+			Input:       `16 foo key667="hello" alpn="f\,oo,h2"`,
+			Printed:     `16 foo.example.com. alpn=f\,oo,h2 key667="hello"`,
+		},
+		{
+			Description: "An unknown type",
+			Type:        Type(731),
+			Input:       `\# 4 0A000001`,
+			Expected:    []byte{10, 0, 0, 1},
+			Printed:     `\# 4 0a000001`,
+		},
+		{
+			Description: "A known type in the generic syntax",
+			Type:        TypeA,
+			Input:       `\# 4 C0000201`,
+			Expected:    []byte{192, 0, 2, 1},
+			Printed:     "192.0.2.1",
+		},
+		{
+			Description: "An unknown type with no data",
+			Type:        Type(65280),
+			Input:       `\# 0`,
+			Expected:    []byte{},
+			Printed:     `\# 0`,
+		},
+	}
+	for _, test := range tests {
+		data, err := ParseRData(test.Type, fields(t, test.Input), origin)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.Description, err)
+			continue
+		}
+		if test.Expected != nil && !cmp.Equal(test.Expected, data) {
+			t.Errorf("%s: (-want +got)\n%v", test.Description, cmp.Diff(test.Expected, data))
+		}
+		rr := ResourceRecord{Type: test.Type, Data: data}
+		rd, err := rr.RData()
+		if err != nil {
+			t.Errorf("%s: unexpected error decoding: %v", test.Description, err)
+			continue
+		}
+		if rd.String() != test.Printed {
+			t.Errorf("%s: expected %q, got %q", test.Description, test.Printed, rd.String())
+		}
+	}
+}
+
+func TestParseRDataErrors(t *testing.T) {
+	type Test struct {
+		Description string
+		Type        Type
+		Input       string
+	}
+
+	tests := []Test{
+		{"A bad address", TypeA, "192.0.2"},
+		{"An IPv6 address in an A record", TypeA, "2001:db8::1"},
+		{"An IPv4 address in an AAAA record", TypeAAAA, "192.0.2.1"},
+		{"An unknown type without the generic syntax", Type(731), "hello"},
+		{"A generic length that doesn't match", Type(731), `\# 3 0A000001`},
+		{"A known type whose generic data is malformed", TypeA, `\# 3 0A0000`},
+		{"A CAA tag with punctuation", TypeCAA, `0 is-sue "ca.example"`},
+		{"An SVCB alias with parameters", TypeSVCB, "0 . port=53"},
+		{"An SVCB parameter given twice", TypeSVCB, "1 . port=53 port=54"},
+		{"A mandatory parameter that's missing", TypeSVCB, "1 . mandatory=port alpn=h2"},
+		{"no-default-alpn without alpn", TypeHTTPS, "1 . no-default-alpn"},
+		{"An IPv6 address in ipv4hint", TypeHTTPS, "1 . ipv4hint=2001:db8::1"},
+		{"Bad hex in a TLSA record", TypeTLSA, "3 1 1 0D6FCE13243AA"},
+		{"A string longer than 255 octets", TypeTXT, strings.Repeat("a", 256)},
+		{"A short decimal escape", TypeTXT, `"a\2"`},
+	}
+	for _, test := range tests {
+		if _, err := ParseRData(test.Type, fields(t, test.Input), Name{}); err == nil {
+			t.Errorf("%s: expected an error", test.Description)
+		}
+	}
+}
+
+func TestTypeAndClassStrings(t *testing.T) {
+	if TypeMX.String() != "MX" || Type(731).String() != "TYPE731" {
+		t.Errorf("unexpected type strings %s and %s", TypeMX, Type(731))
+	}
+	if ClassIN.String() != "IN" || Class(300).String() != "CLASS300" {
+		t.Errorf("unexpected class strings %s and %s", ClassIN, Class(300))
+	}
+	if typ, err := ParseType("type731"); err != nil || typ != 731 {
+		t.Errorf("expected TYPE731 to parse, got %v, %v", typ, err)
+	}
+	if class, err := ParseClass("CLASS300"); err != nil || class != 300 {
+		t.Errorf("expected CLASS300 to parse, got %v, %v", class, err)
+	}
+}
+
+// fields splits presentation format data the way the zone file parser does.
+func fields(t *testing.T, s string) []string {
+	lines, err := tokenizeZone(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 1 {
+		t.Fatalf("expected one line in %q, got %d", s, len(lines))
+	}
+	return lines[0].tokens
+}
+
+func TestSVCBAccessors(t *testing.T) {
+	data, err := ParseRData(TypeHTTPS, fields(t, "1 . alpn=h2,h3 port=8443 ipv4hint=192.0.2.1 ipv6hint=2001:db8::1"), Name{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	https := &HTTPS{}
+	if err := https.Unpack(data); err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal([]string{"h2", "h3"}, https.ALPN()) {
+		t.Errorf("unexpected alpn %v", https.ALPN())
+	}
+	if port, ok := https.Port(); !ok || port != 8443 {
+		t.Errorf("unexpected port %d", port)
+	}
+	hints := https.IPHints()
+	if len(hints) != 2 || hints[0].String() != "192.0.2.1" || hints[1].String() != "2001:db8::1" {
+		t.Errorf("unexpected hints %v", hints)
+	}
+}
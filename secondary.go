@@ -0,0 +1,458 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+)
+
+// transferTimeout is how long a zone transfer may go without a message from
+// the primary before we give up on it.
+const transferTimeout = 30 * time.Second
+
+// defaultRetry is how long a secondary with no copy of its zone waits before
+// trying the primaries again, since there's no SOA to take the retry interval
+// from.
+const defaultRetry = time.Minute
+
+// Secondary keeps our copy of a zone mastered elsewhere up to date, as
+// described in RFC 1034 section 4.3.5. It checks the primaries' SOA serial
+// every SOA refresh interval, or straight away when one sends a NOTIFY, and
+// transfers the zone when it has changed. If the primaries can't be reached
+// for the SOA expire interval the zone stops being served.
+type Secondary struct {
+	Zone *Zone
+	// Key signs the queries and transfers sent to the primaries, if it's set
+	Key *TSIGKey
+	// Path is where the zone is kept between restarts, if it's set
+	Path string
+
+	primaries []*Client
+	notify    chan struct{}
+	now       func() time.Time
+	// checked is when the primaries last confirmed our copy was current
+	checked time.Time
+}
+
+// NewSecondary sets up a secondary zone transferred from primaries, given as
+// addresses like "192.0.2.1:53". If there's a copy of the zone at path it's
+// served until the primaries can be asked for a newer one.
+func NewSecondary(origin Name, primaries []string, key *TSIGKey, path string) (*Secondary, error) {
+	sec := &Secondary{
+		Zone:   &Zone{Origin: origin, Class: ClassIN, expired: true},
+		Key:    key,
+		Path:   path,
+		notify: make(chan struct{}, 1),
+		now:    time.Now,
+	}
+	sec.Zone.secondary = sec
+	for _, p := range primaries {
+		cli, err := NewClient(p)
+		if err != nil {
+			return nil, err
+		}
+		cli.TSIG = key
+		sec.primaries = append(sec.primaries, cli)
+	}
+	if len(sec.primaries) == 0 {
+		return nil, fmt.Errorf("no primaries for %s", origin)
+	}
+	if path == "" {
+		return sec, nil
+	}
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return sec, nil
+	} else if err != nil {
+		return nil, err
+	}
+	saved, err := LoadZone(path, origin)
+	if err != nil {
+		return nil, err
+	}
+	// The file was last written when the primaries last confirmed it, so
+	// its age counts toward expiry
+	sec.Zone.Records = saved.Records
+	sec.checked = info.ModTime()
+	_, soa := saved.SOA()
+	sec.Zone.expired = sec.now().Sub(sec.checked) >= seconds(soa.Expire)
+	return sec, nil
+}
+
+// seconds converts an SOA timer to a duration.
+func seconds(s uint32) time.Duration {
+	return time.Duration(s) * time.Second
+}
+
+// Run keeps the zone up to date. It doesn't return.
+func (sec *Secondary) Run() {
+	for {
+		wait := sec.refresh()
+		select {
+		case <-time.After(wait):
+		case <-sec.notify:
+		}
+	}
+}
+
+// Notify asks for the zone to be refreshed now rather than at the next refresh
+// interval.
+func (sec *Secondary) Notify() {
+	select {
+	case sec.notify <- struct{}{}:
+	default:
+		// A refresh is already on its way
+	}
+}
+
+// isPrimary reports whether a NOTIFY from addr, signed with key if it's set,
+// comes from one of our primaries.
+func (sec *Secondary) isPrimary(addr netip.Addr, key Name) bool {
+	if sec.Key != nil && key != nil && key.Equal(sec.Key.Name) {
+		return true
+	}
+	for _, p := range sec.primaries {
+		if ip, ok := netip.AddrFromSlice(p.addr.IP); ok && ip.Unmap() == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// refresh checks the primaries for a newer copy of the zone, trying each in
+// turn, and returns how long to wait before checking again.
+func (sec *Secondary) refresh() time.Duration {
+	z := sec.Zone
+	var err error
+	for _, primary := range sec.primaries {
+		if err = sec.refreshFrom(primary); err == nil {
+			break
+		}
+		log.Printf("refreshing %s from %v: %v", z.Origin, primary.addr, err)
+	}
+
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	_, soa := z.SOA()
+	if soa == nil {
+		return defaultRetry
+	}
+	now := sec.now()
+	if err == nil {
+		sec.checked = now
+		z.expired = false
+		return seconds(soa.Refresh)
+	}
+	if !z.expired && now.Sub(sec.checked) >= seconds(soa.Expire) {
+		log.Printf("%s has expired, the primaries haven't answered since %v", z.Origin, sec.checked.Format(time.RFC3339))
+		z.expired = true
+	}
+	return seconds(soa.Retry)
+}
+
+// refreshFrom compares our copy of the zone with the primary's and transfers
+// it if the primary has a newer one. We ask for an IXFR when we have a copy,
+// and fall back to AXFR if the changes we're sent don't apply to it.
+func (sec *Secondary) refreshFrom(primary *Client) error {
+	z := sec.Zone
+	z.mu.RLock()
+	soaRR, soa := z.SOA()
+	z.mu.RUnlock()
+
+	var have *ResourceRecord
+	if soa != nil {
+		m := primary.query(Question{Name: z.Origin, Type: TypeSOA, Class: ClassIN})
+		m.RecursionDesired = false
+		resp, err := primary.Exchange(m)
+		if err != nil {
+			return err
+		}
+		if resp.ResponseCode != ResponseCodeOk || !resp.AuthoritativeAnswer {
+			return fmt.Errorf("asking for the SOA: %v, authoritative %v", resp.ResponseCode, resp.AuthoritativeAnswer)
+		}
+		theirs := &SOA{}
+		answer := filterType(filterName(resp.Answer, z.Origin), TypeSOA)
+		if len(answer) == 0 || theirs.Unpack(answer[0].Data) != nil {
+			return errors.New("no SOA record in the answer")
+		}
+		if !serialGreater(theirs.Serial, soa.Serial) {
+			return sec.touch()
+		}
+		have = &soaRR
+	}
+
+	x, err := primary.transfer(z.Origin, have)
+	if err != nil {
+		return err
+	}
+	if !x.full && len(x.diffs) == 0 {
+		return sec.touch()
+	}
+	if err = sec.apply(x); err != nil && !x.full {
+		log.Printf("applying IXFR of %s from %v, trying AXFR: %v", z.Origin, primary.addr, err)
+		if x, err = primary.transfer(z.Origin, nil); err == nil {
+			err = sec.apply(x)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return sec.save()
+}
+
+// apply replaces our copy of the zone with the one transferred.
+func (sec *Secondary) apply(x *zoneTransfer) error {
+	z := sec.Zone
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	records := x.records
+	if !x.full {
+		var err error
+		if records, err = applyDiffs(z.Records, x.diffs); err != nil {
+			return err
+		}
+	}
+	next := &Zone{Origin: z.Origin, Records: records}
+	if err := next.check(); err != nil {
+		return err
+	}
+	previous := z.Records
+	z.Records = records
+	if len(previous) > 0 {
+		z.recordChange(previous)
+	}
+	_, soa := z.SOA()
+	log.Printf("transferred %s, serial now %d", z.Origin, soa.Serial)
+	return nil
+}
+
+// applyDiffs makes the changes from an IXFR to a copy of records.
+func applyDiffs(records []ResourceRecord, diffs []zoneDiff) ([]ResourceRecord, error) {
+	for _, d := range diffs {
+		missing, kept := diffRecords(append([]ResourceRecord{d.from}, d.deleted...), records)
+		if len(missing) > 0 {
+			return nil, fmt.Errorf("can't delete %s, it isn't in our copy", missing[0])
+		}
+		records = append(append(kept, d.to), d.added...)
+	}
+	return records, nil
+}
+
+// save writes the zone to the secondary's path, if it has one, as a master
+// file. It writes to a temporary file first so a crash can't leave it half
+// written.
+func (sec *Secondary) save() error {
+	if sec.Path == "" {
+		return nil
+	}
+	z := sec.Zone
+	var sb strings.Builder
+	z.mu.RLock()
+	fmt.Fprintf(&sb, "; secondary copy of %s\n", z.Origin)
+	for _, rr := range z.Records {
+		sb.WriteString(rr.String() + "\n")
+	}
+	z.mu.RUnlock()
+	tmp := sec.Path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(sb.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, sec.Path)
+}
+
+// touch records that the primaries confirmed the saved copy is current, so
+// the expiry clock starts from now after a restart.
+func (sec *Secondary) touch() error {
+	if sec.Path == "" {
+		return nil
+	}
+	now := sec.now()
+	if err := os.Chtimes(sec.Path, now, now); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// zoneTransfer collects the records of an AXFR or IXFR response as they
+// arrive, following the formats in RFC 5936 section 2.2 and RFC 1995 section
+// 4.
+type zoneTransfer struct {
+	// ixfr is set when we asked for the changes since a copy we have
+	ixfr bool
+	// serial is the zone's new serial, from the SOA the response starts with
+	serial uint32
+	// full is set when the response holds the whole zone, which is in
+	// records. Otherwise it holds the changes, in diffs.
+	full    bool
+	records []ResourceRecord
+	diffs   []zoneDiff
+	// seen counts the records so far, and adding is set while reading the
+	// records one of the changes adds
+	seen   int
+	adding bool
+	done   bool
+}
+
+// add reads the next record of the response.
+func (x *zoneTransfer) add(rr ResourceRecord) error {
+	if x.done {
+		return errors.New("records after the end of the transfer")
+	}
+	x.seen++
+	soa := &SOA{}
+	isSOA := rr.Type == TypeSOA && soa.Unpack(rr.Data) == nil
+	switch {
+	case x.seen == 1:
+		if !isSOA {
+			return fmt.Errorf("transfer starts with %s rather than SOA", rr.Type)
+		}
+		x.serial = soa.Serial
+		x.records = []ResourceRecord{rr}
+		return nil
+	case x.seen == 2:
+		// An IXFR response is incremental when an older SOA follows the
+		// first, and otherwise holds the whole zone like an AXFR
+		if x.ixfr && isSOA && soa.Serial != x.serial {
+			x.diffs = []zoneDiff{{from: rr}}
+			return nil
+		}
+		x.full = true
+	}
+
+	if x.full {
+		if isSOA {
+			x.done = true
+			return nil
+		}
+		x.records = append(x.records, rr)
+		return nil
+	}
+	d := &x.diffs[len(x.diffs)-1]
+	switch {
+	case isSOA && !x.adding:
+		d.to = rr
+		x.adding = true
+	case isSOA && soa.Serial == x.serial:
+		x.done = true
+	case isSOA:
+		x.diffs = append(x.diffs, zoneDiff{from: rr})
+		x.adding = false
+	case x.adding:
+		d.added = append(d.added, rr)
+	default:
+		d.deleted = append(d.deleted, rr)
+	}
+	return nil
+}
+
+// transfer fetches a zone from the client's server over TCP. With have, the
+// SOA of a copy we already hold, it asks for an IXFR, which the server may
+// answer with the changes since then or with the whole zone.
+func (cli *Client) transfer(origin Name, have *ResourceRecord) (*zoneTransfer, error) {
+	q := Question{Name: origin, Type: TypeAXFR, Class: ClassIN}
+	x := &zoneTransfer{}
+	m := Message{ID: randomID(), OpCode: OpCodeStandard}
+	if have != nil {
+		q.Type = TypeIXFR
+		m.Authority = []ResourceRecord{*have}
+		x.ixfr = true
+	}
+	m.Questions = []Question{q}
+	m.updateCounts()
+	req := m.Marshal()
+	var stream *tsigStream
+	if cli.TSIG != nil {
+		var mac []byte
+		req, mac = signMessage(m, cli.TSIG, nil, time.Now())
+		stream = &tsigStream{key: cli.TSIG, mac: mac}
+	}
+
+	conn, err := net.DialTimeout("tcp", cli.addr.String(), queryTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("dialing %v over TCP: %v", cli.addr, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(transferTimeout))
+	if err := writeTCPMessage(conn, req); err != nil {
+		return nil, fmt.Errorf("writing message: %v", err)
+	}
+	for first := true; !x.done; first = false {
+		conn.SetDeadline(time.Now().Add(transferTimeout))
+		b, err := readTCPMessage(conn)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s of %s: %v", q.Type, origin, err)
+		}
+		resp := Message{}
+		if err := Unmarshal(b, &resp); err != nil {
+			return nil, fmt.Errorf("reading %s of %s: %v", q.Type, origin, err)
+		}
+		if resp.ID != m.ID {
+			return nil, fmt.Errorf("response ID %d doesn't match query ID %d", resp.ID, m.ID)
+		}
+		if stream != nil {
+			signed, err := stream.verify(b, time.Now())
+			if err != nil {
+				return nil, fmt.Errorf("TSIG from %v: %v", cli.addr, err)
+			}
+			if signed {
+				resp.Additional = resp.Additional[:len(resp.Additional)-1]
+				resp.updateCounts()
+			}
+		}
+		if resp.ResponseCode != ResponseCodeOk {
+			return nil, fmt.Errorf("%s of %s: %v", q.Type, origin, resp.ResponseCode)
+		}
+		for _, rr := range resp.Answer {
+			if err := x.add(rr); err != nil {
+				return nil, err
+			}
+		}
+		if first && x.seen == 0 {
+			return nil, fmt.Errorf("%s of %s: empty response", q.Type, origin)
+		}
+		// Just the SOA says our copy is already current
+		if first && x.ixfr && x.seen == 1 {
+			x.full, x.done = false, true
+		}
+	}
+	if stream != nil {
+		if err := stream.done(); err != nil {
+			return nil, fmt.Errorf("TSIG from %v: %v", cli.addr, err)
+		}
+	}
+	return x, nil
+}
+
+// serving reports whether we have a copy of the zone we can answer from.
+func (z *Zone) serving() bool {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	return !z.expired
+}
+
+// notified handles a NOTIFY for one of our secondary zones, which RFC 1996
+// section 3 says should start a refresh. Only the zone's primaries are
+// listened to.
+func (s *Server) notified(m Message, c client, ans *Message) {
+	if len(m.Questions) != 1 || m.Questions[0].Type != TypeSOA {
+		ans.ResponseCode = ResponseCodeFormatError
+		return
+	}
+	z := s.findZone(m.Questions[0].Name)
+	if z == nil || !z.Origin.Equal(m.Questions[0].Name) || z.secondary == nil {
+		ans.ResponseCode = ResponseCodeNotAuth
+		return
+	}
+	if !z.secondary.isPrimary(addrOf(c.addr), c.key()) {
+		log.Printf("ignoring NOTIFY for %s from %v", z.Origin, c.addr)
+		ans.ResponseCode = ResponseCodeRefused
+		return
+	}
+	ans.AuthoritativeAnswer = true
+	z.secondary.Notify()
+}
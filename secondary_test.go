@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startPrimary serves z on a local port, returning the server and its address.
+func startPrimary(t *testing.T, z *Zone, keys TSIGKeyring) (*Server, string) {
+	s, err := NewServer("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.keys = keys
+	s.AddZone(z)
+	go s.Listen()
+	t.Cleanup(func() { s.Close() })
+	return s, s.conn.LocalAddr().String()
+}
+
+func TestSecondary(t *testing.T) {
+	key := &TSIGKey{Name: MustParseName("transfer-key."), Algorithm: HMACSHA256, Secret: []byte("0123456789abcdef0123456789abcdef")}
+	primary := mustParseZone(t, testZone, "example.com")
+	primary.Transfers, _ = ParseACL("key:transfer-key")
+	primary.Updates, _ = ParseUpdatePolicy("127.0.0.1")
+	primaryServer, addr := startPrimary(t, primary, TSIGKeyring{"transfer-key.": key})
+	path := filepath.Join(t.TempDir(), "example.com.zone")
+
+	sec, err := NewSecondary(MustParseName("example.com"), []string{addr}, key, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{}
+	s.AddZone(sec.Zone)
+	www := Question{Name: MustParseName("www.example.com"), Type: TypeA, Class: ClassIN}
+	ask := func() Message {
+		return s.handle(Message{Questions: []Question{www}}, client{})
+	}
+	if got := ask().ResponseCode; got != ResponseCodeServerFailure {
+		t.Errorf("expected SERVFAIL before the first transfer, got %v", got)
+	}
+
+	if wait := sec.refresh(); wait != time.Hour {
+		t.Errorf("expected to wait the SOA refresh interval, got %v", wait)
+	}
+	if resp := ask(); resp.ResponseCode != ResponseCodeOk || len(resp.Answer) != 1 {
+		t.Fatalf("expected an answer after the transfer, got %v with %d records", resp.ResponseCode, len(resp.Answer))
+	}
+
+	update := Message{Authority: testRecords(t, "www.example.com. 300 IN A 192.0.2.11")}
+	if rcode := primary.Update(update, netip.MustParseAddr("127.0.0.1"), nil); rcode != ResponseCodeOk {
+		t.Fatalf("update failed with %v", rcode)
+	}
+	sec.refresh()
+	if resp := ask(); len(resp.Answer) != 2 {
+		t.Errorf("expected the IXFR to add a record, got %d", len(resp.Answer))
+	}
+	if len(sec.Zone.journal) != 1 {
+		t.Errorf("expected the change to be journaled for our own secondaries, got %d entries", len(sec.Zone.journal))
+	}
+
+	restarted, err := NewSecondary(MustParseName("example.com"), []string{addr}, key, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !restarted.Zone.serving() || len(restarted.Zone.RRset(www.Name, TypeA)) != 2 {
+		t.Error("expected the saved copy to be served after a restart")
+	}
+
+	primaryServer.Close()
+	sec.now = func() time.Time { return time.Now().Add(8 * 24 * time.Hour) }
+	if wait := sec.refresh(); wait != 15*time.Minute {
+		t.Errorf("expected to wait the SOA retry interval, got %v", wait)
+	}
+	if got := ask().ResponseCode; got != ResponseCodeServerFailure {
+		t.Errorf("expected SERVFAIL once the zone expired, got %v", got)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	sec, err := NewSecondary(MustParseName("example.com"), []string{"192.0.2.1:53"}, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{}
+	s.AddZone(sec.Zone)
+
+	type Test struct {
+		Description string
+		Zone        string
+		From        string
+		Expected    ResponseCode
+		Refresh     bool
+	}
+	tests := []Test{
+		{"From the primary", "example.com", "192.0.2.1", ResponseCodeOk, true},
+		{"From somewhere else", "example.com", "198.51.100.1", ResponseCodeRefused, false},
+		{"Not a zone we're secondary for", "example.net", "192.0.2.1", ResponseCodeNotAuth, false},
+	}
+	for _, test := range tests {
+		m := Message{
+			OpCode:    OpCodeNotify,
+			Questions: []Question{{Name: MustParseName(test.Zone), Type: TypeSOA, Class: ClassIN}},
+		}
+		resp := s.handle(m, client{addr: &net.UDPAddr{IP: net.ParseIP(test.From), Port: 53}})
+		if resp.ResponseCode != test.Expected {
+			t.Errorf("%s: expected %v, got %v", test.Description, test.Expected, resp.ResponseCode)
+		}
+		var refresh bool
+		select {
+		case <-sec.notify:
+			refresh = true
+		default:
+		}
+		if refresh != test.Refresh {
+			t.Errorf("%s: expected refresh %v, got %v", test.Description, test.Refresh, refresh)
+		}
+	}
+}
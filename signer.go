@@ -0,0 +1,618 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// signatureValidity is how long the signatures we make last.
+	signatureValidity = 14 * 24 * time.Hour
+	// signatureRefresh is how long before a cached signature expires that we
+	// replace it, so validators never see one that's about to run out.
+	signatureRefresh = 3 * 24 * time.Hour
+	// signatureSkew backdates signatures to allow for validators whose clocks
+	// are behind ours.
+	signatureSkew = time.Hour
+)
+
+// SigningKey is a DNSKEY along with the private key that signs for it.
+type SigningKey struct {
+	DNSKEY  *DNSKEY
+	private crypto.Signer
+}
+
+// GenerateSigningKey makes a new key for alg, which must be ECDSA P-256 or
+// Ed25519. A key signing key gets the SEP flag and signs the zone's keys,
+// while a zone signing key signs everything else.
+func GenerateSigningKey(alg Algorithm, ksk bool) (*SigningKey, error) {
+	k := &SigningKey{DNSKEY: &DNSKEY{Flags: DNSKEYFlagZone, Protocol: 3, Algorithm: alg}}
+	if ksk {
+		k.DNSKEY.Flags |= DNSKEYFlagSEP
+	}
+	switch alg {
+	case AlgorithmECDSAP256SHA256:
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		k.private = priv
+	case AlgorithmED25519:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		k.private = priv
+	default:
+		return nil, fmt.Errorf("can't sign with %s, only ECDSAP256SHA256 and ED25519", alg)
+	}
+	var err error
+	if k.DNSKEY.PublicKey, err = publicKeyBytes(k.private); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// publicKeyBytes encodes the public half of a private key the way DNSKEY
+// records carry it.
+func publicKeyBytes(priv crypto.Signer) ([]byte, error) {
+	switch pub := priv.Public().(type) {
+	case *ecdsa.PublicKey:
+		b, err := pub.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		// Drop the leading 4 that marks the uncompressed form, per RFC 6605
+		return b[1:], nil
+	case ed25519.PublicKey:
+		return pub, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %T", priv)
+}
+
+// IsKSK reports whether this is a key signing key.
+func (k *SigningKey) IsKSK() bool {
+	return k.DNSKEY.IsKSK()
+}
+
+// signRRset returns an RRSIG record over rrset, made by this key for the zone
+// signer and valid between inception and expiration.
+func (k *SigningKey) signRRset(rrset []ResourceRecord, signer Name, inception, expiration time.Time) (ResourceRecord, error) {
+	sig := &RRSIG{
+		TypeCovered: rrset[0].Type,
+		Algorithm:   k.DNSKEY.Algorithm,
+		Labels:      uint8(labelCount(rrset[0].Name)),
+		OriginalTTL: rrset[0].TTL,
+		Inception:   uint32(inception.Unix()),
+		Expiration:  uint32(expiration.Unix()),
+		KeyTag:      k.DNSKEY.KeyTag(),
+		SignerName:  signer,
+	}
+	data := signedData(sig, rrset)
+	switch priv := k.private.(type) {
+	case *ecdsa.PrivateKey:
+		hashed := sha256.Sum256(data)
+		r, s, err := ecdsa.Sign(rand.Reader, priv, hashed[:])
+		if err != nil {
+			return ResourceRecord{}, err
+		}
+		// RFC 6605 wants r and s as fixed size integers, not the ASN.1 that
+		// crypto.Signer gives us
+		sig.Signature = make([]byte, 64)
+		r.FillBytes(sig.Signature[:32])
+		s.FillBytes(sig.Signature[32:])
+	case ed25519.PrivateKey:
+		sig.Signature = ed25519.Sign(priv, data)
+	default:
+		return ResourceRecord{}, fmt.Errorf("unsupported key type %T", priv)
+	}
+	return ResourceRecord{Name: rrset[0].Name, Type: TypeRRSIG, Class: rrset[0].Class, TTL: rrset[0].TTL, Data: sig.Pack()}, nil
+}
+
+// keyFileName is the BIND style name for a key's files, without the extension.
+func keyFileName(origin Name, key *DNSKEY) string {
+	return fmt.Sprintf("K%s+%03d+%05d", strings.ToLower(origin.String()), key.Algorithm, key.KeyTag())
+}
+
+// SaveSigningKey writes a key to dir as two files: a .key file holding the
+// DNSKEY record and a .private file holding the private key in PKCS #8 form,
+// readable only by us.
+func SaveSigningKey(dir string, origin Name, k *SigningKey) error {
+	base := filepath.Join(dir, keyFileName(origin, k.DNSKEY))
+	der, err := x509.MarshalPKCS8PrivateKey(k.private)
+	if err != nil {
+		return err
+	}
+	priv := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(base+".private", priv, 0600); err != nil {
+		return err
+	}
+	rr := ResourceRecord{Name: origin, Type: TypeDNSKEY, Class: ClassIN, TTL: 3600, Data: k.DNSKEY.Pack()}
+	return os.WriteFile(base+".key", []byte(rr.String()+"\n"), 0644)
+}
+
+// LoadSigningKeys reads every key for origin that SaveSigningKey wrote to dir.
+func LoadSigningKeys(dir string, origin Name) ([]*SigningKey, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "K"+strings.ToLower(origin.String())+"+*.key"))
+	if err != nil {
+		return nil, err
+	}
+	var keys []*SigningKey
+	for _, path := range paths {
+		k, err := loadSigningKey(strings.TrimSuffix(path, ".key"), origin)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func loadSigningKey(base string, origin Name) (*SigningKey, error) {
+	f, err := os.Open(base + ".key")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	records, err := parseRecords(f, origin)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) != 1 || records[0].Type != TypeDNSKEY {
+		return nil, errors.New("expected a single DNSKEY record")
+	}
+	k := &SigningKey{DNSKEY: &DNSKEY{}}
+	if err := k.DNSKEY.Unpack(records[0].Data); err != nil {
+		return nil, err
+	}
+
+	b, err := os.ReadFile(base + ".private")
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("no PEM data in the private key file")
+	}
+	priv, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", priv)
+	}
+	k.private = signer
+	pub, err := publicKeyBytes(signer)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(pub, k.DNSKEY.PublicKey) {
+		return nil, errors.New("private key doesn't match the DNSKEY")
+	}
+	return k, nil
+}
+
+// ZoneSigner signs a zone's RRsets as they're served, remembering signatures
+// until they're close to expiring.
+type ZoneSigner struct {
+	// Keys sign the zone
+	Keys []*SigningKey
+	// Standby keys are published in the DNSKEY RRset without signing
+	// anything, either ahead of a rollover or while signatures made with
+	// them age out of caches
+	Standby []*SigningKey
+	// CDS lists the key signing keys the parent should have DS records for.
+	// If it's nil that's every key signing key in Keys.
+	CDS []*SigningKey
+	// NSEC3 gives the parameters for NSEC3 denial of existence. If it's nil
+	// the zone uses NSEC.
+	NSEC3 *NSEC3PARAM
+	now   func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]cachedSignatures
+}
+
+type cachedSignatures struct {
+	// data is the canonical form of the RRset that was signed, so we notice
+	// when it changes
+	data    []byte
+	sigs    []ResourceRecord
+	refresh time.Time
+}
+
+// NewZoneSigner creates a signer using keys.
+func NewZoneSigner(keys []*SigningKey) *ZoneSigner {
+	return &ZoneSigner{
+		Keys:  keys,
+		now:   time.Now,
+		cache: map[string]cachedSignatures{},
+	}
+}
+
+// keysFor returns the keys that sign RRsets of type t. Key signing keys sign
+// the records that describe the zone's keys, and zone signing keys sign
+// everything else. A zone with only one kind of key signs everything with it.
+func (s *ZoneSigner) keysFor(t Type) []*SigningKey {
+	var ksks, zsks []*SigningKey
+	for _, k := range s.Keys {
+		if k.IsKSK() {
+			ksks = append(ksks, k)
+		} else {
+			zsks = append(zsks, k)
+		}
+	}
+	switch {
+	case len(ksks) == 0:
+		return zsks
+	case len(zsks) == 0:
+		return ksks
+	case t == TypeDNSKEY || t == TypeCDS || t == TypeCDNSKEY:
+		return ksks
+	}
+	return zsks
+}
+
+// sign returns signatures over rrset for the zone origin, reusing earlier ones
+// if the RRset hasn't changed and they aren't close to expiring.
+func (s *ZoneSigner) sign(origin Name, rrset []ResourceRecord) ([]ResourceRecord, error) {
+	data := signedData(&RRSIG{}, rrset)
+	key := rrset[0].Name.Canonical().String() + " " + rrset[0].Type.String()
+	now := s.now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.cache[key]; ok && bytes.Equal(c.data, data) && now.Before(c.refresh) {
+		return c.sigs, nil
+	}
+	var sigs []ResourceRecord
+	expiration := now.Add(signatureValidity)
+	for _, k := range s.keysFor(rrset[0].Type) {
+		sig, err := k.signRRset(rrset, origin, now.Add(-signatureSkew), expiration)
+		if err != nil {
+			return nil, err
+		}
+		sigs = append(sigs, sig)
+	}
+	s.cache[key] = cachedSignatures{data: data, sigs: sigs, refresh: expiration.Add(-signatureRefresh)}
+	return sigs, nil
+}
+
+// Sign makes the zone serve DNSSEC records, signed by s. It publishes the keys
+// at the apex, along with CDS and CDNSKEY records for the key signing keys so
+// the parent can pick them up, and builds the NSEC or NSEC3 chain. It has to
+// be called again whenever the zone's records change.
+func (z *Zone) Sign(s *ZoneSigner) error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return z.sign(s)
+}
+
+// sign does the work of Sign for callers that already hold the lock.
+func (z *Zone) sign(s *ZoneSigner) error {
+	var records []ResourceRecord
+	for _, rr := range z.Records {
+		switch rr.Type {
+		case TypeDNSKEY, TypeCDS, TypeCDNSKEY, TypeNSEC3PARAM:
+			if rr.Name.Equal(z.Origin) {
+				continue
+			}
+		}
+		records = append(records, rr)
+	}
+	z.Records = records
+
+	soaRR, _ := z.SOA()
+	ttl := z.negative().TTL
+	for _, k := range append(s.Keys, s.Standby...) {
+		z.Records = append(z.Records, ResourceRecord{Name: z.Origin, Type: TypeDNSKEY, Class: z.Class, TTL: soaRR.TTL, Data: k.DNSKEY.Pack()})
+	}
+	cds := s.CDS
+	if cds == nil {
+		cds = s.keysFor(TypeCDS)
+	}
+	for _, k := range cds {
+		digest, err := dsDigest(z.Origin, k.DNSKEY, DigestSHA256)
+		if err != nil {
+			return err
+		}
+		ds := &DS{KeyTag: k.DNSKEY.KeyTag(), Algorithm: k.DNSKEY.Algorithm, DigestType: DigestSHA256, Digest: digest}
+		z.Records = append(z.Records,
+			ResourceRecord{Name: z.Origin, Type: TypeCDS, Class: z.Class, TTL: soaRR.TTL, Data: ds.Pack()},
+			ResourceRecord{Name: z.Origin, Type: TypeCDNSKEY, Class: z.Class, TTL: soaRR.TTL, Data: k.DNSKEY.Pack()})
+	}
+
+	var chain []ResourceRecord
+	if s.NSEC3 != nil {
+		param := *s.NSEC3
+		param.Flags = 0
+		z.Records = append(z.Records, ResourceRecord{Name: z.Origin, Type: TypeNSEC3PARAM, Class: z.Class, TTL: ttl, Data: param.Pack()})
+		chain = z.nsec3Chain(s.NSEC3, ttl)
+	} else {
+		chain = z.nsecChain(ttl)
+	}
+	z.signer = s
+	z.denial = newDenial(chain)
+	return nil
+}
+
+// authoritativeNames returns the names in the zone that have records we're
+// authoritative for, including delegation points but not the glue beneath
+// them, in canonical order.
+func (z *Zone) authoritativeNames() []Name {
+	var names []Name
+	for _, rr := range z.Records {
+		if z.isOccluded(rr.Name) {
+			continue
+		}
+		dup := false
+		for _, n := range names {
+			if n.Equal(rr.Name) {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			names = append(names, rr.Name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i].Compare(names[j]) < 0 })
+	return names
+}
+
+// isOccluded reports whether name is below a zone cut.
+func (z *Zone) isOccluded(name Name) bool {
+	for i := len(name) - len(z.Origin) - 1; i > 0; i-- {
+		if len(z.RRset(name[i:], TypeNS)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// typesAt lists the types at name that NSEC and NSEC3 records should claim.
+// At a delegation only the NS and DS records belong to us.
+func (z *Zone) typesAt(name Name) []Type {
+	delegation := !name.Equal(z.Origin) && len(z.RRset(name, TypeNS)) > 0
+	var types []Type
+	for _, rr := range z.lookup(name) {
+		if delegation && rr.Type != TypeNS && rr.Type != TypeDS {
+			continue
+		}
+		if !hasType(types, rr.Type) {
+			types = append(types, rr.Type)
+		}
+	}
+	return types
+}
+
+func (z *Zone) nsecChain(ttl uint32) []ResourceRecord {
+	names := z.authoritativeNames()
+	var chain []ResourceRecord
+	for i, name := range names {
+		types := append(z.typesAt(name), TypeRRSIG, TypeNSEC)
+		nsec := &NSEC{NextDomain: names[(i+1)%len(names)], Types: types}
+		chain = append(chain, ResourceRecord{Name: name, Type: TypeNSEC, Class: z.Class, TTL: ttl, Data: nsec.Pack()})
+	}
+	return chain
+}
+
+func (z *Zone) nsec3Chain(param *NSEC3PARAM, ttl uint32) []ResourceRecord {
+	// NSEC3 also covers empty non-terminals, the names that only exist
+	// because there's something below them
+	var names []Name
+	for _, name := range z.authoritativeNames() {
+		for n := name; len(n) >= len(z.Origin); n = n.Parent() {
+			dup := false
+			for _, m := range names {
+				if m.Equal(n) {
+					dup = true
+					break
+				}
+			}
+			if !dup {
+				names = append(names, n)
+			}
+			if len(n) == len(z.Origin) {
+				break
+			}
+		}
+	}
+
+	type hashed struct {
+		hash []byte
+		name Name
+	}
+	var hashes []hashed
+	for _, name := range names {
+		hashes = append(hashes, hashed{hashName(name, param.Iterations, param.Salt), name})
+	}
+	sort.Slice(hashes, func(i, j int) bool { return bytes.Compare(hashes[i].hash, hashes[j].hash) < 0 })
+
+	var chain []ResourceRecord
+	for i, h := range hashes {
+		types := z.typesAt(h.name)
+		// Unsigned delegations have no signatures at them
+		if len(types) > 0 && !(len(z.RRset(h.name, TypeNS)) > 0 && !h.name.Equal(z.Origin) && !hasType(types, TypeDS)) {
+			types = append(types, TypeRRSIG)
+		}
+		nsec3 := &NSEC3{
+			HashAlgorithm: NSEC3HashSHA1,
+			Iterations:    param.Iterations,
+			Salt:          param.Salt,
+			NextHashed:    hashes[(i+1)%len(hashes)].hash,
+			Types:         types,
+		}
+		owner := z.Origin.Child(strings.ToLower(base32Hex.EncodeToString(h.hash)))
+		chain = append(chain, ResourceRecord{Name: owner, Type: TypeNSEC3, Class: z.Class, TTL: ttl, Data: nsec3.Pack()})
+	}
+	return chain
+}
+
+// AddDNSSEC adds signatures and proofs of non-existence to an answer that
+// Answer built, for clients that set the DO bit. It does nothing if the zone
+// isn't signed.
+func (z *Zone) AddDNSSEC(q Question, resp *Message) {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	if z.signer == nil {
+		return
+	}
+	resp.Answer = z.withSignatures(resp.Answer)
+
+	var authority, proofs []ResourceRecord
+	var negative bool
+	for _, rr := range resp.Authority {
+		switch rr.Type {
+		case TypeSOA:
+			negative = true
+		case TypeNS:
+			if !rr.Name.Equal(z.Origin) {
+				// A referral: show whether the child is signed
+				if ds := z.RRset(rr.Name, TypeDS); len(ds) > 0 {
+					proofs = append(proofs, ds...)
+				} else {
+					proofs = append(proofs, z.matchingDenial(rr.Name)...)
+				}
+			}
+		}
+	}
+	if negative {
+		name := finalName(q, resp.Answer)
+		if resp.ResponseCode == ResponseCodeNameError {
+			proofs = append(proofs, z.nameErrorDenial(name)...)
+		} else {
+			proofs = append(proofs, z.noDataDenial(name)...)
+		}
+	}
+	for _, set := range groupRRsets(resp.Authority) {
+		if set[0].Type == TypeNS && !set[0].Name.Equal(z.Origin) {
+			// The child's NS records aren't ours to sign
+			authority = append(authority, set...)
+			continue
+		}
+		authority = append(authority, z.withSignatures(set)...)
+	}
+	resp.Authority = append(authority, z.withSignatures(dedupRecords(proofs))...)
+}
+
+// withSignatures returns records with the signatures for each of their RRsets
+// following it.
+func (z *Zone) withSignatures(records []ResourceRecord) []ResourceRecord {
+	var signed []ResourceRecord
+	for _, set := range groupRRsets(records) {
+		signed = append(signed, set...)
+		if !set[0].Name.IsSubdomainOf(z.Origin) {
+			continue
+		}
+		sigs, err := z.signer.sign(z.Origin, set)
+		if err != nil {
+			continue
+		}
+		signed = append(signed, sigs...)
+	}
+	return signed
+}
+
+// matchingDenial returns the NSEC or NSEC3 record at name, which lists the
+// types that it has.
+func (z *Zone) matchingDenial(name Name) []ResourceRecord {
+	if n := z.denial.nsecMatching(name); n != nil {
+		return []ResourceRecord{n.rr}
+	}
+	if n := z.denial.nsec3Matching(name); n != nil {
+		return []ResourceRecord{n.rr}
+	}
+	return nil
+}
+
+// noDataDenial proves that name has no records of the type that was asked
+// for. Empty non-terminals have no NSEC record of their own, so the one
+// covering them does the job.
+func (z *Zone) noDataDenial(name Name) []ResourceRecord {
+	if proof := z.matchingDenial(name); proof != nil {
+		return proof
+	}
+	if n := z.denial.nsecCovering(name); n != nil {
+		return []ResourceRecord{n.rr}
+	}
+	return nil
+}
+
+// nameErrorDenial proves that name doesn't exist and that there's no wildcard
+// at its closest encloser that could have answered instead.
+func (z *Zone) nameErrorDenial(name Name) []ResourceRecord {
+	ce := name
+	for len(ce) > len(z.Origin) && len(z.lookup(ce)) == 0 && !z.hasDescendants(ce) {
+		ce = ce.Parent()
+	}
+	wildcard := ce.Child("*")
+	var proof []ResourceRecord
+	if len(z.denial.nsecs) > 0 {
+		for _, n := range []Name{name, wildcard} {
+			if c := z.denial.nsecCovering(n); c != nil {
+				proof = append(proof, c.rr)
+			}
+		}
+		return proof
+	}
+	proof = append(proof, z.matchingDenial(ce)...)
+	nextCloser := name[len(name)-len(ce)-1:]
+	for _, n := range []Name{nextCloser, wildcard} {
+		if c := z.denial.nsec3Covering(n); c != nil {
+			proof = append(proof, c.rr)
+		}
+	}
+	return proof
+}
+
+// finalName follows any CNAMEs in an answer from the name asked about.
+func finalName(q Question, answer []ResourceRecord) Name {
+	name := q.Name
+	for i := 0; i < maxCNAMEChain; i++ {
+		var next Name
+		for _, rr := range answer {
+			if rr.Type == TypeCName && rr.Name.Equal(name) {
+				cname := &CNAME{}
+				if cname.Unpack(rr.Data) == nil {
+					next = cname.Target
+				}
+			}
+		}
+		if next == nil {
+			break
+		}
+		name = next
+	}
+	return name
+}
+
+func dedupRecords(records []ResourceRecord) []ResourceRecord {
+	var kept []ResourceRecord
+outer:
+	for _, rr := range records {
+		for _, k := range kept {
+			if k.Type == rr.Type && k.Name.Equal(rr.Name) && bytes.Equal(k.Data, rr.Data) {
+				continue outer
+			}
+		}
+		kept = append(kept, rr)
+	}
+	return kept
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// signedTestZone signs testZone with a new KSK and ZSK, returning the zone and
+// a validator that trusts the KSK and asks the zone its questions.
+func signedTestZone(t *testing.T, nsec3 bool) (*Zone, *Validator) {
+	z := mustParseZone(t, testZone, "example.com")
+	var keys []*SigningKey
+	for _, ksk := range []bool{true, false} {
+		k, err := GenerateSigningKey(AlgorithmECDSAP256SHA256, ksk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, k)
+	}
+	signer := NewZoneSigner(keys)
+	if nsec3 {
+		signer.NSEC3 = &NSEC3PARAM{HashAlgorithm: NSEC3HashSHA1, Iterations: 1, Salt: []byte{0xab}}
+	}
+	if err := z.Sign(signer); err != nil {
+		t.Fatal(err)
+	}
+
+	v := &Validator{
+		resolve: func(q Question) (Message, error) {
+			resp := Message{Questions: []Question{q}}
+			z.Answer(q, &resp)
+			z.AddDNSSEC(q, &resp)
+			return resp, nil
+		},
+		anchors: StaticTrustAnchors([]ResourceRecord{{Name: z.Origin, Type: TypeDNSKEY, Class: ClassIN, Data: keys[0].DNSKEY.Pack()}}),
+		now:     time.Now,
+		zones:   map[string]*zoneKeys{},
+	}
+	return z, v
+}
+
+func TestSignedZoneValidates(t *testing.T) {
+	type Test struct {
+		Description string
+		Name        string
+		Type        Type
+		Rcode       ResponseCode
+	}
+
+	tests := []Test{
+		{"Existing record", "www.example.com", TypeA, ResponseCodeOk},
+		{"Through a CNAME", "alias.example.com", TypeA, ResponseCodeOk},
+		{"Keys at the apex", "example.com", TypeDNSKEY, ResponseCodeOk},
+		{"CDS at the apex", "example.com", TypeCDS, ResponseCodeOk},
+		{"No such name", "nope.example.com", TypeA, ResponseCodeNameError},
+		{"No such name below an existing one", "a.b.www.example.com", TypeA, ResponseCodeNameError},
+		{"No such type", "www.example.com", TypeMX, ResponseCodeOk},
+		{"Empty non-terminal", "empty.example.com", TypeA, ResponseCodeOk},
+		{"No DS at an unsigned delegation", "sub.example.com", TypeDS, ResponseCodeOk},
+	}
+	for _, nsec3 := range []bool{false, true} {
+		z, v := signedTestZone(t, nsec3)
+		for _, test := range tests {
+			q := Question{Name: MustParseName(test.Name), Type: test.Type, Class: ClassIN}
+			resp, _ := v.resolve(q)
+			if resp.ResponseCode != test.Rcode {
+				t.Errorf("%s (NSEC3 %v): expected rcode %d, got %d", test.Description, nsec3, test.Rcode, resp.ResponseCode)
+			}
+			status, err := v.Validate(q, resp)
+			if status != StatusSecure {
+				t.Errorf("%s (NSEC3 %v): expected secure, got %s (%v)", test.Description, nsec3, status, err)
+			}
+		}
+
+		// A referral to an unsigned child proves there's no DS
+		resp := Message{}
+		q := Question{Name: MustParseName("ns.sub.example.com"), Type: TypeA, Class: ClassIN}
+		z.Answer(q, &resp)
+		z.AddDNSSEC(q, &resp)
+		proof := newDenial(resp.Authority)
+		if s, ok := proof.provesNoData(MustParseName("sub.example.com"), TypeDS); !ok || s != StatusSecure || !proof.isDelegation(MustParseName("sub.example.com")) {
+			t.Errorf("NSEC3 %v: expected the referral to prove sub.example.com is an unsigned delegation, got %v", nsec3, resp.Authority)
+		}
+	}
+}
+
+func TestZoneSignerCache(t *testing.T) {
+	k, err := GenerateSigningKey(AlgorithmED25519, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewZoneSigner([]*SigningKey{k})
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+	origin := MustParseName("example.com")
+	rrset := testRecords(t, "www.example.com. 300 IN A 192.0.2.1")
+
+	first, err := s.sign(origin, rrset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := s.sign(origin, rrset)
+	if !bytes.Equal(first[0].Data, again[0].Data) {
+		t.Error("expected the cached signature to be reused")
+	}
+	changed, _ := s.sign(origin, testRecords(t, "www.example.com. 300 IN A 192.0.2.2"))
+	if bytes.Equal(first[0].Data, changed[0].Data) {
+		t.Error("expected a changed RRset to be signed again")
+	}
+
+	now = now.Add(signatureValidity - signatureRefresh + time.Minute)
+	refreshed, _ := s.sign(origin, rrset)
+	sig := &RRSIG{}
+	if err := sig.Unpack(refreshed[0].Data); err != nil {
+		t.Fatal(err)
+	}
+	if !sig.ValidAt(now.Add(signatureRefresh)) {
+		t.Error("expected the signature to be replaced before it got close to expiring")
+	}
+}
+
+func TestSigningKeyFiles(t *testing.T) {
+	dir := t.TempDir()
+	origin := MustParseName("example.com")
+	for _, alg := range []Algorithm{AlgorithmECDSAP256SHA256, AlgorithmED25519} {
+		k, err := GenerateSigningKey(alg, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := SaveSigningKey(dir, origin, k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keys, err := LoadSigningKeys(dir, origin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("expected 2 keys, got %d", len(keys))
+	}
+	rrset := testRecords(t, "example.com. 300 IN A 192.0.2.1")
+	for _, k := range keys {
+		rr, err := k.signRRset(rrset, origin, time.Now(), time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig := &RRSIG{}
+		sig.Unpack(rr.Data)
+		if err := verifyRRSIG(sig, k.DNSKEY, rrset); err != nil {
+			t.Errorf("%s: unexpected error verifying with a loaded key: %v", k.DNSKEY.Algorithm, err)
+		}
+	}
+}
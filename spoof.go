@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"expvar"
+	"net"
+)
+
+// spoofStats counts responses thrown away because they didn't match the
+// query they claimed to answer, by what was wrong with them. Responses from
+// the wrong address or port never get this far, since the kernel drops them
+// for us on a connected socket.
+var spoofStats = expvar.NewMap("spoofing")
+
+// Source ports for UDP queries are picked from outside the well known range,
+// and if none of sourcePortAttempts random ones are free the OS picks one.
+const (
+	minSourcePort      = 1024
+	sourcePortAttempts = 5
+)
+
+// randomID returns an unpredictable message ID. An off-path attacker has to
+// guess it, along with the source port, to forge an answer.
+func randomID() uint16 {
+	var b [2]byte
+	rand.Read(b[:])
+	return binary.BigEndian.Uint16(b[:])
+}
+
+// dialUDP connects a UDP socket to addr from a random source port.
+func dialUDP(addr *net.UDPAddr) (*net.UDPConn, error) {
+	for i := 0; i < sourcePortAttempts; i++ {
+		port := minSourcePort + int(randomID())%(0x10000-minSourcePort)
+		conn, err := net.DialUDP("udp", &net.UDPAddr{Port: port}, addr)
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return net.DialUDP("udp", nil, addr)
+}
+
+// randomizeCase mixes up the case of the letters in name, as described in
+// draft-vixie-dnsext-dns0x20. Servers echo the question back exactly, so
+// the pattern is a few more bits for an attacker to guess.
+func randomizeCase(name Name) Name {
+	mixed := make(Name, len(name))
+	bits := make([]byte, name.wireLen())
+	rand.Read(bits)
+	var i int
+	for l, label := range name {
+		mixed[l] = append([]byte{}, label...)
+		for j, c := range label {
+			if ('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z') && bits[i]&1 == 1 {
+				mixed[l][j] = c ^ 0x20
+			}
+			i++
+		}
+	}
+	return mixed
+}
+
+// restoreCase puts the name q asked about back the way it was before its
+// case was randomized, wherever it appears in m.
+func restoreCase(m *Message, q Question) {
+	for i := range m.Questions {
+		if m.Questions[i].Name.Equal(q.Name) {
+			m.Questions[i].Name = q.Name
+		}
+	}
+	for _, section := range [][]ResourceRecord{m.Answer, m.Authority, m.Additional} {
+		for i := range section {
+			if section[i].Name.Equal(q.Name) {
+				section[i].Name = q.Name
+			}
+		}
+	}
+}
+
+// responseMismatch says what's wrong with b as the response to req, or
+// returns "" if it could be the response. The question has to come back
+// exactly as it was sent, case and all.
+func responseMismatch(req Message, b []byte) string {
+	if len(b) < 12 || binary.BigEndian.Uint16(b) != req.ID {
+		return "id_mismatch"
+	}
+	resp := Message{}
+	if err := Unmarshal(b, &resp); err != nil {
+		return "malformed"
+	}
+	// A server that couldn't make sense of the query may not be able to
+	// echo its question. Nothing else gets away without it, or a forged
+	// NXDOMAIN would only need the ID and port.
+	if len(resp.Questions) == 0 && (resp.ResponseCode == ResponseCodeFormatError || resp.ResponseCode == ResponseCodeNotImplemented) {
+		return ""
+	}
+	if len(resp.Questions) != len(req.Questions) {
+		return "question_mismatch"
+	}
+	for i, q := range req.Questions {
+		got := resp.Questions[i]
+		if !got.Name.Equal(q.Name) || got.Type != q.Type || got.Class != q.Class {
+			return "question_mismatch"
+		}
+		for l := range q.Name {
+			if !bytes.Equal(got.Name[l], q.Name[l]) {
+				return "case_mismatch"
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"expvar"
+	"net"
+	"testing"
+)
+
+func TestRandomizeCase(t *testing.T) {
+	name := MustParseName("www.example.com")
+	var mixed bool
+	for i := 0; i < 20; i++ {
+		got := randomizeCase(name)
+		if !got.Equal(name) {
+			t.Fatalf("expected %s with its case changed, got %s", name, got)
+		}
+		if got.String() != name.String() {
+			mixed = true
+		}
+	}
+	if !mixed {
+		t.Error("expected the case to be mixed up at least once")
+	}
+	if name.String() != "www.example.com." {
+		t.Errorf("expected the original name to be left alone, got %s", name)
+	}
+}
+
+func TestResponseMismatch(t *testing.T) {
+	q := Question{Name: MustParseName("wWw.ExaMple.cOm"), Type: TypeA, Class: ClassIN}
+	req := Message{ID: 1234, Questions: []Question{q}}
+	response := func(id uint16, q Question, rcode ResponseCode) []byte {
+		m := Message{ID: id, IsResponse: true, ResponseCode: rcode}
+		if q.Name != nil {
+			m.Questions = []Question{q}
+		}
+		m.updateCounts()
+		return m.Marshal()
+	}
+
+	type Test struct {
+		Description string
+		Response    []byte
+		Expected    string
+	}
+	tests := []Test{
+		{"Matching", response(1234, q, ResponseCodeOk), ""},
+		{"Wrong ID", response(4321, q, ResponseCodeOk), "id_mismatch"},
+		{"Wrong name", response(1234, Question{Name: MustParseName("www.example.org"), Type: TypeA, Class: ClassIN}, ResponseCodeOk), "question_mismatch"},
+		{"Wrong type", response(1234, Question{Name: q.Name, Type: TypeAAAA, Class: ClassIN}, ResponseCodeOk), "question_mismatch"},
+		{"Case not echoed", response(1234, Question{Name: MustParseName("www.example.com"), Type: TypeA, Class: ClassIN}, ResponseCodeOk), "case_mismatch"},
+		{"No question", response(1234, Question{}, ResponseCodeOk), "question_mismatch"},
+		{"No question with FORMERR", response(1234, Question{}, ResponseCodeFormatError), ""},
+		{"No question with NOTIMP", response(1234, Question{}, ResponseCodeNotImplemented), ""},
+		{"No question with NXDOMAIN", response(1234, Question{}, ResponseCodeNameError), "question_mismatch"},
+		{"No question with SERVFAIL", response(1234, Question{}, ResponseCodeServerFailure), "question_mismatch"},
+		{"Too short", []byte{0x04, 0xd2}, "id_mismatch"},
+		{"Question cut off", response(1234, q, ResponseCodeOk)[:14], "malformed"},
+	}
+	for _, test := range tests {
+		if got := responseMismatch(req, test.Response); got != test.Expected {
+			t.Errorf("%s: expected %q, got %q", test.Description, test.Expected, got)
+		}
+	}
+}
+
+func TestExchangeUDPIgnoresSpoofed(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	m := newQuery(Question{Name: MustParseName("www.example.com"), Type: TypeA, Class: ClassIN}, false)
+	m.Questions[0].Name = MustParseName("wWw.example.com")
+	go func() {
+		buf := make([]byte, maxBufferSize)
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		query := Message{}
+		Unmarshal(buf[:n], &query)
+		resp := query
+		resp.IsResponse = true
+		// A forgery that guessed the port but not the ID, then one that
+		// didn't know the case, and then the real answer
+		forged := resp
+		forged.ID++
+		conn.WriteTo(forged.Marshal(), from)
+		forged = resp
+		forged.Questions = []Question{{Name: MustParseName("www.example.com"), Type: TypeA, Class: ClassIN}}
+		conn.WriteTo(forged.Marshal(), from)
+		conn.WriteTo(resp.Marshal(), from)
+	}()
+
+	count := func(reason string) int64 {
+		if v, ok := spoofStats.Get(reason).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	ids, cases := count("id_mismatch"), count("case_mismatch")
+	b, err := exchangeUDP(context.Background(), conn.LocalAddr().(*net.UDPAddr), m, m.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binary.BigEndian.Uint16(b) != m.ID || responseMismatch(m, b) != "" {
+		t.Errorf("expected the real response, got %x", b)
+	}
+	if got := count("id_mismatch") - ids; got != 1 {
+		t.Errorf("expected 1 forged ID to be counted, got %d", got)
+	}
+	if got := count("case_mismatch") - cases; got != 1 {
+		t.Errorf("expected 1 forged case to be counted, got %d", got)
+	}
+}
+
+func TestClientFormatError(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, maxBufferSize)
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		query := Message{}
+		Unmarshal(buf[:n], &query)
+		resp := Message{ID: query.ID, IsResponse: true, ResponseCode: ResponseCodeFormatError}
+		conn.WriteTo(resp.Marshal(), from)
+	}()
+
+	cli, err := NewClient(conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cli.Resolve(Question{Name: MustParseName("www.example.com"), Type: TypeA, Class: ClassIN}); err == nil {
+		t.Error("expected FORMERR to be an error, not an answer")
+	}
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SVCParamKey identifies a service parameter in an SVCB or HTTPS record.
+type SVCParamKey uint16
+
+const (
+	SVCParamMandatory SVCParamKey = iota
+	SVCParamALPN
+	SVCParamNoDefaultALPN
+	SVCParamPort
+	SVCParamIPv4Hint
+	SVCParamECH
+	SVCParamIPv6Hint
+)
+
+var svcParamKeyNames = map[SVCParamKey]string{
+	SVCParamMandatory:     "mandatory",
+	SVCParamALPN:          "alpn",
+	SVCParamNoDefaultALPN: "no-default-alpn",
+	SVCParamPort:          "port",
+	SVCParamIPv4Hint:      "ipv4hint",
+	SVCParamECH:           "ech",
+	SVCParamIPv6Hint:      "ipv6hint",
+}
+
+// String returns the key's name, or keyNNNNN for keys we don't know.
+func (k SVCParamKey) String() string {
+	if s, ok := svcParamKeyNames[k]; ok {
+		return s
+	}
+	return "key" + strconv.Itoa(int(k))
+}
+
+func parseSVCParamKey(s string) (SVCParamKey, error) {
+	for k, name := range svcParamKeyNames {
+		if name == s {
+			return k, nil
+		}
+	}
+	if strings.HasPrefix(s, "key") {
+		n, err := strconv.ParseUint(s[len("key"):], 10, 16)
+		// 65535 is reserved as an "invalid key"
+		if err == nil && n != 65535 {
+			return SVCParamKey(n), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown service parameter %q", s)
+}
+
+// SVCParam is a service parameter. Value holds it in wire format; use the
+// methods on SVCB to get at the values of the well known keys.
+type SVCParam struct {
+	Key   SVCParamKey
+	Value []byte
+}
+
+// SVCB describes how to reach a service, from RFC 9460. A priority of zero
+// makes it an alias for Target, and anything else makes it a service endpoint
+// described by its parameters.
+type SVCB struct {
+	Priority uint16
+	Target   Name
+	Params   []SVCParam
+}
+
+// HTTPS is the SVCB layout used for HTTPS origins.
+type HTTPS struct {
+	SVCB
+}
+
+func (s *SVCB) Pack() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, s.Priority)
+	writeName(&buf, s.Target)
+	for _, p := range s.Params {
+		binary.Write(&buf, binary.BigEndian, p.Key)
+		binary.Write(&buf, binary.BigEndian, uint16(len(p.Value)))
+		buf.Write(p.Value)
+	}
+	return buf.Bytes()
+}
+
+func (s *SVCB) Unpack(data []byte) error {
+	r := newWireReader(data)
+	s.Priority = r.uint16()
+	s.Target = r.name()
+	s.Params = nil
+	for r.err == nil && r.len() > 0 {
+		key := SVCParamKey(r.uint16())
+		value := r.bytes(int(r.uint16()))
+		s.Params = append(s.Params, SVCParam{Key: key, Value: value})
+	}
+	if err := r.finish(); err != nil {
+		return err
+	}
+	return s.check()
+}
+
+// Parse reads the presentation format from RFC 9460 section 2.1, where each
+// parameter is written key=value. Values may be quoted.
+func (s *SVCB) Parse(fields []string, origin Name) error {
+	if len(fields) < 2 {
+		return errors.New("expected a priority and a target")
+	}
+	var err error
+	if s.Priority, err = parseUint16(fields[0]); err != nil {
+		return err
+	}
+	if s.Target, err = parseRelativeName(fields[1], origin); err != nil {
+		return err
+	}
+	s.Params = nil
+	for _, f := range fields[2:] {
+		keyStr, valueStr := f, ""
+		hasValue := false
+		if i := strings.Index(f, "="); i >= 0 {
+			keyStr, valueStr, hasValue = f[:i], f[i+1:], true
+		}
+		key, err := parseSVCParamKey(keyStr)
+		if err != nil {
+			return err
+		}
+		raw, err := parseCharStringLong(valueStr)
+		if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		if !hasValue && key <= SVCParamIPv6Hint && key != SVCParamNoDefaultALPN {
+			return fmt.Errorf("%s needs a value", key)
+		}
+		value, err := packSVCParam(key, string(raw))
+		if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		s.Params = append(s.Params, SVCParam{Key: key, Value: value})
+	}
+	// Parameters can be written in any order but are sent sorted
+	sort.SliceStable(s.Params, func(i, j int) bool {
+		return s.Params[i].Key < s.Params[j].Key
+	})
+	return s.check()
+}
+
+// check enforces the rules from RFC 9460 section 2.2 and 8 about which
+// parameters may appear together.
+func (s *SVCB) check() error {
+	if s.Priority == 0 && len(s.Params) > 0 {
+		return errors.New("an alias can't have service parameters")
+	}
+	present := map[SVCParamKey]bool{}
+	for i, p := range s.Params {
+		if i > 0 && p.Key <= s.Params[i-1].Key {
+			return fmt.Errorf("service parameter %s is out of order or repeated", p.Key)
+		}
+		present[p.Key] = true
+		if _, err := formatSVCParam(p); err != nil {
+			return fmt.Errorf("%s: %v", p.Key, err)
+		}
+	}
+	if present[SVCParamNoDefaultALPN] && !present[SVCParamALPN] {
+		return errors.New("no-default-alpn requires alpn")
+	}
+	for _, k := range s.Mandatory() {
+		if k == SVCParamMandatory {
+			return errors.New("mandatory can't list itself")
+		}
+		if !present[k] {
+			return fmt.Errorf("mandatory parameter %s is missing", k)
+		}
+	}
+	return nil
+}
+
+func (s *SVCB) String() string {
+	parts := []string{strconv.Itoa(int(s.Priority)), s.Target.String()}
+	for _, p := range s.Params {
+		v, err := formatSVCParam(p)
+		if err != nil {
+			// Unpack makes sure this can't happen, but don't lose the data
+			v = formatCharString(p.Value)
+		}
+		if v == "" {
+			parts = append(parts, p.Key.String())
+		} else {
+			parts = append(parts, p.Key.String()+"="+v)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func (s *SVCB) param(k SVCParamKey) ([]byte, bool) {
+	for _, p := range s.Params {
+		if p.Key == k {
+			return p.Value, true
+		}
+	}
+	return nil, false
+}
+
+// ALPN returns the protocol identifiers the service supports.
+func (s *SVCB) ALPN() []string {
+	v, _ := s.param(SVCParamALPN)
+	var ids []string
+	r := newWireReader(v)
+	for r.err == nil && r.len() > 0 {
+		ids = append(ids, string(r.charString()))
+	}
+	return ids
+}
+
+// Port returns the port the service is on, if it isn't the default.
+func (s *SVCB) Port() (uint16, bool) {
+	v, ok := s.param(SVCParamPort)
+	if !ok || len(v) != 2 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(v), true
+}
+
+// IPHints returns the addresses from the ipv4hint and ipv6hint parameters.
+func (s *SVCB) IPHints() []net.IP {
+	var ips []net.IP
+	v4, _ := s.param(SVCParamIPv4Hint)
+	for i := 0; i+net.IPv4len <= len(v4); i += net.IPv4len {
+		ips = append(ips, net.IP(v4[i:i+net.IPv4len]))
+	}
+	v6, _ := s.param(SVCParamIPv6Hint)
+	for i := 0; i+net.IPv6len <= len(v6); i += net.IPv6len {
+		ips = append(ips, net.IP(v6[i:i+net.IPv6len]))
+	}
+	return ips
+}
+
+// ECH returns the encrypted ClientHello configuration list, if there is one.
+func (s *SVCB) ECH() []byte {
+	v, _ := s.param(SVCParamECH)
+	return v
+}
+
+// Mandatory returns the keys that a client must understand to use the record.
+func (s *SVCB) Mandatory() []SVCParamKey {
+	v, _ := s.param(SVCParamMandatory)
+	var keys []SVCParamKey
+	for i := 0; i+2 <= len(v); i += 2 {
+		keys = append(keys, SVCParamKey(binary.BigEndian.Uint16(v[i:])))
+	}
+	return keys
+}
+
+// packSVCParam converts a value in presentation format into wire format.
+func packSVCParam(key SVCParamKey, value string) ([]byte, error) {
+	var buf bytes.Buffer
+	switch key {
+	case SVCParamMandatory:
+		var keys []SVCParamKey
+		for _, s := range splitSVCList(value) {
+			k, err := parseSVCParamKey(s)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+		for i, k := range keys {
+			if i > 0 && keys[i-1] == k {
+				return nil, fmt.Errorf("%s is listed twice", k)
+			}
+			binary.Write(&buf, binary.BigEndian, k)
+		}
+	case SVCParamALPN:
+		for _, id := range splitSVCList(value) {
+			if id == "" || len(id) > 255 {
+				return nil, fmt.Errorf("bad protocol id %q", id)
+			}
+			writeCharString(&buf, []byte(id))
+		}
+	case SVCParamNoDefaultALPN:
+		if value != "" {
+			return nil, errors.New("takes no value")
+		}
+	case SVCParamPort:
+		port, err := parseUint16(unescapeSVCValue(value))
+		if err != nil {
+			return nil, err
+		}
+		binary.Write(&buf, binary.BigEndian, port)
+	case SVCParamIPv4Hint, SVCParamIPv6Hint:
+		for _, s := range strings.Split(value, ",") {
+			ip := net.ParseIP(s)
+			if key == SVCParamIPv4Hint {
+				if ip == nil || ip.To4() == nil || strings.Contains(s, ":") {
+					return nil, fmt.Errorf("bad IPv4 address %q", s)
+				}
+				buf.Write(ip.To4())
+			} else {
+				if ip == nil || !strings.Contains(s, ":") {
+					return nil, fmt.Errorf("bad IPv6 address %q", s)
+				}
+				buf.Write(ip.To16())
+			}
+		}
+	case SVCParamECH:
+		ech, err := base64.StdEncoding.DecodeString(unescapeSVCValue(value))
+		if err != nil {
+			return nil, fmt.Errorf("bad base64: %v", err)
+		}
+		buf.Write(ech)
+	default:
+		buf.WriteString(unescapeSVCValue(value))
+	}
+	return buf.Bytes(), nil
+}
+
+// formatSVCParam converts a value into presentation format, checking that it's
+// well formed as it goes.
+func formatSVCParam(p SVCParam) (string, error) {
+	v := p.Value
+	switch p.Key {
+	case SVCParamMandatory:
+		if len(v) == 0 || len(v)%2 != 0 {
+			return "", errors.New("bad length")
+		}
+		var keys []string
+		for i := 0; i < len(v); i += 2 {
+			k := SVCParamKey(binary.BigEndian.Uint16(v[i:]))
+			if i > 0 && k <= SVCParamKey(binary.BigEndian.Uint16(v[i-2:])) {
+				return "", errors.New("keys are out of order")
+			}
+			keys = append(keys, k.String())
+		}
+		return strings.Join(keys, ","), nil
+	case SVCParamALPN:
+		var ids []string
+		r := newWireReader(v)
+		for r.err == nil && r.len() > 0 {
+			id := r.charString()
+			if r.err == nil && len(id) == 0 {
+				return "", errors.New("empty protocol id")
+			}
+			ids = append(ids, strings.NewReplacer(`\`, `\\`, `,`, `\,`).Replace(string(id)))
+		}
+		if len(ids) == 0 {
+			return "", errors.New("no protocol ids")
+		}
+		if err := r.finish(); err != nil {
+			return "", err
+		}
+		list := strings.Join(ids, ",")
+		if strings.ContainsAny(list, " \t\";()") {
+			return `"` + strings.Replace(list, `"`, `\"`, -1) + `"`, nil
+		}
+		return list, nil
+	case SVCParamNoDefaultALPN:
+		if len(v) != 0 {
+			return "", errors.New("takes no value")
+		}
+		return "", nil
+	case SVCParamPort:
+		if len(v) != 2 {
+			return "", errors.New("bad length")
+		}
+		return strconv.Itoa(int(binary.BigEndian.Uint16(v))), nil
+	case SVCParamIPv4Hint, SVCParamIPv6Hint:
+		size := net.IPv4len
+		if p.Key == SVCParamIPv6Hint {
+			size = net.IPv6len
+		}
+		if len(v) == 0 || len(v)%size != 0 {
+			return "", errors.New("bad length")
+		}
+		var ips []string
+		for i := 0; i < len(v); i += size {
+			ips = append(ips, net.IP(v[i:i+size]).String())
+		}
+		return strings.Join(ips, ","), nil
+	case SVCParamECH:
+		return base64.StdEncoding.EncodeToString(v), nil
+	}
+	if len(v) == 0 {
+		return "", nil
+	}
+	return formatCharString(v), nil
+}
+
+// splitSVCList splits a comma separated list, where a comma can be escaped
+// with a backslash as in RFC 9460 appendix A.1.
+func splitSVCList(s string) []string {
+	var items []string
+	var cur strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s):
+			i++
+			cur.WriteByte(s[i])
+		case s[i] == ',':
+			items = append(items, cur.String())
+			cur.Reset()
+		default:
+			cur.WriteByte(s[i])
+		}
+	}
+	return append(items, cur.String())
+}
+
+// unescapeSVCValue removes the escapes that parseCharStringLong leaves in for
+// values that aren't lists.
+func unescapeSVCValue(s string) string {
+	return strings.NewReplacer(`\,`, ",", `\\`, `\`).Replace(s)
+}
+
+// parseCharStringLong is like parseCharString but without the 255 octet limit,
+// because SVCB parameter values can be longer than that. Escaped commas are
+// left escaped so that lists can still be split.
+func parseCharStringLong(s string) ([]byte, error) {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		s = s[1 : len(s)-1]
+	}
+	out, err := unescape(s, 0, `,\`)
+	if err != nil {
+		return nil, fmt.Errorf("string %q: %v", s, err)
+	}
+	return out, nil
+}
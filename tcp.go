@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+// tcpIdleTimeout is how long we keep a client's TCP connection open waiting
+// for its next query. RFC 7766 section 6.2.3 suggests seconds rather than
+// minutes.
+const tcpIdleTimeout = 10 * time.Second
+
+// readTCPMessage reads one message from a stream, where each is preceded by
+// its length as described in RFC 1035 section 4.2.2.
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	b := make([]byte, length)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// writeTCPMessage writes one length prefixed message to a stream. The prefix
+// and message go in a single write so they usually end up in one segment.
+func writeTCPMessage(w io.Writer, b []byte) error {
+	if len(b) > 0xFFFF {
+		return errors.New("message is too long for TCP")
+	}
+	framed := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(framed, uint16(len(b)))
+	copy(framed[2:], b)
+	_, err := w.Write(framed)
+	return err
+}
+
+// serveStream accepts connections on l until it's closed, answering the
+// queries on each with serveConn. It serves plain TCP and, wrapped in TLS,
+// DNS over TLS.
+func (s *Server) serveStream(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			log.Println("error accepting connection:", err)
+			continue
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// serveConn answers the queries on a TCP connection one after another, until
+// the client goes quiet or hangs up. Zone transfers are streamed back as a
+// series of messages.
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+		b, err := readTCPMessage(conn)
+		if err != nil {
+			return
+		}
+		m, c, ans := s.receive(b, conn.RemoteAddr())
+		if ans == nil && isTransfer(m) {
+			err = s.transfer(conn, m, c)
+		} else {
+			err = writeTCPMessage(conn, s.reply(m, c, ans, 0xFFFF))
+		}
+		if err != nil {
+			log.Printf("writing to %v: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
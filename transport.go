@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/quic"
+)
+
+// encryptedTransport carries queries to a server over TLS, HTTPS or QUIC.
+type encryptedTransport interface {
+	exchange(ctx context.Context, req []byte) ([]byte, error)
+}
+
+// upstream is where parseUpstream found a server to be. At most one of the
+// encrypted ways of reaching it is set.
+type upstream struct {
+	// plain is the server's address for plain DNS
+	plain    string
+	tlsAddr  string
+	quicAddr string
+	dohURL   string
+}
+
+// parseUpstream works out how to reach a server given as "host:port",
+// "tls://host[:port]", "quic://host[:port]" or "https://host[:port]/path".
+// For the encrypted ones it keeps the address or URL to build the transport
+// from, along with the plain address on port 53 that opportunistic clients
+// fall back to.
+func parseUpstream(server string) (upstream, error) {
+	switch {
+	case strings.HasPrefix(server, "tls://"):
+		addr := withDefaultPort(strings.TrimPrefix(server, "tls://"), "853")
+		host, _, _ := net.SplitHostPort(addr)
+		return upstream{plain: net.JoinHostPort(host, "53"), tlsAddr: addr}, nil
+	case strings.HasPrefix(server, "quic://"):
+		// RFC 9250 section 4.1.1 uses the same port as DNS over TLS
+		addr := withDefaultPort(strings.TrimPrefix(server, "quic://"), "853")
+		host, _, _ := net.SplitHostPort(addr)
+		return upstream{plain: net.JoinHostPort(host, "53"), quicAddr: addr}, nil
+	case strings.HasPrefix(server, "https://"):
+		rest := strings.TrimPrefix(server, "https://")
+		hostPort, path, _ := strings.Cut(rest, "/")
+		if hostPort == "" {
+			return upstream{}, fmt.Errorf("no host in %q", server)
+		}
+		if path == "" {
+			path = "dns-query"
+		}
+		host := strings.Trim(hostPort, "[]")
+		if h, _, err := net.SplitHostPort(hostPort); err == nil {
+			host = h
+		}
+		return upstream{plain: net.JoinHostPort(host, "53"), dohURL: "https://" + hostPort + "/" + path}, nil
+	}
+	return upstream{plain: server}, nil
+}
+
+// withDefaultPort adds port to addr unless it already has one.
+func withDefaultPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return net.JoinHostPort(strings.Trim(addr, "[]"), port)
+	}
+	return addr
+}
+
+// tlsConfig builds the TLS config for the client's encrypted transport. With
+// SPKI pins the server's certificate only has to carry one of the pinned
+// keys or chain up to one, as described in RFC 7858 section 4.2, and
+// otherwise it's checked against RootCAs as usual.
+func (cli *Client) tlsConfig(serverName string) *tls.Config {
+	config := &tls.Config{
+		ServerName:         serverName,
+		RootCAs:            cli.RootCAs,
+		MinVersion:         tls.VersionTLS12,
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+	}
+	if len(cli.SPKIPins) > 0 {
+		pins := cli.SPKIPins
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			return checkSPKIPins(cs.PeerCertificates, pins)
+		}
+	}
+	return config
+}
+
+// checkSPKIPins makes sure the server's certificate carries one of pins, the
+// base64 SHA-256 digests of public keys, or chains up to a certificate that
+// does. The chain has to check out: anyone can send a copy of a pinned CA's
+// certificate after their own.
+func checkSPKIPins(certs []*x509.Certificate, pins []string) error {
+	if len(certs) == 0 {
+		return errors.New("no certificate to check the SPKI pins against")
+	}
+	pinned := func(cert *x509.Certificate) bool {
+		digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		pin := base64.StdEncoding.EncodeToString(digest[:])
+		for _, p := range pins {
+			if p == pin {
+				return true
+			}
+		}
+		return false
+	}
+	// The handshake proved the server has the leaf's private key
+	if pinned(certs[0]) {
+		return nil
+	}
+	roots, intermediates := x509.NewCertPool(), x509.NewCertPool()
+	var found bool
+	for _, cert := range certs[1:] {
+		if pinned(cert) {
+			roots.AddCert(cert)
+			found = true
+		} else {
+			intermediates.AddCert(cert)
+		}
+	}
+	if !found {
+		return errors.New("no certificate matches the SPKI pins")
+	}
+	if _, err := certs[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates}); err != nil {
+		return fmt.Errorf("certificate doesn't chain to a pinned key: %v", err)
+	}
+	return nil
+}
+
+// transport returns the client's encrypted transport, setting it up the first
+// time it's needed, or nil if the client talks plain DNS.
+func (cli *Client) transport() encryptedTransport {
+	cli.transportOnce.Do(func() {
+		switch {
+		case cli.tlsAddr != "":
+			host, _, _ := net.SplitHostPort(cli.tlsAddr)
+			config := cli.tlsConfig(host)
+			config.NextProtos = []string{"dot"}
+			cli.encrypted = &dotTransport{addr: cli.tlsAddr, config: config}
+		case cli.quicAddr != "":
+			host, _, _ := net.SplitHostPort(cli.quicAddr)
+			config := cli.tlsConfig(host)
+			config.NextProtos = []string{"doq"}
+			cli.encrypted = &doqTransport{addr: cli.quicAddr, config: &quic.Config{TLSConfig: config}}
+		case cli.dohURL != "":
+			host := strings.TrimPrefix(cli.dohURL, "https://")
+			host, _, _ = strings.Cut(host, "/")
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			cli.encrypted = &dohTransport{
+				url: cli.dohURL,
+				client: &http.Client{
+					Timeout: queryTimeout,
+					Transport: &http.Transport{
+						TLSClientConfig:   cli.tlsConfig(strings.Trim(host, "[]")),
+						ForceAttemptHTTP2: true,
+						IdleConnTimeout:   time.Minute,
+					},
+				},
+			}
+		}
+	})
+	return cli.encrypted
+}
+
+// dotTransport sends queries over DNS over TLS (RFC 7858). It keeps one
+// connection open and sends its queries on it one at a time.
+type dotTransport struct {
+	addr   string
+	config *tls.Config
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (t *dotTransport) exchange(ctx context.Context, req []byte) ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// The server may have closed a connection we kept while it sat idle, so
+	// a failure on one gets a second try on a fresh connection
+	for {
+		// A query given up on while it waited its turn isn't sent at all
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		fresh := t.conn == nil
+		if fresh {
+			dialer := &tls.Dialer{NetDialer: &net.Dialer{Timeout: queryTimeout}, Config: t.config}
+			conn, err := dialer.DialContext(ctx, "tcp", t.addr)
+			if err != nil {
+				return nil, fmt.Errorf("dialing %s over TLS: %v", t.addr, err)
+			}
+			t.conn = conn
+		}
+		conn := t.conn
+		conn.SetDeadline(time.Now().Add(queryTimeout))
+		// Giving up partway through a query leaves the connection out of
+		// step, so it's closed along with the query
+		stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+		err := writeTCPMessage(conn, req)
+		var b []byte
+		if err == nil {
+			b, err = readTCPMessage(conn)
+		}
+		stop()
+		if err == nil {
+			return b, nil
+		}
+		conn.Close()
+		t.conn = nil
+		if fresh || ctx.Err() != nil {
+			return nil, fmt.Errorf("querying %s over TLS: %v", t.addr, err)
+		}
+	}
+}
+
+// dohTransport sends queries over DNS over HTTPS (RFC 8484), as POSTs. The
+// HTTP client keeps its connections open between queries.
+type dohTransport struct {
+	url    string
+	client *http.Client
+}
+
+func (t *dohTransport) exchange(ctx context.Context, req []byte) ([]byte, error) {
+	// Section 4.1 asks for an ID of 0, so that identical queries make
+	// identical requests for HTTP caches. The ID goes back on the answer.
+	id := binary.BigEndian.Uint16(req)
+	body := append([]byte{}, req...)
+	binary.BigEndian.PutUint16(body, 0)
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", dohContentType)
+	r.Header.Set("Accept", dohContentType)
+	resp, err := t.client.Do(r)
+	if err != nil {
+		return nil, fmt.Errorf("querying %s: %v", t.url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("querying %s: %s", t.url, resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 0xFFFF))
+	if err != nil {
+		return nil, fmt.Errorf("reading response from %s: %v", t.url, err)
+	}
+	if len(b) < 12 {
+		return nil, fmt.Errorf("response from %s is too short", t.url)
+	}
+	binary.BigEndian.PutUint16(b, id)
+	return b, nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"net"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseUpstream(t *testing.T) {
+	type Test struct {
+		Server   string
+		Expected upstream
+	}
+	tests := []Test{
+		{"8.8.8.8:53", upstream{plain: "8.8.8.8:53"}},
+		{"tls://dns.example", upstream{plain: "dns.example:53", tlsAddr: "dns.example:853"}},
+		{"tls://[2001:db8::1]:8853", upstream{plain: "[2001:db8::1]:53", tlsAddr: "[2001:db8::1]:8853"}},
+		{"quic://dns.example", upstream{plain: "dns.example:53", quicAddr: "dns.example:853"}},
+		{"quic://[2001:db8::1]", upstream{plain: "[2001:db8::1]:53", quicAddr: "[2001:db8::1]:853"}},
+		{"https://dns.example", upstream{plain: "dns.example:53", dohURL: "https://dns.example/dns-query"}},
+		{"https://dns.example:8443/resolve", upstream{plain: "dns.example:53", dohURL: "https://dns.example:8443/resolve"}},
+	}
+	for _, test := range tests {
+		u, err := parseUpstream(test.Server)
+		if err != nil {
+			t.Errorf("%s: %v", test.Server, err)
+			continue
+		}
+		if u != test.Expected {
+			t.Errorf("%s: expected %+v, got %+v", test.Server, test.Expected, u)
+		}
+	}
+}
+
+func TestEncryptedClient(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	cert := writeTestCert(t, certFile, keyFile, 1)
+	config, err := LoadTLSConfig(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{}
+	s.AddZone(mustParseZone(t, testZone, "example.com"))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeTLS(l, config)
+	defer l.Close()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeQUIC(pc, config)
+	defer pc.Close()
+	doh := httptest.NewUnstartedServer(s)
+	doh.EnableHTTP2 = true
+	doh.StartTLS()
+	defer doh.Close()
+	// The plain server answers when opportunistic clients fall back
+	_, plainAddr := startPrimary(t, mustParseZone(t, testZone, "example.com"), nil)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	dohRoots := x509.NewCertPool()
+	dohRoots.AddCert(doh.Certificate())
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(digest[:])
+
+	type Test struct {
+		Description   string
+		Server        string
+		Roots         *x509.CertPool
+		Pins          []string
+		Opportunistic bool
+		Succeeds      bool
+	}
+	tests := []Test{
+		{"TLS", "tls://" + l.Addr().String(), roots, nil, false, true},
+		{"TLS with an untrusted certificate", "tls://" + l.Addr().String(), nil, nil, false, false},
+		{"TLS with a pinned key", "tls://" + l.Addr().String(), nil, []string{pin}, false, true},
+		{"TLS with the wrong pin", "tls://" + l.Addr().String(), roots, []string{base64.StdEncoding.EncodeToString(make([]byte, 32))}, false, false},
+		{"Falling back to plain DNS", "tls://" + l.Addr().String(), nil, nil, true, true},
+		{"QUIC", "quic://" + pc.LocalAddr().String(), roots, nil, false, true},
+		{"QUIC with an untrusted certificate", "quic://" + pc.LocalAddr().String(), nil, nil, false, false},
+		{"QUIC with a pinned key", "quic://" + pc.LocalAddr().String(), nil, []string{pin}, false, true},
+		{"HTTPS", doh.URL + "/dns-query", dohRoots, nil, false, true},
+		{"HTTPS with an untrusted certificate", doh.URL + "/dns-query", roots, nil, false, false},
+	}
+	for _, test := range tests {
+		cli, err := NewClient(test.Server)
+		if err != nil {
+			t.Fatalf("%s: %v", test.Description, err)
+		}
+		cli.RootCAs, cli.SPKIPins, cli.Opportunistic = test.Roots, test.Pins, test.Opportunistic
+		cli.addr, _ = net.ResolveUDPAddr("udp", plainAddr)
+
+		for i := 0; i < 2; i++ {
+			m, err := cli.Resolve(Question{Name: MustParseName("www.example.com"), Type: TypeA, Class: ClassIN})
+			if (err == nil) != test.Succeeds {
+				t.Errorf("%s: expected success %v, got %v", test.Description, test.Succeeds, err)
+				break
+			}
+			if err == nil && len(m.Answer) != 1 {
+				t.Errorf("%s: expected an answer, got %v", test.Description, m)
+			}
+		}
+		if dot, ok := cli.encrypted.(*dotTransport); ok && test.Succeeds && !test.Opportunistic && dot.conn == nil {
+			t.Errorf("%s: expected the connection to be kept for reuse", test.Description)
+		}
+		if doq, ok := cli.encrypted.(*doqTransport); ok && test.Succeeds && doq.conn == nil {
+			t.Errorf("%s: expected the connection to be kept for reuse", test.Description)
+		}
+	}
+}
+
+func TestCheckSPKIPins(t *testing.T) {
+	newCert := func(name string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			IsCA:         isCA,
+
+			BasicConstraintsValid: true,
+		}
+		if parent == nil {
+			parent, parentKey = template, key
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert, key
+	}
+	pin := func(cert *x509.Certificate) string {
+		digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		return base64.StdEncoding.EncodeToString(digest[:])
+	}
+	ca, caKey := newCert("ca", true, nil, nil)
+	intermediate, intermediateKey := newCert("intermediate", true, ca, caKey)
+	leaf, _ := newCert("dns.example", false, intermediate, intermediateKey)
+	forged, _ := newCert("dns.example", false, nil, nil)
+
+	type Test struct {
+		Description string
+		Chain       []*x509.Certificate
+		Pins        []string
+		Succeeds    bool
+	}
+	tests := []Test{
+		{"Pinned leaf", []*x509.Certificate{leaf}, []string{pin(leaf)}, true},
+		{"Pinned CA", []*x509.Certificate{leaf, intermediate, ca}, []string{pin(ca)}, true},
+		{"Pinned intermediate", []*x509.Certificate{leaf, intermediate, ca}, []string{pin(intermediate)}, true},
+		{"No pinned key", []*x509.Certificate{leaf, intermediate, ca}, []string{pin(forged)}, false},
+		{"Forged leaf with the pinned CA", []*x509.Certificate{forged, intermediate, ca}, []string{pin(ca)}, false},
+		{"Forged leaf with the pinned intermediate", []*x509.Certificate{forged, intermediate}, []string{pin(intermediate)}, false},
+		{"No certificates", nil, []string{pin(leaf)}, false},
+	}
+	for _, test := range tests {
+		err := checkSPKIPins(test.Chain, test.Pins)
+		if (err == nil) != test.Succeeds {
+			t.Errorf("%s: expected success %v, got %v", test.Description, test.Succeeds, err)
+		}
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RootAnchors returns the DS records of the root zone's key signing keys, as
+// published by IANA.
+func RootAnchors() []ResourceRecord {
+	var anchors []ResourceRecord
+	for _, ds := range []string{
+		"20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+		"38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+	} {
+		data, err := ParseRData(TypeDS, strings.Fields(ds), Name{})
+		if err != nil {
+			panic(err)
+		}
+		anchors = append(anchors, ResourceRecord{Name: Name{}, Type: TypeDS, Class: ClassIN, Data: data})
+	}
+	return anchors
+}
+
+// LoadTrustAnchors reads the DS and DNSKEY records to trust from a master
+// file. Each record is an anchor for the zone named by its owner.
+func LoadTrustAnchors(path string) ([]ResourceRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	records, err := parseRecords(f, Name{})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for _, rr := range records {
+		if rr.Type != TypeDS && rr.Type != TypeDNSKEY {
+			return nil, fmt.Errorf("%s: trust anchors must be DS or DNSKEY records, not %s", path, rr.Type)
+		}
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("%s: no trust anchors", path)
+	}
+	return records, nil
+}
+
+// Hold-down timers from RFC 5011 section 2.4. A new key has to be seen for
+// addHoldDown before we trust it, so that an attacker who briefly controls a
+// zone's keys can't slip in one of their own. A revoked key is remembered for
+// removeHoldDown so that it isn't mistaken for a new one.
+const (
+	addHoldDown    = 30 * 24 * time.Hour
+	removeHoldDown = 30 * 24 * time.Hour
+)
+
+// AnchorState is where a managed trust anchor is in the RFC 5011 state
+// machine.
+type AnchorState int
+
+const (
+	// AnchorAddPend keys have been seen but are waiting out the add hold-down
+	AnchorAddPend AnchorState = iota
+	// AnchorValid keys are trusted
+	AnchorValid
+	// AnchorMissing keys are trusted but have gone from the zone's DNSKEY RRset
+	AnchorMissing
+	// AnchorRevoked keys have revoked themselves and are no longer trusted
+	AnchorRevoked
+)
+
+var anchorStateNames = map[AnchorState]string{
+	AnchorAddPend: "addpend",
+	AnchorValid:   "valid",
+	AnchorMissing: "missing",
+	AnchorRevoked: "revoked",
+}
+
+func (s AnchorState) String() string {
+	return anchorStateNames[s]
+}
+
+func parseAnchorState(s string) (AnchorState, error) {
+	for state, name := range anchorStateNames {
+		if name == s {
+			return state, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown trust anchor state %q", s)
+}
+
+// managedAnchor is a key signing key we're tracking for a zone.
+type managedAnchor struct {
+	zone  Name
+	key   *DNSKEY
+	state AnchorState
+	// since is when the key entered its current state
+	since time.Time
+}
+
+// TrustAnchors are the keys the validator starts its chains of trust from.
+// Static anchors never change. Managed anchors follow the zone's own key
+// rollovers as described in RFC 5011: they start out from a configured set,
+// and after that new keys are trusted once they've been signed by a trusted
+// key for long enough, and keys that revoke themselves are dropped.
+type TrustAnchors struct {
+	static []ResourceRecord
+	// initial are the configured anchors for the managed zones, which we rely
+	// on until we've seen the zones' keys for ourselves
+	initial []ResourceRecord
+	// path is where the managed anchors' state is kept, if anywhere
+	path string
+	now  func() time.Time
+
+	mu      sync.Mutex
+	managed []*managedAnchor
+}
+
+// NewTrustAnchors sets up static anchors, which are always trusted as they
+// are, and managed ones, which are kept up to date with the state saved in the
+// file at path. The path may be empty to keep the state in memory only.
+func NewTrustAnchors(static, managed []ResourceRecord, path string) (*TrustAnchors, error) {
+	a := &TrustAnchors{static: static, initial: managed, path: path, now: time.Now}
+	if path == "" {
+		return a, nil
+	}
+	if err := a.load(); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return a, nil
+}
+
+// StaticTrustAnchors trusts exactly the given records.
+func StaticTrustAnchors(records []ResourceRecord) *TrustAnchors {
+	return &TrustAnchors{static: records, now: time.Now}
+}
+
+// For returns the DS and DNSKEY records to trust for zone.
+func (a *TrustAnchors) For(zone Name) []ResourceRecord {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	anchors := filterName(a.static, zone)
+	var tracked bool
+	for _, m := range a.managed {
+		if !m.zone.Equal(zone) {
+			continue
+		}
+		tracked = true
+		if m.state == AnchorValid || m.state == AnchorMissing {
+			anchors = append(anchors, ResourceRecord{Name: m.zone, Type: TypeDNSKEY, Class: ClassIN, Data: m.key.Pack()})
+		}
+	}
+	if !tracked {
+		anchors = append(anchors, filterName(a.initial, zone)...)
+	}
+	return anchors
+}
+
+// Zones returns the zones whose anchors are managed.
+func (a *TrustAnchors) Zones() []Name {
+	var zones []Name
+	for _, rr := range a.initial {
+		dup := false
+		for _, z := range zones {
+			dup = dup || z.Equal(rr.Name)
+		}
+		if !dup {
+			zones = append(zones, rr.Name)
+		}
+	}
+	return zones
+}
+
+// isManaged reports whether zone's anchors follow RFC 5011.
+func (a *TrustAnchors) isManaged(zone Name) bool {
+	return len(filterName(a.initial, zone)) > 0
+}
+
+// observe updates the managed anchors for zone from answer, which holds a
+// DNSKEY RRset that has just been validated using the current anchors.
+func (a *TrustAnchors) observe(zone Name, answer []ResourceRecord) {
+	if !a.isManaged(zone) {
+		return
+	}
+	set := filterName(filterType(answer, TypeDNSKEY), zone)
+	var sigs []*RRSIG
+	for _, rr := range filterName(filterType(answer, TypeRRSIG), zone) {
+		sig := &RRSIG{}
+		if sig.Unpack(rr.Data) == nil && sig.TypeCovered == TypeDNSKEY {
+			sigs = append(sigs, sig)
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.now()
+	changed := false
+	bootstrapping := true
+	for _, m := range a.managed {
+		if m.zone.Equal(zone) {
+			bootstrapping = false
+		}
+	}
+
+	seen := map[*managedAnchor]bool{}
+	for _, rr := range set {
+		key := &DNSKEY{}
+		if key.Unpack(rr.Data) != nil || key.Flags&DNSKEYFlagSEP == 0 {
+			continue
+		}
+		revoked := key.Flags&DNSKEYFlagRevoke != 0
+		m := a.find(zone, key)
+		if revoked {
+			// Only the key itself can revoke itself
+			if m == nil || m.state == AnchorRevoked || !selfSigned(key, set, sigs) {
+				continue
+			}
+			m.state, m.since = AnchorRevoked, now
+			changed = true
+			continue
+		}
+		if m == nil {
+			m = &managedAnchor{zone: zone, key: key, state: AnchorAddPend, since: now}
+			if bootstrapping && a.matchesInitial(zone, key) {
+				// The keys we were configured with are trusted from the start
+				m.state = AnchorValid
+			}
+			a.managed = append(a.managed, m)
+			changed = true
+		}
+		seen[m] = true
+		switch {
+		case m.state == AnchorAddPend && !now.Before(m.since.Add(addHoldDown)):
+			m.state, m.since = AnchorValid, now
+			changed = true
+		case m.state == AnchorMissing:
+			m.state, m.since = AnchorValid, now
+			changed = true
+		}
+	}
+
+	var kept []*managedAnchor
+	for _, m := range a.managed {
+		if m.zone.Equal(zone) && !seen[m] {
+			switch m.state {
+			case AnchorAddPend:
+				// A new key that goes away has to start its hold-down again
+				changed = true
+				continue
+			case AnchorValid:
+				m.state, m.since = AnchorMissing, now
+				changed = true
+			case AnchorRevoked:
+				if !now.Before(m.since.Add(removeHoldDown)) {
+					changed = true
+					continue
+				}
+			}
+		}
+		kept = append(kept, m)
+	}
+	a.managed = kept
+
+	if changed && a.path != "" {
+		if err := a.save(); err != nil {
+			log.Printf("saving trust anchors to %s: %v", a.path, err)
+		}
+	}
+}
+
+// find returns the anchor for key, ignoring the revoke bit.
+func (a *TrustAnchors) find(zone Name, key *DNSKEY) *managedAnchor {
+	k := *key
+	k.Flags &^= DNSKEYFlagRevoke
+	data := k.Pack()
+	for _, m := range a.managed {
+		mk := *m.key
+		mk.Flags &^= DNSKEYFlagRevoke
+		if m.zone.Equal(zone) && bytes.Equal(mk.Pack(), data) {
+			return m
+		}
+	}
+	return nil
+}
+
+func (a *TrustAnchors) matchesInitial(zone Name, key *DNSKEY) bool {
+	for _, rr := range filterName(a.initial, zone) {
+		switch rr.Type {
+		case TypeDS:
+			d := &DS{}
+			if d.Unpack(rr.Data) == nil && d.Matches(zone, key) {
+				return true
+			}
+		case TypeDNSKEY:
+			if bytes.Equal(rr.Data, key.Pack()) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// selfSigned reports whether key signed the DNSKEY RRset, which RFC 5011
+// requires of a revoked key.
+func selfSigned(key *DNSKEY, set []ResourceRecord, sigs []*RRSIG) bool {
+	for _, sig := range sigs {
+		if checkSignature(sig, key, set) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// save writes the managed anchors to the state file, one per line as the zone,
+// state, the time it entered that state and the DNSKEY data. It writes to a
+// temporary file first so a crash can't leave it half written.
+func (a *TrustAnchors) save() error {
+	var sb strings.Builder
+	sb.WriteString("; RFC 5011 trust anchor state\n")
+	for _, m := range a.managed {
+		fmt.Fprintf(&sb, "%s %s %s %s\n", m.zone, m.state, m.since.UTC().Format(time.RFC3339), m.key)
+	}
+	tmp := a.path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(sb.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.path)
+}
+
+func (a *TrustAnchors) load() error {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, ";") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			return fmt.Errorf("line %d: expected a zone, state, time and key", n)
+		}
+		m := &managedAnchor{key: &DNSKEY{}}
+		if m.zone, err = ParseName(fields[0]); err != nil {
+			return fmt.Errorf("line %d: %v", n, err)
+		}
+		if m.state, err = parseAnchorState(fields[1]); err != nil {
+			return fmt.Errorf("line %d: %v", n, err)
+		}
+		if m.since, err = time.Parse(time.RFC3339, fields[2]); err != nil {
+			return fmt.Errorf("line %d: %v", n, err)
+		}
+		if err := m.key.Parse(fields[3:], m.zone); err != nil {
+			return fmt.Errorf("line %d: %v", n, err)
+		}
+		a.managed = append(a.managed, m)
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTrustAnchorRollover(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "anchors.state")
+	old := newTestSigner(t, ".", AlgorithmED25519)
+	next := newTestSigner(t, ".", AlgorithmED25519)
+	initial := []ResourceRecord{old.ds(t)}
+	a, err := NewTrustAnchors(nil, initial, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	a.now = func() time.Time { return now }
+
+	// observe hands the anchors a DNSKEY RRset signed by signers
+	observe := func(keys []*testSigner, signers ...*testSigner) {
+		var set []ResourceRecord
+		for _, k := range keys {
+			set = append(set, k.dnskey())
+		}
+		answer := set
+		for _, s := range signers {
+			answer = append(answer, s.sign(t, set))
+		}
+		a.observe(Name{}, answer)
+	}
+	trusted := func(description string, expected ...*testSigner) {
+		anchors := a.For(Name{})
+		if len(anchors) != len(expected) {
+			t.Errorf("%s: expected %d anchors, got %d", description, len(expected), len(anchors))
+			return
+		}
+		for i, k := range expected {
+			if anchors[i].Type != TypeDNSKEY || string(anchors[i].Data) != string(k.key.Pack()) {
+				t.Errorf("%s: unexpected anchor %v", description, anchors[i])
+			}
+		}
+	}
+
+	if anchors := a.For(Name{}); len(anchors) != 1 || anchors[0].Type != TypeDS {
+		t.Fatalf("expected the configured DS before any keys have been seen, got %v", anchors)
+	}
+	observe([]*testSigner{old, next}, old)
+	trusted("new key seen", old)
+	now = now.Add(addHoldDown / 2)
+	observe([]*testSigner{old, next}, old)
+	trusted("new key still in hold-down", old)
+	now = now.Add(addHoldDown / 2)
+	observe([]*testSigner{old, next}, old)
+	trusted("hold-down over", old, next)
+
+	// A revocation has to be signed by the revoked key itself
+	revoked := &testSigner{zone: old.zone, key: &DNSKEY{}, sk: &SigningKey{DNSKEY: &DNSKEY{}}}
+	*revoked.key = *old.key
+	revoked.key.Flags |= DNSKEYFlagRevoke
+	revoked.sk.DNSKEY, revoked.sk.private = revoked.key, old.sk.private
+	observe([]*testSigner{revoked, next}, next)
+	trusted("forged revocation", old, next)
+	observe([]*testSigner{revoked, next}, revoked, next)
+	trusted("revoked", next)
+
+	reloaded, err := NewTrustAnchors(nil, initial, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if anchors := reloaded.For(Name{}); len(anchors) != 1 || string(anchors[0].Data) != string(next.key.Pack()) {
+		t.Errorf("expected the state to survive a restart, got %v", anchors)
+	}
+
+	now = now.Add(removeHoldDown)
+	observe([]*testSigner{next}, next)
+	trusted("revoked key removed", next)
+	if len(a.managed) != 1 {
+		t.Errorf("expected the revoked key to be forgotten, have %d keys", len(a.managed))
+	}
+}
+
+func TestValidatorBootstrapsManagedAnchors(t *testing.T) {
+	h := newTestHierarchy(t)
+	anchors, err := NewTrustAnchors(nil, []ResourceRecord{h.root.ds(t)}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := h.validator(t, time.Now())
+	v.anchors = anchors
+	www := testRecords(t, "www.example. 300 IN A 192.0.2.1")
+	www = append(www, h.example.sign(t, www))
+	q := Question{Name: MustParseName("www.example."), Type: TypeA, Class: ClassIN}
+	if status, err := v.Validate(q, Message{Answer: www}); status != StatusSecure {
+		t.Fatalf("expected secure, got %s (%v)", status, err)
+	}
+	if a := anchors.For(Name{}); len(a) != 1 || a[0].Type != TypeDNSKEY {
+		t.Errorf("expected the root key to be tracked as a DNSKEY anchor, got %v", a)
+	}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"strings"
+	"time"
+)
+
+// The TSIG algorithms we support, named as in RFC 8945 section 6.
+var (
+	HMACSHA256 = MustParseName("hmac-sha256.")
+	HMACSHA512 = MustParseName("hmac-sha512.")
+)
+
+// tsigFudge is how far apart our clock and a peer's may be, in seconds. RFC
+// 8945 section 10 recommends 300.
+const tsigFudge = 300
+
+// TSIGError is the error field of a TSIG record, which explains why a signed
+// message was rejected.
+type TSIGError uint16
+
+const (
+	TSIGBadSig  TSIGError = 16
+	TSIGBadKey  TSIGError = 17
+	TSIGBadTime TSIGError = 18
+)
+
+func (e TSIGError) Error() string {
+	switch e {
+	case TSIGBadSig:
+		return "BADSIG"
+	case TSIGBadKey:
+		return "BADKEY"
+	case TSIGBadTime:
+		return "BADTIME"
+	}
+	return fmt.Sprintf("TSIG error %d", uint16(e))
+}
+
+// TSIG is the transaction signature record from RFC 8945, which authenticates
+// a whole message with a shared secret. It only ever appears as the last
+// record of a message, and never in a zone.
+type TSIG struct {
+	Algorithm Name
+	// TimeSigned is in seconds since the epoch, and is 48 bits on the wire
+	TimeSigned uint64
+	Fudge      uint16
+	MAC        []byte
+	OriginalID uint16
+	Error      TSIGError
+	OtherData  []byte
+}
+
+func (t *TSIG) Pack() []byte {
+	var buf bytes.Buffer
+	writeName(&buf, t.Algorithm)
+	t.writeTime(&buf)
+	binary.Write(&buf, binary.BigEndian, uint16(len(t.MAC)))
+	buf.Write(t.MAC)
+	binary.Write(&buf, binary.BigEndian, t.OriginalID)
+	binary.Write(&buf, binary.BigEndian, t.Error)
+	binary.Write(&buf, binary.BigEndian, uint16(len(t.OtherData)))
+	buf.Write(t.OtherData)
+	return buf.Bytes()
+}
+
+// writeTime writes the time signed and fudge, which are called the timers in
+// RFC 8945.
+func (t *TSIG) writeTime(buf *bytes.Buffer) {
+	binary.Write(buf, binary.BigEndian, uint16(t.TimeSigned>>32))
+	binary.Write(buf, binary.BigEndian, uint32(t.TimeSigned))
+	binary.Write(buf, binary.BigEndian, t.Fudge)
+}
+
+func (t *TSIG) Unpack(data []byte) error {
+	r := newWireReader(data)
+	t.Algorithm = r.name()
+	t.TimeSigned = uint64(r.uint16())<<32 | uint64(r.uint32())
+	t.Fudge = r.uint16()
+	t.MAC = r.bytes(int(r.uint16()))
+	t.OriginalID = r.uint16()
+	t.Error = TSIGError(r.uint16())
+	t.OtherData = r.bytes(int(r.uint16()))
+	return r.finish()
+}
+
+func (t *TSIG) Parse(fields []string, origin Name) error {
+	return errors.New("TSIG records only appear in messages")
+}
+
+func (t *TSIG) String() string {
+	return fmt.Sprintf("%s %d %d %d %s %d %d %d %s", t.Algorithm, t.TimeSigned, t.Fudge, len(t.MAC),
+		base64.StdEncoding.EncodeToString(t.MAC), t.OriginalID, t.Error, len(t.OtherData),
+		base64.StdEncoding.EncodeToString(t.OtherData))
+}
+
+// TSIGKey is a secret shared with another server or client.
+type TSIGKey struct {
+	Name      Name
+	Algorithm Name
+	Secret    []byte
+}
+
+func (k *TSIGKey) hash() func() hash.Hash {
+	switch {
+	case k.Algorithm.Equal(HMACSHA256):
+		return sha256.New
+	case k.Algorithm.Equal(HMACSHA512):
+		return sha512.New
+	}
+	return nil
+}
+
+func (k *TSIGKey) mac(data []byte) []byte {
+	h := hmac.New(k.hash(), k.Secret)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// TSIGKeyring holds the keys we share with others, by name.
+type TSIGKeyring map[string]*TSIGKey
+
+// Get returns the key called name, or nil if there isn't one.
+func (r TSIGKeyring) Get(name Name) *TSIGKey {
+	return r[name.Canonical().String()]
+}
+
+// LoadTSIGKeys reads TSIG keys from a file, one per line as the key's name,
+// its algorithm and its base64 encoded secret. Lines starting with ; or # are
+// comments.
+func LoadTSIGKeys(path string) (TSIGKeyring, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	keys := TSIGKeyring{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, ";") || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s: line %d: expected a name, algorithm and secret", path, n)
+		}
+		k := &TSIGKey{}
+		if k.Name, err = ParseName(fields[0]); err != nil {
+			return nil, fmt.Errorf("%s: line %d: %v", path, n, err)
+		}
+		if k.Algorithm, err = ParseName(fields[1]); err != nil {
+			return nil, fmt.Errorf("%s: line %d: %v", path, n, err)
+		}
+		if k.hash() == nil {
+			return nil, fmt.Errorf("%s: line %d: unsupported algorithm %s", path, n, k.Algorithm)
+		}
+		if k.Secret, err = base64.StdEncoding.DecodeString(fields[2]); err != nil {
+			return nil, fmt.Errorf("%s: line %d: %v", path, n, err)
+		}
+		keys[k.Name.Canonical().String()] = k
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// tsigData builds what a MAC is computed over, from RFC 8945 section 4.3.3:
+// the MAC of the request for a response, the message as it was before the
+// TSIG record was added, and the TSIG record's fields.
+func tsigData(requestMAC, msg []byte, keyName Name, t *TSIG) []byte {
+	var buf bytes.Buffer
+	if requestMAC != nil {
+		binary.Write(&buf, binary.BigEndian, uint16(len(requestMAC)))
+		buf.Write(requestMAC)
+	}
+	buf.Write(msg)
+	writeName(&buf, keyName.Canonical())
+	binary.Write(&buf, binary.BigEndian, ClassANY)
+	binary.Write(&buf, binary.BigEndian, uint32(0))
+	writeName(&buf, t.Algorithm.Canonical())
+	t.writeTime(&buf)
+	binary.Write(&buf, binary.BigEndian, t.Error)
+	binary.Write(&buf, binary.BigEndian, uint16(len(t.OtherData)))
+	buf.Write(t.OtherData)
+	return buf.Bytes()
+}
+
+// appendTSIG adds a TSIG record to the end of a marshalled message.
+func appendTSIG(msg []byte, keyName Name, t *TSIG) []byte {
+	var buf bytes.Buffer
+	buf.Write(msg)
+	writeName(&buf, keyName)
+	binary.Write(&buf, binary.BigEndian, TypeTSIG)
+	binary.Write(&buf, binary.BigEndian, ClassANY)
+	binary.Write(&buf, binary.BigEndian, uint32(0))
+	data := t.Pack()
+	binary.Write(&buf, binary.BigEndian, uint16(len(data)))
+	buf.Write(data)
+	b := buf.Bytes()
+	binary.BigEndian.PutUint16(b[10:], binary.BigEndian.Uint16(b[10:])+1)
+	return b
+}
+
+// signMessage marshals m and signs it with key, returning the signed message
+// and its MAC. requestMAC is the MAC of the request when m is a response.
+func signMessage(m Message, key *TSIGKey, requestMAC []byte, now time.Time) ([]byte, []byte) {
+	m.updateCounts()
+	msg := m.Marshal()
+	t := &TSIG{Algorithm: key.Algorithm, TimeSigned: uint64(now.Unix()), Fudge: tsigFudge, OriginalID: m.ID}
+	t.MAC = key.mac(tsigData(requestMAC, msg, key.Name, t))
+	return appendTSIG(msg, key.Name, t), t.MAC
+}
+
+// splitTSIG finds the TSIG record at the end of a message, returning it along
+// with the message as it was before the record was added.
+func splitTSIG(b []byte) (ResourceRecord, []byte, bool) {
+	if len(b) < 12 {
+		return ResourceRecord{}, nil, false
+	}
+	var m Message
+	if err := Unmarshal(b, &m); err != nil || m.ARCount == 0 {
+		return ResourceRecord{}, nil, false
+	}
+	offset := 12
+	buf := bytes.NewBuffer(b[offset:])
+	for i := uint16(0); i < m.QdCount; i++ {
+		_, n, _ := decodeQuestion(buf)
+		offset += n
+	}
+	scanner := NewResourceRecordScanner(b, offset)
+	records := int(m.AnCount) + int(m.NSCount) + int(m.ARCount)
+	for i := 0; i < records-1; i++ {
+		scanner.decodeRecord()
+	}
+	start := scanner.pos
+	rr, err := scanner.decodeRecord()
+	if err != nil || rr.Type != TypeTSIG {
+		return ResourceRecord{}, nil, false
+	}
+	msg := append([]byte{}, b[:start]...)
+	binary.BigEndian.PutUint16(msg[10:], m.ARCount-1)
+	return rr, msg, true
+}
+
+// tsigSignature is the TSIG record found on a message, with the key it names
+// if we have it.
+type tsigSignature struct {
+	keyName Name
+	key     *TSIGKey
+	tsig    *TSIG
+	// err is why the signature didn't verify, if it didn't
+	err TSIGError
+}
+
+// verifyTSIG checks the TSIG record at the end of message b against keys.
+// requestMAC is the MAC of our request when b is the response to it. It
+// returns nil if the message isn't signed. When the signature doesn't hold up
+// it returns it along with a TSIGError, so the response can say why.
+func verifyTSIG(b []byte, keys TSIGKeyring, requestMAC []byte, now time.Time) (*tsigSignature, error) {
+	rr, msg, ok := splitTSIG(b)
+	if !ok {
+		return nil, nil
+	}
+	t := &TSIG{}
+	if err := t.Unpack(rr.Data); err != nil {
+		return nil, fmt.Errorf("malformed TSIG record: %v", err)
+	}
+	sig := &tsigSignature{keyName: rr.Name, key: keys.Get(rr.Name), tsig: t}
+	if sig.key == nil || !sig.key.Algorithm.Equal(t.Algorithm) {
+		sig.key, sig.err = nil, TSIGBadKey
+		return sig, sig.err
+	}
+	if t.Error != 0 && len(t.MAC) == 0 {
+		// A server that couldn't check our request can't sign its answer
+		sig.err = t.Error
+		return sig, sig.err
+	}
+	binary.BigEndian.PutUint16(msg, t.OriginalID)
+	// RFC 8945 section 5.2.2.1 allows MACs truncated to half their length,
+	// but nobody needs that, so we take the whole thing
+	if !hmac.Equal(sig.key.mac(tsigData(requestMAC, msg, rr.Name, t)), t.MAC) {
+		sig.err = TSIGBadSig
+		return sig, sig.err
+	}
+	skew := now.Unix() - int64(t.TimeSigned)
+	if skew < -int64(t.Fudge) || skew > int64(t.Fudge) {
+		sig.err = TSIGBadTime
+		return sig, sig.err
+	}
+	if t.Error != 0 {
+		// A response saying it couldn't verify our request
+		return sig, t.Error
+	}
+	return sig, nil
+}
+
+// size is how much room the TSIG record on a response will take.
+func (s *tsigSignature) size() int {
+	if s == nil {
+		return 0
+	}
+	t := &TSIG{Algorithm: s.tsig.Algorithm, OtherData: make([]byte, 6)}
+	if s.key != nil {
+		t.MAC = make([]byte, s.key.hash()().Size())
+	}
+	return s.keyName.wireLen() + 10 + len(t.Pack())
+}
+
+// sign marshals the response to a signed request, signing it with the same
+// key. If the request's signature didn't verify, the response says why with
+// a NOTAUTH response code, and is only signed for BADTIME: a client whose key
+// we couldn't check can't check ours either.
+func (s *tsigSignature) sign(resp Message, now time.Time) []byte {
+	if s.err == 0 {
+		b, _ := signMessage(resp, s.key, s.tsig.MAC, now)
+		return b
+	}
+	resp.ResponseCode = ResponseCodeNotAuth
+	resp.updateCounts()
+	msg := resp.Marshal()
+	t := &TSIG{Algorithm: s.tsig.Algorithm, TimeSigned: uint64(now.Unix()), Fudge: tsigFudge, OriginalID: resp.ID, Error: s.err}
+	if s.err == TSIGBadTime {
+		// RFC 8945 section 5.2.3 says to tell the client our time
+		t.OtherData = make([]byte, 6)
+		binary.BigEndian.PutUint16(t.OtherData, uint16(t.TimeSigned>>32))
+		binary.BigEndian.PutUint32(t.OtherData[2:], uint32(t.TimeSigned))
+		t.MAC = s.key.mac(tsigData(s.tsig.MAC, msg, s.keyName, t))
+	}
+	return appendTSIG(msg, s.keyName, t)
+}
+
+// tsigTimersData builds what the MAC covers for every message but the first
+// in a zone transfer, from RFC 8945 section 5.3.1: the MAC of the message
+// before it, the message, and just the timers from the TSIG record.
+func tsigTimersData(priorMAC, msg []byte, t *TSIG) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint16(len(priorMAC)))
+	buf.Write(priorMAC)
+	buf.Write(msg)
+	t.writeTime(&buf)
+	return buf.Bytes()
+}
+
+// signNext marshals and signs a message that follows another in a zone
+// transfer, returning it along with its MAC for signing the next one.
+func signNext(m Message, key *TSIGKey, priorMAC []byte, now time.Time) ([]byte, []byte) {
+	m.updateCounts()
+	msg := m.Marshal()
+	t := &TSIG{Algorithm: key.Algorithm, TimeSigned: uint64(now.Unix()), Fudge: tsigFudge, OriginalID: m.ID}
+	t.MAC = key.mac(tsigTimersData(priorMAC, msg, t))
+	return appendTSIG(msg, key.Name, t), t.MAC
+}
+
+// maxUnsignedMessages is how many messages in a row a zone transfer may leave
+// unsigned. RFC 8945 section 5.3.1 allows 99.
+const maxUnsignedMessages = 99
+
+// tsigStream checks the signatures on the messages of a zone transfer we
+// asked for. Servers may sign only every so often, in which case each
+// signature covers the unsigned messages before it.
+type tsigStream struct {
+	key *TSIGKey
+	// mac is the MAC of the last signed message, starting with our request
+	mac []byte
+	// started is set once the first message has been checked
+	started  bool
+	unsigned []byte
+	count    int
+}
+
+// verify checks the next message of the transfer, reporting whether it was
+// signed so the caller knows whether to strip the TSIG record.
+func (s *tsigStream) verify(b []byte, now time.Time) (bool, error) {
+	if !s.started {
+		// The first message is signed like any other response
+		sig, err := verifyTSIG(b, TSIGKeyring{s.key.Name.Canonical().String(): s.key}, s.mac, now)
+		if err == nil && sig == nil {
+			err = errors.New("response isn't signed")
+		}
+		if err != nil {
+			return false, err
+		}
+		s.started, s.mac = true, sig.tsig.MAC
+		return true, nil
+	}
+	rr, msg, ok := splitTSIG(b)
+	if !ok {
+		if s.count++; s.count > maxUnsignedMessages {
+			return false, fmt.Errorf("more than %d messages in a row aren't signed", maxUnsignedMessages)
+		}
+		s.unsigned = append(s.unsigned, b...)
+		return false, nil
+	}
+	t := &TSIG{}
+	if err := t.Unpack(rr.Data); err != nil {
+		return false, fmt.Errorf("malformed TSIG record: %v", err)
+	}
+	if !rr.Name.Equal(s.key.Name) || !t.Algorithm.Equal(s.key.Algorithm) {
+		return false, TSIGBadKey
+	}
+	binary.BigEndian.PutUint16(msg, t.OriginalID)
+	if !hmac.Equal(s.key.mac(tsigTimersData(s.mac, append(s.unsigned, msg...), t)), t.MAC) {
+		return false, TSIGBadSig
+	}
+	skew := now.Unix() - int64(t.TimeSigned)
+	if skew < -int64(t.Fudge) || skew > int64(t.Fudge) {
+		return false, TSIGBadTime
+	}
+	s.mac, s.unsigned, s.count = t.MAC, nil, 0
+	return true, nil
+}
+
+// done reports whether the transfer ended on a signed message, as it has to.
+func (s *tsigStream) done() error {
+	if s.count > 0 {
+		return errors.New("the last message of the transfer isn't signed")
+	}
+	return nil
+}
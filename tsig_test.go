@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTSIG(t *testing.T) {
+	key := &TSIGKey{Name: MustParseName("transfer-key."), Algorithm: HMACSHA256, Secret: []byte("0123456789abcdef0123456789abcdef")}
+	s := &Server{keys: TSIGKeyring{"transfer-key.": key}}
+	s.AddZone(mustParseZone(t, testZone, "example.com"))
+	from := &net.UDPAddr{IP: net.ParseIP("192.0.2.7"), Port: 5353}
+	query := Message{
+		ID:        1234,
+		Questions: []Question{{Name: MustParseName("www.example.com"), Type: TypeA, Class: ClassIN}},
+	}
+
+	type Test struct {
+		Description string
+		Key         *TSIGKey
+		Skew        time.Duration
+		// Tamper changes a byte of the signed message
+		Tamper   bool
+		Expected error
+	}
+	tests := []Test{
+		{"Good signature", key, 0, false, nil},
+		{"Clocks a little apart", key, 4 * time.Minute, false, nil},
+		{"Wrong secret", &TSIGKey{Name: key.Name, Algorithm: HMACSHA256, Secret: []byte("guess")}, 0, false, TSIGBadSig},
+		{"Changed in transit", key, 0, true, TSIGBadSig},
+		{"Unknown key", &TSIGKey{Name: MustParseName("other-key."), Algorithm: HMACSHA256, Secret: key.Secret}, 0, false, TSIGBadKey},
+		{"Wrong algorithm", &TSIGKey{Name: key.Name, Algorithm: HMACSHA512, Secret: key.Secret}, 0, false, TSIGBadKey},
+		{"Clocks too far apart", key, 10 * time.Minute, false, TSIGBadTime},
+	}
+	for _, test := range tests {
+		req, mac := signMessage(query, test.Key, nil, time.Now().Add(-test.Skew))
+		if test.Tamper {
+			req[2] ^= 1
+		}
+		b := s.respond(req, from, true)
+
+		resp := Message{}
+		Unmarshal(b, &resp)
+		sig, err := verifyTSIG(b, TSIGKeyring{test.Key.Name.Canonical().String(): test.Key}, mac, time.Now())
+		if sig == nil {
+			t.Errorf("%s: expected a TSIG record on the response", test.Description)
+			continue
+		}
+		if !errors.Is(err, test.Expected) {
+			t.Errorf("%s: expected %v, got %v", test.Description, test.Expected, err)
+		}
+		if test.Expected == nil && (resp.ResponseCode != ResponseCodeOk || len(resp.Answer) != 1) {
+			t.Errorf("%s: expected an answer, got %v with %d records", test.Description, resp.ResponseCode, len(resp.Answer))
+		}
+		if test.Expected != nil && resp.ResponseCode != ResponseCodeNotAuth {
+			t.Errorf("%s: expected NOTAUTH, got %v", test.Description, resp.ResponseCode)
+		}
+	}
+}
+
+func TestSignedUpdate(t *testing.T) {
+	key := &TSIGKey{Name: MustParseName("ddns-key."), Algorithm: HMACSHA512, Secret: []byte("dhcp server secret")}
+	z := mustParseZone(t, testZone, "example.com")
+	z.Updates, _ = ParseUpdatePolicy("key:ddns-key")
+	s := &Server{keys: TSIGKeyring{"ddns-key.": key}}
+	s.AddZone(z)
+	from := &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 5353}
+	update := Message{
+		ID:        99,
+		OpCode:    OpCodeUpdate,
+		Questions: []Question{{Name: MustParseName("example.com"), Type: TypeSOA, Class: ClassIN}},
+		Authority: testRecords(t, "new.example.com. 300 IN A 192.0.2.99"),
+	}
+
+	update.updateCounts()
+	resp := Message{}
+	Unmarshal(s.respond(update.Marshal(), from, true), &resp)
+	if resp.ResponseCode != ResponseCodeRefused {
+		t.Errorf("expected an unsigned update to be refused, got %v", resp.ResponseCode)
+	}
+
+	req, _ := signMessage(update, key, nil, time.Now())
+	resp = Message{}
+	Unmarshal(s.respond(req, from, true), &resp)
+	if resp.ResponseCode != ResponseCodeOk {
+		t.Errorf("expected a signed update to succeed, got %v", resp.ResponseCode)
+	}
+	if len(z.RRset(MustParseName("new.example.com"), TypeA)) != 1 {
+		t.Error("expected the signed update to add a record")
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type Type uint16
+
+const (
+	TypeA Type = 1 + iota
+	TypeNS
+	TypeMD
+	TypeMF
+	TypeCName
+	TypeSOA
+	TypeMB
+	TypeMG
+	TypeMR
+	TypeNull
+	TypeWKS
+	TypePTR
+	TypeHIinfo
+	TypeMInfo
+	TypeMX
+	TypeTXT
+)
+
+const (
+	TypeAAAA       Type = 28
+	TypeSRV        Type = 33
+	TypeNAPTR      Type = 35
+	TypeOPT        Type = 41
+	TypeDS         Type = 43
+	TypeSSHFP      Type = 44
+	TypeRRSIG      Type = 46
+	TypeNSEC       Type = 47
+	TypeDNSKEY     Type = 48
+	TypeNSEC3      Type = 50
+	TypeNSEC3PARAM Type = 51
+	TypeTLSA       Type = 52
+	TypeCDS        Type = 59
+	TypeCDNSKEY    Type = 60
+	TypeSVCB       Type = 64
+	TypeHTTPS      Type = 65
+	TypeCAA        Type = 257
+)
+
+const (
+	TypeTSIG  Type = 250
+	TypeIXFR  Type = 251
+	TypeAXFR  Type = 252
+	TypeMailB Type = 253
+	TypeMailA Type = 254
+	TypeANY   Type = 255
+)
+
+var typeNames = map[Type]string{
+	TypeA:          "A",
+	TypeNS:         "NS",
+	TypeMD:         "MD",
+	TypeMF:         "MF",
+	TypeCName:      "CNAME",
+	TypeSOA:        "SOA",
+	TypeMB:         "MB",
+	TypeMG:         "MG",
+	TypeMR:         "MR",
+	TypeNull:       "NULL",
+	TypeWKS:        "WKS",
+	TypePTR:        "PTR",
+	TypeHIinfo:     "HINFO",
+	TypeMInfo:      "MINFO",
+	TypeMX:         "MX",
+	TypeTXT:        "TXT",
+	TypeAAAA:       "AAAA",
+	TypeSRV:        "SRV",
+	TypeNAPTR:      "NAPTR",
+	TypeOPT:        "OPT",
+	TypeDS:         "DS",
+	TypeSSHFP:      "SSHFP",
+	TypeRRSIG:      "RRSIG",
+	TypeNSEC:       "NSEC",
+	TypeDNSKEY:     "DNSKEY",
+	TypeNSEC3:      "NSEC3",
+	TypeNSEC3PARAM: "NSEC3PARAM",
+	TypeTLSA:       "TLSA",
+	TypeCDS:        "CDS",
+	TypeCDNSKEY:    "CDNSKEY",
+	TypeSVCB:       "SVCB",
+	TypeHTTPS:      "HTTPS",
+	TypeCAA:        "CAA",
+	TypeTSIG:       "TSIG",
+	TypeIXFR:       "IXFR",
+	TypeAXFR:       "AXFR",
+	TypeMailB:      "MAILB",
+	TypeMailA:      "MAILA",
+	TypeANY:        "ANY",
+}
+
+// String returns the mnemonic for the type, or TYPEnnn as described in RFC
+// 3597 for types we don't know by name.
+func (t Type) String() string {
+	if s, ok := typeNames[t]; ok {
+		return s
+	}
+	return "TYPE" + strconv.Itoa(int(t))
+}
+
+// ParseType reads a type mnemonic or the generic TYPEnnn form.
+func ParseType(s string) (Type, error) {
+	u := strings.ToUpper(s)
+	for t, name := range typeNames {
+		if name == u {
+			return t, nil
+		}
+	}
+	if strings.HasPrefix(u, "TYPE") {
+		n, err := strconv.ParseUint(u[len("TYPE"):], 10, 16)
+		if err == nil {
+			return Type(n), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown type %q", s)
+}
+
+type Class uint16
+
+const (
+	ClassIN Class = 1 + iota
+	ClassCS
+	ClassCH
+	ClassHS
+)
+
+// ClassNONE is used by dynamic updates to delete records, and ClassANY as
+// their wildcard.
+const (
+	ClassNONE Class = 254
+	ClassANY  Class = 255
+)
+
+var classNames = map[Class]string{
+	ClassIN:   "IN",
+	ClassCS:   "CS",
+	ClassCH:   "CH",
+	ClassHS:   "HS",
+	ClassNONE: "NONE",
+	ClassANY:  "ANY",
+}
+
+// String returns the mnemonic for the class, or CLASSnnn for classes we don't
+// know by name.
+func (c Class) String() string {
+	if s, ok := classNames[c]; ok {
+		return s
+	}
+	return "CLASS" + strconv.Itoa(int(c))
+}
+
+// ParseClass reads a class mnemonic or the generic CLASSnnn form.
+func ParseClass(s string) (Class, error) {
+	u := strings.ToUpper(s)
+	for c, name := range classNames {
+		if name == u {
+			return c, nil
+		}
+	}
+	if strings.HasPrefix(u, "CLASS") {
+		n, err := strconv.ParseUint(u[len("CLASS"):], 10, 16)
+		if err == nil {
+			return Class(n), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown class %q", s)
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/netip"
+)
+
+// UpdatePolicy decides which dynamic updates a zone accepts. A zone without
+// one refuses them all.
+type UpdatePolicy struct {
+	// ACL lists who may send updates
+	ACL
+	// Types limits updates to records of these types, if it's set
+	Types []Type
+}
+
+// ParseUpdatePolicy reads the clients allowed to update a zone, in the form
+// ParseACL takes.
+func ParseUpdatePolicy(s string) (*UpdatePolicy, error) {
+	acl, err := ParseACL(s)
+	if err != nil {
+		return nil, err
+	}
+	return &UpdatePolicy{ACL: *acl}, nil
+}
+
+// allows reports whether a client at from, whose update was signed with key
+// if that's set, may make the changes in updates.
+func (p *UpdatePolicy) allows(from netip.Addr, key Name, updates []ResourceRecord) bool {
+	if p == nil || !p.ACL.allows(from, key) {
+		return false
+	}
+	if p.Types == nil {
+		return true
+	}
+	for _, rr := range updates {
+		// Deleting every RRset at a name could take out any type
+		if !hasType(p.Types, rr.Type) {
+			return false
+		}
+	}
+	return true
+}
+
+// isMetaType reports whether t is a query or meta type rather than a type of
+// data, using the ranges from RFC 6895 section 3.1.
+func isMetaType(t Type) bool {
+	return t == TypeOPT || (t >= 128 && t <= 255)
+}
+
+// isDNSSECType reports whether records of type t are the ones a signed zone
+// generates for itself.
+func isDNSSECType(t Type) bool {
+	switch t {
+	case TypeRRSIG, TypeNSEC, TypeNSEC3, TypeNSEC3PARAM, TypeDNSKEY, TypeCDS, TypeCDNSKEY:
+		return true
+	}
+	return false
+}
+
+// Update applies a dynamic update as described in RFC 2136 section 3, taking
+// the prerequisites from the answer section and the changes from the authority
+// section. from is where the update came from and key the TSIG key that
+// signed it, if any, for checking against the zone's policy. Either all of the
+// changes are made or none of them are, and a zone that changes gets a new
+// serial number and is signed again.
+func (z *Zone) Update(m Message, from netip.Addr, key Name) ResponseCode {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if !z.Updates.allows(from, key, m.Authority) {
+		return ResponseCodeRefused
+	}
+	if rcode := z.checkPrerequisites(m.Answer); rcode != ResponseCodeOk {
+		return rcode
+	}
+	if rcode := z.prescan(m.Authority); rcode != ResponseCodeOk {
+		return rcode
+	}
+
+	// Work on a copy so a failure part way through leaves the zone as it was
+	next := &Zone{Origin: z.Origin, Class: z.Class, Records: append([]ResourceRecord{}, z.Records...)}
+	_, before := next.SOA()
+	var changed bool
+	for _, rr := range m.Authority {
+		changed = next.applyUpdate(rr) || changed
+	}
+	if !changed {
+		return ResponseCodeOk
+	}
+	soaRR, soa := next.SOA()
+	if !serialGreater(soa.Serial, before.Serial) {
+		soa.Serial = before.Serial + 1
+		next.remove(func(rr ResourceRecord) bool { return rr.Type == TypeSOA })
+		soaRR.Data = soa.Pack()
+		next.Records = append(next.Records, soaRR)
+	}
+
+	previous := z.Records
+	z.Records = next.Records
+	if z.signer != nil {
+		if err := z.sign(z.signer); err != nil {
+			log.Printf("signing %s after an update: %v", z.Origin, err)
+			z.Records = previous
+			return ResponseCodeServerFailure
+		}
+	}
+	z.recordChange(previous)
+	log.Printf("updated %s from %s, serial now %d", z.Origin, from, soa.Serial)
+	return ResponseCodeOk
+}
+
+// checkPrerequisites tests the prerequisites of an update against the zone, as
+// described in RFC 2136 section 3.2.
+func (z *Zone) checkPrerequisites(prereqs []ResourceRecord) ResponseCode {
+	var values []ResourceRecord
+	for _, rr := range prereqs {
+		if rr.TTL != 0 {
+			return ResponseCodeFormatError
+		}
+		if !rr.Name.IsSubdomainOf(z.Origin) {
+			return ResponseCodeNotZone
+		}
+		switch rr.Class {
+		case ClassANY:
+			if len(rr.Data) != 0 {
+				return ResponseCodeFormatError
+			}
+			if rr.Type == TypeANY && len(z.lookup(rr.Name)) == 0 {
+				return ResponseCodeNameError
+			}
+			if rr.Type != TypeANY && len(z.RRset(rr.Name, rr.Type)) == 0 {
+				return ResponseCodeNXRRSet
+			}
+		case ClassNONE:
+			if len(rr.Data) != 0 {
+				return ResponseCodeFormatError
+			}
+			if rr.Type == TypeANY && len(z.lookup(rr.Name)) > 0 {
+				return ResponseCodeYXDomain
+			}
+			if rr.Type != TypeANY && len(z.RRset(rr.Name, rr.Type)) > 0 {
+				return ResponseCodeYXRRSet
+			}
+		case z.Class:
+			if isMetaType(rr.Type) {
+				return ResponseCodeFormatError
+			}
+			values = append(values, rr)
+		default:
+			return ResponseCodeFormatError
+		}
+	}
+	// The RRsets given with data have to match the zone's exactly
+	for _, set := range groupRRsets(values) {
+		if !sameRData(set, z.RRset(set[0].Name, set[0].Type)) {
+			return ResponseCodeNXRRSet
+		}
+	}
+	return ResponseCodeOk
+}
+
+// prescan checks that the changes in an update make sense before any of them
+// are made, as described in RFC 2136 section 3.4.1.
+func (z *Zone) prescan(updates []ResourceRecord) ResponseCode {
+	for _, rr := range updates {
+		if !rr.Name.IsSubdomainOf(z.Origin) {
+			return ResponseCodeNotZone
+		}
+		switch rr.Class {
+		case z.Class:
+			if isMetaType(rr.Type) {
+				return ResponseCodeFormatError
+			}
+		case ClassANY:
+			if rr.TTL != 0 || len(rr.Data) != 0 || (isMetaType(rr.Type) && rr.Type != TypeANY) {
+				return ResponseCodeFormatError
+			}
+		case ClassNONE:
+			if rr.TTL != 0 || isMetaType(rr.Type) {
+				return ResponseCodeFormatError
+			}
+		default:
+			return ResponseCodeFormatError
+		}
+		// A signed zone's DNSSEC records are generated by the signer
+		if z.signer != nil && isDNSSECType(rr.Type) {
+			return ResponseCodeRefused
+		}
+	}
+	return ResponseCodeOk
+}
+
+// applyUpdate makes one change from an update, following RFC 2136 section
+// 3.4.2, and reports whether the zone changed. The apex SOA and NS records can
+// be replaced but never deleted outright.
+func (z *Zone) applyUpdate(u ResourceRecord) bool {
+	apex := u.Name.Equal(z.Origin)
+	switch u.Class {
+	case ClassANY:
+		return z.remove(func(rr ResourceRecord) bool {
+			if !rr.Name.Equal(u.Name) || (u.Type != TypeANY && rr.Type != u.Type) {
+				return false
+			}
+			return !apex || (rr.Type != TypeSOA && rr.Type != TypeNS)
+		})
+	case ClassNONE:
+		if u.Type == TypeSOA || (apex && u.Type == TypeNS && len(z.RRset(u.Name, TypeNS)) == 1) {
+			return false
+		}
+		data := canonicalRData(u.Type, u.Data)
+		return z.remove(func(rr ResourceRecord) bool {
+			return rr.Name.Equal(u.Name) && rr.Type == u.Type && bytes.Equal(canonicalRData(rr.Type, rr.Data), data)
+		})
+	}
+
+	existing := z.lookup(u.Name)
+	switch {
+	case u.Type == TypeSOA:
+		_, soa := z.SOA()
+		newSOA := &SOA{}
+		if !apex || newSOA.Unpack(u.Data) != nil || !serialGreater(newSOA.Serial, soa.Serial) {
+			return false
+		}
+		z.remove(func(rr ResourceRecord) bool { return rr.Type == TypeSOA })
+	case u.Type == TypeCName && len(existing) > len(filterType(existing, TypeCName)):
+		// A CNAME can't share its name with anything else
+		return false
+	case u.Type != TypeCName && len(filterType(existing, TypeCName)) > 0:
+		return false
+	case u.Type == TypeCName:
+		z.remove(func(rr ResourceRecord) bool { return rr.Name.Equal(u.Name) && rr.Type == TypeCName })
+	}
+
+	// Records in an RRset share a TTL, so adding one, or adding one that's
+	// already there, sets the TTL for all of them
+	data := canonicalRData(u.Type, u.Data)
+	var found, changed bool
+	for i, rr := range z.Records {
+		if !rr.Name.Equal(u.Name) || rr.Type != u.Type {
+			continue
+		}
+		if bytes.Equal(canonicalRData(rr.Type, rr.Data), data) {
+			found = true
+		}
+		if rr.TTL != u.TTL {
+			z.Records[i].TTL = u.TTL
+			changed = true
+		}
+	}
+	if !found {
+		z.Records = append(z.Records, u)
+		changed = true
+	}
+	return changed
+}
+
+// remove deletes the records that match, reporting whether there were any.
+func (z *Zone) remove(match func(ResourceRecord) bool) bool {
+	var kept []ResourceRecord
+	for _, rr := range z.Records {
+		if !match(rr) {
+			kept = append(kept, rr)
+		}
+	}
+	removed := len(kept) != len(z.Records)
+	z.Records = kept
+	return removed
+}
+
+// sameRData reports whether two RRsets hold the same data, in any order.
+func sameRData(a, b []ResourceRecord) bool {
+	contains := func(set []ResourceRecord, rr ResourceRecord) bool {
+		data := canonicalRData(rr.Type, rr.Data)
+		for _, other := range set {
+			if bytes.Equal(canonicalRData(other.Type, other.Data), data) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, rr := range a {
+		if !contains(b, rr) {
+			return false
+		}
+	}
+	for _, rr := range b {
+		if !contains(a, rr) {
+			return false
+		}
+	}
+	return true
+}
+
+// serialGreater compares SOA serial numbers using the wrapping arithmetic of
+// RFC 1982.
+func serialGreater(a, b uint32) bool {
+	return a != b && a-b < 1<<31
+}
+
+// update handles a dynamic update to one of our zones. The zone section, which
+// shares the question section's format, has to name the zone exactly.
+func (s *Server) update(m Message, c client, ans *Message) {
+	if len(m.Questions) != 1 || m.Questions[0].Type != TypeSOA {
+		ans.ResponseCode = ResponseCodeFormatError
+		return
+	}
+	z := s.findZone(m.Questions[0].Name)
+	if z == nil || !z.Origin.Equal(m.Questions[0].Name) {
+		ans.ResponseCode = ResponseCodeNotAuth
+		return
+	}
+	before := z.serial()
+	ans.ResponseCode = z.Update(m, addrOf(c.addr), c.key())
+	if ans.ResponseCode != ResponseCodeOk {
+		log.Printf("update to %s from %v: %v", z.Origin, c.addr, ans.ResponseCode)
+	}
+	if z.serial() != before {
+		s.notifySecondaries(z)
+	}
+}
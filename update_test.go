@@ -0,0 +1,160 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestZoneUpdate(t *testing.T) {
+	// empty makes the records with no data that updates use to name RRsets
+	empty := func(name string, typ Type, class Class) ResourceRecord {
+		return ResourceRecord{Name: MustParseName(name), Type: typ, Class: class}
+	}
+	deletion := func(line string) ResourceRecord {
+		rr := testRecords(t, line)[0]
+		rr.Class, rr.TTL = ClassNONE, 0
+		return rr
+	}
+	prereq := func(line string) ResourceRecord {
+		rr := testRecords(t, line)[0]
+		rr.TTL = 0
+		return rr
+	}
+	allowed := netip.MustParseAddr("192.0.2.7")
+
+	type Test struct {
+		Description string
+		From        netip.Addr
+		Prereqs     []ResourceRecord
+		Updates     []ResourceRecord
+		Expected    ResponseCode
+		// Name and Type pick an RRset to check the size of afterwards
+		Name   string
+		Type   Type
+		Count  int
+		Serial uint32
+	}
+	tests := []Test{
+		{
+			"Add a record", allowed, nil,
+			testRecords(t, "new.example.com. 300 IN A 192.0.2.99"),
+			ResponseCodeOk, "new.example.com.", TypeA, 1, 2020010102,
+		},
+		{
+			"From an address that isn't allowed", netip.MustParseAddr("198.51.100.1"), nil,
+			testRecords(t, "new.example.com. 300 IN A 192.0.2.99"),
+			ResponseCodeRefused, "new.example.com.", TypeA, 0, 2020010101,
+		},
+		{
+			"Name must be in use", allowed,
+			[]ResourceRecord{empty("nope.example.com.", TypeANY, ClassANY)},
+			testRecords(t, "new.example.com. 300 IN A 192.0.2.99"),
+			ResponseCodeNameError, "new.example.com.", TypeA, 0, 2020010101,
+		},
+		{
+			"Name must not be in use", allowed,
+			[]ResourceRecord{empty("www.example.com.", TypeANY, ClassNONE)},
+			testRecords(t, "www.example.com. 300 IN A 192.0.2.99"),
+			ResponseCodeYXDomain, "www.example.com.", TypeA, 1, 2020010101,
+		},
+		{
+			"RRset must match", allowed,
+			[]ResourceRecord{prereq("www.example.com. 300 IN A 192.0.2.11")},
+			testRecords(t, "www.example.com. 300 IN A 192.0.2.99"),
+			ResponseCodeNXRRSet, "www.example.com.", TypeA, 1, 2020010101,
+		},
+		{
+			"Matching RRset", allowed,
+			[]ResourceRecord{prereq("www.example.com. 300 IN A 192.0.2.10")},
+			testRecords(t, "www.example.com. 300 IN A 192.0.2.99"),
+			ResponseCodeOk, "www.example.com.", TypeA, 2, 2020010102,
+		},
+		{
+			"Delete an RRset", allowed, nil,
+			[]ResourceRecord{empty("www.example.com.", TypeTXT, ClassANY)},
+			ResponseCodeOk, "www.example.com.", TypeTXT, 0, 2020010102,
+		},
+		{
+			"Delete one record", allowed, nil,
+			[]ResourceRecord{deletion("www.example.com. 300 IN A 192.0.2.10")},
+			ResponseCodeOk, "www.example.com.", TypeA, 0, 2020010102,
+		},
+		{
+			"Apex NS records stay", allowed, nil,
+			[]ResourceRecord{empty("example.com.", TypeNS, ClassANY)},
+			ResponseCodeOk, "example.com.", TypeNS, 1, 2020010101,
+		},
+		{
+			"CNAME can't share a name", allowed, nil,
+			testRecords(t, "alias.example.com. 300 IN A 192.0.2.99"),
+			ResponseCodeOk, "alias.example.com.", TypeA, 0, 2020010101,
+		},
+		{
+			"New serial given", allowed, nil,
+			testRecords(t, "example.com. 3600 IN SOA ns1.example.com. hostmaster.example.com. 2020020101 3600 900 604800 300"),
+			ResponseCodeOk, "example.com.", TypeSOA, 1, 2020020101,
+		},
+		{
+			"Outside the zone", allowed, nil,
+			testRecords(t, "www.example.net. 300 IN A 192.0.2.99"),
+			ResponseCodeNotZone, "www.example.net.", TypeA, 0, 2020010101,
+		},
+		{
+			"All or nothing", allowed, nil,
+			[]ResourceRecord{testRecords(t, "new.example.com. 300 IN A 192.0.2.99")[0], empty("www.example.com.", TypeA, ClassCH)},
+			ResponseCodeFormatError, "new.example.com.", TypeA, 0, 2020010101,
+		},
+	}
+	for _, test := range tests {
+		z := mustParseZone(t, testZone, "example.com")
+		z.Updates, _ = ParseUpdatePolicy("192.0.2.0/24")
+		got := z.Update(Message{Answer: test.Prereqs, Authority: test.Updates}, test.From, nil)
+		if got != test.Expected {
+			t.Errorf("%s: expected %v, got %v", test.Description, test.Expected, got)
+		}
+		if n := len(z.RRset(MustParseName(test.Name), test.Type)); n != test.Count {
+			t.Errorf("%s: expected %d %s records at %s, got %d", test.Description, test.Count, test.Type, test.Name, n)
+		}
+		if _, soa := z.SOA(); soa.Serial != test.Serial {
+			t.Errorf("%s: expected serial %d, got %d", test.Description, test.Serial, soa.Serial)
+		}
+	}
+}
+
+func TestServerUpdate(t *testing.T) {
+	z, v := signedTestZone(t, false)
+	z.Updates, _ = ParseUpdatePolicy("127.0.0.1")
+	s := &Server{}
+	s.AddZone(z)
+	from := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5353}
+
+	update := func(zone string, updates ...ResourceRecord) ResponseCode {
+		m := Message{
+			OpCode:    OpCodeUpdate,
+			Questions: []Question{{Name: MustParseName(zone), Type: TypeSOA, Class: ClassIN}},
+			Authority: updates,
+		}
+		return s.handle(m, client{addr: from}).ResponseCode
+	}
+	if got := update("www.example.com", testRecords(t, "new.example.com. 300 IN A 192.0.2.99")...); got != ResponseCodeNotAuth {
+		t.Errorf("expected NOTAUTH for a zone section that isn't a zone, got %v", got)
+	}
+	if got := update("example.com", testRecords(t, "example.com. 300 IN DNSKEY 256 3 13 dGVzdA==")...); got != ResponseCodeRefused {
+		t.Errorf("expected a signed zone to refuse changes to its keys, got %v", got)
+	}
+	if got := update("example.com", testRecords(t, "new.example.com. 300 IN A 192.0.2.99")...); got != ResponseCodeOk {
+		t.Fatalf("expected the update to succeed, got %v", got)
+	}
+
+	q := Question{Name: MustParseName("new.example.com"), Type: TypeA, Class: ClassIN}
+	resp, _ := v.resolve(q)
+	if status, err := v.Validate(q, resp); status != StatusSecure {
+		t.Errorf("expected the new record to be signed, got %v: %v", status, err)
+	}
+	q = Question{Name: MustParseName("newer.example.com"), Type: TypeA, Class: ClassIN}
+	resp, _ = v.resolve(q)
+	if status, err := v.Validate(q, resp); status != StatusSecure || resp.ResponseCode != ResponseCodeNameError {
+		t.Errorf("expected a secure denial from the rebuilt chain, got %v %v: %v", resp.ResponseCode, status, err)
+	}
+}
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// SecurityStatus is the outcome of validating an answer, as defined in RFC
+// 4033 section 5.
+type SecurityStatus int
+
+const (
+	// StatusInsecure means there's proof that the data isn't signed, or no trust
+	// anchor covers it
+	StatusInsecure SecurityStatus = iota
+	// StatusSecure means the data is signed by a chain of trust from an anchor
+	StatusSecure
+	// StatusBogus means the data should have been signed but the signatures
+	// are missing or don't check out
+	StatusBogus
+)
+
+func (s SecurityStatus) String() string {
+	switch s {
+	case StatusSecure:
+		return "secure"
+	case StatusBogus:
+		return "bogus"
+	}
+	return "insecure"
+}
+
+// maxNSEC3Iterations is the most NSEC3 iterations we'll compute. RFC 9276 lets
+// validators treat zones that ask for more as insecure, to bound the work an
+// attacker can make us do.
+const maxNSEC3Iterations = 150
+
+// maxKeyCacheTTL caps how long we trust a zone's keys before fetching them
+// again.
+const maxKeyCacheTTL = time.Hour
+
+// Validator checks the DNSSEC signatures on answers, building chains of trust
+// from its anchors down through DS and DNSKEY records.
+type Validator struct {
+	// resolve looks up the DS and DNSKEY records needed along the way
+	resolve func(Question) (Message, error)
+	anchors *TrustAnchors
+	now     func() time.Time
+
+	mu    sync.Mutex
+	zones map[string]*zoneKeys
+}
+
+// zoneKeys is what we've learned about the zone enclosing some name.
+type zoneKeys struct {
+	apex    Name
+	status  SecurityStatus
+	keys    []*DNSKEY
+	expires time.Time
+}
+
+// NewValidator creates a validator that uses resolve to fetch keys.
+func NewValidator(resolve func(Question) (Message, error), anchors *TrustAnchors) *Validator {
+	return &Validator{
+		resolve: resolve,
+		anchors: anchors,
+		now:     time.Now,
+		zones:   map[string]*zoneKeys{},
+	}
+}
+
+// Validate works out the security status of m, the answer to q. A bogus
+// status comes with an error saying what was wrong.
+func (v *Validator) Validate(q Question, m Message) (SecurityStatus, error) {
+	status, _, err := v.validate(q, m)
+	return status, err
+}
+
+// validate is Validate, also returning the records from m's authority section
+// whose signatures it checked, along with those signatures. Nothing else
+// there can be trusted to say anything about other names, however secure
+// the answer itself is.
+func (v *Validator) validate(q Question, m Message) (SecurityStatus, []ResourceRecord, error) {
+	var verified []ResourceRecord
+	if m.ResponseCode != ResponseCodeOk && m.ResponseCode != ResponseCodeNameError {
+		// There's nothing signed in a failure to vouch for
+		return StatusInsecure, verified, nil
+	}
+	status := StatusSecure
+	combine := func(s SecurityStatus) {
+		if s == StatusInsecure && status == StatusSecure {
+			status = StatusInsecure
+		}
+	}
+
+	// Work out which name the answer ends at after any CNAMEs, and whether we
+	// got the records we asked for there
+	name := q.Name
+	var wildcards []wildcardAnswer
+	var answered bool
+	for _, set := range groupRRsets(m.Answer) {
+		s, wildcard, err := v.verifyRRset(set, m.Answer)
+		if s == StatusBogus {
+			return s, verified, fmt.Errorf("%s %s: %v", set[0].Name, set[0].Type, err)
+		}
+		combine(s)
+		if wildcard != nil {
+			wildcards = append(wildcards, *wildcard)
+		}
+	}
+	for i := 0; i < maxCNAMEChain; i++ {
+		var next Name
+		for _, rr := range m.Answer {
+			if !rr.Name.Equal(name) {
+				continue
+			}
+			if rr.Type == q.Type || q.Type == TypeANY {
+				answered = true
+			} else if rr.Type == TypeCName {
+				cname := &CNAME{}
+				if cname.Unpack(rr.Data) == nil {
+					next = cname.Target
+				}
+			}
+		}
+		if answered || next == nil {
+			break
+		}
+		name = next
+	}
+	if answered && len(wildcards) == 0 || status == StatusInsecure {
+		return status, verified, nil
+	}
+
+	// Anything else needs proof from the authority section, so check the
+	// signatures on that too
+	var nsecs []ResourceRecord
+	for _, set := range groupRRsets(m.Authority) {
+		if set[0].Type == TypeNS {
+			// Delegation NS records aren't signed by the parent
+			continue
+		}
+		s, _, err := v.verifyRRset(set, m.Authority)
+		if s == StatusBogus {
+			return s, verified, fmt.Errorf("%s %s: %v", set[0].Name, set[0].Type, err)
+		}
+		if s == StatusInsecure {
+			return s, verified, nil
+		}
+		sigs, _ := signaturesFor(set, m.Authority)
+		verified = append(append(verified, set...), sigs...)
+		if set[0].Type == TypeNSEC || set[0].Type == TypeNSEC3 {
+			nsecs = append(nsecs, set...)
+		}
+	}
+	denial := newDenial(nsecs)
+	if denial.tooExpensive && len(denial.nsecs) == 0 && len(denial.nsec3s) == 0 {
+		return StatusInsecure, verified, nil
+	}
+
+	for _, w := range wildcards {
+		if !denial.provesNoExactMatch(w.name, w.closestEncloser) {
+			return StatusBogus, verified, fmt.Errorf("no proof that %s doesn't exist to go with the wildcard answer", w.name)
+		}
+	}
+	if answered {
+		return status, verified, nil
+	}
+
+	// A denial from a zone that isn't signed can't come with proof, so only
+	// hold the lack of one against it once we know the zone is signed
+	unsigned := func() bool {
+		zk, err := v.enclosingZone(name)
+		return err == nil && zk.status == StatusInsecure
+	}
+	switch {
+	case m.ResponseCode == ResponseCodeNameError:
+		if !denial.provesNameError(name) {
+			if unsigned() {
+				return StatusInsecure, verified, nil
+			}
+			return StatusBogus, verified, fmt.Errorf("no proof that %s doesn't exist", name)
+		}
+	case m.ResponseCode == ResponseCodeOk:
+		s, ok := denial.provesNoData(name, q.Type)
+		if !ok {
+			if unsigned() {
+				return StatusInsecure, verified, nil
+			}
+			return StatusBogus, verified, fmt.Errorf("no proof that %s has no %s records", name, q.Type)
+		}
+		combine(s)
+	}
+	return status, verified, nil
+}
+
+// wildcardAnswer notes an RRset that was synthesized from a wildcard, which
+// needs proof that there wasn't a better match.
+type wildcardAnswer struct {
+	name            Name
+	closestEncloser Name
+}
+
+// verifyRRset checks the signatures on an RRset, using the RRSIGs found among
+// records.
+func (v *Validator) verifyRRset(set []ResourceRecord, records []ResourceRecord) (SecurityStatus, *wildcardAnswer, error) {
+	owner := set[0].Name
+	var sigs []*RRSIG
+	for _, rr := range records {
+		if rr.Type != TypeRRSIG || !rr.Name.Equal(owner) {
+			continue
+		}
+		sig := &RRSIG{}
+		if sig.Unpack(rr.Data) == nil && sig.TypeCovered == set[0].Type {
+			sigs = append(sigs, sig)
+		}
+	}
+
+	if len(sigs) == 0 {
+		zk, err := v.enclosingZone(owner)
+		if err != nil {
+			return StatusBogus, nil, err
+		}
+		if zk.status == StatusSecure {
+			return StatusBogus, nil, errors.New("missing signature")
+		}
+		return zk.status, nil, nil
+	}
+
+	now := v.now()
+	var lastErr error
+	var sawSupported bool
+	for _, sig := range sigs {
+		if !owner.IsSubdomainOf(sig.SignerName) {
+			lastErr = fmt.Errorf("signed by %s, which isn't above it", sig.SignerName)
+			continue
+		}
+		if int(sig.Labels) > labelCount(owner) {
+			lastErr = errors.New("signature has too many labels")
+			continue
+		}
+		if !sig.ValidAt(now) {
+			lastErr = errors.New("signature has expired or isn't valid yet")
+			continue
+		}
+		zk, err := v.enclosingZone(sig.SignerName)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if zk.status != StatusSecure {
+			return zk.status, nil, nil
+		}
+		if !zk.apex.Equal(sig.SignerName) {
+			lastErr = fmt.Errorf("signer %s isn't the apex of a zone", sig.SignerName)
+			continue
+		}
+		if !supportedAlgorithm(sig.Algorithm) {
+			continue
+		}
+		sawSupported = true
+		for _, key := range zk.keys {
+			if err := verifyRRSIG(sig, key, set); err != nil {
+				lastErr = err
+				continue
+			}
+			var wildcard *wildcardAnswer
+			if int(sig.Labels) < labelCount(owner) {
+				wildcard = &wildcardAnswer{name: owner, closestEncloser: owner[len(owner)-int(sig.Labels):]}
+			}
+			return StatusSecure, wildcard, nil
+		}
+	}
+	if !sawSupported && lastErr == nil {
+		// Only signed with algorithms we don't know, which RFC 4035 section
+		// 5.2 says to treat as insecure
+		return StatusInsecure, nil, nil
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no key verified the signature")
+	}
+	return StatusBogus, nil, lastErr
+}
+
+// enclosingZone finds the zone that name belongs to and whether it's signed,
+// working down from the closest trust anchor.
+func (v *Validator) enclosingZone(name Name) (*zoneKeys, error) {
+	key := name.Canonical().String()
+	v.mu.Lock()
+	zk, ok := v.zones[key]
+	v.mu.Unlock()
+	if ok && v.now().Before(zk.expires) {
+		return zk, nil
+	}
+
+	zk, err := v.findEnclosingZone(name)
+	if err != nil {
+		return nil, err
+	}
+	v.mu.Lock()
+	v.zones[key] = zk
+	v.mu.Unlock()
+	return zk, nil
+}
+
+func (v *Validator) findEnclosingZone(name Name) (*zoneKeys, error) {
+	if anchors := v.anchors.For(name); len(anchors) > 0 {
+		return v.anchoredZone(name, anchors)
+	} else if v.anchors.isManaged(name) {
+		return nil, fmt.Errorf("every trust anchor for %s has been revoked", name)
+	}
+	if name.IsRoot() {
+		// Nothing above us to trust
+		return &zoneKeys{apex: name, status: StatusInsecure, expires: v.now().Add(maxKeyCacheTTL)}, nil
+	}
+	parent, err := v.enclosingZone(name.Parent())
+	if err != nil || parent.status != StatusSecure {
+		return parent, err
+	}
+
+	// Ask the parent whether name is the apex of a signed zone
+	resp, err := v.resolve(Question{Name: name, Type: TypeDS, Class: ClassIN})
+	if err != nil {
+		return nil, fmt.Errorf("looking up DS for %s: %v", name, err)
+	}
+	ds := filterName(filterType(resp.Answer, TypeDS), name)
+	if len(ds) == 0 {
+		return v.noDS(name, parent, resp)
+	}
+	s, _, err := v.verifyRRset(ds, resp.Answer)
+	if s != StatusSecure {
+		if err == nil {
+			err = fmt.Errorf("DS records for %s are %s", name, s)
+		}
+		return nil, err
+	}
+
+	var supported []*DS
+	for _, rr := range ds {
+		d := &DS{}
+		if d.Unpack(rr.Data) == nil && supportedAlgorithm(d.Algorithm) {
+			if _, err := dsDigest(name, &DNSKEY{}, d.DigestType); err == nil {
+				supported = append(supported, d)
+			}
+		}
+	}
+	if len(supported) == 0 {
+		return &zoneKeys{apex: name, status: StatusInsecure, expires: v.expiry(ds)}, nil
+	}
+	zk, _, err := v.trustKeys(name, func(key *DNSKEY) bool {
+		for _, d := range supported {
+			if d.Matches(name, key) {
+				return true
+			}
+		}
+		return false
+	})
+	return zk, err
+}
+
+// noDS handles the answer to a DS query that didn't have any, which proves
+// either that name is an unsigned delegation or that it isn't a zone cut.
+func (v *Validator) noDS(name Name, parent *zoneKeys, resp Message) (*zoneKeys, error) {
+	var nsecs []ResourceRecord
+	for _, set := range groupRRsets(resp.Authority) {
+		if set[0].Type != TypeNSEC && set[0].Type != TypeNSEC3 && set[0].Type != TypeSOA {
+			continue
+		}
+		s, _, err := v.verifyRRset(set, resp.Authority)
+		if s != StatusSecure {
+			if err == nil {
+				err = fmt.Errorf("proof of no DS for %s is %s", name, s)
+			}
+			return nil, err
+		}
+		if set[0].Type != TypeSOA {
+			nsecs = append(nsecs, set...)
+		}
+	}
+	denial := newDenial(nsecs)
+	if denial.tooExpensive && len(denial.nsecs) == 0 && len(denial.nsec3s) == 0 {
+		return &zoneKeys{apex: name, status: StatusInsecure, expires: v.expiry(nsecs)}, nil
+	}
+	if resp.ResponseCode == ResponseCodeNameError {
+		if !denial.provesNameError(name) {
+			return nil, fmt.Errorf("no proof that %s doesn't exist", name)
+		}
+		return parent, nil
+	}
+	s, ok := denial.provesNoData(name, TypeDS)
+	if !ok {
+		return nil, fmt.Errorf("no proof that %s has no DS records", name)
+	}
+	if s == StatusInsecure || denial.isDelegation(name) {
+		return &zoneKeys{apex: name, status: StatusInsecure, expires: v.expiry(nsecs)}, nil
+	}
+	// Not a zone cut, so name is part of its parent's zone
+	return parent, nil
+}
+
+// anchoredZone validates the keys of a zone we have trust anchors for.
+func (v *Validator) anchoredZone(name Name, anchors []ResourceRecord) (*zoneKeys, error) {
+	zk, resp, err := v.trustKeys(name, func(key *DNSKEY) bool {
+		for _, a := range anchors {
+			switch a.Type {
+			case TypeDS:
+				d := &DS{}
+				if d.Unpack(a.Data) == nil && d.Matches(name, key) {
+					return true
+				}
+			case TypeDNSKEY:
+				if bytes.Equal(a.Data, key.Pack()) {
+					return true
+				}
+			}
+		}
+		return false
+	})
+	if err == nil {
+		// The keys are good, so they tell us about any changes to the
+		// anchors
+		v.anchors.observe(name, resp.Answer)
+	}
+	return zk, err
+}
+
+// RefreshAnchors fetches the keys of every zone we have trust anchors for
+// again, so that changes to them are noticed even if nobody is asking about
+// those zones.
+func (v *Validator) RefreshAnchors() {
+	for _, zone := range v.anchors.Zones() {
+		v.mu.Lock()
+		delete(v.zones, zone.Canonical().String())
+		v.mu.Unlock()
+		if _, err := v.enclosingZone(zone); err != nil {
+			log.Printf("refreshing trust anchors for %s: %v", zone, err)
+		}
+	}
+}
+
+// trustKeys fetches a zone's DNSKEY RRset and accepts it if it's signed by one
+// of the keys that trusted approves of.
+func (v *Validator) trustKeys(zone Name, trusted func(*DNSKEY) bool) (*zoneKeys, Message, error) {
+	resp, err := v.resolve(Question{Name: zone, Type: TypeDNSKEY, Class: ClassIN})
+	if err != nil {
+		return nil, resp, fmt.Errorf("looking up DNSKEY for %s: %v", zone, err)
+	}
+	set := filterName(filterType(resp.Answer, TypeDNSKEY), zone)
+	var keys []*DNSKEY
+	for _, rr := range set {
+		key := &DNSKEY{}
+		if key.Unpack(rr.Data) == nil {
+			keys = append(keys, key)
+		}
+	}
+
+	now := v.now()
+	for _, rr := range filterName(filterType(resp.Answer, TypeRRSIG), zone) {
+		sig := &RRSIG{}
+		if sig.Unpack(rr.Data) != nil || sig.TypeCovered != TypeDNSKEY || !sig.SignerName.Equal(zone) || !sig.ValidAt(now) {
+			continue
+		}
+		for _, key := range keys {
+			if !trusted(key) {
+				continue
+			}
+			if verifyRRSIG(sig, key, set) == nil {
+				return &zoneKeys{apex: zone, status: StatusSecure, keys: keys, expires: v.expiry(set)}, resp, nil
+			}
+		}
+	}
+	return nil, resp, fmt.Errorf("no trusted key signed the DNSKEY records for %s", zone)
+}
+
+// expiry works out how long to remember something learned from records.
+func (v *Validator) expiry(records []ResourceRecord) time.Time {
+	ttl := maxKeyCacheTTL
+	for _, rr := range records {
+		if d := time.Duration(rr.TTL) * time.Second; d < ttl {
+			ttl = d
+		}
+	}
+	return v.now().Add(ttl)
+}
+
+// groupRRsets splits records into RRsets, leaving out signatures and the OPT
+// pseudo record.
+func groupRRsets(records []ResourceRecord) [][]ResourceRecord {
+	var sets [][]ResourceRecord
+outer:
+	for _, rr := range records {
+		if rr.Type == TypeRRSIG || rr.Type == TypeOPT {
+			continue
+		}
+		for i, set := range sets {
+			if set[0].Type == rr.Type && set[0].Class == rr.Class && set[0].Name.Equal(rr.Name) {
+				sets[i] = append(set, rr)
+				continue outer
+			}
+		}
+		sets = append(sets, []ResourceRecord{rr})
+	}
+	return sets
+}
+
+func filterName(records []ResourceRecord, name Name) []ResourceRecord {
+	var found []ResourceRecord
+	for _, rr := range records {
+		if rr.Name.Equal(name) {
+			found = append(found, rr)
+		}
+	}
+	return found
+}
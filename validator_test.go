@@ -0,0 +1,282 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// testHierarchy is a signed root with a signed child zone "example." and an
+// unsigned delegation to "insecure.", answering validator lookups from memory.
+type testHierarchy struct {
+	root, example *testSigner
+	answers       map[string]Message
+}
+
+func newTestHierarchy(t *testing.T) *testHierarchy {
+	h := &testHierarchy{
+		root:    newTestSigner(t, ".", AlgorithmED25519),
+		example: newTestSigner(t, "example.", AlgorithmECDSAP256SHA256),
+		answers: map[string]Message{},
+	}
+	rootKey := []ResourceRecord{h.root.dnskey()}
+	h.answer(".", TypeDNSKEY, Message{Answer: append(rootKey, h.root.sign(t, rootKey))})
+	ds := []ResourceRecord{h.example.ds(t)}
+	h.answer("example.", TypeDS, Message{Answer: append(ds, h.root.sign(t, ds))})
+	exampleKey := []ResourceRecord{h.example.dnskey()}
+	h.answer("example.", TypeDNSKEY, Message{Answer: append(exampleKey, h.example.sign(t, exampleKey))})
+
+	nsec := testRecords(t, "www.example. 300 IN NSEC example. A RRSIG NSEC")
+	h.answer("www.example.", TypeDS, Message{Authority: append(nsec, h.example.sign(t, nsec))})
+	nsec = testRecords(t, "insecure. 300 IN NSEC jx. NS RRSIG NSEC")
+	h.answer("insecure.", TypeDS, Message{Authority: append(nsec, h.root.sign(t, nsec))})
+	return h
+}
+
+func (h *testHierarchy) answer(name string, t Type, m Message) {
+	h.answers[MustParseName(name).String()+" "+t.String()] = m
+}
+
+func (h *testHierarchy) resolve(q Question) (Message, error) {
+	m, ok := h.answers[q.Name.Canonical().String()+" "+q.Type.String()]
+	if !ok {
+		return Message{}, errors.New("no answer")
+	}
+	return m, nil
+}
+
+func (h *testHierarchy) validator(t *testing.T, now time.Time) *Validator {
+	return &Validator{
+		resolve: h.resolve,
+		anchors: StaticTrustAnchors([]ResourceRecord{h.root.ds(t)}),
+		now:     func() time.Time { return now },
+		zones:   map[string]*zoneKeys{},
+	}
+}
+
+func TestValidate(t *testing.T) {
+	h := newTestHierarchy(t)
+	signed := func(s *testSigner, lines ...string) []ResourceRecord {
+		rrset := testRecords(t, lines...)
+		return append(rrset, s.sign(t, rrset))
+	}
+
+	www := signed(h.example, "www.example. 300 IN A 192.0.2.1")
+	tampered := append(testRecords(t, "www.example. 300 IN A 192.0.2.2"), www[1])
+	wildcard := signed(h.example, "*.example. 300 IN A 192.0.2.3")
+	for i := range wildcard {
+		wildcard[i].Name = MustParseName("a.example.")
+	}
+	// example. < *.example. < a.example. < nope.example. < www.example.
+	apexNSEC := signed(h.example, "example. 300 IN NSEC www.example. NS SOA RRSIG NSEC DNSKEY")
+	wwwNSEC := signed(h.example, "www.example. 300 IN NSEC example. A RRSIG NSEC")
+	soa := signed(h.example, "example. 300 IN SOA ns.example. admin.example. 1 3600 600 86400 300")
+
+	type Test struct {
+		Description string
+		Question    string
+		Type        Type
+		Response    Message
+		Now         time.Time
+		Expected    SecurityStatus
+	}
+
+	tests := []Test{
+		{
+			Description: "signed answer",
+			Question:    "www.example.",
+			Type:        TypeA,
+			Response:    Message{Answer: www},
+			Expected:    StatusSecure,
+		},
+		{
+			Description: "data that doesn't match its signature",
+			Question:    "www.example.",
+			Type:        TypeA,
+			Response:    Message{Answer: tampered},
+			Expected:    StatusBogus,
+		},
+		{
+			Description: "signature stripped from a signed zone",
+			Question:    "www.example.",
+			Type:        TypeA,
+			Response:    Message{Answer: www[:1]},
+			Expected:    StatusBogus,
+		},
+		{
+			Description: "expired signature",
+			Question:    "www.example.",
+			Type:        TypeA,
+			Response:    Message{Answer: www},
+			Now:         time.Now().Add(48 * time.Hour),
+			Expected:    StatusBogus,
+		},
+		{
+			Description: "unsigned answer below an insecure delegation",
+			Question:    "www.insecure.",
+			Type:        TypeA,
+			Response:    Message{Answer: testRecords(t, "www.insecure. 300 IN A 192.0.2.1")},
+			Expected:    StatusInsecure,
+		},
+		{
+			Description: "name error with NSEC proof",
+			Question:    "nope.example.",
+			Type:        TypeA,
+			Response:    Message{ResponseCode: ResponseCodeNameError, Authority: append(append(soa, apexNSEC...), wwwNSEC...)},
+			Expected:    StatusSecure,
+		},
+		{
+			Description: "name error without proof",
+			Question:    "nope.example.",
+			Type:        TypeA,
+			Response:    Message{ResponseCode: ResponseCodeNameError, Authority: soa},
+			Expected:    StatusBogus,
+		},
+		{
+			Description: "name error from an unsigned zone",
+			Question:    "nope.insecure.",
+			Type:        TypeA,
+			Response:    Message{ResponseCode: ResponseCodeNameError},
+			Expected:    StatusInsecure,
+		},
+		{
+			Description: "no data from an unsigned zone",
+			Question:    "www.insecure.",
+			Type:        TypeTXT,
+			Response:    Message{},
+			Expected:    StatusInsecure,
+		},
+		{
+			Description: "server failure",
+			Question:    "www.example.",
+			Type:        TypeA,
+			Response:    Message{ResponseCode: ResponseCodeServerFailure},
+			Expected:    StatusInsecure,
+		},
+		{
+			Description: "refused",
+			Question:    "www.example.",
+			Type:        TypeA,
+			Response:    Message{ResponseCode: ResponseCodeRefused},
+			Expected:    StatusInsecure,
+		},
+		{
+			Description: "no data with NSEC proof",
+			Question:    "www.example.",
+			Type:        TypeTXT,
+			Response:    Message{Authority: append(soa, wwwNSEC...)},
+			Expected:    StatusSecure,
+		},
+		{
+			Description: "no data for a type the NSEC says exists",
+			Question:    "www.example.",
+			Type:        TypeA,
+			Response:    Message{Authority: append(soa, wwwNSEC...)},
+			Expected:    StatusBogus,
+		},
+		{
+			Description: "wildcard answer with proof the name doesn't exist",
+			Question:    "a.example.",
+			Type:        TypeA,
+			Response:    Message{Answer: wildcard, Authority: apexNSEC},
+			Expected:    StatusSecure,
+		},
+		{
+			Description: "wildcard answer without proof",
+			Question:    "a.example.",
+			Type:        TypeA,
+			Response:    Message{Answer: wildcard},
+			Expected:    StatusBogus,
+		},
+	}
+	for _, test := range tests {
+		now := test.Now
+		if now.IsZero() {
+			now = time.Now()
+		}
+		q := Question{Name: MustParseName(test.Question), Type: test.Type, Class: ClassIN}
+		status, err := h.validator(t, now).Validate(q, test.Response)
+		if status != test.Expected {
+			t.Errorf("%s: expected %s, got %s (%v)", test.Description, test.Expected, status, err)
+		}
+	}
+}
+
+func TestValidateNSEC3(t *testing.T) {
+	h := newTestHierarchy(t)
+	salt := []byte{0xaa, 0xbb, 0xcc, 0xdd}
+	hashOf := func(name string) string {
+		return base32Hex.EncodeToString(hashName(MustParseName(name), 12, salt))
+	}
+	// An NSEC3 chain for a zone holding just the apex and www, in hash order
+	names := []string{"example.", "www.example."}
+	if hashOf(names[0]) > hashOf(names[1]) {
+		names[0], names[1] = names[1], names[0]
+	}
+	var authority []ResourceRecord
+	for i, name := range names {
+		next := hashOf(names[(i+1)%len(names)])
+		types := "A RRSIG"
+		if name == "example." {
+			types = "NS SOA RRSIG DNSKEY NSEC3PARAM"
+		}
+		rrset := testRecords(t, hashOf(name)+".example. 300 IN NSEC3 1 0 12 aabbccdd "+next+" "+types)
+		authority = append(authority, rrset[0], h.example.sign(t, rrset))
+	}
+
+	now := time.Now()
+	q := Question{Name: MustParseName("nope.example."), Type: TypeA, Class: ClassIN}
+	status, err := h.validator(t, now).Validate(q, Message{ResponseCode: ResponseCodeNameError, Authority: authority})
+	if status != StatusSecure {
+		t.Errorf("name error: expected secure, got %s (%v)", status, err)
+	}
+	q = Question{Name: MustParseName("www.example."), Type: TypeTXT, Class: ClassIN}
+	status, err = h.validator(t, now).Validate(q, Message{Authority: authority})
+	if status != StatusSecure {
+		t.Errorf("no data: expected secure, got %s (%v)", status, err)
+	}
+	q = Question{Name: MustParseName("www.example."), Type: TypeA, Class: ClassIN}
+	if status, _ := h.validator(t, now).Validate(q, Message{Authority: authority}); status != StatusBogus {
+		t.Errorf("no data for an existing type: expected bogus, got %s", status)
+	}
+}
+
+func TestValidateForgedDenials(t *testing.T) {
+	h := newTestHierarchy(t)
+	forger := newTestSigner(t, "example.", AlgorithmECDSAP256SHA256)
+	www := testRecords(t, "www.example. 300 IN A 192.0.2.1")
+	// A signed answer with denial records tacked on that claim mail.example.
+	// doesn't exist, signed with a key the zone never published
+	soa := testRecords(t, "example. 300 IN SOA ns.example. admin.example. 1 3600 600 86400 300")
+	nsec := testRecords(t, "example. 300 IN NSEC www.example. NS SOA RRSIG NSEC DNSKEY")
+	m := Message{
+		Answer:    append(www, h.example.sign(t, www)),
+		Authority: append(append(soa, forger.sign(t, soa)), append(nsec, forger.sign(t, nsec))...),
+	}
+
+	q := Question{Name: MustParseName("www.example."), Type: TypeA, Class: ClassIN}
+	status, verified, err := h.validator(t, time.Now()).validate(q, m)
+	if status != StatusSecure {
+		t.Fatalf("expected the answer to be secure, got %s (%v)", status, err)
+	}
+	if len(verified) != 0 {
+		t.Errorf("expected none of the authority section to be verified, got %v", verified)
+	}
+
+	// What resolve caches can't be used to deny anything
+	c := NewCache()
+	c.Aggressive = true
+	cached := m
+	cached.Authority = verified
+	c.Put(q, cached, status)
+	if ans, ok := c.Synthesize(Question{Name: MustParseName("mail.example."), Type: TypeA, Class: ClassIN}); ok {
+		t.Errorf("expected the forged denial not to be cached, got %v", ans)
+	}
+	// Whereas the whole answer would have poisoned it
+	c = NewCache()
+	c.Aggressive = true
+	c.Put(q, m, status)
+	if _, ok := c.Synthesize(Question{Name: MustParseName("mail.example."), Type: TypeA, Class: ClassIN}); !ok {
+		t.Error("expected the unchecked denial to be used when cached as it came")
+	}
+}
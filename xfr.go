@@ -0,0 +1,267 @@
+package main
+
+import (
+	"io"
+	"log"
+	"strconv"
+	"time"
+)
+
+// maxTransferMessageSize is roughly how many bytes of records we put in each
+// message of a zone transfer. TCP allows 64KB, but smaller messages let the
+// secondary start on them sooner.
+const maxTransferMessageSize = 16 * 1024
+
+// maxJournal is how many changes a zone remembers for IXFR. Secondaries
+// further behind than that get the whole zone.
+const maxJournal = 100
+
+// zoneDiff is one change to a zone, in the form IXFR sends it.
+type zoneDiff struct {
+	// from and to are the SOA records before and after the change
+	from, to ResourceRecord
+	deleted  []ResourceRecord
+	added    []ResourceRecord
+}
+
+// isTransfer reports whether m asks for a zone transfer.
+func isTransfer(m Message) bool {
+	return len(m.Questions) == 1 && (m.Questions[0].Type == TypeAXFR || m.Questions[0].Type == TypeIXFR)
+}
+
+// recordChange adds the difference between the zone's previous records and
+// its current ones to the journal.
+func (z *Zone) recordChange(previous []ResourceRecord) {
+	var d zoneDiff
+	deleted, added := diffRecords(previous, z.Records)
+	for _, rr := range deleted {
+		if rr.Type == TypeSOA {
+			d.from = rr
+		} else {
+			d.deleted = append(d.deleted, rr)
+		}
+	}
+	for _, rr := range added {
+		if rr.Type == TypeSOA {
+			d.to = rr
+		} else {
+			d.added = append(d.added, rr)
+		}
+	}
+	z.journal = append(z.journal, d)
+	if len(z.journal) > maxJournal {
+		z.journal = z.journal[len(z.journal)-maxJournal:]
+	}
+}
+
+// diffRecords returns the records in old that aren't in new, and those in new
+// that aren't in old. A record whose TTL changed counts as both.
+func diffRecords(old, new []ResourceRecord) (deleted, added []ResourceRecord) {
+	key := func(rr ResourceRecord) string {
+		return rr.Name.Canonical().String() + " " + rr.Type.String() + " " + strconv.Itoa(int(rr.TTL)) + " " + string(canonicalRData(rr.Type, rr.Data))
+	}
+	missing := func(from, in []ResourceRecord) []ResourceRecord {
+		counts := map[string]int{}
+		for _, rr := range in {
+			counts[key(rr)]++
+		}
+		var out []ResourceRecord
+		for _, rr := range from {
+			if k := key(rr); counts[k] > 0 {
+				counts[k]--
+			} else {
+				out = append(out, rr)
+			}
+		}
+		return out
+	}
+	return missing(old, new), missing(new, old)
+}
+
+// journalSince returns the changes that take the zone from serial to its
+// current version, or false if the journal doesn't go back that far.
+func (z *Zone) journalSince(serial uint32) ([]zoneDiff, bool) {
+	for i, d := range z.journal {
+		from := &SOA{}
+		if from.Unpack(d.from.Data) == nil && from.Serial == serial {
+			return z.journal[i:], true
+		}
+	}
+	return nil, false
+}
+
+// transferRecords lists the records to send for an AXFR or IXFR of the zone,
+// in the order RFC 5936 section 2.2 and RFC 1995 section 4 give. An IXFR
+// request carries the secondary's SOA in its authority section. When the
+// journal can't bring the secondary up to date the whole zone is sent, which
+// RFC 1995 allows.
+func (z *Zone) transferRecords(t Type, authority []ResourceRecord) []ResourceRecord {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	soaRR, soa := z.SOA()
+	if soa == nil {
+		return nil
+	}
+
+	// A signed zone's signatures change without the journal hearing about
+	// it, so its secondaries always get the whole zone
+	if t == TypeIXFR && z.signer == nil {
+		for _, rr := range authority {
+			theirs := &SOA{}
+			if rr.Type != TypeSOA || theirs.Unpack(rr.Data) != nil {
+				continue
+			}
+			if !serialGreater(soa.Serial, theirs.Serial) {
+				return []ResourceRecord{soaRR}
+			}
+			if diffs, ok := z.journalSince(theirs.Serial); ok {
+				records := []ResourceRecord{soaRR}
+				for _, d := range diffs {
+					records = append(records, d.from)
+					records = append(records, d.deleted...)
+					records = append(records, d.to)
+					records = append(records, d.added...)
+				}
+				return append(records, soaRR)
+			}
+		}
+	}
+
+	records := []ResourceRecord{soaRR}
+	for _, rr := range z.contents() {
+		if rr.Type != TypeSOA {
+			records = append(records, rr)
+		}
+	}
+	return append(records, soaRR)
+}
+
+// contents returns every record in the zone, along with the signatures and
+// NSEC or NSEC3 chain of a signed zone.
+func (z *Zone) contents() []ResourceRecord {
+	if z.signer == nil {
+		return z.Records
+	}
+	var records []ResourceRecord
+	for _, set := range groupRRsets(z.Records) {
+		name := set[0].Name
+		// Delegations and glue belong to the child, so they aren't signed
+		if z.isOccluded(name) || (set[0].Type == TypeNS && !name.Equal(z.Origin)) {
+			records = append(records, set...)
+			continue
+		}
+		if set[0].Type == TypeSOA {
+			// The SOA goes first and last, but its signature only once
+			records = append(records, z.withSignatures(set)[len(set):]...)
+			continue
+		}
+		records = append(records, z.withSignatures(set)...)
+	}
+	var chain []ResourceRecord
+	for _, n := range z.denial.nsecs {
+		chain = append(chain, n.rr)
+	}
+	for _, n := range z.denial.nsec3s {
+		chain = append(chain, n.rr)
+	}
+	return append(records, z.withSignatures(chain)...)
+}
+
+// splitRecords divides a transfer's records into messages of about
+// maxTransferMessageSize bytes.
+func splitRecords(records []ResourceRecord) [][]ResourceRecord {
+	var chunks [][]ResourceRecord
+	var size int
+	start := 0
+	for i, rr := range records {
+		// Type, class, TTL and data length take ten bytes
+		n := rr.Name.wireLen() + 10 + len(rr.Data)
+		if size+n > maxTransferMessageSize && i > start {
+			chunks = append(chunks, records[start:i])
+			start, size = i, 0
+		}
+		size += n
+	}
+	return append(chunks, records[start:])
+}
+
+// transfer streams an AXFR or IXFR of one of our zones to w. A signed request
+// gets every message signed, each covering the last as RFC 8945 section 5.3.1
+// describes.
+func (s *Server) transfer(w io.Writer, m Message, c client) error {
+	q := m.Questions[0]
+	resp := Message{
+		ID:                  m.ID,
+		IsResponse:          true,
+		OpCode:              m.OpCode,
+		AuthoritativeAnswer: true,
+		Questions:           m.Questions,
+	}
+	z := s.findZone(q.Name)
+	switch {
+	case z == nil || !z.Origin.Equal(q.Name):
+		resp.ResponseCode = ResponseCodeNotAuth
+	case !z.serving():
+		resp.ResponseCode = ResponseCodeServerFailure
+	case !z.Transfers.allows(addrOf(c.addr), c.key()):
+		log.Printf("refused %s of %s to %v", q.Type, z.Origin, c.addr)
+		resp.ResponseCode = ResponseCodeRefused
+	}
+	if resp.ResponseCode != ResponseCodeOk {
+		return writeTCPMessage(w, s.reply(m, c, &resp, 0xFFFF))
+	}
+
+	records := z.transferRecords(q.Type, m.Authority)
+	if len(records) == 0 {
+		resp.ResponseCode = ResponseCodeServerFailure
+		return writeTCPMessage(w, s.reply(m, c, &resp, 0xFFFF))
+	}
+	var mac []byte
+	if c.sig != nil {
+		mac = c.sig.tsig.MAC
+	}
+	for i, chunk := range splitRecords(records) {
+		// Only the first message repeats the question
+		if i > 0 {
+			resp.Questions = nil
+		}
+		resp.Answer = chunk
+		var b []byte
+		switch {
+		case c.sig == nil:
+			resp.updateCounts()
+			b = resp.Marshal()
+		case i == 0:
+			b, mac = signMessage(resp, c.sig.key, mac, time.Now())
+		default:
+			b, mac = signNext(resp, c.sig.key, mac, time.Now())
+		}
+		if err := writeTCPMessage(w, b); err != nil {
+			return err
+		}
+	}
+	log.Printf("sent %s of %s to %v, %d records", q.Type, z.Origin, c.addr, len(records))
+	return nil
+}
+
+// transferOverUDP answers a zone transfer request that came over UDP. AXFR
+// only works over TCP, and IXFR gets just the current SOA, which tells a
+// secondary that's behind to ask again over TCP as RFC 1995 section 2 allows.
+func (s *Server) transferOverUDP(m Message, c client, ans *Message) {
+	q := m.Questions[0]
+	z := s.findZone(q.Name)
+	switch {
+	case z == nil || !z.Origin.Equal(q.Name):
+		ans.ResponseCode = ResponseCodeNotAuth
+	case !z.serving():
+		ans.ResponseCode = ResponseCodeServerFailure
+	case q.Type == TypeAXFR || !z.Transfers.allows(addrOf(c.addr), c.key()):
+		ans.ResponseCode = ResponseCodeRefused
+	default:
+		z.mu.RLock()
+		soaRR, _ := z.SOA()
+		z.mu.RUnlock()
+		ans.AuthoritativeAnswer = true
+		ans.Answer = []ResourceRecord{soaRR}
+	}
+}
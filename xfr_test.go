@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// readTransfer reads the messages of a zone transfer back out of a stream.
+func readTransfer(t *testing.T, b []byte) []Message {
+	var msgs []Message
+	r := bytes.NewReader(b)
+	for r.Len() > 0 {
+		raw, err := readTCPMessage(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := Message{}
+		Unmarshal(raw, &m)
+		msgs = append(msgs, m)
+	}
+	return msgs
+}
+
+func TestTransfer(t *testing.T) {
+	secondary := &net.TCPAddr{IP: net.ParseIP("192.0.2.53"), Port: 40000}
+	ixfr := func(serial uint32) []ResourceRecord {
+		soa := &SOA{MName: MustParseName("ns1.example.com"), RName: MustParseName("hostmaster.example.com"), Serial: serial}
+		return []ResourceRecord{{Name: MustParseName("example.com"), Type: TypeSOA, Class: ClassIN, Data: soa.Pack()}}
+	}
+
+	type Test struct {
+		Description string
+		Zone        string
+		Type        Type
+		From        net.Addr
+		Authority   []ResourceRecord
+		Expected    ResponseCode
+		// Records counts the records sent, including the SOAs around them
+		Records int
+	}
+	tests := []Test{
+		{"Whole zone", "example.com", TypeAXFR, secondary, nil, ResponseCodeOk, 11},
+		{"Not our zone", "www.example.com", TypeAXFR, secondary, nil, ResponseCodeNotAuth, 0},
+		{"Not allowed", "example.com", TypeAXFR, &net.TCPAddr{IP: net.ParseIP("198.51.100.1")}, nil, ResponseCodeRefused, 0},
+		// SOA, then old SOA, deleted A, new SOA, added A for each change, then SOA
+		{"Changes from the journal", "example.com", TypeIXFR, secondary, ixfr(2020010101), ResponseCodeOk, 10},
+		{"One change from the journal", "example.com", TypeIXFR, secondary, ixfr(2020010102), ResponseCodeOk, 6},
+		{"Up to date", "example.com", TypeIXFR, secondary, ixfr(2020010103), ResponseCodeOk, 1},
+		{"Older than the journal", "example.com", TypeIXFR, secondary, ixfr(2019010101), ResponseCodeOk, 11},
+	}
+	for _, test := range tests {
+		z := mustParseZone(t, testZone, "example.com")
+		z.Updates, _ = ParseUpdatePolicy("127.0.0.1")
+		z.Transfers, _ = ParseACL("192.0.2.0/24")
+		s := &Server{}
+		s.AddZone(z)
+		local := netip.MustParseAddr("127.0.0.1")
+		for _, ip := range []string{"192.0.2.11", "192.0.2.12"} {
+			update := Message{Authority: append(
+				[]ResourceRecord{{Name: MustParseName("www.example.com"), Type: TypeA, Class: ClassANY}},
+				testRecords(t, "www.example.com. 300 IN A "+ip)...,
+			)}
+			if rcode := z.Update(update, local, nil); rcode != ResponseCodeOk {
+				t.Fatalf("%s: update failed with %v", test.Description, rcode)
+			}
+		}
+
+		m := Message{
+			ID:        7,
+			Questions: []Question{{Name: MustParseName(test.Zone), Type: test.Type, Class: ClassIN}},
+			Authority: test.Authority,
+		}
+		var out bytes.Buffer
+		if err := s.transfer(&out, m, client{addr: test.From}); err != nil {
+			t.Fatalf("%s: %v", test.Description, err)
+		}
+		msgs := readTransfer(t, out.Bytes())
+		if msgs[0].ResponseCode != test.Expected {
+			t.Errorf("%s: expected %v, got %v", test.Description, test.Expected, msgs[0].ResponseCode)
+			continue
+		}
+		var records []ResourceRecord
+		for _, msg := range msgs {
+			records = append(records, msg.Answer...)
+		}
+		if len(records) != test.Records {
+			t.Errorf("%s: expected %d records, got %d", test.Description, test.Records, len(records))
+			continue
+		}
+		if test.Records > 0 && (records[0].Type != TypeSOA || records[len(records)-1].Type != TypeSOA) {
+			t.Errorf("%s: expected the transfer to start and end with the SOA", test.Description)
+		}
+	}
+}
+
+func TestSignedTransfer(t *testing.T) {
+	key := &TSIGKey{Name: MustParseName("transfer-key."), Algorithm: HMACSHA256, Secret: []byte("0123456789abcdef0123456789abcdef")}
+	keys := TSIGKeyring{"transfer-key.": key}
+	z, _ := signedTestZone(t, false)
+	z.Transfers, _ = ParseACL("key:transfer-key")
+	// Enough records to need several messages
+	for i := 0; i < 300; i++ {
+		z.Records = append(z.Records, testRecords(t, "www.example.com. 300 IN TXT \"padding to make the zone bigger than one message "+string(rune('a'+i%26))+string(rune('a'+i/26))+"\"")...)
+	}
+	s := &Server{keys: keys}
+	s.AddZone(z)
+	q := Message{ID: 9, Questions: []Question{{Name: MustParseName("example.com"), Type: TypeAXFR, Class: ClassIN}}}
+
+	var out bytes.Buffer
+	req, requestMAC := signMessage(q, key, nil, time.Now())
+	m, c, ans := s.receive(req, &net.TCPAddr{IP: net.ParseIP("198.51.100.1")})
+	if ans != nil {
+		t.Fatalf("expected the signed request to be accepted, got %v", ans.ResponseCode)
+	}
+	if int(m.ARCount) != len(m.Additional) {
+		t.Errorf("expected ARCount to match the %d additional records, got %d", len(m.Additional), m.ARCount)
+	}
+	if err := s.transfer(&out, m, c); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bytes.NewReader(out.Bytes())
+	var n int
+	var mac []byte
+	for r.Len() > 0 {
+		b, err := readTCPMessage(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr, body, ok := splitTSIG(b)
+		if !ok {
+			t.Fatalf("expected message %d to be signed", n)
+		}
+		tsig := &TSIG{}
+		tsig.Unpack(rr.Data)
+		var want []byte
+		if n == 0 {
+			sig, err := verifyTSIG(b, keys, requestMAC, time.Now())
+			if err != nil {
+				t.Fatalf("first message: %v", err)
+			}
+			want = sig.tsig.MAC
+		} else {
+			want = key.mac(tsigTimersData(mac, body, tsig))
+		}
+		if !bytes.Equal(tsig.MAC, want) {
+			t.Errorf("message %d: MAC doesn't cover the one before it", n)
+		}
+		mac = tsig.MAC
+		n++
+	}
+	if n < 2 {
+		t.Errorf("expected the transfer to take several messages, got %d", n)
+	}
+
+	out.Reset()
+	q.updateCounts()
+	m, c, _ = s.receive(q.Marshal(), &net.TCPAddr{IP: net.ParseIP("198.51.100.1")})
+	s.transfer(&out, m, c)
+	if msgs := readTransfer(t, out.Bytes()); msgs[0].ResponseCode != ResponseCodeRefused {
+		t.Errorf("expected an unsigned request to be refused, got %v", msgs[0].ResponseCode)
+	}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Zone is a zone we're authoritative for, loaded from a master file.
+type Zone struct {
+	Origin  Name
+	Class   Class
+	Records []ResourceRecord
+
+	// Updates decides which dynamic updates the zone accepts
+	Updates *UpdatePolicy
+	// Transfers lists who may transfer the zone
+	Transfers *ACL
+	// AlsoNotify lists secondaries to tell about changes besides the ones in
+	// the zone's NS records, as addresses like "192.0.2.2:53"
+	AlsoNotify []string
+
+	// secondary keeps the zone up to date if it's mastered elsewhere, and
+	// expired is set while it has no copy of the zone we can answer from
+	secondary *Secondary
+	expired   bool
+	// journal holds the zone's most recent changes, oldest first, for IXFR
+	journal []zoneDiff
+	// signer and denial are set once the zone is signed
+	signer *ZoneSigner
+	denial *denial
+	// mu guards the records against changes while we're answering from them
+	mu sync.RWMutex
+}
+
+// LoadZone reads the master file at path.
+func LoadZone(path string, origin Name) (*Zone, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	z, err := ParseZone(f, origin)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return z, nil
+}
+
+// ParseZone reads a zone in the master file format from RFC 1035 section 5.
+// Records of any type can be given, using the \# syntax from RFC 3597 for
+// types we don't know the presentation format of.
+func ParseZone(r io.Reader, origin Name) (*Zone, error) {
+	records, err := parseRecords(r, origin)
+	if err != nil {
+		return nil, err
+	}
+	z := &Zone{Origin: origin, Class: ClassIN, Records: records}
+	if err := z.check(); err != nil {
+		return nil, err
+	}
+	return z, nil
+}
+
+// parseRecords reads the records from a master file, all of which must fall
+// under origin.
+func parseRecords(r io.Reader, origin Name) ([]ResourceRecord, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	lines, err := tokenizeZone(string(data))
+	if err != nil {
+		return nil, err
+	}
+
+	var records []ResourceRecord
+	curOrigin := origin
+	var defaultTTL, lastTTL uint32
+	var haveDefaultTTL, haveLastTTL bool
+	var lastOwner Name
+	lastClass := ClassIN
+	for _, line := range lines {
+		tokens := line.tokens
+		switch strings.ToUpper(tokens[0]) {
+		case "$ORIGIN":
+			if len(tokens) != 2 {
+				return nil, fmt.Errorf("line %d: $ORIGIN takes one name", line.number)
+			}
+			if curOrigin, err = parseRelativeName(tokens[1], curOrigin); err != nil {
+				return nil, fmt.Errorf("line %d: %v", line.number, err)
+			}
+			continue
+		case "$TTL":
+			if len(tokens) != 2 {
+				return nil, fmt.Errorf("line %d: $TTL takes one TTL", line.number)
+			}
+			if defaultTTL, err = parseTTL(tokens[1]); err != nil {
+				return nil, fmt.Errorf("line %d: %v", line.number, err)
+			}
+			haveDefaultTTL = true
+			continue
+		case "$INCLUDE":
+			return nil, fmt.Errorf("line %d: $INCLUDE isn't supported", line.number)
+		}
+
+		rr := ResourceRecord{Class: lastClass}
+		if line.indented {
+			if lastOwner == nil {
+				return nil, fmt.Errorf("line %d: no owner name", line.number)
+			}
+			rr.Name = lastOwner
+		} else {
+			if rr.Name, err = parseRelativeName(tokens[0], curOrigin); err != nil {
+				return nil, fmt.Errorf("line %d: %v", line.number, err)
+			}
+			tokens = tokens[1:]
+		}
+
+		// The TTL and class can come in either order, and both are optional
+		var haveTTL bool
+		for i := 0; i < 2 && len(tokens) > 0; i++ {
+			if isDigit(tokens[0][0]) && !haveTTL {
+				if rr.TTL, err = parseTTL(tokens[0]); err != nil {
+					return nil, fmt.Errorf("line %d: %v", line.number, err)
+				}
+				haveTTL = true
+				tokens = tokens[1:]
+			} else if class, err := ParseClass(tokens[0]); err == nil {
+				rr.Class = class
+				tokens = tokens[1:]
+			}
+		}
+		if len(tokens) == 0 {
+			return nil, fmt.Errorf("line %d: no type", line.number)
+		}
+		if rr.Type, err = ParseType(tokens[0]); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line.number, err)
+		}
+		if rr.Data, err = ParseRData(rr.Type, tokens[1:], curOrigin); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line.number, err)
+		}
+		switch {
+		case haveTTL:
+		case haveDefaultTTL:
+			rr.TTL = defaultTTL
+		case haveLastTTL:
+			rr.TTL = lastTTL
+		case rr.Type == TypeSOA:
+			// Older zones without $TTL use the SOA minimum
+			soa := &SOA{}
+			soa.Unpack(rr.Data)
+			rr.TTL = soa.Minimum
+		default:
+			return nil, fmt.Errorf("line %d: no TTL and no $TTL", line.number)
+		}
+		lastOwner, lastTTL, haveLastTTL, lastClass = rr.Name, rr.TTL, true, rr.Class
+
+		if !rr.Name.IsSubdomainOf(origin) {
+			return nil, fmt.Errorf("line %d: %s is outside of the zone %s", line.number, rr.Name, origin)
+		}
+		records = append(records, rr)
+	}
+	return records, nil
+}
+
+// check makes sure the zone has the one SOA record at its apex that we rely
+// on for negative answers.
+func (z *Zone) check() error {
+	var soas int
+	for _, rr := range z.Records {
+		if rr.Type != TypeSOA {
+			continue
+		}
+		if !rr.Name.Equal(z.Origin) {
+			return fmt.Errorf("SOA record for %s isn't at the apex of %s", rr.Name, z.Origin)
+		}
+		soas++
+	}
+	if soas != 1 {
+		return fmt.Errorf("zone %s has %d SOA records, expected 1", z.Origin, soas)
+	}
+	return nil
+}
+
+// SOA returns the zone's SOA record along with its decoded data.
+func (z *Zone) SOA() (ResourceRecord, *SOA) {
+	for _, rr := range z.Records {
+		if rr.Type == TypeSOA {
+			soa := &SOA{}
+			if err := soa.Unpack(rr.Data); err == nil {
+				return rr, soa
+			}
+		}
+	}
+	return ResourceRecord{}, nil
+}
+
+// lookup returns every record owned by name.
+func (z *Zone) lookup(name Name) []ResourceRecord {
+	var found []ResourceRecord
+	for _, rr := range z.Records {
+		if rr.Name.Equal(name) {
+			found = append(found, rr)
+		}
+	}
+	return found
+}
+
+// RRset returns the records of type t owned by name.
+func (z *Zone) RRset(name Name, t Type) []ResourceRecord {
+	return filterType(z.lookup(name), t)
+}
+
+func filterType(records []ResourceRecord, t Type) []ResourceRecord {
+	var found []ResourceRecord
+	for _, rr := range records {
+		if rr.Type == t || t == TypeANY {
+			found = append(found, rr)
+		}
+	}
+	return found
+}
+
+// hasDescendants reports whether there are records beneath name, which means
+// name exists even if it has no records of its own.
+func (z *Zone) hasDescendants(name Name) bool {
+	for _, rr := range z.Records {
+		if len(rr.Name) > len(name) && rr.Name.IsSubdomainOf(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// delegation finds the zone cut closest to the apex on the way down to name,
+// returning the NS records that make it. The DS records at a cut belong to
+// this side of it, so a query for them isn't treated as a delegation.
+func (z *Zone) delegation(name Name, t Type) []ResourceRecord {
+	for i := len(name) - len(z.Origin) - 1; i >= 0; i-- {
+		n := name[i:]
+		if i == 0 && t == TypeDS {
+			break
+		}
+		if ns := z.RRset(n, TypeNS); len(ns) > 0 {
+			return ns
+		}
+	}
+	return nil
+}
+
+// glue returns the addresses we have for the targets of some NS records.
+func (z *Zone) glue(ns []ResourceRecord) []ResourceRecord {
+	var glue []ResourceRecord
+	for _, rr := range ns {
+		target := &NS{}
+		if err := target.Unpack(rr.Data); err != nil || !target.Target.IsSubdomainOf(z.Origin) {
+			continue
+		}
+		glue = append(glue, z.RRset(target.Target, TypeA)...)
+		glue = append(glue, z.RRset(target.Target, TypeAAAA)...)
+	}
+	return glue
+}
+
+// negative returns the SOA record that goes in the authority section of a
+// negative answer, with its TTL capped by the SOA minimum per RFC 2308.
+func (z *Zone) negative() ResourceRecord {
+	rr, soa := z.SOA()
+	if soa != nil && soa.Minimum < rr.TTL {
+		rr.TTL = soa.Minimum
+	}
+	return rr
+}
+
+// maxCNAMEChain bounds how many CNAMEs we'll follow inside one zone.
+const maxCNAMEChain = 8
+
+// Answer fills in resp with the zone's answer to q, as described in RFC 1034
+// section 4.3.2.
+func (z *Zone) Answer(q Question, resp *Message) {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	resp.AuthoritativeAnswer = true
+	name := q.Name
+	for i := 0; i < maxCNAMEChain; i++ {
+		if ns := z.delegation(name, q.Type); ns != nil {
+			if len(resp.Answer) == 0 {
+				resp.AuthoritativeAnswer = false
+			}
+			resp.Authority = append(resp.Authority, ns...)
+			resp.Additional = append(resp.Additional, z.glue(ns)...)
+			return
+		}
+
+		records := z.lookup(name)
+		if len(records) == 0 {
+			if !z.hasDescendants(name) {
+				resp.ResponseCode = ResponseCodeNameError
+			}
+			resp.Authority = append(resp.Authority, z.negative())
+			return
+		}
+		if matched := filterType(records, q.Type); len(matched) > 0 {
+			resp.Answer = append(resp.Answer, matched...)
+			return
+		}
+		cnames := filterType(records, TypeCName)
+		if len(cnames) == 0 {
+			resp.Authority = append(resp.Authority, z.negative())
+			return
+		}
+		resp.Answer = append(resp.Answer, cnames[0])
+		target := &CNAME{}
+		if err := target.Unpack(cnames[0].Data); err != nil || !target.Target.IsSubdomainOf(z.Origin) {
+			return
+		}
+		name = target.Target
+	}
+}
+
+type zoneLine struct {
+	tokens []string
+	// indented lines start with whitespace and so belong to the previous owner
+	indented bool
+	number   int
+}
+
+// tokenizeZone splits a master file into logical lines of tokens, removing
+// comments and joining lines inside parentheses. Tokens are returned as they
+// were written, including quotes and escapes, so that the code reading each
+// field can interpret them.
+func tokenizeZone(data string) ([]zoneLine, error) {
+	var lines []zoneLine
+	var cur zoneLine
+	var token strings.Builder
+	var inToken, inQuote bool
+	var parens int
+	lineNo := 1
+	atLineStart := true
+	cur.number = lineNo
+
+	endToken := func() {
+		if inToken {
+			cur.tokens = append(cur.tokens, token.String())
+			token.Reset()
+			inToken = false
+		}
+	}
+	endLine := func() {
+		endToken()
+		if len(cur.tokens) > 0 {
+			lines = append(lines, cur)
+		}
+		cur = zoneLine{number: lineNo}
+		atLineStart = true
+	}
+
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		if inQuote {
+			token.WriteByte(c)
+			switch c {
+			case '\\':
+				if i+1 < len(data) {
+					i++
+					token.WriteByte(data[i])
+				}
+			case '"':
+				inQuote = false
+			case '\n':
+				lineNo++
+			}
+			continue
+		}
+		if atLineStart {
+			cur.indented = c == ' ' || c == '\t'
+			atLineStart = false
+		}
+		switch c {
+		case '\n':
+			lineNo++
+			if parens == 0 {
+				endLine()
+			} else {
+				endToken()
+			}
+		case ' ', '\t', '\r':
+			endToken()
+		case ';':
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+			i--
+		case '(':
+			endToken()
+			parens++
+		case ')':
+			endToken()
+			if parens == 0 {
+				return nil, fmt.Errorf("line %d: unbalanced parenthesis", lineNo)
+			}
+			parens--
+		case '"':
+			token.WriteByte(c)
+			inToken = true
+			inQuote = true
+		case '\\':
+			token.WriteByte(c)
+			inToken = true
+			if i+1 < len(data) {
+				i++
+				token.WriteByte(data[i])
+			}
+		default:
+			token.WriteByte(c)
+			inToken = true
+		}
+	}
+	if inQuote {
+		return nil, errors.New("unterminated quoted string")
+	}
+	if parens != 0 {
+		return nil, errors.New("unbalanced parenthesis at end of file")
+	}
+	endLine()
+	return lines, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const testZone = `
+$TTL 1h
+@	IN SOA ns1 hostmaster (
+		2020010101 ; serial
+		3600 900 604800
+		300 )
+	IN NS ns1
+ns1	IN A 192.0.2.1
+www	300 IN A 192.0.2.10
+	IN TXT "hello"
+alias	CNAME www
+deep.empty A 192.0.2.20
+sub	NS ns.sub
+ns.sub	A 192.0.2.30
+thing	TYPE731 \# 4 0A000001
+`
+
+func mustParseZone(t *testing.T, data string, origin string) *Zone {
+	z, err := ParseZone(strings.NewReader(data), MustParseName(origin))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return z
+}
+
+func TestParseZone(t *testing.T) {
+	z := mustParseZone(t, testZone, "example.com")
+	if len(z.Records) != 10 {
+		t.Fatalf("expected 10 records, got %d", len(z.Records))
+	}
+	www := z.RRset(MustParseName("www.example.com"), TypeTXT)
+	if len(www) != 1 || www[0].TTL != 3600 {
+		t.Errorf("expected the TXT record to inherit the owner of the line before and the $TTL, got %v", www)
+	}
+	thing := z.RRset(MustParseName("thing.example.com"), Type(731))
+	if len(thing) != 1 || thing[0].String() != "thing.example.com.\t3600\tIN\tTYPE731\t\\# 4 0a000001" {
+		t.Errorf("unexpected unknown record %v", thing)
+	}
+}
+
+func TestParseZoneErrors(t *testing.T) {
+	type Test struct {
+		Description string
+		Data        string
+	}
+
+	tests := []Test{
+		{"No SOA", "$TTL 1h\n@ NS ns1\n"},
+		{"Record outside the zone", "$TTL 1h\n@ SOA ns1 hm 1 2 3 4 5\nexample.net. A 192.0.2.1\n"},
+		{"Unknown type without generic data", "$TTL 1h\n@ SOA ns1 hm 1 2 3 4 5\nx TYPE731 hello\n"},
+		{"Unbalanced parentheses", "$TTL 1h\n@ SOA ns1 hm ( 1 2 3 4 5\n"},
+		{"No TTL", "@ NS ns1\n@ SOA ns1 hm 1 2 3 4 5\n"},
+	}
+	for _, test := range tests {
+		if _, err := ParseZone(strings.NewReader(test.Data), MustParseName("example.com")); err == nil {
+			t.Errorf("%s: expected an error", test.Description)
+		}
+	}
+}
+
+func TestZoneAnswer(t *testing.T) {
+	type Test struct {
+		Description   string
+		Question      Question
+		ResponseCode  ResponseCode
+		Authoritative bool
+		Answer        []string
+		Authority     []string
+		Additional    []string
+	}
+
+	soa := "example.com.\t300\tIN\tSOA\tns1.example.com. hostmaster.example.com. 2020010101 3600 900 604800 300"
+	tests := []Test{
+		{
+			Description:   "A name with the type asked for",
+			Question:      Question{Name: MustParseName("WWW.example.com"), Type: TypeA, Class: ClassIN},
+			Authoritative: true,
+			Answer:        []string{"www.example.com.\t300\tIN\tA\t192.0.2.10"},
+		},
+		{
+			Description:   "A name without the type asked for",
+			Question:      Question{Name: MustParseName("www.example.com"), Type: TypeMX, Class: ClassIN},
+			Authoritative: true,
+			Authority:     []string{soa},
+		},
+		{
+			Description:   "A name that doesn't exist",
+			Question:      Question{Name: MustParseName("nope.example.com"), Type: TypeA, Class: ClassIN},
+			ResponseCode:  ResponseCodeNameError,
+			Authoritative: true,
+			Authority:     []string{soa},
+		},
+		{
+			Description:   "An empty non-terminal",
+			Question:      Question{Name: MustParseName("empty.example.com"), Type: TypeA, Class: ClassIN},
+			Authoritative: true,
+			Authority:     []string{soa},
+		},
+		{
+			Description:   "A CNAME that's followed inside the zone",
+			Question:      Question{Name: MustParseName("alias.example.com"), Type: TypeA, Class: ClassIN},
+			Authoritative: true,
+			Answer: []string{
+				"alias.example.com.\t3600\tIN\tCNAME\twww.example.com.",
+				"www.example.com.\t300\tIN\tA\t192.0.2.10",
+			},
+		},
+		{
+			Description: "A name beneath a delegation",
+			Question:    Question{Name: MustParseName("www.sub.example.com"), Type: TypeA, Class: ClassIN},
+			Authority:   []string{"sub.example.com.\t3600\tIN\tNS\tns.sub.example.com."},
+			Additional:  []string{"ns.sub.example.com.\t3600\tIN\tA\t192.0.2.30"},
+		},
+		{
+			Description:   "A record of an unknown type",
+			Question:      Question{Name: MustParseName("thing.example.com"), Type: Type(731), Class: ClassIN},
+			Authoritative: true,
+			Answer:        []string{"thing.example.com.\t3600\tIN\tTYPE731\t\\# 4 0a000001"},
+		},
+	}
+	z := mustParseZone(t, testZone, "example.com")
+	for _, test := range tests {
+		resp := Message{}
+		z.Answer(test.Question, &resp)
+		if resp.ResponseCode != test.ResponseCode {
+			t.Errorf("%s: expected response code %d, got %d", test.Description, test.ResponseCode, resp.ResponseCode)
+		}
+		if resp.AuthoritativeAnswer != test.Authoritative {
+			t.Errorf("%s: expected authoritative to be %v", test.Description, test.Authoritative)
+		}
+		checkRecords(t, test.Description+" answer", test.Answer, resp.Answer)
+		checkRecords(t, test.Description+" authority", test.Authority, resp.Authority)
+		checkRecords(t, test.Description+" additional", test.Additional, resp.Additional)
+	}
+}
+
+func checkRecords(t *testing.T, description string, expected []string, records []ResourceRecord) {
+	t.Helper()
+	if len(expected) != len(records) {
+		t.Errorf("%s: expected %d records, got %v", description, len(expected), records)
+		return
+	}
+	for i, rr := range records {
+		if rr.String() != expected[i] {
+			t.Errorf("%s: expected %q, got %q", description, expected[i], rr.String())
+		}
+	}
+}